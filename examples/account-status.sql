@@ -0,0 +1,45 @@
+-- This is a fully working example script which shows how to freeze and close
+-- accounts
+--
+-- Note that it uses `\gset` to store sql responses as variables. For example,
+-- `\gset foo_` creates variables for each column in the response like
+-- `foo_col1`, `foo_col2`, etc. These variables can then be used like
+-- `:'foo1_col`.
+
+-- The entire script can be passed to psql. If you are running postgres via the
+-- pgledger docker compose, you can run this script with:
+--
+--   cat account-status.sql | \
+--     docker compose exec --no-TTY postgres psql -U pgledger --echo-all --no-psqlrc
+--
+
+-- Create a couple of accounts for testing
+SELECT id FROM pgledger_create_account('account1', 'USD') \gset account1_
+SELECT id FROM pgledger_create_account('account2', 'USD') \gset account2_
+
+-- Create a transfer to set the balances to non-zero
+SELECT id, amount FROM pgledger_create_transfer(:'account1_id',:'account2_id', 10.00);
+
+-- Freeze account2, recording who did it
+SELECT name, balance, status, status_changed_by FROM pgledger_freeze_account(:'account2_id', 'support@example.com');
+
+-- No transfers to or from account2 will work now:
+SELECT id, amount FROM pgledger_create_transfer(:'account1_id',:'account2_id', 10.00);
+SELECT id, amount FROM pgledger_create_transfer(:'account2_id',:'account1_id', 10.00);
+
+-- An account can't be closed until its balance is zero:
+SELECT name, status FROM pgledger_close_account(:'account2_id', 'support@example.com');
+
+-- So unfreeze it, zero out the balance, and then close it:
+SELECT name, status FROM pgledger_update_account_status(:'account2_id', 'active', 'support@example.com');
+SELECT id, amount FROM pgledger_create_transfer(:'account2_id',:'account1_id', 10.00);
+SELECT name, balance, status FROM pgledger_close_account(:'account2_id', 'support@example.com');
+
+-- Closing is permanent
+SELECT name, status FROM pgledger_update_account_status(:'account2_id', 'active', 'support@example.com');
+
+-- Every status change is recorded:
+SELECT previous_status, status, changed_by
+FROM pgledger_account_status_changes
+WHERE account_id = :'account2_id'
+ORDER BY id;
@@ -24,10 +24,9 @@ SELECT id FROM pgledger_create_account('user2.eur', 'EUR') \gset user2_eur_
 SELECT * FROM pgledger_accounts_view
 WHERE name LIKE 'user2.%';
 
--- And you can even use PostgreSQL's ltree functionality for querying
+-- And you can even use PostgreSQL's ltree functionality for querying. The
+-- pgledger migrations already create the extension for account paths:
 --   https://www.postgresql.org/docs/current/ltree.html
-CREATE EXTENSION ltree;
-
 SELECT * FROM pgledger_accounts_view
 WHERE name::LTREE <@ 'user2';
 
@@ -68,10 +67,8 @@ SELECT
     t.id,
     t.created_at,
     t.event_at,
-    acc_from.name AS acc_from,
-    acc_to.name AS acc_to,
+    t.from_account_name AS acc_from,
+    t.to_account_name AS acc_to,
     t.amount
 FROM pgledger_transfers_view t
-LEFT JOIN pgledger_accounts_view acc_from ON t.from_account_id = acc_from.id
-LEFT JOIN pgledger_accounts_view acc_to ON t.to_account_id = acc_to.id
-WHERE acc_from.name LIKE 'user2.%' OR acc_from.name LIKE 'liquidity.%';
+WHERE t.from_account_name LIKE 'user2.%' OR t.from_account_name LIKE 'liquidity.%';
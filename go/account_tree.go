@@ -0,0 +1,89 @@
+package pgledger
+
+import (
+	"context"
+	"strings"
+)
+
+// AccountTree is a node of the tree of account paths, with the balances of all
+// accounts at or below its path.
+type AccountTree struct {
+	Path     string
+	Balances []AccountTreeBalance
+	Children []*AccountTree
+}
+
+// AccountTreeBalance is the total for one currency in an AccountTree.
+type AccountTreeBalance struct {
+	Currency         string
+	Balance          Amount
+	AvailableBalance Amount
+	AccountCount     int
+}
+
+// accountTreeRow is a row from pgledger_account_tree_balances.
+type accountTreeRow struct {
+	Path             string
+	Currency         string
+	Balance          Amount
+	AvailableBalance Amount
+	AccountCount     int
+}
+
+// AccountTreeBalances calls pgledger_account_tree_balances and returns the
+// subtrees under pathPrefix, or every tree if pathPrefix is empty. Children
+// are sorted by path, and balances by currency.
+func (c *Client) AccountTreeBalances(ctx context.Context, pathPrefix string) ([]*AccountTree, error) {
+	var prefix *string
+	if pathPrefix != "" {
+		prefix = &pathPrefix
+	}
+
+	rows, err := queryAll[accountTreeRow](ctx, c,
+		"select path::text, currency, balance, available_balance, account_count from pgledger_account_tree_balances($1)",
+		prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	return buildAccountTree(rows), nil
+}
+
+// buildAccountTree nests the rows, which must be sorted by path so that
+// parents come before their children.
+func buildAccountTree(rows []accountTreeRow) []*AccountTree {
+	var roots []*AccountTree
+	nodes := map[string]*AccountTree{}
+
+	for _, row := range rows {
+		node, ok := nodes[row.Path]
+		if !ok {
+			node = &AccountTree{Path: row.Path}
+			nodes[row.Path] = node
+
+			parentPath, _, hasParent := cutLastLabel(row.Path)
+			if parent, ok := nodes[parentPath]; hasParent && ok {
+				parent.Children = append(parent.Children, node)
+			} else {
+				roots = append(roots, node)
+			}
+		}
+
+		node.Balances = append(node.Balances, AccountTreeBalance{
+			Currency:         row.Currency,
+			Balance:          row.Balance,
+			AvailableBalance: row.AvailableBalance,
+			AccountCount:     row.AccountCount,
+		})
+	}
+
+	return roots
+}
+
+func cutLastLabel(path string) (string, string, bool) {
+	i := strings.LastIndex(path, ".")
+	if i < 0 {
+		return "", path, false
+	}
+	return path[:i], path[i+1:], true
+}
@@ -0,0 +1,58 @@
+package pgledger
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBuildAccountTree(t *testing.T) {
+	// What pgledger_account_tree_balances returns for the accounts
+	// user1.available (USD 20), user1.available.eur (EUR 5), user1.pending
+	// (USD 10) and user2 (USD 1): every account adds to each prefix of its path
+	rows := []accountTreeRow{
+		{Path: "user1", Currency: "EUR", Balance: MustParseAmount("5"), AccountCount: 1},
+		{Path: "user1", Currency: "USD", Balance: MustParseAmount("30"), AccountCount: 2},
+		{Path: "user1.available", Currency: "EUR", Balance: MustParseAmount("5"), AccountCount: 1},
+		{Path: "user1.available", Currency: "USD", Balance: MustParseAmount("20"), AccountCount: 1},
+		{Path: "user1.available.eur", Currency: "EUR", Balance: MustParseAmount("5"), AccountCount: 1},
+		{Path: "user1.pending", Currency: "USD", Balance: MustParseAmount("10"), AccountCount: 1},
+		{Path: "user2", Currency: "USD", Balance: MustParseAmount("1"), AccountCount: 1},
+	}
+
+	roots := buildAccountTree(rows)
+	assert.Len(t, roots, 2)
+
+	user1 := roots[0]
+	assert.Equal(t, "user1", user1.Path)
+	assert.Len(t, user1.Balances, 2)
+	assert.Equal(t, "EUR", user1.Balances[0].Currency)
+	assert.Equal(t, "30", user1.Balances[1].Balance.String())
+	assert.Equal(t, 2, user1.Balances[1].AccountCount)
+
+	assert.Len(t, user1.Children, 2)
+	assert.Equal(t, "user1.available", user1.Children[0].Path)
+	assert.Equal(t, "user1.pending", user1.Children[1].Path)
+	assert.Len(t, user1.Children[0].Balances, 2)
+	assert.Equal(t, "EUR", user1.Children[0].Balances[0].Currency)
+	assert.Equal(t, "20", user1.Children[0].Balances[1].Balance.String())
+	assert.Equal(t, "user1.available.eur", user1.Children[0].Children[0].Path)
+	assert.Empty(t, user1.Children[1].Children)
+
+	assert.Equal(t, "user2", roots[1].Path)
+	assert.Empty(t, roots[1].Children)
+
+	assert.Empty(t, buildAccountTree(nil))
+}
+
+func TestBuildAccountTreeWithPrefix(t *testing.T) {
+	// With a prefix, the tree starts below the top level
+	roots := buildAccountTree([]accountTreeRow{
+		{Path: "org.user1", Currency: "USD", Balance: MustParseAmount("3"), AccountCount: 1},
+		{Path: "org.user1.available", Currency: "USD", Balance: MustParseAmount("3"), AccountCount: 1},
+	})
+
+	assert.Len(t, roots, 1)
+	assert.Equal(t, "org.user1", roots[0].Path)
+	assert.Equal(t, "org.user1.available", roots[0].Children[0].Path)
+}
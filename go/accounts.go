@@ -0,0 +1,86 @@
+package pgledger
+
+import (
+	"context"
+	"time"
+)
+
+// The statuses of an account. See pgledger_update_account_status.
+const (
+	AccountStatusActive     = "active"
+	AccountStatusFrozen     = "frozen"
+	AccountStatusClosed     = "closed"
+	AccountStatusDebitOnly  = "debit_only"
+	AccountStatusCreditOnly = "credit_only"
+)
+
+// Account is a row from pgledger_accounts_view.
+type Account struct {
+	ID                   string
+	Name                 string
+	Currency             string
+	Balance              Amount
+	Version              int
+	AllowNegativeBalance bool
+	AllowPositiveBalance bool
+	Metadata             *string
+	CreatedAt            time.Time
+	UpdatedAt            time.Time
+	PendingDebits        Amount
+	PendingCredits       Amount
+	AvailableBalance     Amount
+	Status               string
+	StatusChangedAt      *time.Time
+	StatusChangedBy      *string
+	MinBalance           *Amount
+	MaxBalance           *Amount
+	Path                 *string
+	ExternalRef          *string
+}
+
+// CreateAccount calls pgledger_create_account. Accounts allow both negative
+// and positive balances unless configured otherwise with options.
+func (c *Client) CreateAccount(ctx context.Context, name, currency string, opts ...AccountOption) (*Account, error) {
+	named, values := accountArgs(opts).sql(2)
+
+	return queryOne[Account](ctx, c,
+		"select * from pgledger_create_account($1, $2"+named+")",
+		append([]any{name, currency}, values...)...)
+}
+
+// GetAccount returns the account with the given ID, or pgx.ErrNoRows if it
+// does not exist.
+func (c *Client) GetAccount(ctx context.Context, id string) (*Account, error) {
+	return queryOne[Account](ctx, c, "select * from pgledger_accounts_view where id = $1", id)
+}
+
+// GetAccountByExternalRef returns the account with the given external ref, or
+// pgx.ErrNoRows if there isn't one.
+func (c *Client) GetAccountByExternalRef(ctx context.Context, externalRef string) (*Account, error) {
+	return queryOne[Account](ctx, c, "select * from pgledger_accounts_view where external_ref = $1", externalRef)
+}
+
+// UpdateAccountStatus calls pgledger_update_account_status to change the status
+// of an account, recording who changed it.
+func (c *Client) UpdateAccountStatus(ctx context.Context, id, status, changedBy string) (*Account, error) {
+	return queryOne[Account](ctx, c, "select * from pgledger_update_account_status($1, $2, $3)", id, status, changedBy)
+}
+
+// FreezeAccount calls pgledger_freeze_account. No transfers to or from the
+// account are allowed until it is made active again with UpdateAccountStatus.
+func (c *Client) FreezeAccount(ctx context.Context, id, changedBy string) (*Account, error) {
+	return queryOne[Account](ctx, c, "select * from pgledger_freeze_account($1, $2)", id, changedBy)
+}
+
+// CloseAccount calls pgledger_close_account. Only accounts with a zero balance
+// can be closed, and closing is permanent.
+func (c *Client) CloseAccount(ctx context.Context, id, changedBy string) (*Account, error) {
+	return queryOne[Account](ctx, c, "select * from pgledger_close_account($1, $2)", id, changedBy)
+}
+
+// UpdateAccountBalanceLimits calls pgledger_update_account_balance_limits to
+// set the minimum and maximum balance of an account. A nil limit removes it.
+// The limits are checked against the current balance.
+func (c *Client) UpdateAccountBalanceLimits(ctx context.Context, id string, minBalance, maxBalance *Amount) (*Account, error) {
+	return queryOne[Account](ctx, c, "select * from pgledger_update_account_balance_limits($1, $2, $3)", id, minBalance, maxBalance)
+}
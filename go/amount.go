@@ -0,0 +1,229 @@
+package pgledger
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+// Amount is an exact decimal number with arbitrary precision, matching the
+// NUMERIC columns in the ledger. The value is coef * 10^exp. The zero value is
+// 0.
+//
+// Amounts are immutable: arithmetic returns a new Amount. Like NUMERIC, an
+// Amount keeps its scale, so "10.00" is equal to (but prints differently
+// from) "10".
+type Amount struct {
+	coef *big.Int
+	exp  int32
+}
+
+// The limits of NUMERIC: up to 131072 digits before the decimal point, and up
+// to 16383 after it.
+const (
+	maxAmountDigits = 131072
+	maxAmountScale  = 16383
+)
+
+// NewAmount returns coef * 10^exp. For example, NewAmount(1234, -2) is 12.34.
+func NewAmount(coef int64, exp int32) Amount {
+	return Amount{coef: big.NewInt(coef), exp: exp}
+}
+
+// ParseAmount parses a decimal string such as "12.34", "-0.01" or "1e3".
+func ParseAmount(s string) (Amount, error) {
+	mantissa, exponent, hasExponent := strings.Cut(strings.ToLower(s), "e")
+
+	exp := int64(0)
+	if hasExponent {
+		var err error
+		exp, err = strconv.ParseInt(exponent, 10, 32)
+		if err != nil {
+			return Amount{}, fmt.Errorf("invalid amount %q", s)
+		}
+	}
+
+	whole, fraction, _ := strings.Cut(mantissa, ".")
+	digits := whole + fraction
+	if digits == "" || digits == "+" || digits == "-" || strings.ContainsAny(digits[1:], "+-") {
+		return Amount{}, fmt.Errorf("invalid amount %q", s)
+	}
+
+	coef, ok := new(big.Int).SetString(digits, 10)
+	if !ok {
+		return Amount{}, fmt.Errorf("invalid amount %q", s)
+	}
+
+	// Check the limits before anything rescales the coefficient, since an
+	// amount such as "1e2000000000" would need billions of digits
+	exp -= int64(len(fraction))
+	if exp < -maxAmountScale || exp > maxAmountDigits {
+		return Amount{}, fmt.Errorf("amount %q is out of range", s)
+	}
+	if coef.Sign() != 0 && int64(len(new(big.Int).Abs(coef).String()))+exp > maxAmountDigits {
+		return Amount{}, fmt.Errorf("amount %q is out of range", s)
+	}
+
+	return Amount{coef: coef, exp: int32(exp)}, nil
+}
+
+// MustParseAmount is like ParseAmount but panics if s is not a valid amount.
+// It's intended for constants and tests.
+func MustParseAmount(s string) Amount {
+	a, err := ParseAmount(s)
+	if err != nil {
+		panic(err)
+	}
+	return a
+}
+
+func (a Amount) int() *big.Int {
+	if a.coef == nil {
+		return new(big.Int)
+	}
+	return a.coef
+}
+
+// rescale returns the coefficient of a for the given (smaller or equal)
+// exponent.
+func (a Amount) rescale(exp int32) *big.Int {
+	coef := new(big.Int).Set(a.int())
+	if exp < a.exp {
+		coef.Mul(coef, pow10(int64(a.exp)-int64(exp)))
+	}
+	return coef
+}
+
+func pow10(n int64) *big.Int {
+	return new(big.Int).Exp(big.NewInt(10), big.NewInt(n), nil)
+}
+
+// Add returns a + b.
+func (a Amount) Add(b Amount) Amount {
+	exp := min(a.exp, b.exp)
+	return Amount{coef: new(big.Int).Add(a.rescale(exp), b.rescale(exp)), exp: exp}
+}
+
+// Sub returns a - b.
+func (a Amount) Sub(b Amount) Amount {
+	exp := min(a.exp, b.exp)
+	return Amount{coef: new(big.Int).Sub(a.rescale(exp), b.rescale(exp)), exp: exp}
+}
+
+// Mul returns a * b. It panics if the exponent of the result doesn't fit in
+// an int32.
+func (a Amount) Mul(b Amount) Amount {
+	exp := int64(a.exp) + int64(b.exp)
+	if exp < math.MinInt32 || exp > math.MaxInt32 {
+		panic("pgledger: Amount.Mul exponent out of range")
+	}
+	return Amount{coef: new(big.Int).Mul(a.int(), b.int()), exp: int32(exp)}
+}
+
+// Neg returns -a.
+func (a Amount) Neg() Amount {
+	return Amount{coef: new(big.Int).Neg(a.int()), exp: a.exp}
+}
+
+// Abs returns the absolute value of a.
+func (a Amount) Abs() Amount {
+	return Amount{coef: new(big.Int).Abs(a.int()), exp: a.exp}
+}
+
+// Cmp returns -1, 0 or +1 depending on whether a is less than, equal to, or
+// greater than b. The scale is ignored, so "10.00" and "10" are equal.
+func (a Amount) Cmp(b Amount) int {
+	exp := min(a.exp, b.exp)
+	return a.rescale(exp).Cmp(b.rescale(exp))
+}
+
+// Equal reports whether a and b have the same value, ignoring scale.
+func (a Amount) Equal(b Amount) bool {
+	return a.Cmp(b) == 0
+}
+
+// Sign returns -1, 0 or +1 depending on the sign of a.
+func (a Amount) Sign() int {
+	return a.int().Sign()
+}
+
+// IsZero reports whether a is 0.
+func (a Amount) IsZero() bool {
+	return a.Sign() == 0
+}
+
+// Scale returns the number of digits after the decimal point.
+func (a Amount) Scale() int {
+	return max(0, -int(a.exp))
+}
+
+// String formats the amount like PostgreSQL formats NUMERIC, without an
+// exponent and keeping trailing zeros after the decimal point.
+func (a Amount) String() string {
+	coef := a.int()
+	if a.exp >= 0 {
+		if coef.Sign() == 0 {
+			return "0"
+		}
+		return new(big.Int).Mul(coef, pow10(int64(a.exp))).String()
+	}
+
+	digits := new(big.Int).Abs(coef).String()
+	scale := -int(a.exp)
+	if len(digits) <= scale {
+		digits = strings.Repeat("0", scale-len(digits)+1) + digits
+	}
+
+	sign := ""
+	if coef.Sign() < 0 {
+		sign = "-"
+	}
+
+	return sign + digits[:len(digits)-scale] + "." + digits[len(digits)-scale:]
+}
+
+// MarshalText implements encoding.TextMarshaler, so amounts are encoded as
+// JSON strings to avoid any loss of precision.
+func (a Amount) MarshalText() ([]byte, error) {
+	return []byte(a.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (a *Amount) UnmarshalText(text []byte) error {
+	parsed, err := ParseAmount(string(text))
+	if err != nil {
+		return err
+	}
+	*a = parsed
+	return nil
+}
+
+// ScanNumeric implements pgtype.NumericScanner so pgx can scan NUMERIC
+// columns into an Amount. Use *Amount for nullable columns.
+func (a *Amount) ScanNumeric(v pgtype.Numeric) error {
+	if !v.Valid {
+		return errors.New("cannot scan NULL into pgledger.Amount")
+	}
+	if v.NaN || v.InfinityModifier != pgtype.Finite {
+		return errors.New("cannot scan NaN or infinity into pgledger.Amount")
+	}
+
+	coef := new(big.Int)
+	if v.Int != nil {
+		coef.Set(v.Int)
+	}
+
+	*a = Amount{coef: coef, exp: v.Exp}
+	return nil
+}
+
+// NumericValue implements pgtype.NumericValuer so an Amount can be passed as a
+// NUMERIC query argument.
+func (a Amount) NumericValue() (pgtype.Numeric, error) {
+	return pgtype.Numeric{Int: new(big.Int).Set(a.int()), Exp: a.exp, Valid: true}, nil
+}
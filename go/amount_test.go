@@ -0,0 +1,146 @@
+package pgledger
+
+import (
+	"encoding/json"
+	"math"
+	"math/big"
+	"strings"
+	"testing"
+
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseAmount(t *testing.T) {
+	for input, expected := range map[string]string{
+		"0":      "0",
+		"12.34":  "12.34",
+		"-0.01":  "-0.01",
+		"+5":     "5",
+		"10.00":  "10.00",
+		".5":     "0.5",
+		"-.5":    "-0.5",
+		"1e3":    "1000",
+		"1.5E-3": "0.0015",
+		"123456789012345678901234567890.123456789": "123456789012345678901234567890.123456789",
+	} {
+		amount, err := ParseAmount(input)
+		assert.NoError(t, err, input)
+		assert.Equal(t, expected, amount.String(), input)
+	}
+
+	for _, input := range []string{"", ".", "-", "abc", "1.2.3", "1-2", "1e", "e5", "NaN", "Infinity", " 1", "1_000"} {
+		_, err := ParseAmount(input)
+		assert.Error(t, err, input)
+	}
+}
+
+func TestParseAmountLimits(t *testing.T) {
+	// NUMERIC allows up to 131072 digits before the decimal point and 16383
+	// after it
+	for _, input := range []string{
+		"1e131071",
+		"0e131072",
+		strings.Repeat("9", 131072),
+		"1e-16383",
+		"0." + strings.Repeat("0", 16383),
+	} {
+		_, err := ParseAmount(input)
+		assert.NoError(t, err, input[:min(len(input), 20)])
+	}
+
+	for _, input := range []string{
+		"1e131072",
+		"0e131073",
+		strings.Repeat("9", 131073),
+		"10e131071",
+		"1e-16384",
+		"0." + strings.Repeat("0", 16384),
+		"1e2000000000",
+		"1e-2000000000",
+	} {
+		_, err := ParseAmount(input)
+		assert.ErrorContains(t, err, "out of range", input[:min(len(input), 20)])
+	}
+}
+
+func TestAmountMulPanicsOnExponentOverflow(t *testing.T) {
+	assert.Panics(t, func() { NewAmount(1, math.MaxInt32).Mul(NewAmount(1, 1)) })
+	assert.Panics(t, func() { NewAmount(1, math.MinInt32).Mul(NewAmount(1, -1)) })
+}
+
+func TestMustParseAmountPanics(t *testing.T) {
+	assert.Panics(t, func() { MustParseAmount("nope") })
+}
+
+func TestAmountZeroValue(t *testing.T) {
+	var zero Amount
+
+	assert.Equal(t, "0", zero.String())
+	assert.True(t, zero.IsZero())
+	assert.Equal(t, "1.5", zero.Add(MustParseAmount("1.5")).String())
+}
+
+func TestAmountArithmetic(t *testing.T) {
+	a := MustParseAmount("10.00")
+	b := MustParseAmount("0.255")
+
+	assert.Equal(t, "10.255", a.Add(b).String())
+	assert.Equal(t, "9.745", a.Sub(b).String())
+	assert.Equal(t, "-9.745", b.Sub(a).String())
+	assert.Equal(t, "2.55000", a.Mul(b).String())
+	assert.Equal(t, "-10.00", a.Neg().String())
+	assert.Equal(t, "10.00", a.Neg().Abs().String())
+	assert.Equal(t, "1234.56", NewAmount(123456, -2).String())
+	assert.Equal(t, "1200", NewAmount(12, 2).String())
+
+	// Sums are exact, unlike with floats
+	sum := Amount{}
+	for range 10 {
+		sum = sum.Add(MustParseAmount("0.1"))
+	}
+	assert.Equal(t, "1.0", sum.String())
+	assert.True(t, sum.Equal(NewAmount(1, 0)))
+}
+
+func TestAmountComparison(t *testing.T) {
+	assert.Equal(t, 0, MustParseAmount("10.00").Cmp(MustParseAmount("10")))
+	assert.Equal(t, -1, MustParseAmount("9.99").Cmp(MustParseAmount("10")))
+	assert.Equal(t, 1, MustParseAmount("0.001").Cmp(MustParseAmount("-1000")))
+
+	assert.True(t, MustParseAmount("1e2").Equal(MustParseAmount("100.0")))
+	assert.False(t, MustParseAmount("100.01").Equal(MustParseAmount("100")))
+
+	assert.Equal(t, -1, MustParseAmount("-0.01").Sign())
+	assert.Equal(t, 0, MustParseAmount("0.00").Sign())
+	assert.Equal(t, 1, MustParseAmount("0.01").Sign())
+
+	assert.Equal(t, 2, MustParseAmount("-0.01").Scale())
+	assert.Equal(t, 0, MustParseAmount("1e3").Scale())
+}
+
+func TestAmountJSON(t *testing.T) {
+	encoded, err := json.Marshal(map[string]Amount{"amount": MustParseAmount("12.30")})
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"amount": "12.30"}`, string(encoded))
+
+	var decoded struct{ Amount Amount }
+	assert.NoError(t, json.Unmarshal([]byte(`{"amount": "-0.01"}`), &decoded))
+	assert.Equal(t, "-0.01", decoded.Amount.String())
+
+	assert.Error(t, json.Unmarshal([]byte(`{"amount": "abc"}`), &decoded))
+}
+
+func TestAmountNumeric(t *testing.T) {
+	var a Amount
+	assert.NoError(t, a.ScanNumeric(pgtype.Numeric{Int: big.NewInt(-1234), Exp: -2, Valid: true}))
+	assert.Equal(t, "-12.34", a.String())
+
+	numeric, err := a.NumericValue()
+	assert.NoError(t, err)
+	assert.Equal(t, pgtype.Numeric{Int: big.NewInt(-1234), Exp: -2, Valid: true}, numeric)
+
+	assert.Error(t, a.ScanNumeric(pgtype.Numeric{}))
+	assert.Error(t, a.ScanNumeric(pgtype.Numeric{NaN: true, Valid: true}))
+	assert.Error(t, a.ScanNumeric(pgtype.Numeric{InfinityModifier: pgtype.Infinity, Valid: true}))
+}
@@ -0,0 +1,55 @@
+package pgledger
+
+import (
+	"context"
+	"time"
+)
+
+// The ways of looking up a historical balance. See pgledger_account_balance_at.
+const (
+	BalanceByCreatedAt = "created_at"
+	BalanceByEventAt   = "event_at"
+)
+
+// AccountBalance is a row from pgledger_account_balances_at.
+type AccountBalance struct {
+	AccountID string
+	Balance   Amount
+}
+
+// BalanceAt calls pgledger_account_balance_at to get the balance of an account
+// at the given time. by is BalanceByCreatedAt or BalanceByEventAt.
+func (c *Client) BalanceAt(ctx context.Context, accountID string, at time.Time, by string) (Amount, error) {
+	var balance Amount
+
+	err := c.pool.QueryRow(ctx, "select pgledger_account_balance_at($1, $2, $3)", accountID, at, by).Scan(&balance)
+	if err != nil {
+		return Amount{}, wrapError(err)
+	}
+
+	return balance, nil
+}
+
+// BalancesAt calls pgledger_account_balances_at to get the balances of several
+// accounts at the same time. The balances are in the same order as the IDs.
+func (c *Client) BalancesAt(ctx context.Context, accountIDs []string, at time.Time, by string) ([]AccountBalance, error) {
+	return queryAll[AccountBalance](ctx, c, "select * from pgledger_account_balances_at($1, $2, $3)", accountIDs, at, by)
+}
+
+// TrialBalance is a row from pgledger_trial_balance. Debits is the total of
+// the negative balances in the currency (as a positive number), Credits the
+// total of the positive balances, and Net their sum, which is always 0 unless
+// something is wrong.
+type TrialBalance struct {
+	Currency string
+	Debits   Amount
+	Credits  Amount
+	Net      Amount
+}
+
+// TrialBalance calls pgledger_trial_balance to get the totals of the account
+// balances in each currency at the given time. by is BalanceByCreatedAt or
+// BalanceByEventAt.
+func (c *Client) TrialBalance(ctx context.Context, asOf time.Time, by string) ([]TrialBalance, error) {
+	return queryAll[TrialBalance](ctx, c, "select * from pgledger_trial_balance($1, $2)", asOf, by)
+}
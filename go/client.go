@@ -0,0 +1,51 @@
+// Package pgledger is a Go client for the pgledger SQL functions and views.
+//
+// The ledger itself lives entirely in PostgreSQL (see pgledger.sql). This
+// package is a thin, typed wrapper so applications don't have to write the
+// same structs and queries over and over.
+package pgledger
+
+import (
+	"context"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Client calls the pgledger SQL functions and queries the pgledger views.
+type Client struct {
+	pool *pgxpool.Pool
+}
+
+// NewClient returns a Client which uses the given pool for all queries.
+func NewClient(pool *pgxpool.Pool) *Client {
+	return &Client{pool: pool}
+}
+
+func queryOne[T any](ctx context.Context, c *Client, sql string, args ...any) (*T, error) {
+	rows, err := c.pool.Query(ctx, sql, args...)
+	if err != nil {
+		return nil, wrapError(err)
+	}
+
+	result, err := pgx.CollectExactlyOneRow(rows, pgx.RowToAddrOfStructByName[T])
+	if err != nil {
+		return nil, wrapError(err)
+	}
+
+	return result, nil
+}
+
+func queryAll[T any](ctx context.Context, c *Client, sql string, args ...any) ([]T, error) {
+	rows, err := c.pool.Query(ctx, sql, args...)
+	if err != nil {
+		return nil, wrapError(err)
+	}
+
+	results, err := pgx.CollectRows(rows, pgx.RowToStructByName[T])
+	if err != nil {
+		return nil, wrapError(err)
+	}
+
+	return results, nil
+}
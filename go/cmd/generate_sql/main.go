@@ -0,0 +1,28 @@
+// generate_sql writes pgledger.sql, which combines all of the migrations into
+// a single file that's easier to review and can be installed by hand.
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/pgr0ss/pgledger"
+)
+
+func main() {
+	if len(os.Args) != 2 {
+		fmt.Fprintf(os.Stderr, "Usage: generate_sql <output file>\n")
+		os.Exit(1)
+	}
+
+	schema, err := pgledger.Schema()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error building schema: %v\n", err)
+		os.Exit(1)
+	}
+
+	if err := os.WriteFile(os.Args[1], []byte(schema), 0o644); err != nil {
+		fmt.Fprintf(os.Stderr, "Error writing %s: %v\n", os.Args[1], err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pgr0ss/pgledger"
+	"github.com/stretchr/testify/assert"
+)
+
+func testStatement() *pgledger.Statement {
+	june1 := time.Date(2025, 6, 1, 0, 0, 0, 0, time.UTC)
+	metadata := `{"payment_id": "p_1", "tags": ["a", "b"]}`
+
+	return &pgledger.Statement{
+		AccountID:      "pgla_1",
+		StartAt:        &june1,
+		OpeningBalance: pgledger.MustParseAmount("100"),
+		ClosingBalance: pgledger.MustParseAmount("145.50"),
+		Lines: []pgledger.StatementLine{
+			{
+				EventAt:                 june1,
+				EntryID:                 "pgle_1",
+				TransferID:              "pglt_1",
+				CounterpartyAccountID:   "pgla_2",
+				CounterpartyAccountName: "fees",
+				Amount:                  pgledger.MustParseAmount("-5"),
+				Balance:                 pgledger.MustParseAmount("95"),
+			},
+			{
+				EventAt:                 june1.Add(36*time.Hour + 500*time.Microsecond),
+				EntryID:                 "pgle_2",
+				TransferID:              "pglt_2",
+				CounterpartyAccountID:   "pgla_3",
+				CounterpartyAccountName: "bank, main",
+				Amount:                  pgledger.MustParseAmount("50.50"),
+				Balance:                 pgledger.MustParseAmount("145.50"),
+				Metadata:                &metadata,
+			},
+		},
+	}
+}
+
+func TestWriteCSV(t *testing.T) {
+	var out strings.Builder
+	assert.NoError(t, writeCSV(&out, testStatement()))
+
+	// The open end of the period is empty
+	assert.Equal(t, `line_type,event_at,entry_id,transfer_id,counterparty_account_id,counterparty_account_name,amount,balance,metadata
+opening_balance,2025-06-01T00:00:00Z,,,,,,100,
+entry,2025-06-01T00:00:00Z,pgle_1,pglt_1,pgla_2,fees,-5,95,
+entry,2025-06-02T12:00:00.0005Z,pgle_2,pglt_2,pgla_3,"bank, main",50.50,145.50,"{""payment_id"": ""p_1"", ""tags"": [""a"", ""b""]}"
+closing_balance,,,,,,,145.50,
+`, out.String())
+}
+
+func TestWriteJSON(t *testing.T) {
+	var out strings.Builder
+	assert.NoError(t, writeJSON(&out, testStatement()))
+
+	// The metadata is included as JSON rather than as a string, and amounts are
+	// strings
+	assert.JSONEq(t, `{
+		"account_id": "pgla_1",
+		"start_at": "2025-06-01T00:00:00Z",
+		"end_at": null,
+		"opening_balance": "100",
+		"closing_balance": "145.50",
+		"lines": [
+			{
+				"event_at": "2025-06-01T00:00:00Z",
+				"entry_id": "pgle_1",
+				"transfer_id": "pglt_1",
+				"counterparty_account_id": "pgla_2",
+				"counterparty_account_name": "fees",
+				"amount": "-5",
+				"balance": "95",
+				"metadata": null
+			},
+			{
+				"event_at": "2025-06-02T12:00:00.0005Z",
+				"entry_id": "pgle_2",
+				"transfer_id": "pglt_2",
+				"counterparty_account_id": "pgla_3",
+				"counterparty_account_name": "bank, main",
+				"amount": "50.50",
+				"balance": "145.50",
+				"metadata": {"payment_id": "p_1", "tags": ["a", "b"]}
+			}
+		]
+	}`, out.String())
+}
+
+func TestWriteJSONWithoutLines(t *testing.T) {
+	statement := testStatement()
+	statement.StartAt = nil
+	statement.Lines = nil
+
+	var out strings.Builder
+	assert.NoError(t, writeJSON(&out, statement))
+
+	// An empty statement has an empty list of lines, not null
+	assert.Contains(t, out.String(), `"start_at": null`)
+	assert.Contains(t, out.String(), `"lines": []`)
+}
+
+func TestParseTime(t *testing.T) {
+	parsed, err := parseTime("")
+	assert.NoError(t, err)
+	assert.True(t, parsed.IsZero())
+
+	parsed, err = parseTime("2025-06-01")
+	assert.NoError(t, err)
+	assert.Equal(t, time.Date(2025, 6, 1, 0, 0, 0, 0, time.UTC), parsed)
+
+	parsed, err = parseTime("2025-06-01T12:30:00+02:00")
+	assert.NoError(t, err)
+	assert.Equal(t, time.Date(2025, 6, 1, 10, 30, 0, 0, time.UTC), parsed.UTC())
+
+	_, err = parseTime("June 1st")
+	assert.Error(t, err)
+}
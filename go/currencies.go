@@ -0,0 +1,23 @@
+package pgledger
+
+import "context"
+
+// Currency is a row from pgledger_currencies_view. Scale is the number of
+// decimal places of the currency's minor unit, such as 2 for USD.
+type Currency struct {
+	Code        string
+	Scale       int
+	Description *string
+}
+
+// CreateCurrency calls pgledger_create_currency to add a currency which isn't
+// in ISO 4217, such as BTC or loyalty points.
+func (c *Client) CreateCurrency(ctx context.Context, code string, scale int, description *string) (*Currency, error) {
+	return queryOne[Currency](ctx, c, "select * from pgledger_create_currency($1, $2, $3)", code, scale, description)
+}
+
+// GetCurrency returns the currency with the given code, or pgx.ErrNoRows if it
+// does not exist.
+func (c *Client) GetCurrency(ctx context.Context, code string) (*Currency, error) {
+	return queryOne[Currency](ctx, c, "select * from pgledger_currencies_view where code = $1", code)
+}
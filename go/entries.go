@@ -0,0 +1,50 @@
+package pgledger
+
+import (
+	"context"
+	"time"
+)
+
+// Entry is a row from pgledger_entries_view. Every transfer creates two
+// entries: a negative one for the source account and a positive one for the
+// destination account. Entries of pending and released transfers have Pending
+// set, and change the pending amounts of the account instead of its balance.
+//
+// Hash is the hex encoded hash which chains the entry to the previous entry of
+// the account (see VerifyHashChain).
+type Entry struct {
+	ID                     string
+	AccountID              string
+	TransferID             string
+	Amount                 Amount
+	AccountPreviousBalance Amount
+	AccountCurrentBalance  Amount
+	AccountVersion         int
+	CreatedAt              time.Time
+	EventAt                time.Time
+	Metadata               *string
+	Pending                bool
+	Hash                   string
+}
+
+// ListEntries returns all entries for the account, oldest first.
+func (c *Client) ListEntries(ctx context.Context, accountID string) ([]Entry, error) {
+	return queryAll[Entry](ctx, c, "select * from pgledger_entries_view where account_id = $1 order by id", accountID)
+}
+
+// ListEntriesByEventAt calls pgledger_account_entries_by_event_at to return the
+// posted entries for the account with an event_at in [start, end), ordered by
+// event_at. The balances are recomputed in that order, so they match the real
+// world history even when transfers were recorded late. A zero start or end
+// leaves that end of the period open.
+func (c *Client) ListEntriesByEventAt(ctx context.Context, accountID string, start, end time.Time) ([]Entry, error) {
+	return queryAll[Entry](ctx, c, "select * from pgledger_account_entries_by_event_at($1, $2, $3)",
+		accountID, nullTime(start), nullTime(end))
+}
+
+func nullTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
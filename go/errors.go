@@ -0,0 +1,134 @@
+package pgledger
+
+import (
+	"encoding/json"
+	"errors"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// Sentinel errors for each ledger rule. Use errors.Is to check which rule was
+// violated, and errors.As with a *LedgerError to get the details.
+var (
+	ErrInsufficientBalance       = errors.New("account does not allow negative balance")
+	ErrPositiveBalanceNotAllowed = errors.New("account does not allow positive balance")
+	ErrCurrencyMismatch          = errors.New("cannot transfer between different currencies")
+	ErrNonPositiveAmount         = errors.New("amount must be positive")
+	ErrSameAccount               = errors.New("cannot transfer to the same account")
+	ErrAccountNotFound           = errors.New("account does not exist")
+	ErrIdempotencyKeyConflict    = errors.New("idempotency key was already used with different parameters")
+	ErrTransferNotFound          = errors.New("transfer does not exist")
+	ErrTransferAlreadyReversed   = errors.New("transfer has already been reversed")
+	ErrReversalExceedsTransfer   = errors.New("reversal amount exceeds the remaining amount of the transfer")
+	ErrTransferNotPending        = errors.New("transfer is not pending")
+	ErrTransferNotPosted         = errors.New("transfer is not posted")
+	ErrPostExceedsPending        = errors.New("amount exceeds the pending amount of the transfer")
+	ErrAccountStatus             = errors.New("account status does not allow the transfer")
+	ErrAccountNotEmpty           = errors.New("account cannot be closed with a non-zero balance")
+	ErrAccountClosed             = errors.New("account is closed")
+	ErrBelowMinBalance           = errors.New("account balance would be below its minimum balance")
+	ErrAboveMaxBalance           = errors.New("account balance would be above its maximum balance")
+	ErrCurrencyNotFound          = errors.New("currency does not exist")
+	ErrAmountExceedsScale        = errors.New("amount has more decimal places than the currency allows")
+	ErrSameCurrencyExchange      = errors.New("cannot exchange between the same currency")
+	ErrDirectWrite               = errors.New("ledger history can only be changed by the pgledger functions")
+	ErrReconciliationConflict    = errors.New("reconciliation line was already imported with different values")
+)
+
+// These SQLSTATE codes are raised by the pgledger SQL functions. They are
+// stable, so they can be matched from any language.
+var errorCodes = map[string]error{
+	"PGL01": ErrInsufficientBalance,
+	"PGL02": ErrPositiveBalanceNotAllowed,
+	"PGL03": ErrCurrencyMismatch,
+	"PGL04": ErrNonPositiveAmount,
+	"PGL05": ErrSameAccount,
+	"PGL06": ErrAccountNotFound,
+	"PGL07": ErrIdempotencyKeyConflict,
+	"PGL08": ErrTransferNotFound,
+	"PGL09": ErrTransferAlreadyReversed,
+	"PGL10": ErrReversalExceedsTransfer,
+	"PGL11": ErrTransferNotPending,
+	"PGL12": ErrTransferNotPosted,
+	"PGL13": ErrPostExceedsPending,
+	"PGL14": ErrAccountStatus,
+	"PGL15": ErrAccountNotEmpty,
+	"PGL16": ErrAccountClosed,
+	"PGL17": ErrBelowMinBalance,
+	"PGL18": ErrAboveMaxBalance,
+	"PGL19": ErrCurrencyNotFound,
+	"PGL20": ErrAmountExceedsScale,
+	"PGL21": ErrSameCurrencyExchange,
+	"PGL22": ErrDirectWrite,
+	"PGL23": ErrReconciliationConflict,
+}
+
+// LedgerError is returned when a pgledger SQL function rejects a request
+// because it would break one of the ledger rules. The fields are filled in from
+// the DETAIL of the PostgreSQL error, and are empty when they don't apply to
+// the rule that was violated.
+type LedgerError struct {
+	Code             string
+	Message          string
+	AccountID        string `json:"account_id"`
+	AccountName      string `json:"account_name"`
+	Balance          Amount `json:"balance"`
+	Amount           Amount `json:"amount"`
+	FromAccountID    string `json:"from_account_id"`
+	ToAccountID      string `json:"to_account_id"`
+	FromCurrency     string `json:"from_currency"`
+	ToCurrency       string `json:"to_currency"`
+	IdempotencyKey   string `json:"idempotency_key"`
+	TransferID       string `json:"transfer_id"`
+	RemainingAmount  Amount `json:"remaining_amount"`
+	PendingAmount    Amount `json:"pending_amount"`
+	AvailableBalance Amount `json:"available_balance"`
+	Status           string `json:"status"`
+	MinBalance       Amount `json:"min_balance"`
+	MaxBalance       Amount `json:"max_balance"`
+	Currency         string `json:"currency"`
+	Scale            int    `json:"scale"`
+	Table            string `json:"table"`
+	Operation        string `json:"operation"`
+	ExternalID       string `json:"external_id"`
+
+	kind  error
+	pgErr *pgconn.PgError
+}
+
+func (e *LedgerError) Error() string {
+	return e.Message
+}
+
+// Unwrap returns both the sentinel error for the rule and the underlying
+// *pgconn.PgError.
+func (e *LedgerError) Unwrap() []error {
+	return []error{e.kind, e.pgErr}
+}
+
+// wrapError converts PostgreSQL errors with a pgledger SQLSTATE into a
+// *LedgerError. Other errors are returned unchanged.
+func wrapError(err error) error {
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) {
+		return err
+	}
+
+	kind, ok := errorCodes[pgErr.Code]
+	if !ok {
+		return err
+	}
+
+	ledgerErr := &LedgerError{
+		Code:    pgErr.Code,
+		Message: pgErr.Message,
+		kind:    kind,
+		pgErr:   pgErr,
+	}
+
+	// The detail is always a JSON object, but don't hide the real error if it
+	// somehow can't be parsed
+	_ = json.Unmarshal([]byte(pgErr.Detail), ledgerErr)
+
+	return ledgerErr
+}
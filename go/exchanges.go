@@ -0,0 +1,51 @@
+package pgledger
+
+import (
+	"context"
+	"time"
+)
+
+// Exchange is a row from pgledger_exchanges_view. Rate is the effective rate,
+// ToAmount / FromAmount.
+type Exchange struct {
+	ID             string
+	JournalID      string
+	FromTransferID string
+	ToTransferID   string
+	FromCurrency   string
+	ToCurrency     string
+	FromAmount     Amount
+	ToAmount       Amount
+	Rate           Amount
+	CreatedAt      time.Time
+}
+
+// ExchangeRequest is the accounts and amounts of a currency exchange. FromAmount
+// moves from FromAccountID to FromLiquidityAccountID, and ToAmount moves from
+// ToLiquidityAccountID to ToAccountID. The accounts can also be external refs.
+type ExchangeRequest struct {
+	FromAccountID          string
+	ToAccountID            string
+	FromAmount             Amount
+	ToAmount               Amount
+	FromLiquidityAccountID string
+	ToLiquidityAccountID   string
+}
+
+// CreateExchange calls pgledger_exchange to create both transfers of a
+// currency exchange atomically, and record the rate. The options apply to both
+// transfers.
+func (c *Client) CreateExchange(ctx context.Context, request ExchangeRequest, opts ...TransferOption) (*Exchange, error) {
+	named, values := transferArgs(opts).sql(6)
+
+	return queryOne[Exchange](ctx, c,
+		"select * from pgledger_exchange($1, $2, $3, $4, $5, $6"+named+")",
+		append([]any{
+			request.FromAccountID,
+			request.ToAccountID,
+			request.FromAmount,
+			request.ToAmount,
+			request.FromLiquidityAccountID,
+			request.ToLiquidityAccountID,
+		}, values...)...)
+}
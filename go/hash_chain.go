@@ -0,0 +1,202 @@
+package pgledger
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// HashChainProblem is an entry whose stored hash doesn't match the hash
+// recomputed from its columns and the hash of the account's previous entry.
+type HashChainProblem struct {
+	EntryID        string
+	AccountID      string `db:"-"`
+	AccountVersion int
+	Hash           string
+	ExpectedHash   string
+}
+
+// VerifyHashChain calls pgledger_verify_hash_chain to check that the entries of
+// the account haven't been edited or deleted. It returns no problems if the
+// chain is intact.
+func (c *Client) VerifyHashChain(ctx context.Context, accountID string) ([]HashChainProblem, error) {
+	problems, err := queryAll[HashChainProblem](ctx, c, "select * from pgledger_verify_hash_chain($1)", accountID)
+	for i := range problems {
+		problems[i].AccountID = accountID
+	}
+	return problems, err
+}
+
+// VerifyHashChains checks the hash chains of the given entries without a
+// database, such as entries read from an export with ReadEntriesCSV. The
+// entries can be for any number of accounts and in any order, but must include
+// every entry of each account.
+func VerifyHashChains(entries []Entry) []HashChainProblem {
+	sorted := slices.Clone(entries)
+	slices.SortFunc(sorted, func(a, b Entry) int {
+		if c := strings.Compare(a.AccountID, b.AccountID); c != 0 {
+			return c
+		}
+		return a.AccountVersion - b.AccountVersion
+	})
+
+	var problems []HashChainProblem
+	var previous *Entry
+	for i := range sorted {
+		entry := &sorted[i]
+
+		var previousHash string
+		if previous != nil && previous.AccountID == entry.AccountID {
+			previousHash = previous.Hash
+		}
+
+		expected := entryHash(previousHash, entry)
+		if entry.Hash != expected {
+			problems = append(problems, HashChainProblem{
+				EntryID:        entry.ID,
+				AccountID:      entry.AccountID,
+				AccountVersion: entry.AccountVersion,
+				Hash:           entry.Hash,
+				ExpectedHash:   expected,
+			})
+		}
+
+		previous = entry
+	}
+
+	return problems
+}
+
+// entryHash computes the hash of an entry the same way as pgledger_entry_hash.
+// Both hashes are hex encoded.
+func entryHash(previousHash string, entry *Entry) string {
+	// An invalid previous hash is already reported as a problem with the
+	// previous entry, and decoding as much as possible still makes this one fail
+	previous, _ := hex.DecodeString(previousHash)
+
+	fields := []string{
+		entry.ID,
+		entry.AccountID,
+		entry.TransferID,
+		entry.Amount.String(),
+		entry.AccountPreviousBalance.String(),
+		entry.AccountCurrentBalance.String(),
+		strconv.Itoa(entry.AccountVersion),
+		entry.CreatedAt.UTC().Format("2006-01-02T15:04:05.000000Z"),
+		strconv.FormatBool(entry.Pending),
+	}
+
+	hash := sha256.New()
+	hash.Write(previous)
+	hash.Write([]byte(strings.Join(fields, "|")))
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// The columns needed to verify the hash chain. Any other columns are ignored.
+var entryCSVColumns = []string{
+	"id",
+	"account_id",
+	"transfer_id",
+	"amount",
+	"account_previous_balance",
+	"account_current_balance",
+	"account_version",
+	"created_at",
+	"pending",
+	"hash",
+}
+
+// PostgreSQL formats timestamps with as many fractional digits as needed, and
+// a time zone offset which only includes the minutes when they aren't zero.
+var entryCSVTimeLayouts = []string{
+	"2006-01-02 15:04:05.999999-07",
+	"2006-01-02 15:04:05.999999-07:00",
+	time.RFC3339Nano,
+}
+
+// ReadEntriesCSV reads entries exported from pgledger_entries_view (or the
+// pgledger_entries table) as CSV with a header, such as with:
+//
+//	\copy (select * from pgledger_entries_view) to 'entries.csv' with csv header
+//
+// Only the columns needed by VerifyHashChains are read.
+func ReadEntriesCSV(r io.Reader) ([]Entry, error) {
+	reader := csv.NewReader(r)
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("reading header: %w", err)
+	}
+
+	columns := make(map[string]int, len(entryCSVColumns))
+	for _, column := range entryCSVColumns {
+		i := slices.Index(header, column)
+		if i < 0 {
+			return nil, fmt.Errorf("missing column %q", column)
+		}
+		columns[column] = i
+	}
+
+	var entries []Entry
+	for {
+		record, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			return entries, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		entry, err := parseEntryCSV(record, columns)
+		if err != nil {
+			line, _ := reader.FieldPos(0)
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		entries = append(entries, entry)
+	}
+}
+
+func parseEntryCSV(record []string, columns map[string]int) (Entry, error) {
+	value := func(column string) string { return record[columns[column]] }
+
+	entry := Entry{
+		ID:         value("id"),
+		AccountID:  value("account_id"),
+		TransferID: value("transfer_id"),
+		// The table has the raw bytea, and the view has it hex encoded
+		Hash: strings.TrimPrefix(value("hash"), `\x`),
+	}
+
+	var err error
+	if entry.Amount, err = ParseAmount(value("amount")); err != nil {
+		return Entry{}, err
+	}
+	if entry.AccountPreviousBalance, err = ParseAmount(value("account_previous_balance")); err != nil {
+		return Entry{}, err
+	}
+	if entry.AccountCurrentBalance, err = ParseAmount(value("account_current_balance")); err != nil {
+		return Entry{}, err
+	}
+	if entry.AccountVersion, err = strconv.Atoi(value("account_version")); err != nil {
+		return Entry{}, fmt.Errorf("invalid account_version: %w", err)
+	}
+	if entry.Pending, err = strconv.ParseBool(value("pending")); err != nil {
+		return Entry{}, fmt.Errorf("invalid pending: %w", err)
+	}
+
+	createdAt := value("created_at")
+	for _, layout := range entryCSVTimeLayouts {
+		if entry.CreatedAt, err = time.Parse(layout, createdAt); err == nil {
+			return entry, nil
+		}
+	}
+	return Entry{}, fmt.Errorf("invalid created_at %q", createdAt)
+}
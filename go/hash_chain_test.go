@@ -0,0 +1,68 @@
+package pgledger
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const entriesCSV = `id,account_id,transfer_id,amount,account_previous_balance,account_current_balance,account_version,created_at,event_at,metadata,pending,hash
+pgle_2,pgla_1,pglt_2,-2.50,10.00,7.50,2,2025-06-01 12:30:00.123456+00,2025-06-01 12:30:00.123456+00,,f,a6733b3b7a613291207b1567c2a06655f359a69ab9b1e3313d8682207e961f05
+pgle_1,pgla_1,pglt_1,10.00,0,10.00,1,2025-06-01 14:00:00+02,2025-06-01 12:00:00+00,"{""a"": 1}",f,cf587f533ccc5f7783c6c8f29b6537a6b7ad273ec5539a30e667ef58697d2490
+`
+
+func TestReadEntriesCSVAndVerifyHashChains(t *testing.T) {
+	entries, err := ReadEntriesCSV(strings.NewReader(entriesCSV))
+	assert.NoError(t, err)
+	assert.Len(t, entries, 2)
+
+	assert.Equal(t, "pgle_2", entries[0].ID)
+	assert.Equal(t, "-2.50", entries[0].Amount.String())
+	assert.Equal(t, 2, entries[0].AccountVersion)
+	assert.Equal(t, time.Date(2025, 6, 1, 12, 30, 0, 123456000, time.UTC), entries[0].CreatedAt.UTC())
+	assert.False(t, entries[0].Pending)
+	assert.Equal(t, time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC), entries[1].CreatedAt.UTC())
+
+	// The hashes match ones computed independently from the format described
+	// in the migration
+	assert.Empty(t, VerifyHashChains(entries))
+}
+
+func TestVerifyHashChainsFindsTampering(t *testing.T) {
+	entries, err := ReadEntriesCSV(strings.NewReader(entriesCSV))
+	assert.NoError(t, err)
+
+	// An edited entry doesn't match its own hash
+	edited := []Entry{entries[0], entries[1]}
+	edited[1].Amount = MustParseAmount("11.00")
+
+	problems := VerifyHashChains(edited)
+	assert.Len(t, problems, 1)
+	assert.Equal(t, "pgle_1", problems[0].EntryID)
+	assert.Equal(t, "pgla_1", problems[0].AccountID)
+	assert.Equal(t, 1, problems[0].AccountVersion)
+	assert.Equal(t, entries[1].Hash, problems[0].Hash)
+	assert.NotEqual(t, problems[0].Hash, problems[0].ExpectedHash)
+
+	// A deleted entry breaks the chain of the entry after it
+	problems = VerifyHashChains(entries[:1])
+	assert.Len(t, problems, 1)
+	assert.Equal(t, "pgle_2", problems[0].EntryID)
+
+	// Chains are per account
+	other := entries[1]
+	other.AccountID = "pgla_2"
+	problems = VerifyHashChains([]Entry{entries[0], entries[1], other})
+	assert.Len(t, problems, 1)
+	assert.Equal(t, "pgla_2", problems[0].AccountID)
+}
+
+func TestReadEntriesCSVErrors(t *testing.T) {
+	_, err := ReadEntriesCSV(strings.NewReader("id,account_id\npgle_1,pgla_1\n"))
+	assert.ErrorContains(t, err, `missing column "transfer_id"`)
+
+	_, err = ReadEntriesCSV(strings.NewReader(strings.Replace(entriesCSV, "2025-06-01 14:00:00+02", "yesterday", 1)))
+	assert.ErrorContains(t, err, `line 3: invalid created_at "yesterday"`)
+}
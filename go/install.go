@@ -0,0 +1,185 @@
+package pgledger
+
+import (
+	"context"
+	"embed"
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// The SQL files are copied from the root of the repository, since go:embed
+// can't reach outside of the module. pgledger.sql is then regenerated from the
+// migrations.
+//
+//go:generate sh -c "cp ../vendor/scoville-pgsql-ulid/*.sql sql/ && cp ../migrations/*.sql sql/migrations/"
+//go:generate go run ./cmd/generate_sql ../pgledger.sql
+//go:embed sql/*.sql sql/migrations/*.sql
+var sqlFiles embed.FS
+
+// The vendored ULID functions which the migrations depend on. They are run
+// before the first migration.
+var ulidFiles = []string{
+	"sql/ulid-to-uuid.sql",
+	"sql/uuid-to-ulid.sql",
+}
+
+type migration struct {
+	version int
+	name    string
+	sql     string
+}
+
+// migrations returns the embedded migrations in order. Each file is named like
+// pgledger_01.sql and records its own version in pgledger_schema_migrations.
+func migrations() ([]migration, error) {
+	entries, err := sqlFiles.ReadDir("sql/migrations")
+	if err != nil {
+		return nil, err
+	}
+
+	var result []migration
+	for _, entry := range entries {
+		var version int
+		if _, err := fmt.Sscanf(entry.Name(), "pgledger_%d.sql", &version); err != nil {
+			return nil, fmt.Errorf("invalid migration name %s: %w", entry.Name(), err)
+		}
+
+		sql, err := sqlFiles.ReadFile(path.Join("sql/migrations", entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		result = append(result, migration{version: version, name: entry.Name(), sql: string(sql)})
+	}
+
+	slices.SortFunc(result, func(a, b migration) int { return a.version - b.version })
+
+	return result, nil
+}
+
+// Schema returns all of the migrations combined into a single SQL script. This
+// is what pgledger.sql contains, and it can be used to install pgledger with
+// other tools.
+func Schema() (string, error) {
+	migrations, err := migrations()
+	if err != nil {
+		return "", err
+	}
+
+	var sb strings.Builder
+	sb.WriteString("-- This file is generated from the files in the migrations directory by\n")
+	sb.WriteString("-- `just generate`. Don't edit it directly.\n")
+
+	for _, m := range migrations {
+		fmt.Fprintf(&sb, "\n-- migrations/%s\n\n%s", m.name, m.sql)
+	}
+
+	return sb.String(), nil
+}
+
+// TxBeginner starts a transaction. It is satisfied by *pgxpool.Pool and
+// *pgx.Conn.
+type TxBeginner interface {
+	Begin(ctx context.Context) (pgx.Tx, error)
+}
+
+// Install installs pgledger, or upgrades an existing installation, by applying
+// any migrations which are not yet recorded in pgledger_schema_migrations. All
+// pending migrations run in a single transaction while holding an advisory
+// lock, so it is safe to call every time an application starts, even from
+// several processes at once.
+func Install(ctx context.Context, conn TxBeginner) error {
+	migrations, err := migrations()
+	if err != nil {
+		return err
+	}
+
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	// The lock is released when the transaction ends
+	if _, err := tx.Exec(ctx, "select pg_advisory_xact_lock(hashtext('pgledger_schema_migrations'))"); err != nil {
+		return err
+	}
+
+	applied, err := appliedMigrations(ctx, tx)
+	if err != nil {
+		return err
+	}
+
+	if len(applied) == 0 {
+		for _, name := range ulidFiles {
+			sql, err := sqlFiles.ReadFile(name)
+			if err != nil {
+				return err
+			}
+
+			if _, err := tx.Exec(ctx, string(sql)); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, m := range migrations {
+		if slices.Contains(applied, m.version) {
+			continue
+		}
+
+		// Exec without arguments uses the simple protocol, which allows
+		// multiple statements in one call
+		if _, err := tx.Exec(ctx, m.sql); err != nil {
+			return fmt.Errorf("applying migration %s: %w", m.name, err)
+		}
+	}
+
+	return tx.Commit(ctx)
+}
+
+// appliedMigrations returns the versions recorded in
+// pgledger_schema_migrations.
+//
+// Databases which were set up before there were migrations, by running the
+// old pgledger.sql, have the pgledger tables but no migrations table. Those are recorded as
+// having the first migration. The old pgledger.sql only differs from it in the
+// error codes of a few functions, which later migrations replace.
+func appliedMigrations(ctx context.Context, tx pgx.Tx) ([]int, error) {
+	var hasMigrations, hasAccounts bool
+	err := tx.QueryRow(ctx, `
+		select
+			to_regclass('pgledger_schema_migrations') is not null,
+			to_regclass('pgledger_accounts') is not null`,
+	).Scan(&hasMigrations, &hasAccounts)
+	if err != nil {
+		return nil, err
+	}
+
+	if !hasMigrations {
+		if !hasAccounts {
+			return nil, nil
+		}
+
+		_, err := tx.Exec(ctx, `
+			CREATE TABLE pgledger_schema_migrations (
+				version INTEGER PRIMARY KEY,
+				applied_at TIMESTAMPTZ NOT NULL DEFAULT now()
+			);
+			INSERT INTO pgledger_schema_migrations (version) VALUES (1);`)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	rows, err := tx.Query(ctx, "select version from pgledger_schema_migrations order by version")
+	if err != nil {
+		return nil, err
+	}
+
+	return pgx.CollectRows(rows, pgx.RowTo[int])
+}
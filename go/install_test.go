@@ -0,0 +1,62 @@
+package pgledger
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// The embedded SQL files are copies, so make sure they haven't drifted from
+// the originals. Run `just generate` to update them.
+func TestEmbeddedSQLIsUpToDate(t *testing.T) {
+	originals, err := filepath.Glob("../vendor/scoville-pgsql-ulid/*.sql")
+	assert.NoError(t, err)
+	assert.Len(t, originals, len(ulidFiles))
+
+	migrations, err := filepath.Glob("../migrations/*.sql")
+	assert.NoError(t, err)
+	assert.NotEmpty(t, migrations)
+
+	for _, original := range originals {
+		assertEmbedded(t, original, path.Join("sql", filepath.Base(original)))
+	}
+
+	for _, original := range migrations {
+		assertEmbedded(t, original, path.Join("sql/migrations", filepath.Base(original)))
+	}
+}
+
+func assertEmbedded(t *testing.T, originalPath, embeddedPath string) {
+	original, err := os.ReadFile(originalPath)
+	assert.NoError(t, err)
+
+	embedded, err := sqlFiles.ReadFile(embeddedPath)
+	assert.NoError(t, err, "%s is not embedded, run `just generate`", originalPath)
+
+	assert.Equal(t, string(original), string(embedded), "%s is out of date, run `just generate`", embeddedPath)
+}
+
+func TestPgledgerSQLIsUpToDate(t *testing.T) {
+	schema, err := Schema()
+	assert.NoError(t, err)
+
+	combined, err := os.ReadFile("../pgledger.sql")
+	assert.NoError(t, err)
+
+	assert.Equal(t, schema, string(combined), "pgledger.sql is out of date, run `just generate`")
+}
+
+func TestMigrationsAreNumberedAndRecordThemselves(t *testing.T) {
+	migrations, err := migrations()
+	assert.NoError(t, err)
+
+	for i, m := range migrations {
+		assert.Equal(t, i+1, m.version, "migrations must be numbered without gaps")
+		assert.Equal(t, fmt.Sprintf("pgledger_%02d.sql", m.version), m.name)
+		assert.Contains(t, m.sql, fmt.Sprintf("INSERT INTO pgledger_schema_migrations (version) VALUES (%d);", m.version))
+	}
+}
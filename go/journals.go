@@ -0,0 +1,31 @@
+package pgledger
+
+import (
+	"context"
+	"time"
+)
+
+// Journal is a row from pgledger_journals_view, along with the transfers which
+// were created together in it.
+type Journal struct {
+	ID        string
+	Metadata  *string
+	CreatedAt time.Time
+	Transfers []Transfer `db:"-"`
+}
+
+// GetJournal returns the journal with the given ID and all of its transfers,
+// or pgx.ErrNoRows if it does not exist.
+func (c *Client) GetJournal(ctx context.Context, id string) (*Journal, error) {
+	journal, err := queryOne[Journal](ctx, c, "select * from pgledger_journals_view where id = $1", id)
+	if err != nil {
+		return nil, err
+	}
+
+	journal.Transfers, err = queryAll[Transfer](ctx, c, "select * from pgledger_transfers_view where journal_id = $1 order by id", id)
+	if err != nil {
+		return nil, err
+	}
+
+	return journal, nil
+}
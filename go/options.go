@@ -0,0 +1,230 @@
+package pgledger
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// namedArg is an optional `name => value` argument to a pgledger SQL function.
+// Options are passed as named arguments so that anything the caller leaves out
+// falls back to the default declared in SQL.
+type namedArg struct {
+	name  string
+	value any
+}
+
+type namedArgs []namedArg
+
+// set adds the argument, replacing an earlier one with the same name so that
+// the last option wins.
+func (args *namedArgs) set(arg namedArg) {
+	for i := range *args {
+		if (*args)[i].name == arg.name {
+			(*args)[i] = arg
+			return
+		}
+	}
+	*args = append(*args, arg)
+}
+
+// sql renders the arguments as `, name => $n` with placeholders numbered after
+// the given number of positional arguments.
+func (args namedArgs) sql(positional int) (string, []any) {
+	var sb strings.Builder
+	values := make([]any, 0, len(args))
+
+	for i, arg := range args {
+		fmt.Fprintf(&sb, ", %s => $%d", arg.name, positional+i+1)
+		values = append(values, arg.value)
+	}
+
+	return sb.String(), values
+}
+
+// AccountOption sets an optional parameter of pgledger_create_account.
+type AccountOption interface {
+	accountArg() namedArg
+}
+
+// TransferOption sets an optional parameter of pgledger_create_transfer and
+// pgledger_create_transfers.
+type TransferOption interface {
+	transferArg() namedArg
+}
+
+// ReversalOption sets an optional parameter of pgledger_reverse_transfer.
+type ReversalOption interface {
+	reversalArg() namedArg
+}
+
+// PostOption sets an optional parameter of pgledger_post_pending_transfer.
+type PostOption interface {
+	postArg() namedArg
+}
+
+// ReconcileOption sets an optional parameter of pgledger_reconcile.
+type ReconcileOption interface {
+	reconcileArg() namedArg
+}
+
+// MetadataOption can be used when creating accounts, transfers and reversals,
+// and when posting or voiding pending transfers.
+type MetadataOption interface {
+	AccountOption
+	TransferOption
+	ReversalOption
+	PostOption
+}
+
+type accountOption namedArg
+
+func (o accountOption) accountArg() namedArg { return namedArg(o) }
+
+type transferOption namedArg
+
+func (o transferOption) transferArg() namedArg { return namedArg(o) }
+
+type reversalOption namedArg
+
+func (o reversalOption) reversalArg() namedArg { return namedArg(o) }
+
+type postOption namedArg
+
+func (o postOption) postArg() namedArg { return namedArg(o) }
+
+type reconcileOption namedArg
+
+func (o reconcileOption) reconcileArg() namedArg { return namedArg(o) }
+
+type metadataOption namedArg
+
+func (o metadataOption) accountArg() namedArg  { return namedArg(o) }
+func (o metadataOption) transferArg() namedArg { return namedArg(o) }
+func (o metadataOption) reversalArg() namedArg { return namedArg(o) }
+func (o metadataOption) postArg() namedArg     { return namedArg(o) }
+
+// WithMetadata sets the JSONB metadata when creating an account, transfer or
+// reversal, or when posting or voiding a pending transfer. Strings and byte
+// slices are sent as JSON text; anything else is marshaled with encoding/json.
+func WithMetadata(metadata any) MetadataOption {
+	return metadataOption{"metadata", metadata}
+}
+
+// WithAllowNegativeBalance sets allow_negative_balance on a new account.
+func WithAllowNegativeBalance(allow bool) AccountOption {
+	return accountOption{"allow_negative_balance", allow}
+}
+
+// WithAllowPositiveBalance sets allow_positive_balance on a new account.
+func WithAllowPositiveBalance(allow bool) AccountOption {
+	return accountOption{"allow_positive_balance", allow}
+}
+
+// WithMinBalance sets the lowest balance a new account can have, such as an
+// overdraft limit.
+func WithMinBalance(minBalance Amount) AccountOption {
+	return accountOption{"min_balance", minBalance}
+}
+
+// WithMaxBalance sets the highest balance a new account can have.
+func WithMaxBalance(maxBalance Amount) AccountOption {
+	return accountOption{"max_balance", maxBalance}
+}
+
+// WithPath sets the ltree path of a new account, such as "user1.available",
+// which is used to roll up balances with AccountTreeBalances.
+func WithPath(path string) AccountOption {
+	return accountOption{"path", path}
+}
+
+// WithExternalRef sets a unique reference for a new account, such as its ID in
+// another system. The ref can be used in place of the account ID when creating
+// transfers.
+func WithExternalRef(externalRef string) AccountOption {
+	return accountOption{"external_ref", externalRef}
+}
+
+// WithEventAt sets when the transfer happened in the real world. It defaults
+// to now(), the same as created_at.
+func WithEventAt(eventAt time.Time) TransferOption {
+	return transferOption{"event_at", eventAt}
+}
+
+// WithIdempotencyKey makes the call safe to retry. Repeating a call with the
+// same key and parameters returns the transfers created by the first call
+// instead of creating new ones. Repeating it with different parameters fails
+// with ErrIdempotencyKeyConflict.
+func WithIdempotencyKey(key string) TransferOption {
+	return transferOption{"idempotency_key", key}
+}
+
+// WithReversalAmount reverses only part of a transfer. By default, a reversal
+// is for whatever has not been reversed yet.
+func WithReversalAmount(amount Amount) ReversalOption {
+	return reversalOption{"amount", amount}
+}
+
+// WithPending creates pending transfers, which reserve the amount without
+// changing any balances until they are posted or voided.
+func WithPending(pending bool) TransferOption {
+	return transferOption{"pending", pending}
+}
+
+// WithPostAmount posts only part of a pending transfer. The rest of the
+// pending amount is released.
+func WithPostAmount(amount Amount) PostOption {
+	return postOption{"amount", amount}
+}
+
+// WithReferenceKey sets the key of the transfer metadata which is compared to
+// the reference of reconciliation lines. It defaults to "reference".
+func WithReferenceKey(key string) ReconcileOption {
+	return reconcileOption{"reference_key", key}
+}
+
+// WithDateTolerance sets how far apart the date of a reconciliation line and
+// the event_at of a transfer can be for them to match. It defaults to 3 days.
+func WithDateTolerance(tolerance time.Duration) ReconcileOption {
+	return reconcileOption{"date_tolerance", tolerance}
+}
+
+func accountArgs(opts []AccountOption) namedArgs {
+	args := make(namedArgs, 0, len(opts))
+	for _, opt := range opts {
+		args.set(opt.accountArg())
+	}
+	return args
+}
+
+func transferArgs(opts []TransferOption) namedArgs {
+	args := make(namedArgs, 0, len(opts))
+	for _, opt := range opts {
+		args.set(opt.transferArg())
+	}
+	return args
+}
+
+func reversalArgs(opts []ReversalOption) namedArgs {
+	args := make(namedArgs, 0, len(opts))
+	for _, opt := range opts {
+		args.set(opt.reversalArg())
+	}
+	return args
+}
+
+func postArgs(opts []PostOption) namedArgs {
+	args := make(namedArgs, 0, len(opts))
+	for _, opt := range opts {
+		args.set(opt.postArg())
+	}
+	return args
+}
+
+func reconcileArgs(opts []ReconcileOption) namedArgs {
+	args := make(namedArgs, 0, len(opts))
+	for _, opt := range opts {
+		args.set(opt.reconcileArg())
+	}
+	return args
+}
@@ -0,0 +1,119 @@
+package pgledger
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// The statuses of a ReconciliationLine.
+const (
+	ReconciliationUnmatched        = "unmatched"
+	ReconciliationPartiallyMatched = "partially_matched"
+	ReconciliationMatched          = "matched"
+)
+
+// ReconciliationLine is a row from pgledger_reconciliation_lines_view: a line
+// from an external statement, such as a bank statement, imported for the
+// ledger account which represents the external account. MatchedAmount is the
+// total of the entries matched to it so far.
+type ReconciliationLine struct {
+	ID            string
+	AccountID     string
+	ExternalID    string
+	Amount        Amount
+	OccurredAt    time.Time
+	Reference     *string
+	Metadata      *string
+	Status        string
+	MatchedAmount Amount
+	CreatedAt     time.Time
+	UpdatedAt     time.Time
+}
+
+// ReconciliationLineRequest is a line to import with ImportReconciliationLines.
+// ExternalID is the ID of the line in the external system, which makes imports
+// safe to repeat. Amount has the same sign as the entries of the account, so
+// money coming into the account is positive. An empty Reference is stored as
+// NULL, and Metadata follows the same rules as WithMetadata.
+type ReconciliationLineRequest struct {
+	ExternalID string
+	Amount     Amount
+	OccurredAt time.Time
+	Reference  string
+	Metadata   any
+}
+
+// ReconciliationException is a row from pgledger_reconciliation_exceptions.
+// Kind is "line" for a ReconciliationLine which isn't fully matched, or "entry"
+// for an entry which isn't matched to any line. For entries, OccurredAt is the
+// event_at and Metadata is the metadata of the transfer.
+type ReconciliationException struct {
+	Kind          string
+	ID            string
+	Status        string
+	Reference     *string
+	Amount        Amount
+	MatchedAmount Amount
+	OccurredAt    time.Time
+	Metadata      *string
+}
+
+// ImportReconciliationLines calls pgledger_import_reconciliation_lines to
+// import lines from an external statement for the account. Lines which were
+// already imported are returned as they are, unless their values changed, which
+// fails with ErrReconciliationConflict.
+func (c *Client) ImportReconciliationLines(ctx context.Context, accountID string, lines []ReconciliationLineRequest) ([]ReconciliationLine, error) {
+	externalIDs := make([]string, len(lines))
+	amounts := make([]Amount, len(lines))
+	occurredAts := make([]time.Time, len(lines))
+	references := make([]*string, len(lines))
+	metadata := make([]*string, len(lines))
+
+	for i, line := range lines {
+		externalIDs[i] = line.ExternalID
+		amounts[i] = line.Amount
+		occurredAts[i] = line.OccurredAt
+		if line.Reference != "" {
+			references[i] = &line.Reference
+		}
+
+		var err error
+		metadata[i], err = jsonText(line.Metadata)
+		if err != nil {
+			return nil, fmt.Errorf("encoding metadata of reconciliation line %d: %w", i, err)
+		}
+	}
+
+	// Build the RECONCILIATION_LINE_REQUEST[] in SQL so we don't need to
+	// register the composite type with pgx
+	sql := `
+		select * from pgledger_import_reconciliation_lines(
+			$1,
+			array(
+				select (r.external_id, r.amount, r.occurred_at, r.reference, r.metadata::jsonb)::reconciliation_line_request
+				from unnest($2::text[], $3::numeric[], $4::timestamptz[], $5::text[], $6::text[])
+					with ordinality as r(external_id, amount, occurred_at, reference, metadata, n)
+				order by r.n
+			)
+		)`
+
+	return queryAll[ReconciliationLine](ctx, c, sql, accountID, externalIDs, amounts, occurredAts, references, metadata)
+}
+
+// Reconcile calls pgledger_reconcile to match the lines of the account which
+// aren't matched yet with its entries, and returns those lines with their new
+// status.
+func (c *Client) Reconcile(ctx context.Context, accountID string, opts ...ReconcileOption) ([]ReconciliationLine, error) {
+	named, values := reconcileArgs(opts).sql(1)
+
+	return queryAll[ReconciliationLine](ctx, c, "select * from pgledger_reconcile($1"+named+")", append([]any{accountID}, values...)...)
+}
+
+// ReconciliationExceptions calls pgledger_reconciliation_exceptions to list the
+// lines and entries of the account in [start, end) which still need attention.
+// A zero start or end leaves that end of the period open.
+func (c *Client) ReconciliationExceptions(ctx context.Context, accountID string, start, end time.Time) ([]ReconciliationException, error) {
+	return queryAll[ReconciliationException](ctx, c, "select * from pgledger_reconciliation_exceptions($1, $2, $3)",
+		accountID, nullTime(start), nullTime(end))
+}
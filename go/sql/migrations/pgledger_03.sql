@@ -0,0 +1,96 @@
+-- Transfer reversals. A reversal is a new transfer in the opposite direction
+-- which points back to the transfer it reverses, so the original transfer and
+-- its entries are never modified.
+ALTER TABLE pgledger_transfers ADD COLUMN reverses_transfer_id TEXT REFERENCES pgledger_transfers (id);
+
+CREATE INDEX ON pgledger_transfers (reverses_transfer_id) WHERE reverses_transfer_id IS NOT NULL;
+
+CREATE OR REPLACE VIEW pgledger_transfers_view AS
+SELECT
+    id,
+    from_account_id,
+    to_account_id,
+    amount,
+    created_at,
+    event_at,
+    metadata,
+    idempotency_key,
+    reverses_transfer_id
+FROM pgledger_transfers;
+
+-- Reverse all (or, if amount is given, part) of a transfer. A transfer can be
+-- reversed several times, as long as the reversals don't add up to more than
+-- the original amount. The reversal goes through pgledger_create_transfer, so
+-- it respects the balance constraints of both accounts.
+CREATE FUNCTION pgledger_reverse_transfer(
+    transfer_id TEXT,
+    metadata JSONB DEFAULT NULL,
+    amount NUMERIC DEFAULT NULL
+)
+RETURNS SETOF PGLEDGER_TRANSFERS_VIEW
+AS $$
+DECLARE
+    original_transfer pgledger_transfers;
+    reversal pgledger_transfers_view;
+    remaining_amount NUMERIC;
+BEGIN
+    -- Lock the original transfer so that concurrent reversals of it can't add
+    -- up to more than the original amount
+    SELECT * INTO original_transfer
+    FROM pgledger_transfers t
+    WHERE t.id = pgledger_reverse_transfer.transfer_id
+    FOR UPDATE;
+
+    IF NOT FOUND THEN
+        RAISE EXCEPTION 'Transfer (id=%) does not exist', transfer_id
+        USING
+            ERRCODE = 'PGL08',
+            DETAIL = json_build_object('transfer_id', transfer_id)::TEXT;
+    END IF;
+
+    SELECT original_transfer.amount - coalesce(sum(t.amount), 0) INTO remaining_amount
+    FROM pgledger_transfers t
+    WHERE t.reverses_transfer_id = original_transfer.id;
+
+    IF remaining_amount <= 0 THEN
+        RAISE EXCEPTION 'Transfer (id=%) has already been reversed', transfer_id
+        USING
+            ERRCODE = 'PGL09',
+            DETAIL = json_build_object('transfer_id', transfer_id)::TEXT;
+    END IF;
+
+    -- Default to reversing whatever is left of the transfer
+    amount := coalesce(amount, remaining_amount);
+
+    IF amount > remaining_amount THEN
+        RAISE EXCEPTION 'Reversal amount (%) exceeds the remaining amount (%) of transfer (id=%)',
+        amount, remaining_amount, transfer_id
+        USING
+            ERRCODE = 'PGL10',
+            DETAIL = json_build_object(
+                'transfer_id', transfer_id,
+                'amount', amount::TEXT,
+                'remaining_amount', remaining_amount::TEXT
+            )::TEXT;
+    END IF;
+
+    SELECT * INTO reversal
+    FROM pgledger_create_transfer(
+        from_account_id => original_transfer.to_account_id,
+        to_account_id => original_transfer.from_account_id,
+        amount => amount,
+        metadata => metadata
+    );
+
+    UPDATE pgledger_transfers
+    SET reverses_transfer_id = original_transfer.id
+    WHERE pgledger_transfers.id = reversal.id;
+
+    RETURN QUERY
+    SELECT *
+    FROM pgledger_transfers_view v
+    WHERE v.id = reversal.id;
+END;
+$$ LANGUAGE plpgsql;
+
+INSERT INTO pgledger_schema_migrations (version) VALUES (3);
@@ -0,0 +1,617 @@
+-- Two-phase (pending) transfers, for flows like card payments where funds are
+-- reserved first and settled later.
+--
+-- A pending transfer doesn't change the balance of either account. Instead,
+-- it adds to the pending_debits of the source account and the pending_credits
+-- of the destination account. Pending debits reduce the available balance
+-- (balance - pending_debits), which is what the negative balance check uses,
+-- so reserved funds can't be spent twice.
+--
+-- A pending transfer is finished by posting or voiding it. Both release the
+-- reserved amount with a 'released' transfer, and posting also creates a
+-- regular 'posted' transfer for the settled amount (which can be less than the
+-- pending amount). Both point back to the pending transfer with
+-- pending_transfer_id. This way, transfers and entries are only ever inserted,
+-- every transfer has exactly two entries, and the pending entries of an
+-- account add up to its outstanding pending amounts.
+--
+-- New error codes:
+--
+--   PGL11: transfer is not pending (or was already posted or voided)
+--   PGL12: transfer is not posted
+--   PGL13: amount exceeds the pending amount of the transfer
+ALTER TABLE pgledger_accounts
+ADD COLUMN pending_debits NUMERIC NOT NULL DEFAULT 0,
+ADD COLUMN pending_credits NUMERIC NOT NULL DEFAULT 0;
+
+ALTER TABLE pgledger_transfers
+ADD COLUMN status TEXT NOT NULL DEFAULT 'posted' CHECK (status IN ('posted', 'pending', 'released')),
+ADD COLUMN pending_transfer_id TEXT REFERENCES pgledger_transfers (id);
+
+CREATE INDEX ON pgledger_transfers (pending_transfer_id) WHERE pending_transfer_id IS NOT NULL;
+
+ALTER TABLE pgledger_entries ADD COLUMN pending BOOLEAN NOT NULL DEFAULT FALSE;
+
+CREATE OR REPLACE VIEW pgledger_accounts_view AS
+SELECT
+    id,
+    name,
+    currency,
+    balance,
+    version,
+    allow_negative_balance,
+    allow_positive_balance,
+    metadata,
+    created_at,
+    updated_at,
+    pending_debits,
+    pending_credits,
+    balance - pending_debits AS available_balance
+FROM pgledger_accounts;
+
+CREATE OR REPLACE VIEW pgledger_transfers_view AS
+SELECT
+    id,
+    from_account_id,
+    to_account_id,
+    amount,
+    created_at,
+    event_at,
+    metadata,
+    idempotency_key,
+    reverses_transfer_id,
+    status,
+    pending_transfer_id
+FROM pgledger_transfers;
+
+CREATE OR REPLACE VIEW pgledger_entries_view AS
+SELECT
+    e.id,
+    e.account_id,
+    e.transfer_id,
+    e.amount,
+    e.account_previous_balance,
+    e.account_current_balance,
+    e.account_version,
+    e.created_at,
+    t.event_at,
+    t.metadata,
+    e.pending
+FROM pgledger_entries e
+INNER JOIN pgledger_transfers t ON e.transfer_id = t.id;
+
+-- The view no longer has the same columns as the table, so return the row from
+-- the view instead of using RETURNING *
+CREATE OR REPLACE FUNCTION pgledger_create_account(
+    name TEXT,
+    currency TEXT,
+    allow_negative_balance BOOLEAN DEFAULT TRUE,
+    allow_positive_balance BOOLEAN DEFAULT TRUE,
+    metadata JSONB DEFAULT NULL
+)
+RETURNS SETOF PGLEDGER_ACCOUNTS_VIEW
+AS $$
+DECLARE
+    new_account_id TEXT;
+BEGIN
+    INSERT INTO pgledger_accounts (name, currency, allow_negative_balance, allow_positive_balance, metadata, created_at, updated_at)
+    VALUES (name, currency, allow_negative_balance, allow_positive_balance, metadata, now(), now())
+    RETURNING pgledger_accounts.id INTO new_account_id;
+
+    RETURN QUERY
+    SELECT *
+    FROM pgledger_accounts_view v
+    WHERE v.id = new_account_id;
+END;
+$$ LANGUAGE plpgsql;
+
+-- Pending debits count against the negative balance check and pending credits
+-- count against the positive balance check, so that posting a pending transfer
+-- can never break them.
+CREATE OR REPLACE FUNCTION pgledger_check_account_balance_constraints(account PGLEDGER_ACCOUNTS) RETURNS VOID AS $$
+BEGIN
+    -- If account doesn't allow negative balance and available balance is negative, raise an error
+    IF NOT account.allow_negative_balance AND (account.balance - account.pending_debits < 0) THEN
+        RAISE EXCEPTION 'Account (id=%, name=%) does not allow negative balance', account.id, account.name
+        USING
+            ERRCODE = 'PGL01',
+            DETAIL = json_build_object(
+                'account_id', account.id,
+                'account_name', account.name,
+                'balance', account.balance::TEXT,
+                'available_balance', (account.balance - account.pending_debits)::TEXT
+            )::TEXT;
+    END IF;
+
+    -- If account doesn't allow positive balance and balance (including pending credits) is positive, raise an error
+    IF NOT account.allow_positive_balance AND (account.balance + account.pending_credits > 0) THEN
+        RAISE EXCEPTION 'Account (id=%, name=%) does not allow positive balance', account.id, account.name
+        USING
+            ERRCODE = 'PGL02',
+            DETAIL = json_build_object(
+                'account_id', account.id,
+                'account_name', account.name,
+                'balance', account.balance::TEXT
+            )::TEXT;
+    END IF;
+END;
+$$ LANGUAGE plpgsql;
+
+-- Apply a single transfer to accounts which the caller has already locked, and
+-- record the transfer and its two entries. Returns the ID of the new transfer.
+-- The transfer_status decides what is changed:
+--
+--   posted: amount moves from the balance of one account to the other
+--   pending: amount is added to pending_debits/pending_credits
+--   released: amount is removed from pending_debits/pending_credits
+CREATE FUNCTION pgledger_apply_transfer(
+    from_account_id TEXT,
+    to_account_id TEXT,
+    amount NUMERIC,
+    transfer_status TEXT,
+    pending_transfer_id TEXT,
+    event_at TIMESTAMPTZ,
+    metadata JSONB,
+    idempotency_key TEXT
+)
+RETURNS TEXT
+AS $$
+DECLARE
+    from_account pgledger_accounts;
+    to_account pgledger_accounts;
+    balance_change NUMERIC := 0;
+    pending_change NUMERIC := 0;
+    new_transfer_id TEXT;
+BEGIN
+    -- Preliminary checks
+    IF amount <= 0 THEN
+        RAISE EXCEPTION 'Amount (%) must be positive', amount
+        USING
+            ERRCODE = 'PGL04',
+            DETAIL = json_build_object('amount', amount::TEXT)::TEXT;
+    END IF;
+
+    IF from_account_id = to_account_id THEN
+        RAISE EXCEPTION 'Cannot transfer to the same account (id=%)', from_account_id
+        USING
+            ERRCODE = 'PGL05',
+            DETAIL = json_build_object('account_id', from_account_id)::TEXT;
+    END IF;
+
+    IF transfer_status = 'posted' THEN
+        balance_change := amount;
+    ELSIF transfer_status = 'pending' THEN
+        pending_change := amount;
+    ELSE
+        pending_change := -amount;
+    END IF;
+
+    -- Update account balances
+    UPDATE pgledger_accounts a
+    SET balance = a.balance - balance_change,
+        pending_debits = a.pending_debits + pending_change,
+        version = a.version + 1,
+        updated_at = now()
+    WHERE a.id = from_account_id
+    RETURNING * INTO from_account;
+
+    -- Check balance constraints for the source account
+    PERFORM pgledger_check_account_balance_constraints(from_account);
+
+    UPDATE pgledger_accounts a
+    SET balance = a.balance + balance_change,
+        pending_credits = a.pending_credits + pending_change,
+        version = a.version + 1,
+        updated_at = now()
+    WHERE a.id = to_account_id
+    RETURNING * INTO to_account;
+
+    -- Check balance constraints for the destination account
+    PERFORM pgledger_check_account_balance_constraints(to_account);
+
+    -- Check that currencies match
+    IF from_account.currency != to_account.currency THEN
+        RAISE EXCEPTION 'Cannot transfer between different currencies (% and %)', from_account.currency, to_account.currency
+        USING
+            ERRCODE = 'PGL03',
+            DETAIL = json_build_object(
+                'from_account_id', from_account.id,
+                'to_account_id', to_account.id,
+                'from_currency', from_account.currency,
+                'to_currency', to_account.currency
+            )::TEXT;
+    END IF;
+
+    -- Create transfer record
+    INSERT INTO pgledger_transfers (
+        from_account_id, to_account_id, amount, created_at, event_at, metadata, idempotency_key, status, pending_transfer_id
+    )
+    VALUES (
+        from_account_id, to_account_id, amount, now(), event_at, metadata, idempotency_key, transfer_status, pending_transfer_id
+    )
+    RETURNING pgledger_transfers.id INTO new_transfer_id;
+
+    -- Create entry for the source account (negative amount, or positive when
+    -- releasing a pending amount)
+    INSERT INTO pgledger_entries (
+        account_id, transfer_id, amount, account_previous_balance, account_current_balance, account_version, created_at, pending
+    )
+    VALUES (
+        from_account_id,
+        new_transfer_id,
+        -(balance_change + pending_change),
+        from_account.balance + balance_change,
+        from_account.balance,
+        from_account.version,
+        now(),
+        transfer_status != 'posted'
+    );
+
+    -- Create entry for the destination account (positive amount, or negative
+    -- when releasing a pending amount)
+    INSERT INTO pgledger_entries (
+        account_id, transfer_id, amount, account_previous_balance, account_current_balance, account_version, created_at, pending
+    )
+    VALUES (
+        to_account_id,
+        new_transfer_id,
+        balance_change + pending_change,
+        to_account.balance - balance_change,
+        to_account.balance,
+        to_account.version,
+        now(),
+        transfer_status != 'posted'
+    );
+
+    RETURN new_transfer_id;
+END;
+$$ LANGUAGE plpgsql;
+
+-- The functions gain a pending parameter, so the old versions have to be
+-- dropped rather than replaced
+DROP FUNCTION pgledger_create_transfer(TEXT, TEXT, NUMERIC, TIMESTAMPTZ, JSONB, TEXT);
+DROP FUNCTION pgledger_create_transfers(TRANSFER_REQUEST [], TIMESTAMPTZ, JSONB, TEXT);
+
+CREATE FUNCTION pgledger_create_transfer(
+    from_account_id TEXT,
+    to_account_id TEXT,
+    amount NUMERIC,
+    event_at TIMESTAMPTZ DEFAULT NULL,
+    metadata JSONB DEFAULT NULL,
+    idempotency_key TEXT DEFAULT NULL,
+    pending BOOLEAN DEFAULT FALSE
+)
+RETURNS SETOF PGLEDGER_TRANSFERS_VIEW
+AS $$
+BEGIN
+    -- Simply call pgledger_create_transfers with a single transfer
+    RETURN QUERY
+    SELECT * FROM pgledger_create_transfers(
+        transfer_requests => array[(from_account_id, to_account_id, amount)::TRANSFER_REQUEST],
+        event_at => event_at,
+        metadata => metadata,
+        idempotency_key => idempotency_key,
+        pending => pending
+    );
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE FUNCTION pgledger_create_transfers(
+    transfer_requests TRANSFER_REQUEST [],
+    event_at TIMESTAMPTZ DEFAULT NULL,
+    metadata JSONB DEFAULT NULL,
+    idempotency_key TEXT DEFAULT NULL,
+    pending BOOLEAN DEFAULT FALSE
+)
+RETURNS SETOF PGLEDGER_TRANSFERS_VIEW
+AS $$
+DECLARE
+    transfer_request transfer_request;
+    transfer_ids TEXT[] := '{}';
+    account_id TEXT;
+    all_account_ids TEXT[] := '{}';
+    request JSONB;
+    existing_key pgledger_idempotency_keys;
+BEGIN
+    IF idempotency_key IS NOT NULL THEN
+        request := jsonb_build_object('transfer_requests', to_jsonb(transfer_requests), 'metadata', metadata);
+
+        -- Only include pending when it's set, so that keys stored before it
+        -- existed still match
+        IF pending THEN
+            request := request || jsonb_build_object('pending', TRUE);
+        END IF;
+
+        -- If another transaction is using the same key, this waits for it to
+        -- commit or roll back
+        INSERT INTO pgledger_idempotency_keys (idempotency_key, request, event_at, created_at)
+        VALUES (idempotency_key, request, event_at, now())
+        ON CONFLICT ON CONSTRAINT pgledger_idempotency_keys_pkey DO NOTHING;
+
+        IF NOT FOUND THEN
+            SELECT * INTO existing_key
+            FROM pgledger_idempotency_keys k
+            WHERE k.idempotency_key = pgledger_create_transfers.idempotency_key;
+
+            IF existing_key.request != request OR existing_key.event_at IS DISTINCT FROM event_at THEN
+                RAISE EXCEPTION 'Idempotency key (%) was already used with different parameters', idempotency_key
+                USING
+                    ERRCODE = 'PGL07',
+                    DETAIL = json_build_object('idempotency_key', idempotency_key)::TEXT;
+            END IF;
+
+            -- Return the transfers from the original call
+            RETURN QUERY
+            SELECT *
+            FROM pgledger_transfers_view t
+            WHERE t.idempotency_key = pgledger_create_transfers.idempotency_key
+            ORDER BY t.id;
+
+            RETURN;
+        END IF;
+    END IF;
+
+    -- Collect all unique account IDs and sort them to prevent deadlocks
+    FOREACH transfer_request IN ARRAY transfer_requests LOOP
+        all_account_ids := array_append(all_account_ids, transfer_request.from_account_id);
+        all_account_ids := array_append(all_account_ids, transfer_request.to_account_id);
+    END LOOP;
+
+    -- Remove duplicates and sort
+    SELECT ARRAY(SELECT DISTINCT unnest FROM unnest(all_account_ids) ORDER BY unnest)
+    INTO all_account_ids;
+
+    -- Lock all accounts in order
+    FOREACH account_id IN ARRAY all_account_ids LOOP
+        PERFORM pgledger_accounts.id
+        FROM pgledger_accounts
+        WHERE pgledger_accounts.id = account_id
+        FOR UPDATE;
+
+        IF NOT FOUND THEN
+            RAISE EXCEPTION 'Account (id=%) does not exist', account_id
+            USING
+                ERRCODE = 'PGL06',
+                DETAIL = json_build_object('account_id', account_id)::TEXT;
+        END IF;
+    END LOOP;
+
+    -- Process each transfer
+    FOREACH transfer_request IN ARRAY transfer_requests LOOP
+        transfer_ids := array_append(transfer_ids, pgledger_apply_transfer(
+            from_account_id => transfer_request.from_account_id,
+            to_account_id => transfer_request.to_account_id,
+            amount => transfer_request.amount,
+            transfer_status => CASE WHEN pending THEN 'pending' ELSE 'posted' END,
+            pending_transfer_id => NULL,
+            event_at => coalesce(event_at, now()),
+            metadata => metadata,
+            idempotency_key => idempotency_key
+        ));
+    END LOOP;
+
+    -- Return all created transfers
+    RETURN QUERY
+    SELECT *
+    FROM pgledger_transfers_view
+    WHERE id = ANY(transfer_ids)
+    ORDER BY id;
+END;
+$$ LANGUAGE plpgsql;
+
+-- Lock a pending transfer which hasn't been posted or voided yet, and then its
+-- accounts. The transfer is always locked first (like in
+-- pgledger_reverse_transfer), and the accounts are locked in ID order (like in
+-- pgledger_create_transfers), to prevent deadlocks.
+CREATE FUNCTION pgledger_lock_pending_transfer(transfer_id TEXT)
+RETURNS PGLEDGER_TRANSFERS
+AS $$
+DECLARE
+    pending_transfer pgledger_transfers;
+BEGIN
+    SELECT * INTO pending_transfer
+    FROM pgledger_transfers t
+    WHERE t.id = pgledger_lock_pending_transfer.transfer_id
+    FOR UPDATE;
+
+    IF NOT FOUND THEN
+        RAISE EXCEPTION 'Transfer (id=%) does not exist', transfer_id
+        USING
+            ERRCODE = 'PGL08',
+            DETAIL = json_build_object('transfer_id', transfer_id)::TEXT;
+    END IF;
+
+    IF pending_transfer.status != 'pending' OR EXISTS (
+        SELECT 1
+        FROM pgledger_transfers t
+        WHERE t.pending_transfer_id = pending_transfer.id
+    ) THEN
+        RAISE EXCEPTION 'Transfer (id=%) is not pending', transfer_id
+        USING
+            ERRCODE = 'PGL11',
+            DETAIL = json_build_object('transfer_id', transfer_id)::TEXT;
+    END IF;
+
+    PERFORM a.id
+    FROM pgledger_accounts a
+    WHERE a.id IN (pending_transfer.from_account_id, pending_transfer.to_account_id)
+    ORDER BY a.id
+    FOR UPDATE;
+
+    RETURN pending_transfer;
+END;
+$$ LANGUAGE plpgsql;
+
+-- Settle a pending transfer for all (or, if amount is given, part) of the
+-- pending amount. Anything that isn't posted is released, so a pending transfer
+-- can only be posted once. The metadata defaults to the pending transfer's.
+CREATE FUNCTION pgledger_post_pending_transfer(
+    pending_transfer_id TEXT,
+    amount NUMERIC DEFAULT NULL,
+    metadata JSONB DEFAULT NULL
+)
+RETURNS SETOF PGLEDGER_TRANSFERS_VIEW
+AS $$
+DECLARE
+    pending_transfer pgledger_transfers;
+    posted_transfer_id TEXT;
+BEGIN
+    pending_transfer := pgledger_lock_pending_transfer(pending_transfer_id);
+
+    amount := coalesce(amount, pending_transfer.amount);
+    metadata := coalesce(metadata, pending_transfer.metadata);
+
+    IF amount > pending_transfer.amount THEN
+        RAISE EXCEPTION 'Amount (%) exceeds the pending amount (%) of transfer (id=%)',
+        amount, pending_transfer.amount, pending_transfer.id
+        USING
+            ERRCODE = 'PGL13',
+            DETAIL = json_build_object(
+                'transfer_id', pending_transfer.id,
+                'amount', amount::TEXT,
+                'pending_amount', pending_transfer.amount::TEXT
+            )::TEXT;
+    END IF;
+
+    PERFORM pgledger_apply_transfer(
+        from_account_id => pending_transfer.from_account_id,
+        to_account_id => pending_transfer.to_account_id,
+        amount => pending_transfer.amount,
+        transfer_status => 'released',
+        pending_transfer_id => pending_transfer.id,
+        event_at => now(),
+        metadata => metadata,
+        idempotency_key => NULL
+    );
+
+    posted_transfer_id := pgledger_apply_transfer(
+        from_account_id => pending_transfer.from_account_id,
+        to_account_id => pending_transfer.to_account_id,
+        amount => amount,
+        transfer_status => 'posted',
+        pending_transfer_id => pending_transfer.id,
+        event_at => now(),
+        metadata => metadata,
+        idempotency_key => NULL
+    );
+
+    RETURN QUERY
+    SELECT *
+    FROM pgledger_transfers_view v
+    WHERE v.id = posted_transfer_id;
+END;
+$$ LANGUAGE plpgsql;
+
+-- Cancel a pending transfer, releasing the whole pending amount. Returns the
+-- 'released' transfer. The metadata defaults to the pending transfer's.
+CREATE FUNCTION pgledger_void_pending_transfer(
+    pending_transfer_id TEXT,
+    metadata JSONB DEFAULT NULL
+)
+RETURNS SETOF PGLEDGER_TRANSFERS_VIEW
+AS $$
+DECLARE
+    pending_transfer pgledger_transfers;
+    released_transfer_id TEXT;
+BEGIN
+    pending_transfer := pgledger_lock_pending_transfer(pending_transfer_id);
+
+    released_transfer_id := pgledger_apply_transfer(
+        from_account_id => pending_transfer.from_account_id,
+        to_account_id => pending_transfer.to_account_id,
+        amount => pending_transfer.amount,
+        transfer_status => 'released',
+        pending_transfer_id => pending_transfer.id,
+        event_at => now(),
+        metadata => coalesce(metadata, pending_transfer.metadata),
+        idempotency_key => NULL
+    );
+
+    RETURN QUERY
+    SELECT *
+    FROM pgledger_transfers_view v
+    WHERE v.id = released_transfer_id;
+END;
+$$ LANGUAGE plpgsql;
+
+-- Only posted transfers can be reversed. Pending transfers should be voided
+-- instead, and released transfers don't move any money.
+CREATE OR REPLACE FUNCTION pgledger_reverse_transfer(
+    transfer_id TEXT,
+    metadata JSONB DEFAULT NULL,
+    amount NUMERIC DEFAULT NULL
+)
+RETURNS SETOF PGLEDGER_TRANSFERS_VIEW
+AS $$
+DECLARE
+    original_transfer pgledger_transfers;
+    reversal pgledger_transfers_view;
+    remaining_amount NUMERIC;
+BEGIN
+    -- Lock the original transfer so that concurrent reversals of it can't add
+    -- up to more than the original amount
+    SELECT * INTO original_transfer
+    FROM pgledger_transfers t
+    WHERE t.id = pgledger_reverse_transfer.transfer_id
+    FOR UPDATE;
+
+    IF NOT FOUND THEN
+        RAISE EXCEPTION 'Transfer (id=%) does not exist', transfer_id
+        USING
+            ERRCODE = 'PGL08',
+            DETAIL = json_build_object('transfer_id', transfer_id)::TEXT;
+    END IF;
+
+    IF original_transfer.status != 'posted' THEN
+        RAISE EXCEPTION 'Transfer (id=%) is not posted', transfer_id
+        USING
+            ERRCODE = 'PGL12',
+            DETAIL = json_build_object('transfer_id', transfer_id)::TEXT;
+    END IF;
+
+    SELECT original_transfer.amount - coalesce(sum(t.amount), 0) INTO remaining_amount
+    FROM pgledger_transfers t
+    WHERE t.reverses_transfer_id = original_transfer.id;
+
+    IF remaining_amount <= 0 THEN
+        RAISE EXCEPTION 'Transfer (id=%) has already been reversed', transfer_id
+        USING
+            ERRCODE = 'PGL09',
+            DETAIL = json_build_object('transfer_id', transfer_id)::TEXT;
+    END IF;
+
+    -- Default to reversing whatever is left of the transfer
+    amount := coalesce(amount, remaining_amount);
+
+    IF amount > remaining_amount THEN
+        RAISE EXCEPTION 'Reversal amount (%) exceeds the remaining amount (%) of transfer (id=%)',
+        amount, remaining_amount, transfer_id
+        USING
+            ERRCODE = 'PGL10',
+            DETAIL = json_build_object(
+                'transfer_id', transfer_id,
+                'amount', amount::TEXT,
+                'remaining_amount', remaining_amount::TEXT
+            )::TEXT;
+    END IF;
+
+    SELECT * INTO reversal
+    FROM pgledger_create_transfer(
+        from_account_id => original_transfer.to_account_id,
+        to_account_id => original_transfer.from_account_id,
+        amount => amount,
+        metadata => metadata
+    );
+
+    UPDATE pgledger_transfers
+    SET reverses_transfer_id = original_transfer.id
+    WHERE pgledger_transfers.id = reversal.id;
+
+    RETURN QUERY
+    SELECT *
+    FROM pgledger_transfers_view v
+    WHERE v.id = reversal.id;
+END;
+$$ LANGUAGE plpgsql;
+
+INSERT INTO pgledger_schema_migrations (version) VALUES (4);
@@ -0,0 +1,167 @@
+-- Optional balance limits for accounts, such as an overdraft limit of -500
+-- (min_balance) or a wallet cap of 10000 (max_balance). NULL means no limit.
+--
+-- Like allow_negative_balance and allow_positive_balance, the limits are
+-- checked against the balance including pending amounts: the available balance
+-- (balance - pending_debits) must be at least min_balance, and balance +
+-- pending_credits must be at most max_balance.
+--
+-- New error codes:
+--
+--   PGL17: account balance would be below its minimum balance
+--   PGL18: account balance would be above its maximum balance
+ALTER TABLE pgledger_accounts
+ADD COLUMN min_balance NUMERIC,
+ADD COLUMN max_balance NUMERIC,
+ADD CHECK (min_balance <= max_balance);
+
+CREATE OR REPLACE VIEW pgledger_accounts_view AS
+SELECT
+    id,
+    name,
+    currency,
+    balance,
+    version,
+    allow_negative_balance,
+    allow_positive_balance,
+    metadata,
+    created_at,
+    updated_at,
+    pending_debits,
+    pending_credits,
+    balance - pending_debits AS available_balance,
+    status,
+    status_changed_at,
+    status_changed_by,
+    min_balance,
+    max_balance
+FROM pgledger_accounts;
+
+CREATE OR REPLACE FUNCTION pgledger_check_account_balance_constraints(account PGLEDGER_ACCOUNTS) RETURNS VOID AS $$
+BEGIN
+    -- If account doesn't allow negative balance and available balance is negative, raise an error
+    IF NOT account.allow_negative_balance AND (account.balance - account.pending_debits < 0) THEN
+        RAISE EXCEPTION 'Account (id=%, name=%) does not allow negative balance', account.id, account.name
+        USING
+            ERRCODE = 'PGL01',
+            DETAIL = json_build_object(
+                'account_id', account.id,
+                'account_name', account.name,
+                'balance', account.balance::TEXT,
+                'available_balance', (account.balance - account.pending_debits)::TEXT
+            )::TEXT;
+    END IF;
+
+    -- If account doesn't allow positive balance and balance (including pending credits) is positive, raise an error
+    IF NOT account.allow_positive_balance AND (account.balance + account.pending_credits > 0) THEN
+        RAISE EXCEPTION 'Account (id=%, name=%) does not allow positive balance', account.id, account.name
+        USING
+            ERRCODE = 'PGL02',
+            DETAIL = json_build_object(
+                'account_id', account.id,
+                'account_name', account.name,
+                'balance', account.balance::TEXT
+            )::TEXT;
+    END IF;
+
+    -- If the available balance is below the minimum balance, raise an error
+    IF account.balance - account.pending_debits < account.min_balance THEN
+        RAISE EXCEPTION 'Account (id=%, name=%) balance would be below its minimum balance (%)',
+        account.id, account.name, account.min_balance
+        USING
+            ERRCODE = 'PGL17',
+            DETAIL = json_build_object(
+                'account_id', account.id,
+                'account_name', account.name,
+                'balance', account.balance::TEXT,
+                'available_balance', (account.balance - account.pending_debits)::TEXT,
+                'min_balance', account.min_balance::TEXT
+            )::TEXT;
+    END IF;
+
+    -- If the balance (including pending credits) is above the maximum balance, raise an error
+    IF account.balance + account.pending_credits > account.max_balance THEN
+        RAISE EXCEPTION 'Account (id=%, name=%) balance would be above its maximum balance (%)',
+        account.id, account.name, account.max_balance
+        USING
+            ERRCODE = 'PGL18',
+            DETAIL = json_build_object(
+                'account_id', account.id,
+                'account_name', account.name,
+                'balance', account.balance::TEXT,
+                'max_balance', account.max_balance::TEXT
+            )::TEXT;
+    END IF;
+END;
+$$ LANGUAGE plpgsql;
+
+-- The function gains new parameters, so the old version has to be dropped
+-- rather than replaced
+DROP FUNCTION pgledger_create_account(TEXT, TEXT, BOOLEAN, BOOLEAN, JSONB);
+
+CREATE FUNCTION pgledger_create_account(
+    name TEXT,
+    currency TEXT,
+    allow_negative_balance BOOLEAN DEFAULT TRUE,
+    allow_positive_balance BOOLEAN DEFAULT TRUE,
+    metadata JSONB DEFAULT NULL,
+    min_balance NUMERIC DEFAULT NULL,
+    max_balance NUMERIC DEFAULT NULL
+)
+RETURNS SETOF PGLEDGER_ACCOUNTS_VIEW
+AS $$
+DECLARE
+    new_account_id TEXT;
+BEGIN
+    INSERT INTO pgledger_accounts (
+        name, currency, allow_negative_balance, allow_positive_balance, metadata, min_balance, max_balance, created_at, updated_at
+    )
+    VALUES (
+        name, currency, allow_negative_balance, allow_positive_balance, metadata, min_balance, max_balance, now(), now()
+    )
+    RETURNING pgledger_accounts.id INTO new_account_id;
+
+    RETURN QUERY
+    SELECT *
+    FROM pgledger_accounts_view v
+    WHERE v.id = new_account_id;
+END;
+$$ LANGUAGE plpgsql;
+
+-- Change the balance limits of an account. NULL removes a limit. The new limits
+-- are checked against the current balance, so they can't be set to something
+-- the account already breaks.
+CREATE FUNCTION pgledger_update_account_balance_limits(
+    account_id TEXT,
+    min_balance NUMERIC,
+    max_balance NUMERIC
+)
+RETURNS SETOF PGLEDGER_ACCOUNTS_VIEW
+AS $$
+DECLARE
+    account pgledger_accounts;
+BEGIN
+    UPDATE pgledger_accounts a
+    SET min_balance = pgledger_update_account_balance_limits.min_balance,
+        max_balance = pgledger_update_account_balance_limits.max_balance,
+        updated_at = now()
+    WHERE a.id = pgledger_update_account_balance_limits.account_id
+    RETURNING * INTO account;
+
+    IF NOT FOUND THEN
+        RAISE EXCEPTION 'Account (id=%) does not exist', account_id
+        USING
+            ERRCODE = 'PGL06',
+            DETAIL = json_build_object('account_id', account_id)::TEXT;
+    END IF;
+
+    PERFORM pgledger_check_account_balance_constraints(account);
+
+    RETURN QUERY
+    SELECT *
+    FROM pgledger_accounts_view v
+    WHERE v.id = account.id;
+END;
+$$ LANGUAGE plpgsql;
+
+INSERT INTO pgledger_schema_migrations (version) VALUES (6);
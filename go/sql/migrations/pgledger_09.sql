@@ -0,0 +1,36 @@
+-- Add the currency, the account names, and the resulting balances and versions
+-- of both accounts to pgledger_transfers_view, so that callers don't need to
+-- join to the accounts and entries themselves. Since pgledger_create_transfer(s)
+-- return the view, they return these columns too.
+--
+-- The balances and versions come from the entries of the transfer, so they are
+-- the balances of the accounts right after the transfer. Pending transfers and
+-- releases don't change the balances (only pending_debits and pending_credits),
+-- so their balances are the same as the previous transfer's.
+CREATE OR REPLACE VIEW pgledger_transfers_view AS
+SELECT
+    t.id,
+    t.from_account_id,
+    t.to_account_id,
+    t.amount,
+    t.created_at,
+    t.event_at,
+    t.metadata,
+    t.idempotency_key,
+    t.reverses_transfer_id,
+    t.status,
+    t.pending_transfer_id,
+    fa.currency,
+    fa.name AS from_account_name,
+    ta.name AS to_account_name,
+    fe.account_current_balance AS from_account_balance,
+    fe.account_version AS from_account_version,
+    te.account_current_balance AS to_account_balance,
+    te.account_version AS to_account_version
+FROM pgledger_transfers t
+JOIN pgledger_accounts fa ON t.from_account_id = fa.id
+JOIN pgledger_accounts ta ON t.to_account_id = ta.id
+JOIN pgledger_entries fe ON t.id = fe.transfer_id AND t.from_account_id = fe.account_id
+JOIN pgledger_entries te ON t.id = te.transfer_id AND t.to_account_id = te.account_id;
+
+INSERT INTO pgledger_schema_migrations (version) VALUES (9);
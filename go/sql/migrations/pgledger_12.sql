@@ -0,0 +1,461 @@
+-- A registry of currencies, seeded with the ISO 4217 currencies, so that typos
+-- (such as 'usd' instead of 'USD') are rejected when accounts are created, and
+-- transfer amounts can't have more decimal places than the currency's minor
+-- unit (such as 0.001 USD). Other currencies (such as BTC, or loyalty points)
+-- can be added with pgledger_create_currency.
+--
+-- Trailing zeros don't count towards the scale of an amount, so 10.000 USD is
+-- still allowed. The scale isn't checked for transfers created before this
+-- migration.
+--
+-- Existing accounts may use currencies which aren't in ISO 4217, so those are
+-- added with the largest scale already used in their transfers (and no
+-- description).
+--
+-- New error codes:
+--
+--   PGL19: currency does not exist
+--   PGL20: amount has more decimal places than the currency allows
+CREATE TABLE pgledger_currencies (
+    code TEXT PRIMARY KEY,
+    scale INTEGER NOT NULL CHECK (scale >= 0),
+    description TEXT
+);
+
+INSERT INTO pgledger_currencies (code, scale, description) VALUES
+('AED', 2, 'UAE Dirham'),
+('AFN', 2, 'Afghani'),
+('ALL', 2, 'Lek'),
+('AMD', 2, 'Armenian Dram'),
+('ANG', 2, 'Netherlands Antillean Guilder'),
+('AOA', 2, 'Kwanza'),
+('ARS', 2, 'Argentine Peso'),
+('AUD', 2, 'Australian Dollar'),
+('AWG', 2, 'Aruban Florin'),
+('AZN', 2, 'Azerbaijan Manat'),
+('BAM', 2, 'Convertible Mark'),
+('BBD', 2, 'Barbados Dollar'),
+('BDT', 2, 'Taka'),
+('BGN', 2, 'Bulgarian Lev'),
+('BHD', 3, 'Bahraini Dinar'),
+('BIF', 0, 'Burundi Franc'),
+('BMD', 2, 'Bermudian Dollar'),
+('BND', 2, 'Brunei Dollar'),
+('BOB', 2, 'Boliviano'),
+('BOV', 2, 'Mvdol'),
+('BRL', 2, 'Brazilian Real'),
+('BSD', 2, 'Bahamian Dollar'),
+('BTN', 2, 'Ngultrum'),
+('BWP', 2, 'Pula'),
+('BYN', 2, 'Belarusian Ruble'),
+('BZD', 2, 'Belize Dollar'),
+('CAD', 2, 'Canadian Dollar'),
+('CDF', 2, 'Congolese Franc'),
+('CHE', 2, 'WIR Euro'),
+('CHF', 2, 'Swiss Franc'),
+('CHW', 2, 'WIR Franc'),
+('CLF', 4, 'Unidad de Fomento'),
+('CLP', 0, 'Chilean Peso'),
+('CNY', 2, 'Yuan Renminbi'),
+('COP', 2, 'Colombian Peso'),
+('COU', 2, 'Unidad de Valor Real'),
+('CRC', 2, 'Costa Rican Colon'),
+('CUP', 2, 'Cuban Peso'),
+('CVE', 2, 'Cabo Verde Escudo'),
+('CZK', 2, 'Czech Koruna'),
+('DJF', 0, 'Djibouti Franc'),
+('DKK', 2, 'Danish Krone'),
+('DOP', 2, 'Dominican Peso'),
+('DZD', 2, 'Algerian Dinar'),
+('EGP', 2, 'Egyptian Pound'),
+('ERN', 2, 'Nakfa'),
+('ETB', 2, 'Ethiopian Birr'),
+('EUR', 2, 'Euro'),
+('FJD', 2, 'Fiji Dollar'),
+('FKP', 2, 'Falkland Islands Pound'),
+('GBP', 2, 'Pound Sterling'),
+('GEL', 2, 'Lari'),
+('GHS', 2, 'Ghana Cedi'),
+('GIP', 2, 'Gibraltar Pound'),
+('GMD', 2, 'Dalasi'),
+('GNF', 0, 'Guinean Franc'),
+('GTQ', 2, 'Quetzal'),
+('GYD', 2, 'Guyana Dollar'),
+('HKD', 2, 'Hong Kong Dollar'),
+('HNL', 2, 'Lempira'),
+('HTG', 2, 'Gourde'),
+('HUF', 2, 'Forint'),
+('IDR', 2, 'Rupiah'),
+('ILS', 2, 'New Israeli Sheqel'),
+('INR', 2, 'Indian Rupee'),
+('IQD', 3, 'Iraqi Dinar'),
+('IRR', 2, 'Iranian Rial'),
+('ISK', 0, 'Iceland Krona'),
+('JMD', 2, 'Jamaican Dollar'),
+('JOD', 3, 'Jordanian Dinar'),
+('JPY', 0, 'Yen'),
+('KES', 2, 'Kenyan Shilling'),
+('KGS', 2, 'Som'),
+('KHR', 2, 'Riel'),
+('KMF', 0, 'Comorian Franc'),
+('KPW', 2, 'North Korean Won'),
+('KRW', 0, 'Won'),
+('KWD', 3, 'Kuwaiti Dinar'),
+('KYD', 2, 'Cayman Islands Dollar'),
+('KZT', 2, 'Tenge'),
+('LAK', 2, 'Lao Kip'),
+('LBP', 2, 'Lebanese Pound'),
+('LKR', 2, 'Sri Lanka Rupee'),
+('LRD', 2, 'Liberian Dollar'),
+('LSL', 2, 'Loti'),
+('LYD', 3, 'Libyan Dinar'),
+('MAD', 2, 'Moroccan Dirham'),
+('MDL', 2, 'Moldovan Leu'),
+('MGA', 2, 'Malagasy Ariary'),
+('MKD', 2, 'Denar'),
+('MMK', 2, 'Kyat'),
+('MNT', 2, 'Tugrik'),
+('MOP', 2, 'Pataca'),
+('MRU', 2, 'Ouguiya'),
+('MUR', 2, 'Mauritius Rupee'),
+('MVR', 2, 'Rufiyaa'),
+('MWK', 2, 'Malawi Kwacha'),
+('MXN', 2, 'Mexican Peso'),
+('MXV', 2, 'Mexican Unidad de Inversion (UDI)'),
+('MYR', 2, 'Malaysian Ringgit'),
+('MZN', 2, 'Mozambique Metical'),
+('NAD', 2, 'Namibia Dollar'),
+('NGN', 2, 'Naira'),
+('NIO', 2, 'Cordoba Oro'),
+('NOK', 2, 'Norwegian Krone'),
+('NPR', 2, 'Nepalese Rupee'),
+('NZD', 2, 'New Zealand Dollar'),
+('OMR', 3, 'Rial Omani'),
+('PAB', 2, 'Balboa'),
+('PEN', 2, 'Sol'),
+('PGK', 2, 'Kina'),
+('PHP', 2, 'Philippine Peso'),
+('PKR', 2, 'Pakistan Rupee'),
+('PLN', 2, 'Zloty'),
+('PYG', 0, 'Guarani'),
+('QAR', 2, 'Qatari Rial'),
+('RON', 2, 'Romanian Leu'),
+('RSD', 2, 'Serbian Dinar'),
+('RUB', 2, 'Russian Ruble'),
+('RWF', 0, 'Rwanda Franc'),
+('SAR', 2, 'Saudi Riyal'),
+('SBD', 2, 'Solomon Islands Dollar'),
+('SCR', 2, 'Seychelles Rupee'),
+('SDG', 2, 'Sudanese Pound'),
+('SEK', 2, 'Swedish Krona'),
+('SGD', 2, 'Singapore Dollar'),
+('SHP', 2, 'Saint Helena Pound'),
+('SLE', 2, 'Leone'),
+('SOS', 2, 'Somali Shilling'),
+('SRD', 2, 'Surinam Dollar'),
+('SSP', 2, 'South Sudanese Pound'),
+('STN', 2, 'Dobra'),
+('SVC', 2, 'El Salvador Colon'),
+('SYP', 2, 'Syrian Pound'),
+('SZL', 2, 'Lilangeni'),
+('THB', 2, 'Baht'),
+('TJS', 2, 'Somoni'),
+('TMT', 2, 'Turkmenistan New Manat'),
+('TND', 3, 'Tunisian Dinar'),
+('TOP', 2, 'Pa''anga'),
+('TRY', 2, 'Turkish Lira'),
+('TTD', 2, 'Trinidad and Tobago Dollar'),
+('TWD', 2, 'New Taiwan Dollar'),
+('TZS', 2, 'Tanzanian Shilling'),
+('UAH', 2, 'Hryvnia'),
+('UGX', 0, 'Uganda Shilling'),
+('USD', 2, 'US Dollar'),
+('USN', 2, 'US Dollar (Next day)'),
+('UYI', 0, 'Uruguay Peso en Unidades Indexadas (UI)'),
+('UYU', 2, 'Peso Uruguayo'),
+('UYW', 4, 'Unidad Previsional'),
+('UZS', 2, 'Uzbekistan Sum'),
+('VED', 2, 'Bolivar Soberano'),
+('VES', 2, 'Bolivar Soberano'),
+('VND', 0, 'Dong'),
+('VUV', 0, 'Vatu'),
+('WST', 2, 'Tala'),
+('XAF', 0, 'CFA Franc BEAC'),
+('XCD', 2, 'East Caribbean Dollar'),
+('XCG', 2, 'Caribbean Guilder'),
+('XOF', 0, 'CFA Franc BCEAO'),
+('XPF', 0, 'CFP Franc'),
+('YER', 2, 'Yemeni Rial'),
+('ZAR', 2, 'Rand'),
+('ZMW', 2, 'Zambian Kwacha'),
+('ZWG', 2, 'Zimbabwe Gold');
+
+INSERT INTO pgledger_currencies (code, scale)
+SELECT
+    a.currency,
+    coalesce(max(min_scale(t.amount)), 0)
+FROM pgledger_accounts a
+LEFT JOIN pgledger_transfers t ON a.id = t.from_account_id
+WHERE a.currency NOT IN (SELECT c.code FROM pgledger_currencies c)
+GROUP BY a.currency;
+
+ALTER TABLE pgledger_accounts ADD FOREIGN KEY (currency) REFERENCES pgledger_currencies (code);
+
+CREATE VIEW pgledger_currencies_view AS
+SELECT
+    code,
+    scale,
+    description
+FROM pgledger_currencies;
+
+CREATE FUNCTION pgledger_create_currency(
+    code TEXT,
+    scale INTEGER,
+    description TEXT DEFAULT NULL
+)
+RETURNS SETOF PGLEDGER_CURRENCIES_VIEW
+AS $$
+    INSERT INTO pgledger_currencies (code, scale, description)
+    VALUES (code, scale, description);
+
+    SELECT *
+    FROM pgledger_currencies_view v
+    WHERE v.code = pgledger_create_currency.code;
+$$ LANGUAGE sql;
+
+-- Same as before, but checking that the currency exists, so that the error is
+-- clearer than the foreign key violation
+CREATE OR REPLACE FUNCTION pgledger_create_account(
+    name TEXT,
+    currency TEXT,
+    allow_negative_balance BOOLEAN DEFAULT TRUE,
+    allow_positive_balance BOOLEAN DEFAULT TRUE,
+    metadata JSONB DEFAULT NULL,
+    min_balance NUMERIC DEFAULT NULL,
+    max_balance NUMERIC DEFAULT NULL,
+    path LTREE DEFAULT NULL,
+    external_ref TEXT DEFAULT NULL
+)
+RETURNS SETOF PGLEDGER_ACCOUNTS_VIEW
+AS $$
+DECLARE
+    new_account_id TEXT;
+BEGIN
+    IF NOT EXISTS (
+        SELECT 1
+        FROM pgledger_currencies c
+        WHERE c.code = pgledger_create_account.currency
+    ) THEN
+        RAISE EXCEPTION 'Currency (%) does not exist', currency
+        USING
+            ERRCODE = 'PGL19',
+            DETAIL = json_build_object('currency', currency)::TEXT;
+    END IF;
+
+    INSERT INTO pgledger_accounts (
+        name,
+        currency,
+        allow_negative_balance,
+        allow_positive_balance,
+        metadata,
+        min_balance,
+        max_balance,
+        path,
+        external_ref,
+        created_at,
+        updated_at
+    )
+    VALUES (
+        name,
+        currency,
+        allow_negative_balance,
+        allow_positive_balance,
+        metadata,
+        min_balance,
+        max_balance,
+        path,
+        external_ref,
+        now(),
+        now()
+    )
+    RETURNING pgledger_accounts.id INTO new_account_id;
+
+    RETURN QUERY
+    SELECT *
+    FROM pgledger_accounts_view v
+    WHERE v.id = new_account_id;
+END;
+$$ LANGUAGE plpgsql;
+
+
+-- Same as before, but checking the scale of the amount
+CREATE OR REPLACE FUNCTION pgledger_apply_transfer(
+    from_account_id TEXT,
+    to_account_id TEXT,
+    amount NUMERIC,
+    transfer_status TEXT,
+    pending_transfer_id TEXT,
+    event_at TIMESTAMPTZ,
+    metadata JSONB,
+    idempotency_key TEXT,
+    journal_id TEXT
+)
+RETURNS TEXT
+AS $$
+DECLARE
+    from_account pgledger_accounts;
+    to_account pgledger_accounts;
+    balance_change NUMERIC := 0;
+    pending_change NUMERIC := 0;
+    new_transfer_id TEXT;
+    currency_scale INTEGER;
+BEGIN
+    -- Preliminary checks
+    IF amount <= 0 THEN
+        RAISE EXCEPTION 'Amount (%) must be positive', amount
+        USING
+            ERRCODE = 'PGL04',
+            DETAIL = json_build_object('amount', amount::TEXT)::TEXT;
+    END IF;
+
+    IF from_account_id = to_account_id THEN
+        RAISE EXCEPTION 'Cannot transfer to the same account (id=%)', from_account_id
+        USING
+            ERRCODE = 'PGL05',
+            DETAIL = json_build_object('account_id', from_account_id)::TEXT;
+    END IF;
+
+    IF transfer_status = 'posted' THEN
+        balance_change := amount;
+    ELSIF transfer_status = 'pending' THEN
+        pending_change := amount;
+    ELSE
+        pending_change := -amount;
+    END IF;
+
+    -- Update account balances
+    UPDATE pgledger_accounts a
+    SET balance = a.balance - balance_change,
+        pending_debits = a.pending_debits + pending_change,
+        version = a.version + 1,
+        updated_at = now()
+    WHERE a.id = from_account_id
+    RETURNING * INTO from_account;
+
+    -- Check status and balance constraints for the source account. Releasing a
+    -- pending amount is always allowed, so that pending transfers can still be
+    -- voided after an account is frozen.
+    IF transfer_status != 'released' THEN
+        PERFORM pgledger_check_account_status(from_account, debit => TRUE);
+    END IF;
+    PERFORM pgledger_check_account_balance_constraints(from_account);
+
+    UPDATE pgledger_accounts a
+    SET balance = a.balance + balance_change,
+        pending_credits = a.pending_credits + pending_change,
+        version = a.version + 1,
+        updated_at = now()
+    WHERE a.id = to_account_id
+    RETURNING * INTO to_account;
+
+    -- Check status and balance constraints for the destination account
+    IF transfer_status != 'released' THEN
+        PERFORM pgledger_check_account_status(to_account, debit => FALSE);
+    END IF;
+    PERFORM pgledger_check_account_balance_constraints(to_account);
+
+    -- Check that currencies match
+    IF from_account.currency != to_account.currency THEN
+        RAISE EXCEPTION 'Cannot transfer between different currencies (% and %)', from_account.currency, to_account.currency
+        USING
+            ERRCODE = 'PGL03',
+            DETAIL = json_build_object(
+                'from_account_id', from_account.id,
+                'to_account_id', to_account.id,
+                'from_currency', from_account.currency,
+                'to_currency', to_account.currency
+            )::TEXT;
+    END IF;
+
+    -- Check that the amount fits in the minor units of the currency
+    SELECT c.scale INTO currency_scale
+    FROM pgledger_currencies c
+    WHERE c.code = from_account.currency;
+
+    IF min_scale(amount) > currency_scale THEN
+        RAISE EXCEPTION 'Amount (%) has more decimal places than currency % allows (%)',
+        amount, from_account.currency, currency_scale
+        USING
+            ERRCODE = 'PGL20',
+            DETAIL = json_build_object(
+                'amount', amount::TEXT,
+                'currency', from_account.currency,
+                'scale', currency_scale
+            )::TEXT;
+    END IF;
+
+    -- Create transfer record
+    INSERT INTO pgledger_transfers (
+        from_account_id,
+        to_account_id,
+        amount,
+        created_at,
+        event_at,
+        metadata,
+        idempotency_key,
+        status,
+        pending_transfer_id,
+        journal_id
+    )
+    VALUES (
+        from_account_id,
+        to_account_id,
+        amount,
+        now(),
+        event_at,
+        metadata,
+        idempotency_key,
+        transfer_status,
+        pending_transfer_id,
+        journal_id
+    )
+    RETURNING pgledger_transfers.id INTO new_transfer_id;
+
+    -- Create entry for the source account (negative amount, or positive when
+    -- releasing a pending amount)
+    INSERT INTO pgledger_entries (
+        account_id, transfer_id, amount, account_previous_balance, account_current_balance, account_version, created_at, pending
+    )
+    VALUES (
+        from_account_id,
+        new_transfer_id,
+        -(balance_change + pending_change),
+        from_account.balance + balance_change,
+        from_account.balance,
+        from_account.version,
+        now(),
+        transfer_status != 'posted'
+    );
+
+    -- Create entry for the destination account (positive amount, or negative
+    -- when releasing a pending amount)
+    INSERT INTO pgledger_entries (
+        account_id, transfer_id, amount, account_previous_balance, account_current_balance, account_version, created_at, pending
+    )
+    VALUES (
+        to_account_id,
+        new_transfer_id,
+        balance_change + pending_change,
+        to_account.balance - balance_change,
+        to_account.balance,
+        to_account.version,
+        now(),
+        transfer_status != 'posted'
+    );
+
+    RETURN new_transfer_id;
+END;
+$$ LANGUAGE plpgsql;
+
+
+INSERT INTO pgledger_schema_migrations (version) VALUES (12);
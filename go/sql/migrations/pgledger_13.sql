@@ -0,0 +1,134 @@
+-- Currency exchanges. pgledger_exchange creates the 2 transfers (4 entries) of
+-- an exchange in one call:
+--
+--   from_account -> from_liquidity_account: from_amount in the from currency
+--   to_liquidity_account -> to_account: to_amount in the to currency
+--
+-- Both transfers go through pgledger_create_transfers, so they share a journal,
+-- and the exchange records both amounts and the effective rate
+-- (to_amount / from_amount), which would otherwise be lost.
+--
+-- New error codes:
+--
+--   PGL21: cannot exchange between the same currency
+CREATE TABLE pgledger_exchanges (
+    id TEXT PRIMARY KEY DEFAULT pgledger_generate_id('pglx'),
+    journal_id TEXT NOT NULL UNIQUE REFERENCES pgledger_journals (id),
+    from_transfer_id TEXT NOT NULL REFERENCES pgledger_transfers (id),
+    to_transfer_id TEXT NOT NULL REFERENCES pgledger_transfers (id),
+    from_currency TEXT NOT NULL REFERENCES pgledger_currencies (code),
+    to_currency TEXT NOT NULL REFERENCES pgledger_currencies (code),
+    from_amount NUMERIC NOT NULL,
+    to_amount NUMERIC NOT NULL,
+    rate NUMERIC NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE VIEW pgledger_exchanges_view AS
+SELECT
+    id,
+    journal_id,
+    from_transfer_id,
+    to_transfer_id,
+    from_currency,
+    to_currency,
+    from_amount,
+    to_amount,
+    rate,
+    created_at
+FROM pgledger_exchanges;
+
+-- The accounts can be given by ID or external ref, and the optional parameters
+-- are passed through to pgledger_create_transfers. Retrying with the same
+-- idempotency key returns the original exchange.
+CREATE FUNCTION pgledger_exchange(
+    from_account_id TEXT,
+    to_account_id TEXT,
+    from_amount NUMERIC,
+    to_amount NUMERIC,
+    from_liquidity_account_id TEXT,
+    to_liquidity_account_id TEXT,
+    event_at TIMESTAMPTZ DEFAULT NULL,
+    metadata JSONB DEFAULT NULL,
+    idempotency_key TEXT DEFAULT NULL,
+    pending BOOLEAN DEFAULT FALSE
+)
+RETURNS SETOF PGLEDGER_EXCHANGES_VIEW
+AS $$
+DECLARE
+    leg pgledger_transfers_view;
+    from_transfer pgledger_transfers_view;
+    to_transfer pgledger_transfers_view;
+    resolved_from_account_id TEXT := pgledger_resolve_account_id(from_account_id);
+    resolved_from_liquidity_account_id TEXT := pgledger_resolve_account_id(from_liquidity_account_id);
+BEGIN
+    -- The transfers are returned in ID order, which isn't always the order of
+    -- the requests (IDs are not monotonic before PostgreSQL 18), so the legs
+    -- are told apart by their accounts
+    FOR leg IN
+        SELECT *
+        FROM pgledger_create_transfers(
+            transfer_requests => array[
+                (from_account_id, from_liquidity_account_id, from_amount, NULL, NULL)::TRANSFER_REQUEST_V2,
+                (to_liquidity_account_id, to_account_id, to_amount, NULL, NULL)::TRANSFER_REQUEST_V2
+            ],
+            event_at => event_at,
+            metadata => metadata,
+            idempotency_key => idempotency_key,
+            pending => pending
+        )
+    LOOP
+        IF from_transfer.id IS NULL
+            AND leg.from_account_id = resolved_from_account_id
+            AND leg.to_account_id = resolved_from_liquidity_account_id THEN
+            from_transfer := leg;
+        ELSE
+            to_transfer := leg;
+        END IF;
+    END LOOP;
+
+    IF from_transfer.currency = to_transfer.currency THEN
+        RAISE EXCEPTION 'Cannot exchange between the same currency (%)', from_transfer.currency
+        USING
+            ERRCODE = 'PGL21',
+            DETAIL = json_build_object(
+                'from_account_id', from_transfer.from_account_id,
+                'to_account_id', to_transfer.to_account_id,
+                'currency', from_transfer.currency
+            )::TEXT;
+    END IF;
+
+    INSERT INTO pgledger_exchanges (
+        journal_id,
+        from_transfer_id,
+        to_transfer_id,
+        from_currency,
+        to_currency,
+        from_amount,
+        to_amount,
+        rate,
+        created_at
+    )
+    VALUES (
+        from_transfer.journal_id,
+        from_transfer.id,
+        to_transfer.id,
+        from_transfer.currency,
+        to_transfer.currency,
+        from_transfer.amount,
+        to_transfer.amount,
+        to_transfer.amount / from_transfer.amount,
+        now()
+    )
+    -- A retry with the same idempotency key returns the same transfers, which
+    -- already have an exchange
+    ON CONFLICT ON CONSTRAINT pgledger_exchanges_journal_id_key DO NOTHING;
+
+    RETURN QUERY
+    SELECT *
+    FROM pgledger_exchanges_view v
+    WHERE v.journal_id = from_transfer.journal_id;
+END;
+$$ LANGUAGE plpgsql;
+
+INSERT INTO pgledger_schema_migrations (version) VALUES (13);
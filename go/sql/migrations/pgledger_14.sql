@@ -0,0 +1,85 @@
+-- Historical balances. pgledger_account_balance_at returns the balance of an
+-- account at a point in time, either by when the entries were created
+-- (created_at, the default) or by when the transfers happened in the real world
+-- (event_at).
+--
+-- By created_at, the balance is the account_current_balance of the most recent
+-- entry at or before the time. Since transfers can be recorded with an event_at
+-- in the past, the entries aren't in event_at order, so by event_at the balance
+-- is the sum of the posted transfers at or before the time instead.
+--
+-- Pending transfers don't change the balance, so they are ignored either way.
+CREATE INDEX ON pgledger_entries (account_id, created_at);
+CREATE INDEX ON pgledger_transfers (from_account_id, event_at) WHERE status = 'posted';
+CREATE INDEX ON pgledger_transfers (to_account_id, event_at) WHERE status = 'posted';
+
+CREATE FUNCTION pgledger_account_balance_at(
+    account_id TEXT,
+    at TIMESTAMPTZ,
+    by TEXT DEFAULT 'created_at'
+)
+RETURNS NUMERIC
+AS $$
+DECLARE
+    balance_at NUMERIC;
+BEGIN
+    PERFORM 1
+    FROM pgledger_accounts a
+    WHERE a.id = pgledger_account_balance_at.account_id;
+
+    IF NOT FOUND THEN
+        RAISE EXCEPTION 'Account (id=%) does not exist', account_id
+        USING
+            ERRCODE = 'PGL06',
+            DETAIL = json_build_object('account_id', account_id)::TEXT;
+    END IF;
+
+    IF pgledger_account_balance_at.by = 'created_at' THEN
+        SELECT e.account_current_balance INTO balance_at
+        FROM pgledger_entries e
+        WHERE e.account_id = pgledger_account_balance_at.account_id
+            AND e.created_at <= pgledger_account_balance_at.at
+        ORDER BY e.created_at DESC, e.account_version DESC
+        LIMIT 1;
+    ELSIF pgledger_account_balance_at.by = 'event_at' THEN
+        SELECT
+            (
+                SELECT coalesce(sum(t.amount), 0)
+                FROM pgledger_transfers t
+                WHERE t.to_account_id = pgledger_account_balance_at.account_id
+                    AND t.status = 'posted'
+                    AND t.event_at <= pgledger_account_balance_at.at
+            ) - (
+                SELECT coalesce(sum(t.amount), 0)
+                FROM pgledger_transfers t
+                WHERE t.from_account_id = pgledger_account_balance_at.account_id
+                    AND t.status = 'posted'
+                    AND t.event_at <= pgledger_account_balance_at.at
+            )
+        INTO balance_at;
+    ELSE
+        RAISE EXCEPTION 'Invalid by (%), must be created_at or event_at', pgledger_account_balance_at.by
+        USING ERRCODE = 'invalid_parameter_value';
+    END IF;
+
+    RETURN coalesce(balance_at, 0);
+END;
+$$ LANGUAGE plpgsql STABLE;
+
+-- The balances of several accounts at the same point in time, such as for a
+-- balance sheet
+CREATE FUNCTION pgledger_account_balances_at(
+    account_ids TEXT [],
+    at TIMESTAMPTZ,
+    by TEXT DEFAULT 'created_at'
+)
+RETURNS TABLE (account_id TEXT, balance NUMERIC)
+AS $$
+    SELECT
+        ids.account_id,
+        pgledger_account_balance_at(ids.account_id, pgledger_account_balances_at.at, pgledger_account_balances_at.by)
+    FROM unnest(pgledger_account_balances_at.account_ids) WITH ORDINALITY AS ids (account_id, n)
+    ORDER BY ids.n;
+$$ LANGUAGE sql STABLE;
+
+INSERT INTO pgledger_schema_migrations (version) VALUES (14);
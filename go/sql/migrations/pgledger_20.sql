@@ -0,0 +1,103 @@
+-- Account statements, such as for reconciling an account against a bank
+-- statement. pgledger_account_statement returns the opening balance of the
+-- account at start_at, its posted entries with an event_at in [start_at,
+-- end_at), and the closing balance at end_at, as rows with a line_type of
+-- opening_balance, entry and closing_balance. Either end of the period can be
+-- left out.
+--
+-- Like pgledger_account_entries_by_event_at, the statement is in event_at
+-- order, so it matches the real world history even when transfers were
+-- recorded late, and pending transfers are left out. Each entry includes the
+-- other account of the transfer (the counterparty), the running balance after
+-- the entry, and the metadata of the transfer.
+CREATE FUNCTION pgledger_account_statement(
+    account_id TEXT,
+    start_at TIMESTAMPTZ DEFAULT NULL,
+    end_at TIMESTAMPTZ DEFAULT NULL
+)
+RETURNS TABLE (
+    line_type TEXT,
+    event_at TIMESTAMPTZ,
+    entry_id TEXT,
+    transfer_id TEXT,
+    counterparty_account_id TEXT,
+    counterparty_account_name TEXT,
+    amount NUMERIC,
+    balance NUMERIC,
+    metadata JSONB
+)
+AS $$
+DECLARE
+    opening_balance NUMERIC;
+    closing_balance NUMERIC;
+BEGIN
+    PERFORM 1
+    FROM pgledger_accounts a
+    WHERE a.id = pgledger_account_statement.account_id;
+
+    IF NOT FOUND THEN
+        RAISE EXCEPTION 'Account (id=%) does not exist', account_id
+        USING
+            ERRCODE = 'PGL06',
+            DETAIL = json_build_object('account_id', account_id)::TEXT;
+    END IF;
+
+    SELECT
+        coalesce(sum(e.amount) FILTER (WHERE t.event_at < pgledger_account_statement.start_at), 0),
+        coalesce(sum(e.amount) FILTER (
+            WHERE pgledger_account_statement.end_at IS NULL OR t.event_at < pgledger_account_statement.end_at
+        ), 0)
+    INTO opening_balance, closing_balance
+    FROM pgledger_entries e
+    INNER JOIN pgledger_transfers t ON e.transfer_id = t.id
+    WHERE e.account_id = pgledger_account_statement.account_id
+        AND NOT e.pending;
+
+    RETURN QUERY
+    SELECT
+        'opening_balance'::TEXT,
+        pgledger_account_statement.start_at,
+        NULL::TEXT,
+        NULL::TEXT,
+        NULL::TEXT,
+        NULL::TEXT,
+        NULL::NUMERIC,
+        opening_balance,
+        NULL::JSONB;
+
+    RETURN QUERY
+    SELECT
+        'entry'::TEXT,
+        v.event_at,
+        v.id,
+        v.transfer_id,
+        counterparty.id,
+        counterparty.name,
+        v.amount,
+        v.account_current_balance,
+        v.metadata
+    FROM pgledger_account_entries_by_event_at(
+        pgledger_account_statement.account_id,
+        pgledger_account_statement.start_at,
+        pgledger_account_statement.end_at
+    ) v
+    INNER JOIN pgledger_transfers t ON v.transfer_id = t.id
+    INNER JOIN pgledger_accounts counterparty
+        ON counterparty.id = CASE WHEN t.from_account_id = v.account_id THEN t.to_account_id ELSE t.from_account_id END
+    ORDER BY v.event_at, v.id;
+
+    RETURN QUERY
+    SELECT
+        'closing_balance'::TEXT,
+        pgledger_account_statement.end_at,
+        NULL::TEXT,
+        NULL::TEXT,
+        NULL::TEXT,
+        NULL::TEXT,
+        NULL::NUMERIC,
+        closing_balance,
+        NULL::JSONB;
+END;
+$$ LANGUAGE plpgsql STABLE;
+
+INSERT INTO pgledger_schema_migrations (version) VALUES (20);
@@ -0,0 +1,291 @@
+-- Reconciliation against external statements, such as the statement of a bank
+-- account. Lines from the statement are imported for the ledger account which
+-- represents the external account, and pgledger_reconcile matches them with the
+-- posted entries of that account:
+--
+--   1. By reference: entries whose transfer metadata has the line's reference
+--      (under the key "reference" by default), with an event_at within the
+--      date tolerance of the line. All such entries are matched to the line,
+--      so several transfers can make up one line, such as a payout of several
+--      payments.
+--   2. By amount and date: for lines which didn't match anything by reference,
+--      the unmatched entry with the same amount and the closest event_at
+--      within the date tolerance.
+--
+-- A line is matched when the amounts of its entries add up to the amount of
+-- the line, partially_matched when they don't (such as a short payment), and
+-- unmatched when no entry was found. Lines which aren't matched are retried the
+-- next time pgledger_reconcile runs, so entries which show up later are picked
+-- up then. An entry can only be matched to one line.
+--
+-- The amounts of the lines have the same sign as the entries of the account, so
+-- money coming into the account is positive.
+--
+-- New error code:
+--   PGL23: Reconciliation line was already imported with different values
+CREATE TABLE pgledger_reconciliation_lines (
+    id TEXT PRIMARY KEY DEFAULT pgledger_generate_id('pglr'),
+    account_id TEXT NOT NULL REFERENCES pgledger_accounts (id),
+    external_id TEXT NOT NULL,
+    amount NUMERIC NOT NULL,
+    occurred_at TIMESTAMPTZ NOT NULL,
+    reference TEXT,
+    metadata JSONB,
+    status TEXT NOT NULL DEFAULT 'unmatched' CHECK (status IN ('unmatched', 'partially_matched', 'matched')),
+    matched_amount NUMERIC NOT NULL DEFAULT 0,
+    created_at TIMESTAMPTZ NOT NULL,
+    updated_at TIMESTAMPTZ NOT NULL,
+    -- The ID of the line in the external system, so that importing the same
+    -- statement twice doesn't create duplicate lines
+    CONSTRAINT pgledger_reconciliation_lines_external_id_key UNIQUE (account_id, external_id)
+);
+
+CREATE INDEX ON pgledger_reconciliation_lines (account_id, occurred_at) WHERE status != 'matched';
+
+CREATE TABLE pgledger_reconciliation_matches (
+    line_id TEXT NOT NULL REFERENCES pgledger_reconciliation_lines (id),
+    entry_id TEXT NOT NULL UNIQUE REFERENCES pgledger_entries (id),
+    created_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX ON pgledger_reconciliation_matches (line_id);
+
+CREATE VIEW pgledger_reconciliation_lines_view AS
+SELECT
+    id,
+    account_id,
+    external_id,
+    amount,
+    occurred_at,
+    reference,
+    metadata,
+    status,
+    matched_amount,
+    created_at,
+    updated_at
+FROM pgledger_reconciliation_lines;
+
+CREATE VIEW pgledger_reconciliation_matches_view AS
+SELECT
+    line_id,
+    entry_id,
+    created_at
+FROM pgledger_reconciliation_matches;
+
+CREATE TYPE RECONCILIATION_LINE_REQUEST AS (
+    external_id TEXT,
+    amount NUMERIC,
+    occurred_at TIMESTAMPTZ,
+    reference TEXT,
+    metadata JSONB
+);
+
+-- Import lines from an external statement for the account. Lines which were
+-- already imported (by external_id) are returned as they are, so the same
+-- statement can be imported again safely, but fail with PGL23 if the amount,
+-- date or reference changed.
+CREATE FUNCTION pgledger_import_reconciliation_lines(
+    account_id TEXT,
+    lines RECONCILIATION_LINE_REQUEST []
+)
+RETURNS SETOF PGLEDGER_RECONCILIATION_LINES_VIEW
+AS $$
+DECLARE
+    line reconciliation_line_request;
+    existing_line pgledger_reconciliation_lines;
+    line_ids TEXT[] := '{}';
+BEGIN
+    PERFORM 1
+    FROM pgledger_accounts a
+    WHERE a.id = pgledger_import_reconciliation_lines.account_id;
+
+    IF NOT FOUND THEN
+        RAISE EXCEPTION 'Account (id=%) does not exist', account_id
+        USING
+            ERRCODE = 'PGL06',
+            DETAIL = json_build_object('account_id', account_id)::TEXT;
+    END IF;
+
+    FOREACH line IN ARRAY lines LOOP
+        INSERT INTO pgledger_reconciliation_lines (
+            account_id, external_id, amount, occurred_at, reference, metadata, created_at, updated_at
+        )
+        VALUES (
+            pgledger_import_reconciliation_lines.account_id,
+            line.external_id,
+            line.amount,
+            line.occurred_at,
+            line.reference,
+            line.metadata,
+            now(),
+            now()
+        )
+        ON CONFLICT ON CONSTRAINT pgledger_reconciliation_lines_external_id_key DO NOTHING;
+
+        SELECT * INTO existing_line
+        FROM pgledger_reconciliation_lines l
+        WHERE l.account_id = pgledger_import_reconciliation_lines.account_id
+            AND l.external_id = line.external_id;
+
+        IF existing_line.amount != line.amount
+            OR existing_line.occurred_at != line.occurred_at
+            OR existing_line.reference IS DISTINCT FROM line.reference THEN
+            RAISE EXCEPTION 'Reconciliation line (external_id=%) was already imported with different values', line.external_id
+            USING
+                ERRCODE = 'PGL23',
+                DETAIL = json_build_object(
+                    'account_id', account_id,
+                    'external_id', line.external_id
+                )::TEXT;
+        END IF;
+
+        line_ids := array_append(line_ids, existing_line.id);
+    END LOOP;
+
+    RETURN QUERY
+    SELECT v.*
+    FROM unnest(line_ids) WITH ORDINALITY AS ids (id, n)
+    INNER JOIN pgledger_reconciliation_lines_view v ON ids.id = v.id
+    ORDER BY ids.n;
+END;
+$$ LANGUAGE plpgsql;
+
+-- Match the lines of the account which aren't matched yet with its entries,
+-- and return those lines with their new status
+CREATE FUNCTION pgledger_reconcile(
+    account_id TEXT,
+    reference_key TEXT DEFAULT 'reference',
+    date_tolerance INTERVAL DEFAULT '3 days'
+)
+RETURNS SETOF PGLEDGER_RECONCILIATION_LINES_VIEW
+AS $$
+DECLARE
+    line pgledger_reconciliation_lines;
+    line_ids TEXT[] := '{}';
+    match_count BIGINT;
+    total_matched NUMERIC;
+BEGIN
+    -- Lock the lines, so that concurrent runs don't match the same line twice
+    FOR line IN
+        SELECT *
+        FROM pgledger_reconciliation_lines l
+        WHERE l.account_id = pgledger_reconcile.account_id
+            AND l.status != 'matched'
+        ORDER BY l.occurred_at, l.id
+        FOR UPDATE
+    LOOP
+        IF line.reference IS NOT NULL THEN
+            INSERT INTO pgledger_reconciliation_matches (line_id, entry_id, created_at)
+            SELECT line.id, e.id, now()
+            FROM pgledger_entries e
+            INNER JOIN pgledger_transfers t ON e.transfer_id = t.id
+            WHERE e.account_id = line.account_id
+                AND NOT e.pending
+                AND t.metadata ->> pgledger_reconcile.reference_key = line.reference
+                AND t.event_at BETWEEN line.occurred_at - pgledger_reconcile.date_tolerance
+                AND line.occurred_at + pgledger_reconcile.date_tolerance
+                AND NOT EXISTS (SELECT 1 FROM pgledger_reconciliation_matches m WHERE m.entry_id = e.id);
+        END IF;
+
+        -- Fall back to the amount and date if the reference didn't match
+        -- anything (or the line doesn't have one)
+        IF NOT EXISTS (SELECT 1 FROM pgledger_reconciliation_matches m WHERE m.line_id = line.id) THEN
+            INSERT INTO pgledger_reconciliation_matches (line_id, entry_id, created_at)
+            SELECT line.id, e.id, now()
+            FROM pgledger_entries e
+            INNER JOIN pgledger_transfers t ON e.transfer_id = t.id
+            WHERE e.account_id = line.account_id
+                AND NOT e.pending
+                AND e.amount = line.amount
+                AND t.event_at BETWEEN line.occurred_at - pgledger_reconcile.date_tolerance
+                AND line.occurred_at + pgledger_reconcile.date_tolerance
+                AND NOT EXISTS (SELECT 1 FROM pgledger_reconciliation_matches m WHERE m.entry_id = e.id)
+            ORDER BY abs(extract(EPOCH FROM t.event_at - line.occurred_at)), e.id
+            LIMIT 1;
+        END IF;
+
+        SELECT count(*), coalesce(sum(e.amount), 0) INTO match_count, total_matched
+        FROM pgledger_reconciliation_matches m
+        INNER JOIN pgledger_entries e ON m.entry_id = e.id
+        WHERE m.line_id = line.id;
+
+        UPDATE pgledger_reconciliation_lines l
+        SET status = CASE
+                WHEN match_count = 0 THEN 'unmatched'
+                WHEN total_matched = line.amount THEN 'matched'
+                ELSE 'partially_matched'
+            END,
+            matched_amount = total_matched,
+            updated_at = now()
+        WHERE l.id = line.id;
+
+        line_ids := array_append(line_ids, line.id);
+    END LOOP;
+
+    RETURN QUERY
+    SELECT *
+    FROM pgledger_reconciliation_lines_view v
+    WHERE v.id = ANY(line_ids)
+    ORDER BY v.occurred_at, v.id;
+END;
+$$ LANGUAGE plpgsql;
+
+-- Everything which still needs attention for the account: lines which aren't
+-- fully matched, and posted entries which aren't matched to any line (such as
+-- a transfer which never showed up on the statement). Only lines and entries
+-- in [start_at, end_at) are included, by occurred_at and event_at. Either end
+-- of the period can be left out.
+CREATE FUNCTION pgledger_reconciliation_exceptions(
+    account_id TEXT,
+    start_at TIMESTAMPTZ DEFAULT NULL,
+    end_at TIMESTAMPTZ DEFAULT NULL
+)
+RETURNS TABLE (
+    kind TEXT,
+    id TEXT,
+    status TEXT,
+    reference TEXT,
+    amount NUMERIC,
+    matched_amount NUMERIC,
+    occurred_at TIMESTAMPTZ,
+    metadata JSONB
+)
+AS $$
+    SELECT *
+    FROM (
+        SELECT
+            'line' AS kind,
+            l.id,
+            l.status,
+            l.reference,
+            l.amount,
+            l.matched_amount,
+            l.occurred_at,
+            l.metadata
+        FROM pgledger_reconciliation_lines l
+        WHERE l.account_id = pgledger_reconciliation_exceptions.account_id
+            AND l.status != 'matched'
+
+        UNION ALL
+
+        SELECT
+            'entry',
+            e.id,
+            'unmatched',
+            NULL,
+            e.amount,
+            0,
+            t.event_at,
+            t.metadata
+        FROM pgledger_entries e
+        INNER JOIN pgledger_transfers t ON e.transfer_id = t.id
+        WHERE e.account_id = pgledger_reconciliation_exceptions.account_id
+            AND NOT e.pending
+            AND NOT EXISTS (SELECT 1 FROM pgledger_reconciliation_matches m WHERE m.entry_id = e.id)
+    ) exceptions
+    WHERE (pgledger_reconciliation_exceptions.start_at IS NULL OR exceptions.occurred_at >= pgledger_reconciliation_exceptions.start_at)
+        AND (pgledger_reconciliation_exceptions.end_at IS NULL OR exceptions.occurred_at < pgledger_reconciliation_exceptions.end_at)
+    ORDER BY exceptions.occurred_at, exceptions.id;
+$$ LANGUAGE sql STABLE;
+
+INSERT INTO pgledger_schema_migrations (version) VALUES (21);
@@ -0,0 +1,86 @@
+package pgledger
+
+import (
+	"context"
+	"time"
+)
+
+// Statement is the result of pgledger_account_statement: the balance of an
+// account at the start of a period, its posted entries in event_at order, and
+// the balance at the end of the period.
+type Statement struct {
+	AccountID      string
+	StartAt        *time.Time
+	EndAt          *time.Time
+	OpeningBalance Amount
+	ClosingBalance Amount
+	Lines          []StatementLine
+}
+
+// StatementLine is an entry on a statement. The counterparty is the other
+// account of the transfer, Balance is the running balance of the account after
+// the entry, and Metadata is the metadata of the transfer.
+type StatementLine struct {
+	EventAt                 time.Time
+	EntryID                 string
+	TransferID              string
+	CounterpartyAccountID   string
+	CounterpartyAccountName string
+	Amount                  Amount
+	Balance                 Amount
+	Metadata                *string
+}
+
+// statementRow is a row from pgledger_account_statement, which also returns
+// the opening and closing balances as rows.
+type statementRow struct {
+	LineType                string
+	EventAt                 *time.Time
+	EntryID                 *string
+	TransferID              *string
+	CounterpartyAccountID   *string
+	CounterpartyAccountName *string
+	Amount                  *Amount
+	Balance                 Amount
+	Metadata                *string
+}
+
+// AccountStatement calls pgledger_account_statement to get the statement of
+// the account for the period [start, end). A zero start or end leaves that end
+// of the period open.
+func (c *Client) AccountStatement(ctx context.Context, accountID string, start, end time.Time) (*Statement, error) {
+	rows, err := queryAll[statementRow](ctx, c, "select * from pgledger_account_statement($1, $2, $3)",
+		accountID, nullTime(start), nullTime(end))
+	if err != nil {
+		return nil, err
+	}
+
+	statement := &Statement{
+		AccountID: accountID,
+		StartAt:   nullTime(start),
+		EndAt:     nullTime(end),
+		Lines:     []StatementLine{},
+	}
+
+	for _, row := range rows {
+		switch row.LineType {
+		case "opening_balance":
+			statement.OpeningBalance = row.Balance
+		case "closing_balance":
+			statement.ClosingBalance = row.Balance
+		default:
+			statement.Lines = append(statement.Lines, StatementLine{
+				EventAt:                 *row.EventAt,
+				EntryID:                 *row.EntryID,
+				TransferID:              *row.TransferID,
+				CounterpartyAccountID:   *row.CounterpartyAccountID,
+				CounterpartyAccountName: *row.CounterpartyAccountName,
+				Amount:                  *row.Amount,
+				Balance:                 row.Balance,
+				Metadata:                row.Metadata,
+			})
+		}
+	}
+
+	return statement, nil
+}
@@ -0,0 +1,166 @@
+package test
+
+import (
+	"testing"
+
+	"github.com/pgr0ss/pgledger"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAccountStatusDefaultsToActive(t *testing.T) {
+	conn := setupTest(t)
+
+	account := createAccount(t, conn, "account 1", "USD")
+	assert.Equal(t, pgledger.AccountStatusActive, account.Status)
+	assert.Nil(t, account.StatusChangedAt)
+	assert.Nil(t, account.StatusChangedBy)
+}
+
+func TestFreezeAccount(t *testing.T) {
+	conn := setupTest(t)
+	client := pgledger.NewClient(conn)
+
+	account1 := createAccount(t, conn, "account 1", "USD")
+	account2 := createAccount(t, conn, "account 2", "USD")
+
+	_ = createTransfer(t, conn, account1.ID, account2.ID, "10.00")
+
+	frozen, err := client.FreezeAccount(t.Context(), account2.ID, "support@example.com")
+	assert.NoError(t, err)
+	assert.Equal(t, pgledger.AccountStatusFrozen, frozen.Status)
+	assert.Equal(t, "support@example.com", *frozen.StatusChangedBy)
+	assert.NotNil(t, frozen.StatusChangedAt)
+	assert.Equal(t, "10.00", frozen.Balance.String())
+
+	// No transfers in either direction
+	_, err = createTransferReturnErr(t.Context(), conn, account1.ID, account2.ID, "1.00")
+	assert.ErrorIs(t, err, pgledger.ErrAccountStatus)
+
+	var ledgerErr *pgledger.LedgerError
+	if assert.ErrorAs(t, err, &ledgerErr) {
+		assert.Equal(t, "PGL14", ledgerErr.Code)
+		assert.Equal(t, account2.ID, ledgerErr.AccountID)
+		assert.Equal(t, "account 2", ledgerErr.AccountName)
+		assert.Equal(t, pgledger.AccountStatusFrozen, ledgerErr.Status)
+	}
+
+	_, err = createTransferReturnErr(t.Context(), conn, account2.ID, account1.ID, "1.00")
+	assert.ErrorIs(t, err, pgledger.ErrAccountStatus)
+
+	// Unfreezing allows transfers again
+	active, err := client.UpdateAccountStatus(t.Context(), account2.ID, pgledger.AccountStatusActive, "support@example.com")
+	assert.NoError(t, err)
+	assert.Equal(t, pgledger.AccountStatusActive, active.Status)
+
+	_ = createTransfer(t, conn, account2.ID, account1.ID, "1.00")
+	assert.Equal(t, "9.00", getAccount(t, conn, account2.ID).Balance.String())
+
+	// Each change is recorded
+	changes := queryAll[struct {
+		PreviousStatus string
+		Status         string
+		ChangedBy      string
+	}](t, conn, "select previous_status, status, changed_by from pgledger_account_status_changes where account_id = $1 order by id", account2.ID)
+	assert.Len(t, changes, 2)
+	assert.Equal(t, "active", changes[0].PreviousStatus)
+	assert.Equal(t, "frozen", changes[0].Status)
+	assert.Equal(t, "frozen", changes[1].PreviousStatus)
+	assert.Equal(t, "active", changes[1].Status)
+	assert.Equal(t, "support@example.com", changes[1].ChangedBy)
+}
+
+func TestFrozenAccountCanStillVoidPendingTransfers(t *testing.T) {
+	conn := setupTest(t)
+	client := pgledger.NewClient(conn)
+
+	account1 := createAccount(t, conn, "account 1", "USD")
+	account2 := createAccount(t, conn, "account 2", "USD")
+
+	pending1 := createPendingTransfer(t, client, account1.ID, account2.ID, "5.00")
+	pending2 := createPendingTransfer(t, client, account1.ID, account2.ID, "5.00")
+
+	_, err := client.FreezeAccount(t.Context(), account1.ID, "risk")
+	assert.NoError(t, err)
+
+	_, err = client.PostPendingTransfer(t.Context(), pending1.ID)
+	assert.ErrorIs(t, err, pgledger.ErrAccountStatus)
+
+	_, err = client.VoidPendingTransfer(t.Context(), pending2.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, "5.00", getAccount(t, conn, account1.ID).PendingDebits.String())
+}
+
+func TestCloseAccount(t *testing.T) {
+	conn := setupTest(t)
+	client := pgledger.NewClient(conn)
+
+	account1 := createAccount(t, conn, "account 1", "USD")
+	account2 := createAccount(t, conn, "account 2", "USD")
+
+	_ = createTransfer(t, conn, account1.ID, account2.ID, "10.00")
+
+	_, err := client.CloseAccount(t.Context(), account2.ID, "ops")
+	assert.ErrorIs(t, err, pgledger.ErrAccountNotEmpty)
+
+	var ledgerErr *pgledger.LedgerError
+	if assert.ErrorAs(t, err, &ledgerErr) {
+		assert.Equal(t, "PGL15", ledgerErr.Code)
+		assert.Equal(t, "10.00", ledgerErr.Balance.String())
+	}
+
+	// Pending amounts also have to be settled first
+	_ = createTransfer(t, conn, account2.ID, account1.ID, "10.00")
+	pending := createPendingTransfer(t, client, account2.ID, account1.ID, "1.00")
+
+	_, err = client.CloseAccount(t.Context(), account2.ID, "ops")
+	assert.ErrorIs(t, err, pgledger.ErrAccountNotEmpty)
+
+	_, err = client.VoidPendingTransfer(t.Context(), pending.ID)
+	assert.NoError(t, err)
+
+	closed, err := client.CloseAccount(t.Context(), account2.ID, "ops")
+	assert.NoError(t, err)
+	assert.Equal(t, pgledger.AccountStatusClosed, closed.Status)
+	assert.Equal(t, "ops", *closed.StatusChangedBy)
+
+	_, err = createTransferReturnErr(t.Context(), conn, account1.ID, account2.ID, "1.00")
+	assert.ErrorIs(t, err, pgledger.ErrAccountStatus)
+
+	// Closing is permanent
+	_, err = client.UpdateAccountStatus(t.Context(), account2.ID, pgledger.AccountStatusActive, "ops")
+	assert.ErrorIs(t, err, pgledger.ErrAccountClosed)
+
+	_, err = client.FreezeAccount(t.Context(), "pgla_missing", "ops")
+	assert.ErrorIs(t, err, pgledger.ErrAccountNotFound)
+}
+
+func TestDebitOnlyAndCreditOnlyAccounts(t *testing.T) {
+	conn := setupTest(t)
+	client := pgledger.NewClient(conn)
+
+	source := createAccount(t, conn, "source", "USD")
+	sink := createAccount(t, conn, "sink", "USD")
+	other := createAccount(t, conn, "other", "USD")
+
+	_, err := client.UpdateAccountStatus(t.Context(), source.ID, pgledger.AccountStatusDebitOnly, "ops")
+	assert.NoError(t, err)
+	_, err = client.UpdateAccountStatus(t.Context(), sink.ID, pgledger.AccountStatusCreditOnly, "ops")
+	assert.NoError(t, err)
+
+	_ = createTransfer(t, conn, source.ID, other.ID, "10.00")
+	_ = createTransfer(t, conn, other.ID, sink.ID, "4.00")
+	_ = createTransfer(t, conn, source.ID, sink.ID, "1.00")
+
+	_, err = createTransferReturnErr(t.Context(), conn, other.ID, source.ID, "1.00")
+	assert.ErrorIs(t, err, pgledger.ErrAccountStatus)
+	assert.ErrorContains(t, err, "is debit_only and cannot be credited")
+
+	_, err = createTransferReturnErr(t.Context(), conn, sink.ID, other.ID, "1.00")
+	assert.ErrorIs(t, err, pgledger.ErrAccountStatus)
+	assert.ErrorContains(t, err, "is credit_only and cannot be debited")
+
+	// Reversals are checked too
+	transfer := createTransfer(t, conn, source.ID, other.ID, "1.00")
+	_, err = client.ReverseTransfer(t.Context(), transfer.ID)
+	assert.ErrorIs(t, err, pgledger.ErrAccountStatus)
+}
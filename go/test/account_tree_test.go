@@ -0,0 +1,69 @@
+package test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/pgr0ss/pgledger"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAccountTreeBalances(t *testing.T) {
+	conn := setupTest(t)
+	client := pgledger.NewClient(conn)
+
+	// Use a unique top level, since other tests share the database
+	root := fmt.Sprintf("tree_%d", time.Now().UnixNano())
+
+	available := createAccount(t, conn, "user1 available", "USD", pgledger.WithPath(root+".user1.available"))
+	pending := createAccount(t, conn, "user1 pending", "USD", pgledger.WithPath(root+".user1.pending"))
+	eur := createAccount(t, conn, "user1 EUR", "EUR", pgledger.WithPath(root+".user1.available"))
+	user2 := createAccount(t, conn, "user2", "USD", pgledger.WithPath(root+".user2"))
+	noPath := createAccount(t, conn, "no path", "USD")
+	eurSource := createAccount(t, conn, "EUR source", "EUR")
+
+	assert.Equal(t, root+".user1.available", *available.Path)
+	assert.Nil(t, noPath.Path)
+
+	_ = createTransfer(t, conn, noPath.ID, available.ID, "100.00")
+	_ = createTransfer(t, conn, noPath.ID, pending.ID, "25.00")
+	_ = createTransfer(t, conn, eurSource.ID, eur.ID, "9.26")
+	_ = createTransfer(t, conn, user2.ID, noPath.ID, "1.00")
+	_ = createPendingTransfer(t, client, available.ID, noPath.ID, "10.00")
+
+	trees, err := client.AccountTreeBalances(t.Context(), root+".user1")
+	assert.NoError(t, err)
+	assert.Len(t, trees, 1)
+
+	user1 := trees[0]
+	assert.Equal(t, root+".user1", user1.Path)
+	assert.Len(t, user1.Balances, 2)
+	assert.Equal(t, "EUR", user1.Balances[0].Currency)
+	assert.Equal(t, "9.26", user1.Balances[0].Balance.String())
+	assert.Equal(t, "USD", user1.Balances[1].Currency)
+	assert.Equal(t, "125.00", user1.Balances[1].Balance.String())
+	assert.Equal(t, "115.00", user1.Balances[1].AvailableBalance.String())
+	assert.Equal(t, 2, user1.Balances[1].AccountCount)
+
+	assert.Len(t, user1.Children, 2)
+	assert.Equal(t, root+".user1.available", user1.Children[0].Path)
+	assert.Len(t, user1.Children[0].Balances, 2)
+	assert.Equal(t, "100.00", user1.Children[0].Balances[1].Balance.String())
+	assert.Equal(t, root+".user1.pending", user1.Children[1].Path)
+	assert.Equal(t, "25.00", user1.Children[1].Balances[0].Balance.String())
+
+	// The whole tree includes user2, but not accounts without a path
+	trees, err = client.AccountTreeBalances(t.Context(), root)
+	assert.NoError(t, err)
+	assert.Len(t, trees, 1)
+	assert.Equal(t, root, trees[0].Path)
+	assert.Equal(t, "124.00", trees[0].Balances[1].Balance.String())
+	assert.Equal(t, 3, trees[0].Balances[1].AccountCount)
+	assert.Len(t, trees[0].Children, 2)
+	assert.Equal(t, root+".user2", trees[0].Children[1].Path)
+
+	trees, err = client.AccountTreeBalances(t.Context(), root+".missing")
+	assert.NoError(t, err)
+	assert.Empty(t, trees)
+}
@@ -0,0 +1,101 @@
+package test
+
+import (
+	"testing"
+
+	"github.com/pgr0ss/pgledger"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAccountMinBalance(t *testing.T) {
+	conn := setupTest(t)
+
+	account1 := createAccount(t, conn, "account 1", "USD", pgledger.WithMinBalance(pgledger.MustParseAmount("-500")))
+	account2 := createAccount(t, conn, "account 2", "USD")
+	assert.Equal(t, "-500", account1.MinBalance.String())
+	assert.Nil(t, account1.MaxBalance)
+
+	// The overdraft can be used up to the limit
+	_ = createTransfer(t, conn, account1.ID, account2.ID, "500.00")
+
+	_, err := createTransferReturnErr(t.Context(), conn, account1.ID, account2.ID, "0.01")
+	assert.ErrorIs(t, err, pgledger.ErrBelowMinBalance)
+
+	var ledgerErr *pgledger.LedgerError
+	if assert.ErrorAs(t, err, &ledgerErr) {
+		assert.Equal(t, "PGL17", ledgerErr.Code)
+		assert.Equal(t, account1.ID, ledgerErr.AccountID)
+		assert.Equal(t, "-500.01", ledgerErr.Balance.String())
+		assert.Equal(t, "-500", ledgerErr.MinBalance.String())
+	}
+
+	assert.Equal(t, "-500.00", getAccount(t, conn, account1.ID).Balance.String())
+}
+
+func TestAccountMaxBalance(t *testing.T) {
+	conn := setupTest(t)
+	client := pgledger.NewClient(conn)
+
+	account1 := createAccount(t, conn, "account 1", "USD")
+	account2 := createAccount(t, conn, "account 2", "USD", pgledger.WithMaxBalance(pgledger.MustParseAmount("10000")))
+
+	_ = createTransfer(t, conn, account1.ID, account2.ID, "9000")
+
+	// Pending credits count towards the maximum
+	_, err := client.CreateTransfer(t.Context(), account1.ID, account2.ID, pgledger.MustParseAmount("1000.01"),
+		pgledger.WithPending(true))
+	assert.ErrorIs(t, err, pgledger.ErrAboveMaxBalance)
+
+	var ledgerErr *pgledger.LedgerError
+	if assert.ErrorAs(t, err, &ledgerErr) {
+		assert.Equal(t, "PGL18", ledgerErr.Code)
+		assert.Equal(t, "9000", ledgerErr.Balance.String())
+		assert.Equal(t, "10000", ledgerErr.MaxBalance.String())
+	}
+
+	_ = createTransfer(t, conn, account1.ID, account2.ID, "1000")
+	assert.Equal(t, "10000", getAccount(t, conn, account2.ID).Balance.String())
+}
+
+func TestUpdateAccountBalanceLimits(t *testing.T) {
+	conn := setupTest(t)
+	client := pgledger.NewClient(conn)
+
+	account1 := createAccount(t, conn, "account 1", "USD")
+	account2 := createAccount(t, conn, "account 2", "USD")
+
+	_ = createTransfer(t, conn, account1.ID, account2.ID, "100")
+
+	minBalance := pgledger.MustParseAmount("-200")
+	maxBalance := pgledger.MustParseAmount("50")
+
+	account, err := client.UpdateAccountBalanceLimits(t.Context(), account1.ID, &minBalance, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "-200", account.MinBalance.String())
+	assert.Nil(t, account.MaxBalance)
+
+	// The current balance of account 2 is already above the new maximum
+	_, err = client.UpdateAccountBalanceLimits(t.Context(), account2.ID, nil, &maxBalance)
+	assert.ErrorIs(t, err, pgledger.ErrAboveMaxBalance)
+	assert.Nil(t, getAccount(t, conn, account2.ID).MaxBalance)
+
+	// And the current balance of account 1 is below this minimum
+	tooHigh := pgledger.MustParseAmount("-50")
+	_, err = client.UpdateAccountBalanceLimits(t.Context(), account1.ID, &tooHigh, nil)
+	assert.ErrorIs(t, err, pgledger.ErrBelowMinBalance)
+	assert.Equal(t, "-200", getAccount(t, conn, account1.ID).MinBalance.String())
+
+	_ = createTransfer(t, conn, account1.ID, account2.ID, "100")
+	_, err = createTransferReturnErr(t.Context(), conn, account1.ID, account2.ID, "0.01")
+	assert.ErrorIs(t, err, pgledger.ErrBelowMinBalance)
+
+	// Removing the limit allows the transfer
+	account, err = client.UpdateAccountBalanceLimits(t.Context(), account1.ID, nil, nil)
+	assert.NoError(t, err)
+	assert.Nil(t, account.MinBalance)
+
+	_ = createTransfer(t, conn, account1.ID, account2.ID, "0.01")
+
+	_, err = client.UpdateAccountBalanceLimits(t.Context(), "pgla_missing", nil, nil)
+	assert.ErrorIs(t, err, pgledger.ErrAccountNotFound)
+}
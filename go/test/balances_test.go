@@ -0,0 +1,173 @@
+package test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/pgr0ss/pgledger"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBalanceAtByEventAt(t *testing.T) {
+	conn := setupTest(t)
+	client := pgledger.NewClient(conn)
+
+	account1 := createAccount(t, conn, "account 1", "USD")
+	account2 := createAccount(t, conn, "account 2", "USD")
+
+	june1 := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+	june2 := june1.AddDate(0, 0, 1)
+	june3 := june1.AddDate(0, 0, 2)
+
+	// Recorded out of order: the June 3rd transfer is created first
+	_, err := client.CreateTransfer(t.Context(), account1.ID, account2.ID, pgledger.MustParseAmount("50"), pgledger.WithEventAt(june3))
+	assert.NoError(t, err)
+	_, err = client.CreateTransfer(t.Context(), account1.ID, account2.ID, pgledger.MustParseAmount("10"), pgledger.WithEventAt(june1))
+	assert.NoError(t, err)
+	_, err = client.CreateTransfer(t.Context(), account2.ID, account1.ID, pgledger.MustParseAmount("3"), pgledger.WithEventAt(june2))
+	assert.NoError(t, err)
+
+	// Pending transfers don't change the balance
+	_, err = client.CreateTransfer(t.Context(), account1.ID, account2.ID, pgledger.MustParseAmount("100"),
+		pgledger.WithEventAt(june1), pgledger.WithPending(true))
+	assert.NoError(t, err)
+
+	cases := []struct {
+		at       time.Time
+		expected string
+	}{
+		{june1.Add(-time.Second), "0"},
+		{june1, "10"},
+		{june2, "7"},
+		{june3.Add(-time.Second), "7"},
+		{june3, "57"},
+	}
+
+	for _, c := range cases {
+		balance, err := client.BalanceAt(t.Context(), account2.ID, c.at, pgledger.BalanceByEventAt)
+		assert.NoError(t, err)
+		assert.Equal(t, c.expected, balance.String(), "at %s", c.at)
+	}
+
+	// By created_at, every transfer was created after the event times
+	balance, err := client.BalanceAt(t.Context(), account2.ID, june3, pgledger.BalanceByCreatedAt)
+	assert.NoError(t, err)
+	assert.Equal(t, "0", balance.String())
+
+	balance, err = client.BalanceAt(t.Context(), account2.ID, time.Now(), pgledger.BalanceByCreatedAt)
+	assert.NoError(t, err)
+	assert.Equal(t, "57", balance.String())
+}
+
+func TestBalancesAt(t *testing.T) {
+	conn := setupTest(t)
+	client := pgledger.NewClient(conn)
+
+	account1 := createAccount(t, conn, "account 1", "USD")
+	account2 := createAccount(t, conn, "account 2", "USD")
+	account3 := createAccount(t, conn, "account 3", "USD")
+
+	_ = createTransfer(t, conn, account1.ID, account2.ID, "10.00")
+	before := time.Now()
+	_ = createTransfer(t, conn, account2.ID, account3.ID, "4.00")
+
+	balances, err := client.BalancesAt(t.Context(), []string{account3.ID, account1.ID, account2.ID}, before, pgledger.BalanceByCreatedAt)
+	assert.NoError(t, err)
+	assert.Len(t, balances, 3)
+	assert.Equal(t, account3.ID, balances[0].AccountID)
+	assert.Equal(t, "0", balances[0].Balance.String())
+	assert.Equal(t, account1.ID, balances[1].AccountID)
+	assert.Equal(t, "-10.00", balances[1].Balance.String())
+	assert.Equal(t, account2.ID, balances[2].AccountID)
+	assert.Equal(t, "10.00", balances[2].Balance.String())
+
+	balances, err = client.BalancesAt(t.Context(), []string{account2.ID, account3.ID}, time.Now(), pgledger.BalanceByEventAt)
+	assert.NoError(t, err)
+	assert.Equal(t, "6.00", balances[0].Balance.String())
+	assert.Equal(t, "4.00", balances[1].Balance.String())
+}
+
+func TestBalanceAtErrors(t *testing.T) {
+	conn := setupTest(t)
+	client := pgledger.NewClient(conn)
+
+	_, err := client.BalanceAt(t.Context(), "pgla_missing", time.Now(), pgledger.BalanceByCreatedAt)
+	assert.ErrorIs(t, err, pgledger.ErrAccountNotFound)
+
+	account := createAccount(t, conn, "account 1", "USD")
+
+	_, err = client.BalanceAt(t.Context(), account.ID, time.Now(), "updated_at")
+	assert.ErrorContains(t, err, "Invalid by (updated_at), must be created_at or event_at")
+}
+
+func trialBalanceFor(t *testing.T, client *pgledger.Client, currency string, asOf time.Time, by string) *pgledger.TrialBalance {
+	balances, err := client.TrialBalance(t.Context(), asOf, by)
+	assert.NoError(t, err)
+
+	for _, balance := range balances {
+		if balance.Currency == currency {
+			return &balance
+		}
+	}
+	return nil
+}
+
+func TestTrialBalance(t *testing.T) {
+	conn := setupTest(t)
+	client := pgledger.NewClient(conn)
+
+	// Use a unique currency, since other tests share the database
+	code := fmt.Sprintf("TB%d", time.Now().UnixNano())
+	_, err := client.CreateCurrency(t.Context(), code, 2, nil)
+	assert.NoError(t, err)
+
+	account1 := createAccount(t, conn, "account 1", code)
+	account2 := createAccount(t, conn, "account 2", code)
+	account3 := createAccount(t, conn, "account 3", code)
+
+	june1 := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+	june2 := june1.AddDate(0, 0, 1)
+	june3 := june1.AddDate(0, 0, 2)
+
+	beforeTransfers := time.Now()
+
+	_, err = client.CreateTransfer(t.Context(), account1.ID, account2.ID, pgledger.MustParseAmount("10"), pgledger.WithEventAt(june1))
+	assert.NoError(t, err)
+	_, err = client.CreateTransfer(t.Context(), account1.ID, account3.ID, pgledger.MustParseAmount("5"), pgledger.WithEventAt(june3))
+	assert.NoError(t, err)
+	_, err = client.CreateTransfer(t.Context(), account2.ID, account3.ID, pgledger.MustParseAmount("2"), pgledger.WithEventAt(june2))
+	assert.NoError(t, err)
+
+	// Pending transfers are ignored
+	_, err = client.CreateTransfer(t.Context(), account3.ID, account1.ID, pgledger.MustParseAmount("1"), pgledger.WithPending(true))
+	assert.NoError(t, err)
+
+	balance := trialBalanceFor(t, client, code, time.Now(), pgledger.BalanceByCreatedAt)
+	if assert.NotNil(t, balance) {
+		assert.Equal(t, "15", balance.Debits.String())
+		assert.Equal(t, "15", balance.Credits.String())
+		assert.Equal(t, "0", balance.Net.String())
+	}
+
+	assert.Nil(t, trialBalanceFor(t, client, code, beforeTransfers, pgledger.BalanceByCreatedAt))
+
+	balance = trialBalanceFor(t, client, code, june2, pgledger.BalanceByEventAt)
+	if assert.NotNil(t, balance) {
+		assert.Equal(t, "10", balance.Debits.String())
+		assert.Equal(t, "10", balance.Credits.String())
+		assert.Equal(t, "0", balance.Net.String())
+	}
+
+	assert.Nil(t, trialBalanceFor(t, client, code, june1.Add(-time.Second), pgledger.BalanceByEventAt))
+
+	// The balances add up to 0 in every currency
+	balances, err := client.TrialBalance(t.Context(), time.Now(), pgledger.BalanceByEventAt)
+	assert.NoError(t, err)
+	for _, balance := range balances {
+		assert.True(t, balance.Net.IsZero(), balance.Currency)
+	}
+
+	_, err = client.TrialBalance(t.Context(), time.Now(), "updated_at")
+	assert.ErrorContains(t, err, "Invalid by (updated_at), must be created_at or event_at")
+}
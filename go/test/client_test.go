@@ -0,0 +1,415 @@
+package test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/pgr0ss/pgledger"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClientCreateAccountWithOptions(t *testing.T) {
+	conn := setupTest(t)
+	client := pgledger.NewClient(conn)
+
+	account, err := client.CreateAccount(t.Context(), "client account", "USD",
+		pgledger.WithAllowNegativeBalance(false),
+		pgledger.WithAllowPositiveBalance(true),
+		pgledger.WithMetadata(map[string]string{"a": "b"}))
+	assert.NoError(t, err)
+
+	assert.Regexp(t, "^pgla_\\w+$", account.ID)
+	assert.Equal(t, "client account", account.Name)
+	assert.Equal(t, "USD", account.Currency)
+	assert.False(t, account.AllowNegativeBalance)
+	assert.True(t, account.AllowPositiveBalance)
+	assert.Equal(t, `{"a": "b"}`, *account.Metadata)
+
+	foundAccount, err := client.GetAccount(t.Context(), account.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, account, foundAccount)
+}
+
+func TestClientCreateAccountDefaults(t *testing.T) {
+	conn := setupTest(t)
+	client := pgledger.NewClient(conn)
+
+	account, err := client.CreateAccount(t.Context(), "client account", "USD")
+	assert.NoError(t, err)
+
+	assert.True(t, account.AllowNegativeBalance)
+	assert.True(t, account.AllowPositiveBalance)
+	assert.Nil(t, account.Metadata)
+}
+
+func TestClientGetMissingRows(t *testing.T) {
+	conn := setupTest(t)
+	client := pgledger.NewClient(conn)
+
+	_, err := client.GetAccount(t.Context(), "pgla_missing")
+	assert.ErrorIs(t, err, pgx.ErrNoRows)
+
+	_, err = client.GetTransfer(t.Context(), "pglt_missing")
+	assert.ErrorIs(t, err, pgx.ErrNoRows)
+
+	_, err = client.GetJournal(t.Context(), "pglj_missing")
+	assert.ErrorIs(t, err, pgx.ErrNoRows)
+}
+
+func TestClientCreateTransferWithOptions(t *testing.T) {
+	conn := setupTest(t)
+	client := pgledger.NewClient(conn)
+
+	account1 := createAccount(t, conn, "account 1", "USD")
+	account2 := createAccount(t, conn, "account 2", "USD")
+
+	eventAt, err := time.Parse(time.RFC3339, "2025-07-01T12:34:56Z")
+	assert.NoError(t, err)
+
+	transfer, err := client.CreateTransfer(t.Context(), account1.ID, account2.ID, pgledger.MustParseAmount("12.34"),
+		pgledger.WithEventAt(eventAt),
+		pgledger.WithMetadata(`{"c": "d"}`))
+	assert.NoError(t, err)
+
+	assert.Regexp(t, "^pglt_\\w+$", transfer.ID)
+	assert.Equal(t, account1.ID, transfer.FromAccountID)
+	assert.Equal(t, account2.ID, transfer.ToAccountID)
+	assert.Equal(t, "12.34", transfer.Amount.String())
+	assert.Equal(t, eventAt, transfer.EventAt.UTC())
+	assert.Equal(t, `{"c": "d"}`, *transfer.Metadata)
+
+	entries, err := client.ListEntries(t.Context(), account2.ID)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 1)
+	assert.Equal(t, transfer.ID, entries[0].TransferID)
+	assert.Equal(t, "12.34", entries[0].Amount.String())
+	assert.Equal(t, eventAt, entries[0].EventAt.UTC())
+	assert.Equal(t, `{"c": "d"}`, *entries[0].Metadata)
+}
+
+func TestClientCreateTransfers(t *testing.T) {
+	conn := setupTest(t)
+	client := pgledger.NewClient(conn)
+
+	userUSD := createAccount(t, conn, "user.USD", "USD")
+	userEUR := createAccount(t, conn, "user.EUR", "EUR")
+	liquidityUSD := createAccount(t, conn, "liquidity.USD", "USD")
+	liquidityEUR := createAccount(t, conn, "liquidity.EUR", "EUR")
+
+	transfers, err := client.CreateTransfers(t.Context(), []pgledger.TransferRequest{
+		{FromAccountID: userUSD.ID, ToAccountID: liquidityUSD.ID, Amount: pgledger.MustParseAmount("10.00")},
+		{FromAccountID: liquidityEUR.ID, ToAccountID: userEUR.ID, Amount: pgledger.MustParseAmount("9.26")},
+	}, pgledger.WithMetadata(`{"kind": "exchange"}`))
+	assert.NoError(t, err)
+
+	assert.Len(t, transfers, 2)
+
+	assert.Equal(t, userUSD.ID, transfers[0].FromAccountID)
+	assert.Equal(t, liquidityUSD.ID, transfers[0].ToAccountID)
+	assert.Equal(t, "10.00", transfers[0].Amount.String())
+	assert.Equal(t, `{"kind": "exchange"}`, *transfers[0].Metadata)
+
+	assert.Equal(t, liquidityEUR.ID, transfers[1].FromAccountID)
+	assert.Equal(t, userEUR.ID, transfers[1].ToAccountID)
+	assert.Equal(t, "9.26", transfers[1].Amount.String())
+	assert.Equal(t, `{"kind": "exchange"}`, *transfers[1].Metadata)
+
+	assert.Equal(t, "-10.00", getAccount(t, conn, userUSD.ID).Balance.String())
+	assert.Equal(t, "9.26", getAccount(t, conn, userEUR.ID).Balance.String())
+}
+
+func TestClientCreateTransfersIncludesAccountDetails(t *testing.T) {
+	conn := setupTest(t)
+	client := pgledger.NewClient(conn)
+
+	account1 := createAccount(t, conn, "account 1", "USD")
+	account2 := createAccount(t, conn, "account 2", "USD")
+	account3 := createAccount(t, conn, "account 3", "USD")
+
+	transfers, err := client.CreateTransfers(t.Context(), []pgledger.TransferRequest{
+		{FromAccountID: account1.ID, ToAccountID: account2.ID, Amount: pgledger.MustParseAmount("10.00")},
+		{FromAccountID: account1.ID, ToAccountID: account3.ID, Amount: pgledger.MustParseAmount("5")},
+	})
+	assert.NoError(t, err)
+	assert.Len(t, transfers, 2)
+
+	first := transfers[0]
+	assert.Equal(t, "USD", first.Currency)
+	assert.Equal(t, "account 1", first.FromAccountName)
+	assert.Equal(t, "account 2", first.ToAccountName)
+	assert.Equal(t, "-10.00", first.FromAccountBalance.String())
+	assert.Equal(t, 1, first.FromAccountVersion)
+	assert.Equal(t, "10.00", first.ToAccountBalance.String())
+	assert.Equal(t, 1, first.ToAccountVersion)
+
+	// The balances are the ones right after each transfer, not the final ones
+	second := transfers[1]
+	assert.Equal(t, "account 1", second.FromAccountName)
+	assert.Equal(t, "account 3", second.ToAccountName)
+	assert.Equal(t, "-15.00", second.FromAccountBalance.String())
+	assert.Equal(t, 2, second.FromAccountVersion)
+	assert.Equal(t, "5", second.ToAccountBalance.String())
+	assert.Equal(t, 1, second.ToAccountVersion)
+
+	assert.Equal(t, first, *getTransfer(t, conn, first.ID))
+}
+
+func TestClientCreateTransfersWithPerRequestMetadataAndEventAt(t *testing.T) {
+	conn := setupTest(t)
+	client := pgledger.NewClient(conn)
+
+	userUSD := createAccount(t, conn, "user.USD", "USD")
+	userEUR := createAccount(t, conn, "user.EUR", "EUR")
+	liquidityUSD := createAccount(t, conn, "liquidity.USD", "USD")
+	liquidityEUR := createAccount(t, conn, "liquidity.EUR", "EUR")
+
+	batchEventAt := time.Date(2025, 7, 1, 12, 0, 0, 0, time.UTC)
+	eurEventAt := time.Date(2025, 7, 2, 9, 30, 0, 0, time.UTC)
+
+	transfers, err := client.CreateTransfers(t.Context(), []pgledger.TransferRequest{
+		pgledger.NewTransferRequest(userUSD.ID, liquidityUSD.ID, pgledger.MustParseAmount("10.00")).
+			WithMetadata(map[string]string{"leg": "usd"}),
+		pgledger.NewTransferRequest(liquidityEUR.ID, userEUR.ID, pgledger.MustParseAmount("9.26")).
+			WithMetadata(`{"leg": "eur"}`).
+			WithEventAt(eurEventAt),
+		{FromAccountID: liquidityUSD.ID, ToAccountID: userUSD.ID, Amount: pgledger.MustParseAmount("0.10")},
+	}, pgledger.WithMetadata(`{"kind": "exchange"}`), pgledger.WithEventAt(batchEventAt))
+	assert.NoError(t, err)
+	assert.Len(t, transfers, 3)
+
+	assert.Equal(t, `{"leg": "usd"}`, *transfers[0].Metadata)
+	assert.Equal(t, batchEventAt, transfers[0].EventAt.UTC())
+
+	assert.Equal(t, `{"leg": "eur"}`, *transfers[1].Metadata)
+	assert.Equal(t, eurEventAt, transfers[1].EventAt.UTC())
+
+	// Requests without their own values use the batch values
+	assert.Equal(t, `{"kind": "exchange"}`, *transfers[2].Metadata)
+	assert.Equal(t, batchEventAt, transfers[2].EventAt.UTC())
+}
+
+func TestClientCreateTransfersRollsBackIfOneIsBad(t *testing.T) {
+	conn := setupTest(t)
+	client := pgledger.NewClient(conn)
+
+	account1 := createAccount(t, conn, "account 1", "USD")
+	account2 := createAccount(t, conn, "account 2", "USD")
+
+	_, err := client.CreateTransfers(t.Context(), []pgledger.TransferRequest{
+		{FromAccountID: account1.ID, ToAccountID: account2.ID, Amount: pgledger.MustParseAmount("10")},
+		{FromAccountID: account2.ID, ToAccountID: account2.ID, Amount: pgledger.MustParseAmount("5")},
+	})
+	assert.ErrorIs(t, err, pgledger.ErrSameAccount)
+
+	assert.Equal(t, "0", getAccount(t, conn, account1.ID).Balance.String())
+	assert.Equal(t, "0", getAccount(t, conn, account2.ID).Balance.String())
+}
+
+func TestClientSumEntries(t *testing.T) {
+	conn := setupTest(t)
+	client := pgledger.NewClient(conn)
+
+	account1 := createAccount(t, conn, "account 1", "USD")
+	account2 := createAccount(t, conn, "account 2", "USD")
+
+	for range 10 {
+		_ = createTransfer(t, conn, account1.ID, account2.ID, "0.10")
+	}
+	_ = createTransfer(t, conn, account2.ID, account1.ID, "0.01")
+
+	entries, err := client.ListEntries(t.Context(), account2.ID)
+	assert.NoError(t, err)
+
+	sum := pgledger.Amount{}
+	for _, entry := range entries {
+		sum = sum.Add(entry.Amount)
+	}
+
+	assert.Equal(t, "0.99", sum.String())
+	assert.True(t, sum.Equal(getAccount(t, conn, account2.ID).Balance))
+	assert.True(t, sum.Equal(entries[len(entries)-1].AccountCurrentBalance))
+}
+
+func TestClientCreateTransferIdempotencyKey(t *testing.T) {
+	conn := setupTest(t)
+	client := pgledger.NewClient(conn)
+
+	account1 := createAccount(t, conn, "account 1", "USD")
+	account2 := createAccount(t, conn, "account 2", "USD")
+
+	transfer, err := client.CreateTransfer(t.Context(), account1.ID, account2.ID, pgledger.MustParseAmount("12.34"),
+		pgledger.WithIdempotencyKey("key-1"))
+	assert.NoError(t, err)
+	assert.Equal(t, "key-1", *transfer.IdempotencyKey)
+
+	retried, err := client.CreateTransfer(t.Context(), account1.ID, account2.ID, pgledger.MustParseAmount("12.34"),
+		pgledger.WithIdempotencyKey("key-1"))
+	assert.NoError(t, err)
+	assert.Equal(t, transfer, retried)
+
+	// The transfer was only applied once
+	assert.Equal(t, "-12.34", getAccount(t, conn, account1.ID).Balance.String())
+	assert.Equal(t, "12.34", getAccount(t, conn, account2.ID).Balance.String())
+	assert.Len(t, getEntries(t, conn, account2.ID), 1)
+
+	// A different key creates a new transfer
+	other, err := client.CreateTransfer(t.Context(), account1.ID, account2.ID, pgledger.MustParseAmount("12.34"),
+		pgledger.WithIdempotencyKey("key-2"))
+	assert.NoError(t, err)
+	assert.NotEqual(t, transfer.ID, other.ID)
+	assert.Equal(t, "24.68", getAccount(t, conn, account2.ID).Balance.String())
+
+	// No key means no deduplication
+	noKey1 := createTransfer(t, conn, account1.ID, account2.ID, "1.00")
+	noKey2 := createTransfer(t, conn, account1.ID, account2.ID, "1.00")
+	assert.NotEqual(t, noKey1.ID, noKey2.ID)
+	assert.Nil(t, noKey1.IdempotencyKey)
+}
+
+func TestClientCreateTransferIdempotencyKeyConflict(t *testing.T) {
+	conn := setupTest(t)
+	client := pgledger.NewClient(conn)
+
+	account1 := createAccount(t, conn, "account 1", "USD")
+	account2 := createAccount(t, conn, "account 2", "USD")
+
+	_, err := client.CreateTransfer(t.Context(), account1.ID, account2.ID, pgledger.MustParseAmount("12.34"),
+		pgledger.WithIdempotencyKey("key-1"),
+		pgledger.WithMetadata(`{"a": "b"}`))
+	assert.NoError(t, err)
+
+	for _, opts := range [][]pgledger.TransferOption{
+		{pgledger.WithMetadata(`{"a": "c"}`)},
+		{pgledger.WithMetadata(`{"a": "b"}`), pgledger.WithEventAt(time.Date(2025, 7, 1, 0, 0, 0, 0, time.UTC))},
+	} {
+		_, err = client.CreateTransfer(t.Context(), account1.ID, account2.ID, pgledger.MustParseAmount("12.34"),
+			append(opts, pgledger.WithIdempotencyKey("key-1"))...)
+		assert.ErrorIs(t, err, pgledger.ErrIdempotencyKeyConflict)
+
+		var ledgerErr *pgledger.LedgerError
+		if assert.ErrorAs(t, err, &ledgerErr) {
+			assert.Equal(t, "PGL07", ledgerErr.Code)
+			assert.Equal(t, "key-1", ledgerErr.IdempotencyKey)
+		}
+	}
+
+	_, err = client.CreateTransfer(t.Context(), account1.ID, account2.ID, pgledger.MustParseAmount("12.35"),
+		pgledger.WithIdempotencyKey("key-1"),
+		pgledger.WithMetadata(`{"a": "b"}`))
+	assert.ErrorIs(t, err, pgledger.ErrIdempotencyKeyConflict)
+
+	_, err = client.CreateTransfer(t.Context(), account2.ID, account1.ID, pgledger.MustParseAmount("12.34"),
+		pgledger.WithIdempotencyKey("key-1"),
+		pgledger.WithMetadata(`{"a": "b"}`))
+	assert.ErrorIs(t, err, pgledger.ErrIdempotencyKeyConflict)
+
+	assert.Equal(t, "12.34", getAccount(t, conn, account2.ID).Balance.String())
+}
+
+func TestClientCreateTransfersIdempotencyKey(t *testing.T) {
+	conn := setupTest(t)
+	client := pgledger.NewClient(conn)
+
+	account1 := createAccount(t, conn, "account 1", "USD")
+	account2 := createAccount(t, conn, "account 2", "USD")
+	account3 := createAccount(t, conn, "account 3", "USD")
+
+	requests := []pgledger.TransferRequest{
+		{FromAccountID: account1.ID, ToAccountID: account2.ID, Amount: pgledger.MustParseAmount("10.00")},
+		{FromAccountID: account2.ID, ToAccountID: account3.ID, Amount: pgledger.MustParseAmount("4.00")},
+	}
+
+	transfers, err := client.CreateTransfers(t.Context(), requests, pgledger.WithIdempotencyKey("batch-1"))
+	assert.NoError(t, err)
+	assert.Len(t, transfers, 2)
+
+	retried, err := client.CreateTransfers(t.Context(), requests, pgledger.WithIdempotencyKey("batch-1"))
+	assert.NoError(t, err)
+	assert.Equal(t, transfers, retried)
+
+	assert.Equal(t, "6.00", getAccount(t, conn, account2.ID).Balance.String())
+	assert.Equal(t, "4.00", getAccount(t, conn, account3.ID).Balance.String())
+
+	// Same key with only the first request is a conflict
+	_, err = client.CreateTransfers(t.Context(), requests[:1], pgledger.WithIdempotencyKey("batch-1"))
+	assert.ErrorIs(t, err, pgledger.ErrIdempotencyKeyConflict)
+}
+
+func TestClientCreateTransfersIdempotencyKeyMatchesTransferRequestVersion(t *testing.T) {
+	conn := setupTest(t)
+	client := pgledger.NewClient(conn)
+
+	account1 := createAccount(t, conn, "account 1", "USD")
+	account2 := createAccount(t, conn, "account 2", "USD")
+	key := fmt.Sprintf("key_%d", time.Now().UnixNano())
+
+	original := queryOne[pgledger.Transfer](t, conn, `
+		select * from pgledger_create_transfers(
+			array[($1, $2, 5)]::transfer_request[],
+			idempotency_key => $3
+		)`, account1.ID, account2.ID, key)
+
+	// Retrying through the TRANSFER_REQUEST_V2 version returns the original
+	// transfer, since the request doesn't set any of the new fields
+	transfers, err := client.CreateTransfers(t.Context(), []pgledger.TransferRequest{
+		pgledger.NewTransferRequest(account1.ID, account2.ID, pgledger.MustParseAmount("5")),
+	}, pgledger.WithIdempotencyKey(key))
+	assert.NoError(t, err)
+	assert.Len(t, transfers, 1)
+	assert.Equal(t, original.ID, transfers[0].ID)
+
+	_, err = client.CreateTransfers(t.Context(), []pgledger.TransferRequest{
+		pgledger.NewTransferRequest(account1.ID, account2.ID, pgledger.MustParseAmount("5")).WithMetadata(`{"a": 1}`),
+	}, pgledger.WithIdempotencyKey(key))
+	assert.ErrorIs(t, err, pgledger.ErrIdempotencyKeyConflict)
+}
+
+func TestClientCreateTransfersIdempotencyKeyKeepsNullsInMetadata(t *testing.T) {
+	conn := setupTest(t)
+	client := pgledger.NewClient(conn)
+
+	account1 := createAccount(t, conn, "account 1", "USD")
+	account2 := createAccount(t, conn, "account 2", "USD")
+	key := fmt.Sprintf("key_%d", time.Now().UnixNano())
+
+	request := pgledger.NewTransferRequest(account1.ID, account2.ID, pgledger.MustParseAmount("5"))
+
+	transfers, err := client.CreateTransfers(t.Context(), []pgledger.TransferRequest{
+		request.WithMetadata(`{"a": null}`),
+	}, pgledger.WithIdempotencyKey(key))
+	assert.NoError(t, err)
+
+	retried, err := client.CreateTransfers(t.Context(), []pgledger.TransferRequest{
+		request.WithMetadata(`{"a": null}`),
+	}, pgledger.WithIdempotencyKey(key))
+	assert.NoError(t, err)
+	assert.Equal(t, transfers, retried)
+
+	// Only a missing metadata is left out of the request, not the nulls inside it
+	_, err = client.CreateTransfers(t.Context(), []pgledger.TransferRequest{
+		request.WithMetadata(`{}`),
+	}, pgledger.WithIdempotencyKey(key))
+	assert.ErrorIs(t, err, pgledger.ErrIdempotencyKeyConflict)
+}
+
+func TestClientCreateTransferIdempotencyKeyIsReleasedOnFailure(t *testing.T) {
+	conn := setupTest(t)
+	client := pgledger.NewClient(conn)
+
+	account1 := createAccount(t, conn, "account 1", "USD", pgledger.WithAllowNegativeBalance(false))
+	account2 := createAccount(t, conn, "account 2", "USD")
+
+	_, err := client.CreateTransfer(t.Context(), account1.ID, account2.ID, pgledger.MustParseAmount("5"),
+		pgledger.WithIdempotencyKey("key-1"))
+	assert.ErrorIs(t, err, pgledger.ErrInsufficientBalance)
+
+	// The failed call rolled back, so the key can be used once the balance is there
+	_ = createTransfer(t, conn, account2.ID, account1.ID, "5")
+
+	transfer, err := client.CreateTransfer(t.Context(), account1.ID, account2.ID, pgledger.MustParseAmount("5"),
+		pgledger.WithIdempotencyKey("key-1"))
+	assert.NoError(t, err)
+	assert.Equal(t, "key-1", *transfer.IdempotencyKey)
+}
@@ -0,0 +1,114 @@
+package test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/pgr0ss/pgledger"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCurrenciesAreSeededWithISO4217(t *testing.T) {
+	conn := setupTest(t)
+	client := pgledger.NewClient(conn)
+
+	usd, err := client.GetCurrency(t.Context(), "USD")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, usd.Scale)
+	assert.Equal(t, "US Dollar", *usd.Description)
+
+	jpy, err := client.GetCurrency(t.Context(), "JPY")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, jpy.Scale)
+
+	kwd, err := client.GetCurrency(t.Context(), "KWD")
+	assert.NoError(t, err)
+	assert.Equal(t, 3, kwd.Scale)
+}
+
+func TestCreateAccountWithUnknownCurrency(t *testing.T) {
+	conn := setupTest(t)
+	client := pgledger.NewClient(conn)
+
+	_, err := client.CreateAccount(t.Context(), "account 1", "usd")
+	assert.ErrorIs(t, err, pgledger.ErrCurrencyNotFound)
+	assert.ErrorContains(t, err, "Currency (usd) does not exist")
+
+	var ledgerErr *pgledger.LedgerError
+	if assert.ErrorAs(t, err, &ledgerErr) {
+		assert.Equal(t, "PGL19", ledgerErr.Code)
+		assert.Equal(t, "usd", ledgerErr.Currency)
+	}
+}
+
+func TestTransferAmountCannotExceedCurrencyScale(t *testing.T) {
+	conn := setupTest(t)
+
+	account1 := createAccount(t, conn, "account 1", "USD")
+	account2 := createAccount(t, conn, "account 2", "USD")
+
+	_, err := createTransferReturnErr(t.Context(), conn, account1.ID, account2.ID, "0.001")
+	assert.ErrorIs(t, err, pgledger.ErrAmountExceedsScale)
+	assert.ErrorContains(t, err, "Amount (0.001) has more decimal places than currency USD allows (2)")
+
+	var ledgerErr *pgledger.LedgerError
+	if assert.ErrorAs(t, err, &ledgerErr) {
+		assert.Equal(t, "PGL20", ledgerErr.Code)
+		assert.Equal(t, "0.001", ledgerErr.Amount.String())
+		assert.Equal(t, "USD", ledgerErr.Currency)
+		assert.Equal(t, 2, ledgerErr.Scale)
+	}
+
+	// Trailing zeros don't count
+	_ = createTransfer(t, conn, account1.ID, account2.ID, "1.230")
+	assert.Equal(t, "1.230", getAccount(t, conn, account2.ID).Balance.String())
+}
+
+func TestZeroDecimalCurrency(t *testing.T) {
+	conn := setupTest(t)
+
+	account1 := createAccount(t, conn, "account 1", "JPY")
+	account2 := createAccount(t, conn, "account 2", "JPY")
+
+	_, err := createTransferReturnErr(t.Context(), conn, account1.ID, account2.ID, "100.5")
+	assert.ErrorIs(t, err, pgledger.ErrAmountExceedsScale)
+
+	_ = createTransfer(t, conn, account1.ID, account2.ID, "100")
+}
+
+func TestPartialReversalAmountIsCheckedAgainstScale(t *testing.T) {
+	conn := setupTest(t)
+	client := pgledger.NewClient(conn)
+
+	account1 := createAccount(t, conn, "account 1", "USD")
+	account2 := createAccount(t, conn, "account 2", "USD")
+
+	transfer := createTransfer(t, conn, account1.ID, account2.ID, "10.00")
+
+	_, err := client.ReverseTransfer(t.Context(), transfer.ID, pgledger.WithReversalAmount(pgledger.MustParseAmount("0.005")))
+	assert.ErrorIs(t, err, pgledger.ErrAmountExceedsScale)
+}
+
+func TestCreateCurrency(t *testing.T) {
+	conn := setupTest(t)
+	client := pgledger.NewClient(conn)
+
+	// Use a unique code, since other tests share the database
+	code := fmt.Sprintf("PTS%d", time.Now().UnixNano())
+	description := "Loyalty points"
+
+	currency, err := client.CreateCurrency(t.Context(), code, 0, &description)
+	assert.NoError(t, err)
+	assert.Equal(t, code, currency.Code)
+	assert.Equal(t, 0, currency.Scale)
+	assert.Equal(t, description, *currency.Description)
+
+	account1 := createAccount(t, conn, "account 1", code)
+	account2 := createAccount(t, conn, "account 2", code)
+
+	_ = createTransfer(t, conn, account1.ID, account2.ID, "500")
+
+	_, err = createTransferReturnErr(t.Context(), conn, account1.ID, account2.ID, "0.5")
+	assert.ErrorIs(t, err, pgledger.ErrAmountExceedsScale)
+}
@@ -7,7 +7,9 @@ import (
 	"time"
 
 	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/pgr0ss/pgledger"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -19,7 +21,7 @@ func TestAddAccount(t *testing.T) {
 	assert.Regexp(t, "^pgla_\\w+$", account.ID)
 	assert.Equal(t, "account 1", account.Name)
 	assert.Equal(t, "USD", account.Currency)
-	assert.Equal(t, "0", account.Balance)
+	assert.Equal(t, "0", account.Balance.String())
 	assert.Equal(t, 0, account.Version)
 	assert.WithinDuration(t, time.Now(), account.CreatedAt, time.Minute)
 	assert.Equal(t, account.CreatedAt, account.UpdatedAt)
@@ -28,46 +30,62 @@ func TestAddAccount(t *testing.T) {
 func TestAccountsThatCannotBeNegative(t *testing.T) {
 	conn := setupTest(t)
 
-	account1 := queryOne[Account](t, conn, "select * from pgledger_create_account('positive-only', 'USD', allow_negative_balance => false)")
-	account2 := queryOne[Account](t, conn, "select * from pgledger_create_account('account 2', 'USD')")
+	account1 := queryOne[pgledger.Account](t, conn, "select * from pgledger_create_account('positive-only', 'USD', allow_negative_balance => false)")
+	account2 := queryOne[pgledger.Account](t, conn, "select * from pgledger_create_account('account 2', 'USD')")
 
 	_, err := createTransferReturnErr(t.Context(), conn, account1.ID, account2.ID, "12.34")
 	assert.ErrorContains(t, err, fmt.Sprintf("Account (id=%s, name=%s) does not allow negative balance", account1.ID, "positive-only"))
+	assert.ErrorIs(t, err, pgledger.ErrInsufficientBalance)
+
+	var ledgerErr *pgledger.LedgerError
+	assert.ErrorAs(t, err, &ledgerErr)
+	assert.Equal(t, "PGL01", ledgerErr.Code)
+	assert.Equal(t, account1.ID, ledgerErr.AccountID)
+	assert.Equal(t, "positive-only", ledgerErr.AccountName)
+	assert.Equal(t, "-12.34", ledgerErr.Balance.String())
 
 	foundAccount1 := getAccount(t, conn, account1.ID)
 	foundAccount2 := getAccount(t, conn, account2.ID)
 
-	assert.Equal(t, "0", foundAccount1.Balance)
-	assert.Equal(t, "0", foundAccount2.Balance)
+	assert.Equal(t, "0", foundAccount1.Balance.String())
+	assert.Equal(t, "0", foundAccount2.Balance.String())
 }
 
 func TestAccountsThatCannotBePositive(t *testing.T) {
 	conn := setupTest(t)
 
-	account1 := queryOne[Account](t, conn, `SELECT * FROM pgledger_create_account('negative-only', 'USD', allow_positive_balance => false)`)
-	account2 := queryOne[Account](t, conn, `SELECT * FROM pgledger_create_account('account 2', 'USD')`)
+	account1 := queryOne[pgledger.Account](t, conn, `SELECT * FROM pgledger_create_account('negative-only', 'USD', allow_positive_balance => false)`)
+	account2 := queryOne[pgledger.Account](t, conn, `SELECT * FROM pgledger_create_account('account 2', 'USD')`)
 
 	_, err := createTransferReturnErr(t.Context(), conn, account2.ID, account1.ID, "12.34")
 	assert.ErrorContains(t, err, fmt.Sprintf("Account (id=%s, name=%s) does not allow positive balance", account1.ID, "negative-only"))
+	assert.ErrorIs(t, err, pgledger.ErrPositiveBalanceNotAllowed)
+
+	var ledgerErr *pgledger.LedgerError
+	assert.ErrorAs(t, err, &ledgerErr)
+	assert.Equal(t, "PGL02", ledgerErr.Code)
+	assert.Equal(t, account1.ID, ledgerErr.AccountID)
+	assert.Equal(t, "negative-only", ledgerErr.AccountName)
+	assert.Equal(t, "12.34", ledgerErr.Balance.String())
 
 	foundAccount1 := getAccount(t, conn, account1.ID)
 	foundAccount2 := getAccount(t, conn, account2.ID)
 
-	assert.Equal(t, "0", foundAccount1.Balance)
-	assert.Equal(t, "0", foundAccount2.Balance)
+	assert.Equal(t, "0", foundAccount1.Balance.String())
+	assert.Equal(t, "0", foundAccount2.Balance.String())
 }
 
 func TestAccountMetadata(t *testing.T) {
 	conn := setupTest(t)
 
 	// No metadata
-	account1 := queryOne[Account](t, conn, "select * from pgledger_create_account($1, $2)", "no-metadata", "USD")
+	account1 := queryOne[pgledger.Account](t, conn, "select * from pgledger_create_account($1, $2)", "no-metadata", "USD")
 
 	// With regular parameter
-	account2 := queryOne[Account](t, conn, "select * from pgledger_create_account($1, $2, $3, $4, $5)", "no-metadata", "USD", true, true, `{"a": "b"}`)
+	account2 := queryOne[pgledger.Account](t, conn, "select * from pgledger_create_account($1, $2, $3, $4, $5)", "no-metadata", "USD", true, true, `{"a": "b"}`)
 
 	// With named parameter
-	account3 := queryOne[Account](t, conn, "select * from pgledger_create_account($1, $2, metadata => $3)", "no-metadata", "USD", `{"c": "d"}`)
+	account3 := queryOne[pgledger.Account](t, conn, "select * from pgledger_create_account($1, $2, metadata => $3)", "no-metadata", "USD", `{"c": "d"}`)
 
 	assert.Nil(t, account1.Metadata)
 	assert.Equal(t, `{"a": "b"}`, *account2.Metadata)
@@ -85,21 +103,21 @@ func TestCreateTransfer(t *testing.T) {
 	assert.Regexp(t, "^pglt_\\w+$", transfer.ID)
 	assert.Equal(t, account1.ID, transfer.FromAccountID)
 	assert.Equal(t, account2.ID, transfer.ToAccountID)
-	assert.Equal(t, "12.34", transfer.Amount)
+	assert.Equal(t, "12.34", transfer.Amount.String())
 	assert.WithinDuration(t, time.Now(), transfer.CreatedAt, time.Minute)
 
 	foundTransfer := getTransfer(t, conn, transfer.ID)
 	assert.Regexp(t, transfer.ID, foundTransfer.ID)
 	assert.Equal(t, account1.ID, foundTransfer.FromAccountID)
 	assert.Equal(t, account2.ID, foundTransfer.ToAccountID)
-	assert.Equal(t, "12.34", foundTransfer.Amount)
+	assert.Equal(t, "12.34", foundTransfer.Amount.String())
 	assert.WithinDuration(t, time.Now(), foundTransfer.CreatedAt, time.Minute)
 
 	foundAccount1 := getAccount(t, conn, account1.ID)
 	foundAccount2 := getAccount(t, conn, account2.ID)
 
-	assert.Equal(t, "-12.34", foundAccount1.Balance)
-	assert.Equal(t, "12.34", foundAccount2.Balance)
+	assert.Equal(t, "-12.34", foundAccount1.Balance.String())
+	assert.Equal(t, "12.34", foundAccount2.Balance.String())
 	assert.Equal(t, 1, foundAccount1.Version)
 	assert.Equal(t, 1, foundAccount2.Version)
 	assert.Greater(t, foundAccount1.UpdatedAt, foundAccount1.CreatedAt)
@@ -124,10 +142,10 @@ func TestCreateTransferWithAndWithoutEventAt(t *testing.T) {
 	_, err = conn.Exec(t.Context(), "select pgledger_create_transfer($1, $2, 10, event_at => $3)", account1.ID, account2.ID, eventAt)
 	assert.NoError(t, err)
 
-	rows, err := conn.Query(t.Context(), "select * from pgledger_transfers where from_account_id = $1", account1.ID)
+	rows, err := conn.Query(t.Context(), "select * from pgledger_transfers_view where from_account_id = $1", account1.ID)
 	assert.NoError(t, err)
 
-	transfers, err := pgx.CollectRows(rows, pgx.RowToAddrOfStructByName[Transfer])
+	transfers, err := pgx.CollectRows(rows, pgx.RowToAddrOfStructByName[pgledger.Transfer])
 	assert.NoError(t, err)
 
 	assert.Len(t, transfers, 3)
@@ -178,10 +196,10 @@ func TestCreateTransfersWithAndWithoutEventAt(t *testing.T) {
 		account1.ID, account2.ID, eventAt)
 	assert.NoError(t, err)
 
-	rows, err := conn.Query(t.Context(), "select * from pgledger_transfers where from_account_id = $1", account1.ID)
+	rows, err := conn.Query(t.Context(), "select * from pgledger_transfers_view where from_account_id = $1", account1.ID)
 	assert.NoError(t, err)
 
-	transfers, err := pgx.CollectRows(rows, pgx.RowToAddrOfStructByName[Transfer])
+	transfers, err := pgx.CollectRows(rows, pgx.RowToAddrOfStructByName[pgledger.Transfer])
 	assert.NoError(t, err)
 
 	assert.Len(t, transfers, 6)
@@ -216,10 +234,10 @@ func TestCreateTransferWithAndWithoutMetadata(t *testing.T) {
 	_, err = conn.Exec(t.Context(), "select pgledger_create_transfer($1, $2, 10, metadata => $3)", account1.ID, account2.ID, `{"c": "d"}`)
 	assert.NoError(t, err)
 
-	rows, err := conn.Query(t.Context(), "select * from pgledger_transfers where from_account_id = $1", account1.ID)
+	rows, err := conn.Query(t.Context(), "select * from pgledger_transfers_view where from_account_id = $1", account1.ID)
 	assert.NoError(t, err)
 
-	transfers, err := pgx.CollectRows(rows, pgx.RowToAddrOfStructByName[Transfer])
+	transfers, err := pgx.CollectRows(rows, pgx.RowToAddrOfStructByName[pgledger.Transfer])
 	assert.NoError(t, err)
 
 	assert.Len(t, transfers, 3)
@@ -263,10 +281,10 @@ func TestCreateTransfersWithAndWithoutMetadata(t *testing.T) {
 		account1.ID, account2.ID, `{"e": "f"}`)
 	assert.NoError(t, err)
 
-	rows, err := conn.Query(t.Context(), "select * from pgledger_transfers where from_account_id = $1", account1.ID)
+	rows, err := conn.Query(t.Context(), "select * from pgledger_transfers_view where from_account_id = $1", account1.ID)
 	assert.NoError(t, err)
 
-	transfers, err := pgx.CollectRows(rows, pgx.RowToAddrOfStructByName[Transfer])
+	transfers, err := pgx.CollectRows(rows, pgx.RowToAddrOfStructByName[pgledger.Transfer])
 	assert.NoError(t, err)
 
 	assert.Len(t, transfers, 6)
@@ -298,9 +316,9 @@ func TestCreateMultipleTransfers(t *testing.T) {
 	foundAccount2 := getAccount(t, conn, account2.ID)
 	foundAccount3 := getAccount(t, conn, account3.ID)
 
-	assert.Equal(t, "40", foundAccount1.Balance)
-	assert.Equal(t, "-10", foundAccount2.Balance)
-	assert.Equal(t, "-30", foundAccount3.Balance)
+	assert.Equal(t, "40", foundAccount1.Balance.String())
+	assert.Equal(t, "-10", foundAccount2.Balance.String())
+	assert.Equal(t, "-30", foundAccount3.Balance.String())
 
 	assert.Equal(t, 2, foundAccount1.Version)
 	assert.Equal(t, 2, foundAccount2.Version)
@@ -313,7 +331,7 @@ func TestMultipleTransfersRollsBackIfOneIsBad(t *testing.T) {
 	account1 := createAccount(t, conn, "account 1", "USD")
 	account2 := createAccount(t, conn, "account 2", "USD")
 
-	account3 := queryOne[Account](t, conn, "select * from pgledger_create_account('negative-only', 'USD', allow_positive_balance => false)")
+	account3 := queryOne[pgledger.Account](t, conn, "select * from pgledger_create_account('negative-only', 'USD', allow_positive_balance => false)")
 
 	_, err := conn.Exec(t.Context(), `
 		select * from pgledger_create_transfers(
@@ -327,9 +345,9 @@ func TestMultipleTransfersRollsBackIfOneIsBad(t *testing.T) {
 	foundAccount2 := getAccount(t, conn, account2.ID)
 	foundAccount3 := getAccount(t, conn, account3.ID)
 
-	assert.Equal(t, "0", foundAccount1.Balance)
-	assert.Equal(t, "0", foundAccount2.Balance)
-	assert.Equal(t, "0", foundAccount3.Balance)
+	assert.Equal(t, "0", foundAccount1.Balance.String())
+	assert.Equal(t, "0", foundAccount2.Balance.String())
+	assert.Equal(t, "0", foundAccount3.Balance.String())
 
 	assert.Equal(t, 0, foundAccount1.Version)
 	assert.Equal(t, 0, foundAccount2.Version)
@@ -354,8 +372,8 @@ func TestTransfersRollbackIfTransctionRollback(t *testing.T) {
 	err = tx.Commit(t.Context())
 	assert.ErrorContains(t, err, "rollback")
 
-	assert.Equal(t, "0", getAccount(t, conn, account1.ID).Balance)
-	assert.Equal(t, "0", getAccount(t, conn, account2.ID).Balance)
+	assert.Equal(t, "0", getAccount(t, conn, account1.ID).Balance.String())
+	assert.Equal(t, "0", getAccount(t, conn, account2.ID).Balance.String())
 }
 
 func TestCreateMultipleTransfersRollbackOnFailure(t *testing.T) {
@@ -363,7 +381,7 @@ func TestCreateMultipleTransfersRollbackOnFailure(t *testing.T) {
 
 	account1 := createAccount(t, conn, "account 1", "USD")
 
-	positiveOnlyAccount := queryOne[Account](t, conn, "select * from pgledger_create_account('positive-only', 'USD', allow_negative_balance => false)")
+	positiveOnlyAccount := queryOne[pgledger.Account](t, conn, "select * from pgledger_create_account('positive-only', 'USD', allow_negative_balance => false)")
 
 	_, err := conn.Exec(t.Context(), fmt.Sprintf(`
 		BEGIN;
@@ -377,8 +395,8 @@ func TestCreateMultipleTransfersRollbackOnFailure(t *testing.T) {
 	foundAccount1 := getAccount(t, conn, account1.ID)
 	foundAccount2 := getAccount(t, conn, positiveOnlyAccount.ID)
 
-	assert.Equal(t, "0", foundAccount1.Balance)
-	assert.Equal(t, "0", foundAccount2.Balance)
+	assert.Equal(t, "0", foundAccount1.Balance.String())
+	assert.Equal(t, "0", foundAccount2.Balance.String())
 
 	assert.Equal(t, 0, foundAccount1.Version)
 	assert.Equal(t, 0, foundAccount2.Version)
@@ -390,10 +408,18 @@ func TestTransferWithInvalidAccountID(t *testing.T) {
 	account1 := createAccount(t, conn, "account 1", "USD")
 
 	_, err := createTransferReturnErr(t.Context(), conn, account1.ID, "bad_id", "12.34")
-	assert.ErrorContains(t, err, "violates foreign key constraint")
+	assert.ErrorContains(t, err, "Account (id=bad_id) does not exist")
+	assert.ErrorIs(t, err, pgledger.ErrAccountNotFound)
+
+	var ledgerErr *pgledger.LedgerError
+	assert.ErrorAs(t, err, &ledgerErr)
+	assert.Equal(t, "bad_id", ledgerErr.AccountID)
 
 	_, err = createTransferReturnErr(t.Context(), conn, "bad_id", account1.ID, "12.34")
-	assert.ErrorContains(t, err, "violates foreign key constraint")
+	assert.ErrorIs(t, err, pgledger.ErrAccountNotFound)
+
+	// Nothing was changed on the account that does exist
+	assert.Equal(t, 0, getAccount(t, conn, account1.ID).Version)
 }
 
 func TestEntries(t *testing.T) {
@@ -412,27 +438,27 @@ func TestEntries(t *testing.T) {
 
 	assert.Regexp(t, "^pgle_\\w+$", entries[0].ID)
 	assert.Equal(t, t1.ID, entries[0].TransferID)
-	assert.Equal(t, "-5", entries[0].Amount)
-	assert.Equal(t, "0", entries[0].AccountPreviousBalance)
-	assert.Equal(t, "-5", entries[0].AccountCurrentBalance)
+	assert.Equal(t, "-5", entries[0].Amount.String())
+	assert.Equal(t, "0", entries[0].AccountPreviousBalance.String())
+	assert.Equal(t, "-5", entries[0].AccountCurrentBalance.String())
 	assert.Equal(t, 1, entries[0].AccountVersion)
 	assert.WithinDuration(t, time.Now(), entries[0].CreatedAt, time.Minute)
 	assert.Equal(t, entries[0].CreatedAt, entries[0].EventAt)
 
 	assert.Regexp(t, "^pgle_\\w+$", entries[1].ID)
 	assert.Equal(t, t2.ID, entries[1].TransferID)
-	assert.Equal(t, "-10", entries[1].Amount)
-	assert.Equal(t, "-5", entries[1].AccountPreviousBalance)
-	assert.Equal(t, "-15", entries[1].AccountCurrentBalance)
+	assert.Equal(t, "-10", entries[1].Amount.String())
+	assert.Equal(t, "-5", entries[1].AccountPreviousBalance.String())
+	assert.Equal(t, "-15", entries[1].AccountCurrentBalance.String())
 	assert.Equal(t, 2, entries[1].AccountVersion)
 	assert.WithinDuration(t, time.Now(), entries[1].CreatedAt, time.Minute)
 	assert.Equal(t, entries[1].CreatedAt, entries[1].EventAt)
 
 	assert.Regexp(t, "^pgle_\\w+$", entries[2].ID)
 	assert.Equal(t, t3.ID, entries[2].TransferID)
-	assert.Equal(t, "20", entries[2].Amount)
-	assert.Equal(t, "-15", entries[2].AccountPreviousBalance)
-	assert.Equal(t, "5", entries[2].AccountCurrentBalance)
+	assert.Equal(t, "20", entries[2].Amount.String())
+	assert.Equal(t, "-15", entries[2].AccountPreviousBalance.String())
+	assert.Equal(t, "5", entries[2].AccountCurrentBalance.String())
 	assert.Equal(t, 3, entries[2].AccountVersion)
 	assert.WithinDuration(t, time.Now(), entries[2].CreatedAt, time.Minute)
 	assert.Equal(t, entries[2].CreatedAt, entries[2].EventAt)
@@ -443,27 +469,27 @@ func TestEntries(t *testing.T) {
 
 	assert.Regexp(t, "^pgle_\\w+$", entries[0].ID)
 	assert.Equal(t, t1.ID, entries[0].TransferID)
-	assert.Equal(t, "5", entries[0].Amount)
-	assert.Equal(t, "0", entries[0].AccountPreviousBalance)
-	assert.Equal(t, "5", entries[0].AccountCurrentBalance)
+	assert.Equal(t, "5", entries[0].Amount.String())
+	assert.Equal(t, "0", entries[0].AccountPreviousBalance.String())
+	assert.Equal(t, "5", entries[0].AccountCurrentBalance.String())
 	assert.Equal(t, 1, entries[0].AccountVersion)
 	assert.WithinDuration(t, time.Now(), entries[0].CreatedAt, time.Minute)
 	assert.Equal(t, entries[0].CreatedAt, entries[0].EventAt)
 
 	assert.Regexp(t, "^pgle_\\w+$", entries[1].ID)
 	assert.Equal(t, t2.ID, entries[1].TransferID)
-	assert.Equal(t, "10", entries[1].Amount)
-	assert.Equal(t, "5", entries[1].AccountPreviousBalance)
-	assert.Equal(t, "15", entries[1].AccountCurrentBalance)
+	assert.Equal(t, "10", entries[1].Amount.String())
+	assert.Equal(t, "5", entries[1].AccountPreviousBalance.String())
+	assert.Equal(t, "15", entries[1].AccountCurrentBalance.String())
 	assert.Equal(t, 2, entries[1].AccountVersion)
 	assert.WithinDuration(t, time.Now(), entries[1].CreatedAt, time.Minute)
 	assert.Equal(t, entries[1].CreatedAt, entries[1].EventAt)
 
 	assert.Regexp(t, "^pgle_\\w+$", entries[2].ID)
 	assert.Equal(t, t3.ID, entries[2].TransferID)
-	assert.Equal(t, "-20", entries[2].Amount)
-	assert.Equal(t, "15", entries[2].AccountPreviousBalance)
-	assert.Equal(t, "-5", entries[2].AccountCurrentBalance)
+	assert.Equal(t, "-20", entries[2].Amount.String())
+	assert.Equal(t, "15", entries[2].AccountPreviousBalance.String())
+	assert.Equal(t, "-5", entries[2].AccountCurrentBalance.String())
 	assert.Equal(t, 3, entries[2].AccountVersion)
 	assert.WithinDuration(t, time.Now(), entries[2].CreatedAt, time.Minute)
 	assert.Equal(t, entries[2].CreatedAt, entries[2].EventAt)
@@ -477,9 +503,15 @@ func TestTransferAmountsArePositive(t *testing.T) {
 
 	_, err := createTransferReturnErr(t.Context(), conn, account1.ID, account2.ID, "0")
 	assert.ErrorContains(t, err, "Amount (0) must be positive")
+	assert.ErrorIs(t, err, pgledger.ErrNonPositiveAmount)
 
 	_, err = createTransferReturnErr(t.Context(), conn, account1.ID, account2.ID, "-0.01")
 	assert.ErrorContains(t, err, "Amount (-0.01) must be positive")
+	assert.ErrorIs(t, err, pgledger.ErrNonPositiveAmount)
+
+	var ledgerErr *pgledger.LedgerError
+	assert.ErrorAs(t, err, &ledgerErr)
+	assert.Equal(t, "-0.01", ledgerErr.Amount.String())
 }
 
 func TestCannotTransferBetweenDifferentCurrencies(t *testing.T) {
@@ -491,13 +523,21 @@ func TestCannotTransferBetweenDifferentCurrencies(t *testing.T) {
 
 	_, err := createTransferReturnErr(t.Context(), conn, accountUSD.ID, accountEUR.ID, "10.00")
 	assert.ErrorContains(t, err, "Cannot transfer between different currencies (USD and EUR)")
+	assert.ErrorIs(t, err, pgledger.ErrCurrencyMismatch)
+
+	var ledgerErr *pgledger.LedgerError
+	assert.ErrorAs(t, err, &ledgerErr)
+	assert.Equal(t, accountUSD.ID, ledgerErr.FromAccountID)
+	assert.Equal(t, accountEUR.ID, ledgerErr.ToAccountID)
+	assert.Equal(t, "USD", ledgerErr.FromCurrency)
+	assert.Equal(t, "EUR", ledgerErr.ToCurrency)
 
 	// Verify account balances remain unchanged
 	foundAccountUSD := getAccount(t, conn, accountUSD.ID)
 	foundAccountEUR := getAccount(t, conn, accountEUR.ID)
 
-	assert.Equal(t, "0", foundAccountUSD.Balance)
-	assert.Equal(t, "0", foundAccountEUR.Balance)
+	assert.Equal(t, "0", foundAccountUSD.Balance.String())
+	assert.Equal(t, "0", foundAccountEUR.Balance.String())
 }
 
 func TestTransferBetweenCurrenciesWithExtraAccounts(t *testing.T) {
@@ -519,10 +559,10 @@ func TestTransferBetweenCurrenciesWithExtraAccounts(t *testing.T) {
 		`, userUSD.ID, liquidityUSD.ID, liquidityEUR.ID, userEUR.ID))
 	assert.NoError(t, err)
 
-	assert.Equal(t, "-10.00", getAccount(t, conn, userUSD.ID).Balance)
-	assert.Equal(t, "10.00", getAccount(t, conn, liquidityUSD.ID).Balance)
-	assert.Equal(t, "-9.26", getAccount(t, conn, liquidityEUR.ID).Balance)
-	assert.Equal(t, "9.26", getAccount(t, conn, userEUR.ID).Balance)
+	assert.Equal(t, "-10.00", getAccount(t, conn, userUSD.ID).Balance.String())
+	assert.Equal(t, "10.00", getAccount(t, conn, liquidityUSD.ID).Balance.String())
+	assert.Equal(t, "-9.26", getAccount(t, conn, liquidityEUR.ID).Balance.String())
+	assert.Equal(t, "9.26", getAccount(t, conn, userEUR.ID).Balance.String())
 }
 
 func TestTransfersUseDifferentAccounts(t *testing.T) {
@@ -532,6 +572,11 @@ func TestTransfersUseDifferentAccounts(t *testing.T) {
 
 	_, err := createTransferReturnErr(t.Context(), conn, account1.ID, account1.ID, "10")
 	assert.ErrorContains(t, err, fmt.Sprintf("Cannot transfer to the same account (id=%s)", account1.ID))
+	assert.ErrorIs(t, err, pgledger.ErrSameAccount)
+
+	var ledgerErr *pgledger.LedgerError
+	assert.ErrorAs(t, err, &ledgerErr)
+	assert.Equal(t, account1.ID, ledgerErr.AccountID)
 }
 
 func TestConcurrency(t *testing.T) {
@@ -560,8 +605,8 @@ func TestConcurrency(t *testing.T) {
 	foundAccount1 := getAccount(t, conn, account1.ID)
 	foundAccount2 := getAccount(t, conn, account2.ID)
 
-	assert.Equal(t, "0", foundAccount1.Balance)
-	assert.Equal(t, "0", foundAccount2.Balance)
+	assert.Equal(t, "0", foundAccount1.Balance.String())
+	assert.Equal(t, "0", foundAccount2.Balance.String())
 }
 
 func TestConcurrencyWithCurrencyExchange(t *testing.T) {
@@ -598,10 +643,10 @@ func TestConcurrencyWithCurrencyExchange(t *testing.T) {
 	// Wait for all goroutines to complete
 	wg.Wait()
 
-	assert.Equal(t, "0", getAccount(t, conn, userUSD.ID).Balance)
-	assert.Equal(t, "0", getAccount(t, conn, userEUR.ID).Balance)
-	assert.Equal(t, "0", getAccount(t, conn, liquidityUSD.ID).Balance)
-	assert.Equal(t, "0", getAccount(t, conn, liquidityEUR.ID).Balance)
+	assert.Equal(t, "0", getAccount(t, conn, userUSD.ID).Balance.String())
+	assert.Equal(t, "0", getAccount(t, conn, userEUR.ID).Balance.String())
+	assert.Equal(t, "0", getAccount(t, conn, liquidityUSD.ID).Balance.String())
+	assert.Equal(t, "0", getAccount(t, conn, liquidityEUR.ID).Balance.String())
 }
 
 func TestIdsAreMonotonic(t *testing.T) {
@@ -645,15 +690,20 @@ func TestFindHistoricalBalanceAtGivenTime(t *testing.T) {
 	assert.Len(t, entries, 3)
 
 	// Normally, we would never update the ledger. But here I'm doing it to make testing easier.
-	_, err := conn.Exec(t.Context(), "update pgledger_entries set created_at = $1 where id = $2", "2025-06-01T12:00:00Z", entries[0].ID)
+	tx, err := conn.Begin(t.Context())
+	assert.NoError(t, err)
+	_, err = tx.Exec(t.Context(), "select pgledger_allow_direct_writes('backdate entries for a test')")
+	assert.NoError(t, err)
+	_, err = tx.Exec(t.Context(), "update pgledger_entries set created_at = $1 where id = $2", "2025-06-01T12:00:00Z", entries[0].ID)
 	assert.NoError(t, err)
-	_, err = conn.Exec(t.Context(), "update pgledger_entries set created_at = $1 where id = $2", "2025-06-01T13:00:00Z", entries[1].ID)
+	_, err = tx.Exec(t.Context(), "update pgledger_entries set created_at = $1 where id = $2", "2025-06-01T13:00:00Z", entries[1].ID)
 	assert.NoError(t, err)
-	_, err = conn.Exec(t.Context(), "update pgledger_entries set created_at = $1 where id = $2", "2025-06-01T14:00:00Z", entries[2].ID)
+	_, err = tx.Exec(t.Context(), "update pgledger_entries set created_at = $1 where id = $2", "2025-06-01T14:00:00Z", entries[2].ID)
 	assert.NoError(t, err)
+	assert.NoError(t, tx.Commit(t.Context()))
 
 	// Current balance
-	assert.Equal(t, "80", getAccount(t, conn, account2.ID).Balance)
+	assert.Equal(t, "80", getAccount(t, conn, account2.ID).Balance.String())
 
 	// Historical balances
 	assert.Equal(t, "10", accountBalanceAtTime(t, conn, account2.ID, "2025-06-01T12:00:00Z"))
@@ -665,18 +715,210 @@ func TestFindHistoricalBalanceAtGivenTime(t *testing.T) {
 }
 
 func accountBalanceAtTime(t *testing.T, conn *pgxpool.Pool, accountID string, datetime string) string {
-	rows, err := conn.Query(t.Context(), `
-		select account_current_balance
-		from pgledger_entries
-		where account_id = $1
-		and created_at <= $2
-		order by created_at desc
-		limit 1`,
-		accountID, datetime)
+	at, err := time.Parse(time.RFC3339, datetime)
 	assert.NoError(t, err)
 
-	balance, err := pgx.CollectExactlyOneRow(rows, pgx.RowTo[string])
+	balance, err := pgledger.NewClient(conn).BalanceAt(t.Context(), accountID, at, pgledger.BalanceByCreatedAt)
 	assert.NoError(t, err)
 
-	return balance
+	return balance.String()
+}
+
+func assertDirectWriteRejected(t *testing.T, conn *pgxpool.Pool, sql string, args ...any) {
+	t.Helper()
+
+	_, err := conn.Exec(t.Context(), sql, args...)
+
+	var pgErr *pgconn.PgError
+	if assert.ErrorAs(t, err, &pgErr, sql) {
+		assert.Equal(t, "PGL22", pgErr.Code, sql)
+		assert.Contains(t, pgErr.Message, "outside the pgledger functions", sql)
+	}
+}
+
+func TestDirectWritesToLedgerHistoryAreRejected(t *testing.T) {
+	conn := setupTest(t)
+
+	account1 := createAccount(t, conn, "account 1", "USD")
+	account2 := createAccount(t, conn, "account 2", "USD")
+
+	transfer := createTransfer(t, conn, account1.ID, account2.ID, "10")
+	entries := getEntries(t, conn, account2.ID)
+	assert.Len(t, entries, 1)
+
+	assertDirectWriteRejected(t, conn, "update pgledger_transfers set amount = 20 where id = $1", transfer.ID)
+	assertDirectWriteRejected(t, conn, "delete from pgledger_transfers where id = $1", transfer.ID)
+	assertDirectWriteRejected(t, conn, "update pgledger_entries set amount = 20 where id = $1", entries[0].ID)
+	assertDirectWriteRejected(t, conn, "delete from pgledger_entries where id = $1", entries[0].ID)
+	assertDirectWriteRejected(t, conn, "update pgledger_journals set metadata = '{}' where id = $1", *transfer.JournalID)
+	assertDirectWriteRejected(t, conn, "update pgledger_accounts set balance = 20 where id = $1", account2.ID)
+	assertDirectWriteRejected(t, conn, "update pgledger_accounts set version = 5 where id = $1", account2.ID)
+	assertDirectWriteRejected(t, conn, "update pgledger_accounts set pending_credits = 5 where id = $1", account2.ID)
+	assertDirectWriteRejected(t, conn, "update pgledger_accounts set currency = 'EUR' where id = $1", account2.ID)
+
+	_, err := conn.Exec(t.Context(), "update pgledger_entries set amount = 20 where id = $1", entries[0].ID)
+	assert.ErrorContains(t, err, fmt.Sprintf("Cannot UPDATE pgledger_entries (id=%s) outside the pgledger functions", entries[0].ID))
+
+	// Nothing changed
+	assert.Equal(t, "10", getTransfer(t, conn, transfer.ID).Amount.String())
+	assert.Equal(t, "10", getEntries(t, conn, account2.ID)[0].Amount.String())
+	account := getAccount(t, conn, account2.ID)
+	assert.Equal(t, "10", account.Balance.String())
+	assert.Equal(t, 1, account.Version)
+
+	// Other account columns can still be updated
+	_, err = conn.Exec(t.Context(), "update pgledger_accounts set name = 'renamed' where id = $1", account2.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, "renamed", getAccount(t, conn, account2.ID).Name)
+
+	// And the ledger functions can still change balances and link reversals
+	_ = createTransfer(t, conn, account1.ID, account2.ID, "5")
+	_, err = pgledger.NewClient(conn).ReverseTransfer(t.Context(), transfer.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, "5", getAccount(t, conn, account2.ID).Balance.String())
+}
+
+func TestDirectWritesCantPretendToBeLedgerFunctions(t *testing.T) {
+	conn := setupTest(t)
+
+	account1 := createAccount(t, conn, "account 1", "USD")
+	account2 := createAccount(t, conn, "account 2", "USD")
+	transfer := createTransfer(t, conn, account1.ID, account2.ID, "10")
+
+	writes := []struct {
+		sql string
+		id  string
+	}{
+		{"update pgledger_accounts set balance = 20 where id = $1", account2.ID},
+		{"delete from pgledger_transfers where id = $1", transfer.ID},
+		{"update pgledger_transfers set reverses_transfer_id = id where id = $1", transfer.ID},
+	}
+
+	for _, write := range writes {
+		// Use a transaction, so that nothing is lost if the write isn't rejected
+		tx, err := conn.Begin(t.Context())
+		assert.NoError(t, err)
+
+		// Any session can change a setting, so settings don't exempt anything
+		_, err = tx.Exec(t.Context(), "set local pgledger.ledger_write = on")
+		assert.NoError(t, err)
+
+		_, err = tx.Exec(t.Context(), write.sql, write.id)
+
+		var pgErr *pgconn.PgError
+		if assert.ErrorAs(t, err, &pgErr, write.sql) {
+			assert.Equal(t, "PGL22", pgErr.Code, write.sql)
+		}
+
+		_ = tx.Rollback(t.Context())
+	}
+
+	assert.Equal(t, "10", getAccount(t, conn, account2.ID).Balance.String())
+	assert.Equal(t, "10", getTransfer(t, conn, transfer.ID).Amount.String())
+}
+
+func TestDirectWritesCantUseImpostorLedgerFunctions(t *testing.T) {
+	conn := setupTest(t)
+
+	account1 := createAccount(t, conn, "account 1", "USD")
+	account2 := createAccount(t, conn, "account 2", "USD")
+	_ = createTransfer(t, conn, account1.ID, account2.ID, "10")
+
+	// Use a transaction, so that nothing is lost if the write isn't rejected
+	tx, err := conn.Begin(t.Context())
+	assert.NoError(t, err)
+	defer func() { _ = tx.Rollback(t.Context()) }()
+
+	// Any session can create a temporary function with the same name and
+	// arguments as a pgledger function
+	_, err = tx.Exec(t.Context(), `
+		create function pg_temp.pgledger_apply_transfer(
+			from_account_id text, to_account_id text, amount numeric, transfer_status text,
+			pending_transfer_id text, event_at timestamptz, metadata jsonb, idempotency_key text,
+			journal_id text, reverses_transfer_id text default null
+		) returns text as $$
+		begin
+			update pgledger_accounts a
+			set balance = a.balance + amount, version = a.version + 1
+			where a.id = to_account_id;
+
+			return null;
+		end;
+		$$ language plpgsql`)
+	assert.NoError(t, err)
+
+	_, err = tx.Exec(t.Context(),
+		"select pg_temp.pgledger_apply_transfer($1, $2, 100, 'posted', null, now(), null, null, null)",
+		account1.ID, account2.ID)
+
+	var pgErr *pgconn.PgError
+	if assert.ErrorAs(t, err, &pgErr) {
+		assert.Equal(t, "PGL22", pgErr.Code)
+	}
+
+	_ = tx.Rollback(t.Context())
+
+	account := getAccount(t, conn, account2.ID)
+	assert.Equal(t, "10", account.Balance.String())
+	assert.Equal(t, 1, account.Version)
+}
+
+func TestTruncateLedgerHistoryIsRejected(t *testing.T) {
+	conn := setupTest(t)
+
+	// Use a transaction, so that nothing is lost if the truncate isn't rejected
+	tx, err := conn.Begin(t.Context())
+	assert.NoError(t, err)
+	defer func() { _ = tx.Rollback(t.Context()) }()
+
+	_, err = tx.Exec(t.Context(), "truncate pgledger_entries")
+	assert.ErrorContains(t, err, "Cannot TRUNCATE pgledger_entries outside the pgledger functions")
+}
+
+func TestAllowDirectWrites(t *testing.T) {
+	conn := setupTest(t)
+
+	account1 := createAccount(t, conn, "account 1", "USD")
+	account2 := createAccount(t, conn, "account 2", "USD")
+	transfer := createTransfer(t, conn, account1.ID, account2.ID, "10")
+
+	_, err := conn.Exec(t.Context(), "select pgledger_allow_direct_writes('  ')")
+	assert.ErrorContains(t, err, "A reason is required to allow direct writes")
+
+	tx, err := conn.Begin(t.Context())
+	assert.NoError(t, err)
+	defer func() { _ = tx.Rollback(t.Context()) }()
+
+	reason := fmt.Sprintf("fix metadata %d", time.Now().UnixNano())
+	_, err = tx.Exec(t.Context(), "select pgledger_allow_direct_writes($1)", reason)
+	assert.NoError(t, err)
+
+	_, err = tx.Exec(t.Context(), `update pgledger_transfers set metadata = '{"fixed": true}' where id = $1`, transfer.ID)
+	assert.NoError(t, err)
+
+	type directWrite struct {
+		TableName string
+		Operation string
+		RowID     string
+		OldRow    map[string]any
+		NewRow    map[string]any
+		Username  string
+	}
+
+	rows, err := tx.Query(t.Context(), "select table_name, operation, row_id, old_row, new_row, username from pgledger_direct_writes where reason = $1", reason)
+	assert.NoError(t, err)
+	writes, err := pgx.CollectRows(rows, pgx.RowToStructByName[directWrite])
+	assert.NoError(t, err)
+
+	assert.Len(t, writes, 1)
+	assert.Equal(t, "pgledger_transfers", writes[0].TableName)
+	assert.Equal(t, "UPDATE", writes[0].Operation)
+	assert.Equal(t, transfer.ID, writes[0].RowID)
+	assert.Nil(t, writes[0].OldRow["metadata"])
+	assert.Equal(t, map[string]any{"fixed": true}, writes[0].NewRow["metadata"])
+	assert.Equal(t, "pgledger", writes[0].Username)
+
+	// The log can't be changed either, without another exception
+	assert.NoError(t, tx.Commit(t.Context()))
+	assertDirectWriteRejected(t, conn, "delete from pgledger_direct_writes where reason = $1", reason)
 }
@@ -0,0 +1,91 @@
+package test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pgr0ss/pgledger"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestListEntriesByEventAt(t *testing.T) {
+	conn := setupTest(t)
+	client := pgledger.NewClient(conn)
+
+	bank := createAccount(t, conn, "bank", "USD")
+	cash := createAccount(t, conn, "cash", "USD")
+
+	june1 := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+	june2 := june1.AddDate(0, 0, 1)
+	june3 := june1.AddDate(0, 0, 2)
+
+	createAt := func(from, to, amount string, eventAt time.Time) *pgledger.Transfer {
+		transfer, err := client.CreateTransfer(t.Context(), from, to, pgledger.MustParseAmount(amount), pgledger.WithEventAt(eventAt))
+		assert.NoError(t, err)
+		return transfer
+	}
+
+	first := createAt(bank.ID, cash.ID, "100", june1)
+	third := createAt(cash.ID, bank.ID, "30", june3)
+	// Recorded late, after the June 3rd transfer
+	second := createAt(bank.ID, cash.ID, "20", june2)
+
+	// Pending transfers are left out
+	_ = createPendingTransfer(t, client, bank.ID, cash.ID, "1000")
+
+	entries, err := client.ListEntriesByEventAt(t.Context(), cash.ID, time.Time{}, time.Time{})
+	assert.NoError(t, err)
+	assert.Len(t, entries, 3)
+
+	assert.Equal(t, first.ID, entries[0].TransferID)
+	assert.Equal(t, "0", entries[0].AccountPreviousBalance.String())
+	assert.Equal(t, "100", entries[0].AccountCurrentBalance.String())
+
+	assert.Equal(t, second.ID, entries[1].TransferID)
+	assert.Equal(t, "100", entries[1].AccountPreviousBalance.String())
+	assert.Equal(t, "120", entries[1].AccountCurrentBalance.String())
+	assert.Equal(t, june2, entries[1].EventAt.UTC())
+
+	assert.Equal(t, third.ID, entries[2].TransferID)
+	assert.Equal(t, "120", entries[2].AccountPreviousBalance.String())
+	assert.Equal(t, "90", entries[2].AccountCurrentBalance.String())
+
+	// In created_at order, the late transfer comes last
+	created := getEntries(t, conn, cash.ID)
+	assert.Equal(t, second.ID, created[2].TransferID)
+	assert.Equal(t, "70", created[2].AccountPreviousBalance.String())
+
+	// A period still has the balances from the start of the account's history
+	entries, err = client.ListEntriesByEventAt(t.Context(), cash.ID, june2, june3)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 1)
+	assert.Equal(t, second.ID, entries[0].TransferID)
+	assert.Equal(t, "100", entries[0].AccountPreviousBalance.String())
+	assert.Equal(t, "120", entries[0].AccountCurrentBalance.String())
+}
+
+func TestListEntriesByEventAtUsesIDAsTiebreaker(t *testing.T) {
+	conn := setupTest(t)
+	client := pgledger.NewClient(conn)
+
+	account1 := createAccount(t, conn, "account 1", "USD")
+	account2 := createAccount(t, conn, "account 2", "USD")
+
+	eventAt := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	transfers, err := client.CreateTransfers(t.Context(), []pgledger.TransferRequest{
+		{FromAccountID: account1.ID, ToAccountID: account2.ID, Amount: pgledger.MustParseAmount("1")},
+		{FromAccountID: account1.ID, ToAccountID: account2.ID, Amount: pgledger.MustParseAmount("2")},
+		{FromAccountID: account1.ID, ToAccountID: account2.ID, Amount: pgledger.MustParseAmount("3")},
+	}, pgledger.WithEventAt(eventAt))
+	assert.NoError(t, err)
+
+	entries, err := client.ListEntriesByEventAt(t.Context(), account2.ID, eventAt, eventAt.Add(time.Second))
+	assert.NoError(t, err)
+	assert.Len(t, entries, 3)
+
+	for i, entry := range entries {
+		assert.Equal(t, transfers[i].ID, entry.TransferID)
+		assert.Equal(t, transfers[i].ToAccountBalance.String(), entry.AccountCurrentBalance.String())
+	}
+}
@@ -0,0 +1,174 @@
+package test
+
+import (
+	"testing"
+
+	"github.com/pgr0ss/pgledger"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCreateExchange(t *testing.T) {
+	conn := setupTest(t)
+	client := pgledger.NewClient(conn)
+
+	userUSD := createAccount(t, conn, "user.USD", "USD")
+	userEUR := createAccount(t, conn, "user.EUR", "EUR")
+	liquidityUSD := createAccount(t, conn, "liquidity.USD", "USD")
+	liquidityEUR := createAccount(t, conn, "liquidity.EUR", "EUR")
+
+	exchange, err := client.CreateExchange(t.Context(), pgledger.ExchangeRequest{
+		FromAccountID:          userUSD.ID,
+		ToAccountID:            userEUR.ID,
+		FromAmount:             pgledger.MustParseAmount("10.00"),
+		ToAmount:               pgledger.MustParseAmount("9.26"),
+		FromLiquidityAccountID: liquidityUSD.ID,
+		ToLiquidityAccountID:   liquidityEUR.ID,
+	}, pgledger.WithMetadata(`{"quote_id": "q_123"}`))
+	assert.NoError(t, err)
+
+	assert.Regexp(t, "^pglx_\\w+$", exchange.ID)
+	assert.Equal(t, "USD", exchange.FromCurrency)
+	assert.Equal(t, "EUR", exchange.ToCurrency)
+	assert.Equal(t, "10.00", exchange.FromAmount.String())
+	assert.Equal(t, "9.26", exchange.ToAmount.String())
+	assert.True(t, exchange.Rate.Equal(pgledger.MustParseAmount("0.926")))
+
+	journal, err := client.GetJournal(t.Context(), exchange.JournalID)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"quote_id": "q_123"}`, *journal.Metadata)
+	assert.Len(t, journal.Transfers, 2)
+
+	fromTransfer := getTransfer(t, conn, exchange.FromTransferID)
+	assert.Equal(t, exchange.JournalID, *fromTransfer.JournalID)
+	assert.Equal(t, userUSD.ID, fromTransfer.FromAccountID)
+	assert.Equal(t, liquidityUSD.ID, fromTransfer.ToAccountID)
+
+	toTransfer := getTransfer(t, conn, exchange.ToTransferID)
+	assert.Equal(t, exchange.JournalID, *toTransfer.JournalID)
+	assert.Equal(t, liquidityEUR.ID, toTransfer.FromAccountID)
+	assert.Equal(t, userEUR.ID, toTransfer.ToAccountID)
+
+	assert.Equal(t, "-10.00", getAccount(t, conn, userUSD.ID).Balance.String())
+	assert.Equal(t, "10.00", getAccount(t, conn, liquidityUSD.ID).Balance.String())
+	assert.Equal(t, "-9.26", getAccount(t, conn, liquidityEUR.ID).Balance.String())
+	assert.Equal(t, "9.26", getAccount(t, conn, userEUR.ID).Balance.String())
+}
+
+func TestCreateExchangeInBothDirections(t *testing.T) {
+	conn := setupTest(t)
+	client := pgledger.NewClient(conn)
+
+	userUSD := createAccount(t, conn, "user.USD", "USD")
+	userEUR := createAccount(t, conn, "user.EUR", "EUR")
+	liquidityUSD := createAccount(t, conn, "liquidity.USD", "USD")
+	liquidityEUR := createAccount(t, conn, "liquidity.EUR", "EUR")
+
+	// The two transfers of an exchange are created within microseconds of each
+	// other, and their IDs aren't always in the same order as the legs, so
+	// create enough exchanges for both orders to show up
+	for range 20 {
+		exchange, err := client.CreateExchange(t.Context(), pgledger.ExchangeRequest{
+			FromAccountID:          userUSD.ID,
+			ToAccountID:            userEUR.ID,
+			FromAmount:             pgledger.MustParseAmount("10.00"),
+			ToAmount:               pgledger.MustParseAmount("8.00"),
+			FromLiquidityAccountID: liquidityUSD.ID,
+			ToLiquidityAccountID:   liquidityEUR.ID,
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, "USD", exchange.FromCurrency)
+		assert.Equal(t, "EUR", exchange.ToCurrency)
+		assert.True(t, exchange.Rate.Equal(pgledger.MustParseAmount("0.8")), exchange.Rate.String())
+		assert.Equal(t, userUSD.ID, getTransfer(t, conn, exchange.FromTransferID).FromAccountID)
+		assert.Equal(t, userEUR.ID, getTransfer(t, conn, exchange.ToTransferID).ToAccountID)
+
+		exchange, err = client.CreateExchange(t.Context(), pgledger.ExchangeRequest{
+			FromAccountID:          userEUR.ID,
+			ToAccountID:            userUSD.ID,
+			FromAmount:             pgledger.MustParseAmount("8.00"),
+			ToAmount:               pgledger.MustParseAmount("10.00"),
+			FromLiquidityAccountID: liquidityEUR.ID,
+			ToLiquidityAccountID:   liquidityUSD.ID,
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, "EUR", exchange.FromCurrency)
+		assert.Equal(t, "USD", exchange.ToCurrency)
+		assert.True(t, exchange.Rate.Equal(pgledger.MustParseAmount("1.25")), exchange.Rate.String())
+		assert.Equal(t, userEUR.ID, getTransfer(t, conn, exchange.FromTransferID).FromAccountID)
+		assert.Equal(t, userUSD.ID, getTransfer(t, conn, exchange.ToTransferID).ToAccountID)
+	}
+
+	assert.True(t, getAccount(t, conn, userUSD.ID).Balance.IsZero())
+	assert.True(t, getAccount(t, conn, userEUR.ID).Balance.IsZero())
+}
+
+func TestCreateExchangeIdempotencyKey(t *testing.T) {
+	conn := setupTest(t)
+	client := pgledger.NewClient(conn)
+
+	userUSD := createAccount(t, conn, "user.USD", "USD")
+	userEUR := createAccount(t, conn, "user.EUR", "EUR")
+	liquidityUSD := createAccount(t, conn, "liquidity.USD", "USD")
+	liquidityEUR := createAccount(t, conn, "liquidity.EUR", "EUR")
+
+	request := pgledger.ExchangeRequest{
+		FromAccountID:          userUSD.ID,
+		ToAccountID:            userEUR.ID,
+		FromAmount:             pgledger.MustParseAmount("10.00"),
+		ToAmount:               pgledger.MustParseAmount("9.26"),
+		FromLiquidityAccountID: liquidityUSD.ID,
+		ToLiquidityAccountID:   liquidityEUR.ID,
+	}
+	key := pgledger.WithIdempotencyKey("exchange_" + userUSD.ID)
+
+	exchange, err := client.CreateExchange(t.Context(), request, key)
+	assert.NoError(t, err)
+
+	retried, err := client.CreateExchange(t.Context(), request, key)
+	assert.NoError(t, err)
+	assert.Equal(t, exchange, retried)
+
+	assert.Equal(t, "-10.00", getAccount(t, conn, userUSD.ID).Balance.String())
+}
+
+func TestCreateExchangeValidatesCurrencies(t *testing.T) {
+	conn := setupTest(t)
+	client := pgledger.NewClient(conn)
+
+	userUSD := createAccount(t, conn, "user.USD", "USD")
+	userEUR := createAccount(t, conn, "user.EUR", "EUR")
+	otherUSD := createAccount(t, conn, "other.USD", "USD")
+	liquidityUSD := createAccount(t, conn, "liquidity.USD", "USD")
+	liquidityEUR := createAccount(t, conn, "liquidity.EUR", "EUR")
+
+	// The liquidity accounts are swapped
+	_, err := client.CreateExchange(t.Context(), pgledger.ExchangeRequest{
+		FromAccountID:          userUSD.ID,
+		ToAccountID:            userEUR.ID,
+		FromAmount:             pgledger.MustParseAmount("10.00"),
+		ToAmount:               pgledger.MustParseAmount("9.26"),
+		FromLiquidityAccountID: liquidityEUR.ID,
+		ToLiquidityAccountID:   liquidityUSD.ID,
+	})
+	assert.ErrorIs(t, err, pgledger.ErrCurrencyMismatch)
+
+	_, err = client.CreateExchange(t.Context(), pgledger.ExchangeRequest{
+		FromAccountID:          userUSD.ID,
+		ToAccountID:            otherUSD.ID,
+		FromAmount:             pgledger.MustParseAmount("10.00"),
+		ToAmount:               pgledger.MustParseAmount("10.00"),
+		FromLiquidityAccountID: liquidityUSD.ID,
+		ToLiquidityAccountID:   liquidityUSD.ID,
+	})
+	assert.ErrorIs(t, err, pgledger.ErrSameCurrencyExchange)
+
+	var ledgerErr *pgledger.LedgerError
+	if assert.ErrorAs(t, err, &ledgerErr) {
+		assert.Equal(t, "PGL21", ledgerErr.Code)
+		assert.Equal(t, "USD", ledgerErr.Currency)
+	}
+
+	// Nothing was created
+	assert.Equal(t, "0", getAccount(t, conn, userUSD.ID).Balance.String())
+	assert.Equal(t, "0", getAccount(t, conn, liquidityUSD.ID).Balance.String())
+}
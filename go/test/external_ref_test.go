@@ -0,0 +1,105 @@
+package test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/pgr0ss/pgledger"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCreateAccountWithExternalRef(t *testing.T) {
+	conn := setupTest(t)
+	client := pgledger.NewClient(conn)
+
+	ref := fmt.Sprintf("cus_%d", time.Now().UnixNano())
+
+	account := createAccount(t, conn, "account 1", "USD", pgledger.WithExternalRef(ref))
+	assert.Equal(t, ref, *account.ExternalRef)
+
+	found, err := client.GetAccountByExternalRef(t.Context(), ref)
+	assert.NoError(t, err)
+	assert.Equal(t, account.ID, found.ID)
+
+	noRef := createAccount(t, conn, "account 2", "USD")
+	assert.Nil(t, noRef.ExternalRef)
+}
+
+func TestExternalRefMustBeUnique(t *testing.T) {
+	conn := setupTest(t)
+	client := pgledger.NewClient(conn)
+
+	ref := fmt.Sprintf("cus_%d", time.Now().UnixNano())
+
+	_ = createAccount(t, conn, "account 1", "USD", pgledger.WithExternalRef(ref))
+
+	_, err := client.CreateAccount(t.Context(), "account 2", "USD", pgledger.WithExternalRef(ref))
+	var pgErr *pgconn.PgError
+	assert.ErrorAs(t, err, &pgErr)
+	assert.Equal(t, "23505", pgErr.Code)
+}
+
+func TestExternalRefCannotLookLikeAnAccountID(t *testing.T) {
+	conn := setupTest(t)
+	client := pgledger.NewClient(conn)
+
+	_, err := client.CreateAccount(t.Context(), "account 1", "USD", pgledger.WithExternalRef("pgla_123"))
+	var pgErr *pgconn.PgError
+	assert.ErrorAs(t, err, &pgErr)
+	assert.Equal(t, "23514", pgErr.Code)
+}
+
+func TestCreateTransferWithExternalRefs(t *testing.T) {
+	conn := setupTest(t)
+
+	suffix := time.Now().UnixNano()
+	fromRef := fmt.Sprintf("bank_%d", suffix)
+	toRef := fmt.Sprintf("cus_%d", suffix)
+
+	account1 := createAccount(t, conn, "account 1", "USD", pgledger.WithExternalRef(fromRef))
+	account2 := createAccount(t, conn, "account 2", "USD", pgledger.WithExternalRef(toRef))
+
+	transfer := createTransfer(t, conn, fromRef, toRef, "12.34")
+	assert.Equal(t, account1.ID, transfer.FromAccountID)
+	assert.Equal(t, account2.ID, transfer.ToAccountID)
+
+	assert.Equal(t, "-12.34", getAccount(t, conn, account1.ID).Balance.String())
+	assert.Equal(t, "12.34", getAccount(t, conn, account2.ID).Balance.String())
+}
+
+func TestCreateTransfersWithMixedIDsAndExternalRefs(t *testing.T) {
+	conn := setupTest(t)
+	client := pgledger.NewClient(conn)
+
+	ref := fmt.Sprintf("cus_%d", time.Now().UnixNano())
+
+	account1 := createAccount(t, conn, "account 1", "USD")
+	account2 := createAccount(t, conn, "account 2", "USD", pgledger.WithExternalRef(ref))
+	account3 := createAccount(t, conn, "account 3", "USD")
+
+	transfers, err := client.CreateTransfers(t.Context(), []pgledger.TransferRequest{
+		{FromAccountID: account1.ID, ToAccountID: ref, Amount: pgledger.MustParseAmount("10")},
+		{FromAccountID: ref, ToAccountID: account3.ID, Amount: pgledger.MustParseAmount("4")},
+	})
+	assert.NoError(t, err)
+	assert.Len(t, transfers, 2)
+
+	assert.Equal(t, account2.ID, transfers[0].ToAccountID)
+	assert.Equal(t, account2.ID, transfers[1].FromAccountID)
+
+	updated := getAccount(t, conn, account2.ID)
+	assert.Equal(t, "6", updated.Balance.String())
+	assert.Equal(t, 2, updated.Version)
+}
+
+func TestCreateTransferWithUnknownExternalRef(t *testing.T) {
+	conn := setupTest(t)
+
+	account1 := createAccount(t, conn, "account 1", "USD")
+
+	_, err := createTransferReturnErr(t.Context(), conn, account1.ID, "cus_does_not_exist", "1")
+	assert.ErrorIs(t, err, pgledger.ErrAccountNotFound)
+	assert.ErrorContains(t, err, "Account (id=cus_does_not_exist) does not exist")
+}
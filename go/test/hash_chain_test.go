@@ -0,0 +1,82 @@
+package test
+
+import (
+	"testing"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/pgr0ss/pgledger"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEntriesHaveHashChain(t *testing.T) {
+	conn := setupTest(t)
+	client := pgledger.NewClient(conn)
+
+	account1 := createAccount(t, conn, "account 1", "USD")
+	account2 := createAccount(t, conn, "account 2", "USD")
+
+	_ = createTransfer(t, conn, account1.ID, account2.ID, "10.00")
+	_ = createTransfer(t, conn, account2.ID, account1.ID, "2.5")
+	pending := createPendingTransfer(t, client, account1.ID, account2.ID, "3.00")
+	_, err := client.PostPendingTransfer(t.Context(), pending.ID)
+	assert.NoError(t, err)
+
+	for _, accountID := range []string{account1.ID, account2.ID} {
+		problems, err := client.VerifyHashChain(t.Context(), accountID)
+		assert.NoError(t, err)
+		assert.Empty(t, problems)
+
+		entries := getEntries(t, conn, accountID)
+		assert.Len(t, entries, 5)
+		for _, entry := range entries {
+			assert.Len(t, entry.Hash, 64)
+		}
+
+		// The Go verifier computes the same hashes as the database
+		assert.Empty(t, pgledger.VerifyHashChains(entries))
+	}
+}
+
+func TestVerifyHashChainFindsTampering(t *testing.T) {
+	conn := setupTest(t)
+
+	account1 := createAccount(t, conn, "account 1", "USD")
+	account2 := createAccount(t, conn, "account 2", "USD")
+
+	_ = createTransfer(t, conn, account1.ID, account2.ID, "10.00")
+	_ = createTransfer(t, conn, account1.ID, account2.ID, "20.00")
+	_ = createTransfer(t, conn, account1.ID, account2.ID, "30.00")
+
+	entries := getEntries(t, conn, account2.ID)
+	assert.Len(t, entries, 3)
+
+	// Tamper with the entries in a transaction which is rolled back, so that
+	// it doesn't affect other tests
+	tx, err := conn.Begin(t.Context())
+	assert.NoError(t, err)
+	defer func() { _ = tx.Rollback(t.Context()) }()
+
+	_, err = tx.Exec(t.Context(), "SELECT pgledger_allow_direct_writes('test')")
+	assert.NoError(t, err)
+
+	_, err = tx.Exec(t.Context(), "UPDATE pgledger_entries SET amount = 15.00 WHERE id = $1", entries[0].ID)
+	assert.NoError(t, err)
+
+	_, err = tx.Exec(t.Context(), "DELETE FROM pgledger_entries WHERE id = $1", entries[1].ID)
+	assert.NoError(t, err)
+
+	rows, err := tx.Query(t.Context(), "select * from pgledger_verify_hash_chain($1)", account2.ID)
+	assert.NoError(t, err)
+	problems, err := pgx.CollectRows(rows, pgx.RowToStructByName[pgledger.HashChainProblem])
+	assert.NoError(t, err)
+
+	assert.Len(t, problems, 2)
+	assert.Equal(t, entries[0].ID, problems[0].EntryID)
+	assert.Equal(t, 1, problems[0].AccountVersion)
+	assert.Equal(t, entries[0].Hash, problems[0].Hash)
+	assert.NotEqual(t, entries[0].Hash, problems[0].ExpectedHash)
+
+	// The entry after the deleted one no longer chains to the entry before it
+	assert.Equal(t, entries[2].ID, problems[1].EntryID)
+	assert.Equal(t, 3, problems[1].AccountVersion)
+}
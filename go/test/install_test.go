@@ -0,0 +1,165 @@
+package test
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/pgr0ss/pgledger"
+	"github.com/stretchr/testify/assert"
+)
+
+// Create a brand new database, so we start from scratch without touching the
+// database the other tests use. A schema isn't enough, because extensions
+// (such as ltree) are installed once per database.
+func emptyDatabaseConfig(t *testing.T) *pgx.ConnConfig {
+	database := fmt.Sprintf("install_test_%d", time.Now().UnixNano())
+
+	admin := dbconn(t)
+	_, err := admin.Exec(t.Context(), "create database "+database)
+	assert.NoError(t, err)
+	t.Cleanup(func() {
+		_, _ = admin.Exec(context.Background(), "drop database "+database+" with (force)")
+	})
+
+	config, err := pgx.ParseConfig(databaseURL)
+	assert.NoError(t, err)
+	config.Database = database
+
+	return config
+}
+
+func connect(t *testing.T, config *pgx.ConnConfig) *pgx.Conn {
+	conn, err := pgx.ConnectConfig(t.Context(), config)
+	assert.NoError(t, err)
+	t.Cleanup(func() { _ = conn.Close(context.Background()) })
+
+	return conn
+}
+
+func appliedMigrations(t *testing.T, conn *pgx.Conn) []int {
+	rows, err := conn.Query(t.Context(), "select version from pgledger_schema_migrations order by version")
+	assert.NoError(t, err)
+
+	versions, err := pgx.CollectRows(rows, pgx.RowTo[int])
+	assert.NoError(t, err)
+
+	return versions
+}
+
+func assertAllMigrationsApplied(t *testing.T, versions []int) {
+	assert.NotEmpty(t, versions)
+	for i, version := range versions {
+		assert.Equal(t, i+1, version)
+	}
+}
+
+func TestInstallIntoEmptySchema(t *testing.T) {
+	t.Parallel()
+
+	conn := connect(t, emptyDatabaseConfig(t))
+
+	assert.NoError(t, pgledger.Install(t.Context(), conn))
+
+	versions := appliedMigrations(t, conn)
+	assertAllMigrationsApplied(t, versions)
+
+	account := queryOneConn[pgledger.Account](t, conn, "select * from pgledger_create_account('account 1', 'USD')")
+	assert.Regexp(t, "^pgla_\\w+$", account.ID)
+
+	// Installing again is a no-op
+	assert.NoError(t, pgledger.Install(t.Context(), conn))
+	assert.Equal(t, versions, appliedMigrations(t, conn))
+
+	var count int
+	err := conn.QueryRow(t.Context(), "select count(*) from pgledger_accounts").Scan(&count)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+}
+
+func TestInstallConcurrently(t *testing.T) {
+	t.Parallel()
+
+	config := emptyDatabaseConfig(t)
+
+	var wg sync.WaitGroup
+	for range 3 {
+		conn := connect(t, config)
+		wg.Go(func() {
+			assert.NoError(t, pgledger.Install(t.Context(), conn))
+		})
+	}
+	wg.Wait()
+
+	assertAllMigrationsApplied(t, appliedMigrations(t, connect(t, config)))
+}
+
+// execFiles runs each SQL file against the database, the way psql -f would.
+func execFiles(t *testing.T, conn *pgx.Conn, files ...string) {
+	for _, file := range files {
+		sql, err := os.ReadFile(file)
+		assert.NoError(t, err)
+		_, err = conn.Exec(t.Context(), string(sql))
+		assert.NoError(t, err)
+	}
+}
+
+func TestInstallUpgradesDatabaseFromBeforeMigrations(t *testing.T) {
+	t.Parallel()
+
+	conn := connect(t, emptyDatabaseConfig(t))
+
+	// testdata/pgledger_before_migrations.sql is the pgledger.sql from before
+	// there were migrations or error codes, exactly as it was loaded with psql
+	execFiles(t, conn,
+		"../../vendor/scoville-pgsql-ulid/ulid-to-uuid.sql",
+		"../../vendor/scoville-pgsql-ulid/uuid-to-ulid.sql",
+		"testdata/pgledger_before_migrations.sql",
+	)
+
+	// The old functions return fewer columns than pgledger.Account has
+	var account1ID, account2ID string
+	assert.NoError(t, conn.QueryRow(t.Context(), "select id from pgledger_create_account('account 1', 'USD')").Scan(&account1ID))
+	assert.NoError(t, conn.QueryRow(t.Context(), "select id from pgledger_create_account('account 2', 'USD', allow_negative_balance => false)").Scan(&account2ID))
+	_, err := conn.Exec(t.Context(), "select pgledger_create_transfer($1, $2, 12.34)", account1ID, account2ID)
+	assert.NoError(t, err)
+
+	assert.NoError(t, pgledger.Install(t.Context(), conn))
+
+	assertAllMigrationsApplied(t, appliedMigrations(t, conn))
+
+	// Existing money is still there
+	account2 := queryOneConn[pgledger.Account](t, conn, "select * from pgledger_accounts_view where id = $1", account2ID)
+	assert.Equal(t, "12.34", account2.Balance.String())
+
+	// The old functions raised plain exceptions, and the upgraded ones raise
+	// the error codes
+	for code, args := range map[string][]any{
+		"PGL01": {account2ID, account1ID, "100"},
+		"PGL04": {account1ID, account2ID, "-1"},
+		"PGL05": {account1ID, account1ID, "1"},
+		"PGL06": {"pgla_missing", account1ID, "1"},
+	} {
+		_, err := conn.Exec(t.Context(), "select pgledger_create_transfer($1, $2, $3::numeric)", args...)
+
+		var pgErr *pgconn.PgError
+		if assert.ErrorAs(t, err, &pgErr) {
+			assert.Equal(t, code, pgErr.Code)
+		}
+	}
+}
+
+func queryOneConn[T any](t *testing.T, conn *pgx.Conn, sql string, args ...any) *T {
+	rows, err := conn.Query(t.Context(), sql, args...)
+	assert.NoError(t, err)
+
+	result, err := pgx.CollectExactlyOneRow(rows, pgx.RowToAddrOfStructByName[T])
+	assert.NoError(t, err)
+
+	return result
+}
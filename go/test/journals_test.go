@@ -0,0 +1,105 @@
+package test
+
+import (
+	"testing"
+
+	"github.com/pgr0ss/pgledger"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCreateTransfersCreatesJournal(t *testing.T) {
+	conn := setupTest(t)
+	client := pgledger.NewClient(conn)
+
+	userUSD := createAccount(t, conn, "user.USD", "USD")
+	userEUR := createAccount(t, conn, "user.EUR", "EUR")
+	liquidityUSD := createAccount(t, conn, "liquidity.USD", "USD")
+	liquidityEUR := createAccount(t, conn, "liquidity.EUR", "EUR")
+
+	transfers, err := client.CreateTransfers(t.Context(), []pgledger.TransferRequest{
+		{FromAccountID: userUSD.ID, ToAccountID: liquidityUSD.ID, Amount: pgledger.MustParseAmount("10.00")},
+		{FromAccountID: liquidityEUR.ID, ToAccountID: userEUR.ID, Amount: pgledger.MustParseAmount("9.26")},
+	}, pgledger.WithMetadata(`{"kind": "exchange"}`))
+	assert.NoError(t, err)
+	assert.Len(t, transfers, 2)
+
+	journalID := *transfers[0].JournalID
+	assert.Regexp(t, "^pglj_\\w+$", journalID)
+	assert.Equal(t, journalID, *transfers[1].JournalID)
+
+	journal, err := client.GetJournal(t.Context(), journalID)
+	assert.NoError(t, err)
+	assert.Equal(t, journalID, journal.ID)
+	assert.Equal(t, `{"kind": "exchange"}`, *journal.Metadata)
+	assert.Equal(t, transfers[0].CreatedAt, journal.CreatedAt)
+	assert.Equal(t, transfers, journal.Transfers)
+
+	// Each call gets its own journal
+	other := createTransfer(t, conn, userUSD.ID, liquidityUSD.ID, "1.00")
+	assert.NotEqual(t, journalID, *other.JournalID)
+
+	journal, err = client.GetJournal(t.Context(), *other.JournalID)
+	assert.NoError(t, err)
+	assert.Nil(t, journal.Metadata)
+	assert.Equal(t, []pgledger.Transfer{*other}, journal.Transfers)
+}
+
+func TestIdempotentRetryReturnsOriginalJournal(t *testing.T) {
+	conn := setupTest(t)
+	client := pgledger.NewClient(conn)
+
+	account1 := createAccount(t, conn, "account 1", "USD")
+	account2 := createAccount(t, conn, "account 2", "USD")
+	key := "journal_" + account1.ID
+
+	transfer, err := client.CreateTransfer(t.Context(), account1.ID, account2.ID, pgledger.MustParseAmount("5"),
+		pgledger.WithIdempotencyKey(key))
+	assert.NoError(t, err)
+
+	retried, err := client.CreateTransfer(t.Context(), account1.ID, account2.ID, pgledger.MustParseAmount("5"),
+		pgledger.WithIdempotencyKey(key))
+	assert.NoError(t, err)
+	assert.Equal(t, *transfer.JournalID, *retried.JournalID)
+}
+
+func TestPostPendingTransferCreatesJournal(t *testing.T) {
+	conn := setupTest(t)
+	client := pgledger.NewClient(conn)
+
+	account1 := createAccount(t, conn, "account 1", "USD")
+	account2 := createAccount(t, conn, "account 2", "USD")
+
+	pending := createPendingTransfer(t, client, account1.ID, account2.ID, "10")
+
+	posted, err := client.PostPendingTransfer(t.Context(), pending.ID, pgledger.WithPostAmount(pgledger.MustParseAmount("8")))
+	assert.NoError(t, err)
+	assert.NotEqual(t, *pending.JournalID, *posted.JournalID)
+
+	// The journal has both the release of the pending amount and the posted
+	// transfer
+	journal, err := client.GetJournal(t.Context(), *posted.JournalID)
+	assert.NoError(t, err)
+	assert.Len(t, journal.Transfers, 2)
+	assert.Equal(t, pgledger.TransferStatusReleased, journal.Transfers[0].Status)
+	assert.Equal(t, "10", journal.Transfers[0].Amount.String())
+	assert.Equal(t, *posted, journal.Transfers[1])
+}
+
+func TestReverseTransferCreatesJournal(t *testing.T) {
+	conn := setupTest(t)
+	client := pgledger.NewClient(conn)
+
+	account1 := createAccount(t, conn, "account 1", "USD")
+	account2 := createAccount(t, conn, "account 2", "USD")
+
+	transfer := createTransfer(t, conn, account1.ID, account2.ID, "10")
+
+	reversal, err := client.ReverseTransfer(t.Context(), transfer.ID, pgledger.WithMetadata(`{"reason": "refund"}`))
+	assert.NoError(t, err)
+	assert.NotEqual(t, *transfer.JournalID, *reversal.JournalID)
+
+	journal, err := client.GetJournal(t.Context(), *reversal.JournalID)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"reason": "refund"}`, *journal.Metadata)
+	assert.Equal(t, []pgledger.Transfer{*reversal}, journal.Transfers)
+}
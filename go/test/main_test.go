@@ -0,0 +1,32 @@
+package test
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/pgr0ss/pgledger"
+)
+
+// Install the ledger before running any tests, so they work against an empty
+// database. This is a no-op if it's already installed.
+func TestMain(m *testing.M) {
+	ctx := context.Background()
+
+	conn, err := pgx.Connect(ctx, databaseURL)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error connecting to database: %v\n", err)
+		os.Exit(1)
+	}
+
+	err = pgledger.Install(ctx, conn)
+	_ = conn.Close(ctx)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error installing pgledger: %v\n", err)
+		os.Exit(1)
+	}
+
+	os.Exit(m.Run())
+}
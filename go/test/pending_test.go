@@ -0,0 +1,256 @@
+package test
+
+import (
+	"testing"
+
+	"github.com/pgr0ss/pgledger"
+	"github.com/stretchr/testify/assert"
+)
+
+func createPendingTransfer(t *testing.T, client *pgledger.Client, fromAccountID, toAccountID, amount string) *pgledger.Transfer {
+	transfer, err := client.CreateTransfer(t.Context(), fromAccountID, toAccountID, pgledger.MustParseAmount(amount),
+		pgledger.WithPending(true))
+	assert.NoError(t, err)
+
+	return transfer
+}
+
+func TestCreatePendingTransfer(t *testing.T) {
+	conn := setupTest(t)
+	client := pgledger.NewClient(conn)
+
+	account1 := createAccount(t, conn, "account 1", "USD")
+	account2 := createAccount(t, conn, "account 2", "USD")
+
+	transfer := createPendingTransfer(t, client, account1.ID, account2.ID, "12.34")
+	assert.Equal(t, pgledger.TransferStatusPending, transfer.Status)
+	assert.Nil(t, transfer.PendingTransferID)
+
+	account1 = getAccount(t, conn, account1.ID)
+	assert.Equal(t, "0", account1.Balance.String())
+	assert.Equal(t, "12.34", account1.PendingDebits.String())
+	assert.Equal(t, "0", account1.PendingCredits.String())
+	assert.Equal(t, "-12.34", account1.AvailableBalance.String())
+	assert.Equal(t, 1, account1.Version)
+
+	account2 = getAccount(t, conn, account2.ID)
+	assert.Equal(t, "0", account2.Balance.String())
+	assert.Equal(t, "0", account2.PendingDebits.String())
+	assert.Equal(t, "12.34", account2.PendingCredits.String())
+	assert.Equal(t, "0", account2.AvailableBalance.String())
+
+	entries := getEntries(t, conn, account1.ID)
+	assert.Len(t, entries, 1)
+	assert.True(t, entries[0].Pending)
+	assert.Equal(t, "-12.34", entries[0].Amount.String())
+	assert.Equal(t, "0", entries[0].AccountPreviousBalance.String())
+	assert.Equal(t, "0", entries[0].AccountCurrentBalance.String())
+
+	// Regular transfers are posted
+	posted := createTransfer(t, conn, account1.ID, account2.ID, "1.00")
+	assert.Equal(t, pgledger.TransferStatusPosted, posted.Status)
+	assert.False(t, getEntries(t, conn, account1.ID)[1].Pending)
+}
+
+func TestPendingTransferReducesAvailableBalance(t *testing.T) {
+	conn := setupTest(t)
+	client := pgledger.NewClient(conn)
+
+	account1 := createAccount(t, conn, "account 1", "USD", pgledger.WithAllowNegativeBalance(false))
+	account2 := createAccount(t, conn, "account 2", "USD")
+
+	_ = createTransfer(t, conn, account2.ID, account1.ID, "10.00")
+	_ = createPendingTransfer(t, client, account1.ID, account2.ID, "8.00")
+
+	// Only 2.00 is available, even though the balance is 10.00
+	_, err := client.CreateTransfer(t.Context(), account1.ID, account2.ID, pgledger.MustParseAmount("2.01"))
+	assert.ErrorIs(t, err, pgledger.ErrInsufficientBalance)
+
+	var ledgerErr *pgledger.LedgerError
+	if assert.ErrorAs(t, err, &ledgerErr) {
+		assert.Equal(t, "7.99", ledgerErr.Balance.String())
+		assert.Equal(t, "-0.01", ledgerErr.AvailableBalance.String())
+	}
+
+	_, err = client.CreateTransfer(t.Context(), account1.ID, account2.ID, pgledger.MustParseAmount("2.01"),
+		pgledger.WithPending(true))
+	assert.ErrorIs(t, err, pgledger.ErrInsufficientBalance)
+
+	_ = createTransfer(t, conn, account1.ID, account2.ID, "2.00")
+	assert.Equal(t, "0.00", getAccount(t, conn, account1.ID).AvailableBalance.String())
+}
+
+func TestPendingTransferCountsTowardsPositiveBalance(t *testing.T) {
+	conn := setupTest(t)
+	client := pgledger.NewClient(conn)
+
+	account1 := createAccount(t, conn, "account 1", "USD")
+	account2 := createAccount(t, conn, "account 2", "USD", pgledger.WithAllowPositiveBalance(false))
+
+	_, err := client.CreateTransfer(t.Context(), account1.ID, account2.ID, pgledger.MustParseAmount("1.00"),
+		pgledger.WithPending(true))
+	assert.ErrorIs(t, err, pgledger.ErrPositiveBalanceNotAllowed)
+}
+
+func TestPostPendingTransfer(t *testing.T) {
+	conn := setupTest(t)
+	client := pgledger.NewClient(conn)
+
+	account1 := createAccount(t, conn, "account 1", "USD")
+	account2 := createAccount(t, conn, "account 2", "USD")
+
+	pending := createPendingTransfer(t, client, account1.ID, account2.ID, "12.34")
+
+	posted, err := client.PostPendingTransfer(t.Context(), pending.ID)
+	assert.NoError(t, err)
+
+	assert.Equal(t, pgledger.TransferStatusPosted, posted.Status)
+	assert.Equal(t, pending.ID, *posted.PendingTransferID)
+	assert.Equal(t, account1.ID, posted.FromAccountID)
+	assert.Equal(t, account2.ID, posted.ToAccountID)
+	assert.Equal(t, "12.34", posted.Amount.String())
+
+	account1 = getAccount(t, conn, account1.ID)
+	assert.Equal(t, "-12.34", account1.Balance.String())
+	assert.Equal(t, "0.00", account1.PendingDebits.String())
+	assert.Equal(t, "-12.34", account1.AvailableBalance.String())
+
+	account2 = getAccount(t, conn, account2.ID)
+	assert.Equal(t, "12.34", account2.Balance.String())
+	assert.Equal(t, "0.00", account2.PendingCredits.String())
+
+	// The pending amount is released by its own transfer, so every transfer
+	// still has two entries
+	entries := getEntries(t, conn, account2.ID)
+	assert.Len(t, entries, 3)
+
+	assert.True(t, entries[0].Pending)
+	assert.Equal(t, pending.ID, entries[0].TransferID)
+	assert.Equal(t, "12.34", entries[0].Amount.String())
+
+	assert.True(t, entries[1].Pending)
+	assert.Equal(t, "-12.34", entries[1].Amount.String())
+	released := getTransfer(t, conn, entries[1].TransferID)
+	assert.Equal(t, pgledger.TransferStatusReleased, released.Status)
+	assert.Equal(t, pending.ID, *released.PendingTransferID)
+
+	assert.False(t, entries[2].Pending)
+	assert.Equal(t, posted.ID, entries[2].TransferID)
+	assert.Equal(t, "12.34", entries[2].Amount.String())
+	assert.Equal(t, "0.00", entries[2].AccountPreviousBalance.String())
+	assert.Equal(t, "12.34", entries[2].AccountCurrentBalance.String())
+
+	// A pending transfer can only be posted once
+	_, err = client.PostPendingTransfer(t.Context(), pending.ID)
+	assert.ErrorIs(t, err, pgledger.ErrTransferNotPending)
+
+	_, err = client.VoidPendingTransfer(t.Context(), pending.ID)
+	assert.ErrorIs(t, err, pgledger.ErrTransferNotPending)
+
+	assert.Equal(t, "12.34", getAccount(t, conn, account2.ID).Balance.String())
+}
+
+func TestPostPendingTransferPartially(t *testing.T) {
+	conn := setupTest(t)
+	client := pgledger.NewClient(conn)
+
+	account1 := createAccount(t, conn, "account 1", "USD")
+	account2 := createAccount(t, conn, "account 2", "USD")
+
+	pending, err := client.CreateTransfer(t.Context(), account1.ID, account2.ID, pgledger.MustParseAmount("10.00"),
+		pgledger.WithPending(true),
+		pgledger.WithMetadata(`{"authorization": "auth_1"}`))
+	assert.NoError(t, err)
+
+	_, err = client.PostPendingTransfer(t.Context(), pending.ID, pgledger.WithPostAmount(pgledger.MustParseAmount("10.01")))
+	assert.ErrorIs(t, err, pgledger.ErrPostExceedsPending)
+
+	var ledgerErr *pgledger.LedgerError
+	if assert.ErrorAs(t, err, &ledgerErr) {
+		assert.Equal(t, "PGL13", ledgerErr.Code)
+		assert.Equal(t, pending.ID, ledgerErr.TransferID)
+		assert.Equal(t, "10.01", ledgerErr.Amount.String())
+		assert.Equal(t, "10.00", ledgerErr.PendingAmount.String())
+	}
+
+	posted, err := client.PostPendingTransfer(t.Context(), pending.ID, pgledger.WithPostAmount(pgledger.MustParseAmount("7.50")))
+	assert.NoError(t, err)
+	assert.Equal(t, "7.50", posted.Amount.String())
+	assert.Equal(t, `{"authorization": "auth_1"}`, *posted.Metadata)
+
+	// The rest of the pending amount is released
+	account1 = getAccount(t, conn, account1.ID)
+	assert.Equal(t, "-7.50", account1.Balance.String())
+	assert.Equal(t, "0.00", account1.PendingDebits.String())
+
+	account2 = getAccount(t, conn, account2.ID)
+	assert.Equal(t, "7.50", account2.Balance.String())
+	assert.Equal(t, "0.00", account2.PendingCredits.String())
+}
+
+func TestVoidPendingTransfer(t *testing.T) {
+	conn := setupTest(t)
+	client := pgledger.NewClient(conn)
+
+	account1 := createAccount(t, conn, "account 1", "USD")
+	account2 := createAccount(t, conn, "account 2", "USD")
+
+	pending := createPendingTransfer(t, client, account1.ID, account2.ID, "12.34")
+
+	released, err := client.VoidPendingTransfer(t.Context(), pending.ID, pgledger.WithMetadata(`{"reason": "expired"}`))
+	assert.NoError(t, err)
+
+	assert.Equal(t, pgledger.TransferStatusReleased, released.Status)
+	assert.Equal(t, pending.ID, *released.PendingTransferID)
+	assert.Equal(t, "12.34", released.Amount.String())
+	assert.Equal(t, `{"reason": "expired"}`, *released.Metadata)
+
+	account1 = getAccount(t, conn, account1.ID)
+	assert.Equal(t, "0", account1.Balance.String())
+	assert.Equal(t, "0.00", account1.PendingDebits.String())
+	assert.Equal(t, 2, account1.Version)
+
+	account2 = getAccount(t, conn, account2.ID)
+	assert.Equal(t, "0", account2.Balance.String())
+	assert.Equal(t, "0.00", account2.PendingCredits.String())
+
+	entries := getEntries(t, conn, account1.ID)
+	assert.Len(t, entries, 2)
+	assert.True(t, entries[1].Pending)
+	assert.Equal(t, "12.34", entries[1].Amount.String())
+
+	_, err = client.PostPendingTransfer(t.Context(), pending.ID)
+	assert.ErrorIs(t, err, pgledger.ErrTransferNotPending)
+}
+
+func TestPostOrVoidNonPendingTransfer(t *testing.T) {
+	conn := setupTest(t)
+	client := pgledger.NewClient(conn)
+
+	account1 := createAccount(t, conn, "account 1", "USD")
+	account2 := createAccount(t, conn, "account 2", "USD")
+
+	transfer := createTransfer(t, conn, account1.ID, account2.ID, "12.34")
+
+	_, err := client.PostPendingTransfer(t.Context(), transfer.ID)
+	assert.ErrorIs(t, err, pgledger.ErrTransferNotPending)
+
+	_, err = client.VoidPendingTransfer(t.Context(), transfer.ID)
+	assert.ErrorIs(t, err, pgledger.ErrTransferNotPending)
+
+	_, err = client.PostPendingTransfer(t.Context(), "pglt_missing")
+	assert.ErrorIs(t, err, pgledger.ErrTransferNotFound)
+
+	// Pending transfers can't be reversed, only voided
+	pending := createPendingTransfer(t, client, account1.ID, account2.ID, "1.00")
+	_, err = client.ReverseTransfer(t.Context(), pending.ID)
+	assert.ErrorIs(t, err, pgledger.ErrTransferNotPosted)
+
+	// But a posted pending transfer can be
+	posted, err := client.PostPendingTransfer(t.Context(), pending.ID)
+	assert.NoError(t, err)
+
+	reversal, err := client.ReverseTransfer(t.Context(), posted.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, "1.00", reversal.Amount.String())
+}
@@ -0,0 +1,205 @@
+package test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pgr0ss/pgledger"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReconciliation(t *testing.T) {
+	conn := setupTest(t)
+	client := pgledger.NewClient(conn)
+
+	bank := createAccount(t, conn, "bank", "USD")
+	receivables := createAccount(t, conn, "receivables", "USD")
+
+	june1 := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+	june2 := june1.AddDate(0, 0, 1)
+	june3 := june1.AddDate(0, 0, 2)
+	june4 := june1.AddDate(0, 0, 3)
+
+	receive := func(amount, metadata string, eventAt time.Time) *pgledger.Transfer {
+		opts := []pgledger.TransferOption{pgledger.WithEventAt(eventAt)}
+		if metadata != "" {
+			opts = append(opts, pgledger.WithMetadata(metadata))
+		}
+		transfer, err := client.CreateTransfer(t.Context(), receivables.ID, bank.ID, pgledger.MustParseAmount(amount), opts...)
+		assert.NoError(t, err)
+		return transfer
+	}
+
+	_ = receive("50", `{"reference": "p_1"}`, june1)
+	// A payout made up of two payments
+	_ = receive("30", `{"reference": "p_2"}`, june2)
+	_ = receive("20", `{"reference": "p_2"}`, june2)
+	_ = receive("12.34", "", june3)
+	_ = receive("59.75", `{"reference": "p_3"}`, june1)
+	// Never showed up on the statement
+	missing := receive("99", `{"reference": "p_4"}`, june4)
+
+	lines := []pgledger.ReconciliationLineRequest{
+		{ExternalID: "l1", Amount: pgledger.MustParseAmount("50"), OccurredAt: june1.Add(time.Hour), Reference: "p_1"},
+		{ExternalID: "l2", Amount: pgledger.MustParseAmount("50"), OccurredAt: june2, Reference: "p_2"},
+		// No reference, so this matches by amount and date
+		{ExternalID: "l3", Amount: pgledger.MustParseAmount("12.34"), OccurredAt: june4},
+		// Short by 0.25
+		{ExternalID: "l4", Amount: pgledger.MustParseAmount("60"), OccurredAt: june1, Reference: "p_3", Metadata: map[string]string{"row": "4"}},
+		{ExternalID: "l5", Amount: pgledger.MustParseAmount("10"), OccurredAt: june2, Reference: "p_9"},
+	}
+
+	imported, err := client.ImportReconciliationLines(t.Context(), bank.ID, lines)
+	assert.NoError(t, err)
+	assert.Len(t, imported, 5)
+	assert.Regexp(t, "^pglr_\\w+$", imported[0].ID)
+	assert.Equal(t, "l1", imported[0].ExternalID)
+	assert.Equal(t, "p_1", *imported[0].Reference)
+	assert.Nil(t, imported[2].Reference)
+	assert.JSONEq(t, `{"row": "4"}`, *imported[3].Metadata)
+	for _, line := range imported {
+		assert.Equal(t, pgledger.ReconciliationUnmatched, line.Status)
+	}
+
+	// Importing the same lines again doesn't create duplicates
+	reimported, err := client.ImportReconciliationLines(t.Context(), bank.ID, lines)
+	assert.NoError(t, err)
+	assert.Equal(t, imported[4].ID, reimported[4].ID)
+
+	reconciled, err := client.Reconcile(t.Context(), bank.ID)
+	assert.NoError(t, err)
+	assert.Len(t, reconciled, 5)
+
+	statuses := map[string]string{}
+	matchedAmounts := map[string]string{}
+	for _, line := range reconciled {
+		statuses[line.ExternalID] = line.Status
+		matchedAmounts[line.ExternalID] = line.MatchedAmount.String()
+	}
+
+	assert.Equal(t, map[string]string{
+		"l1": pgledger.ReconciliationMatched,
+		"l2": pgledger.ReconciliationMatched,
+		"l3": pgledger.ReconciliationMatched,
+		"l4": pgledger.ReconciliationPartiallyMatched,
+		"l5": pgledger.ReconciliationUnmatched,
+	}, statuses)
+	assert.Equal(t, "50", matchedAmounts["l2"])
+	assert.Equal(t, "59.75", matchedAmounts["l4"])
+	assert.Equal(t, "0", matchedAmounts["l5"])
+
+	// Only the lines which aren't matched are tried again
+	reconciled, err = client.Reconcile(t.Context(), bank.ID)
+	assert.NoError(t, err)
+	assert.Len(t, reconciled, 2)
+
+	exceptions, err := client.ReconciliationExceptions(t.Context(), bank.ID, time.Time{}, time.Time{})
+	assert.NoError(t, err)
+	assert.Len(t, exceptions, 3)
+
+	assert.Equal(t, "line", exceptions[0].Kind)
+	assert.Equal(t, imported[3].ID, exceptions[0].ID)
+	assert.Equal(t, pgledger.ReconciliationPartiallyMatched, exceptions[0].Status)
+	assert.Equal(t, "60", exceptions[0].Amount.String())
+	assert.Equal(t, "59.75", exceptions[0].MatchedAmount.String())
+
+	assert.Equal(t, "line", exceptions[1].Kind)
+	assert.Equal(t, imported[4].ID, exceptions[1].ID)
+	assert.Equal(t, "p_9", *exceptions[1].Reference)
+
+	assert.Equal(t, "entry", exceptions[2].Kind)
+	assert.Equal(t, pgledger.ReconciliationUnmatched, exceptions[2].Status)
+	assert.Equal(t, "99", exceptions[2].Amount.String())
+	assert.Equal(t, june4, exceptions[2].OccurredAt.UTC())
+	assert.JSONEq(t, `{"reference": "p_4"}`, *exceptions[2].Metadata)
+	assert.Equal(t, getEntries(t, conn, bank.ID)[5].ID, exceptions[2].ID)
+	assert.Equal(t, missing.ID, getEntries(t, conn, bank.ID)[5].TransferID)
+
+	// The period filters both lines and entries
+	exceptions, err = client.ReconciliationExceptions(t.Context(), bank.ID, june2, june4)
+	assert.NoError(t, err)
+	assert.Len(t, exceptions, 1)
+	assert.Equal(t, imported[4].ID, exceptions[0].ID)
+}
+
+func TestReconciliationDateTolerance(t *testing.T) {
+	conn := setupTest(t)
+	client := pgledger.NewClient(conn)
+
+	bank := createAccount(t, conn, "bank", "USD")
+	receivables := createAccount(t, conn, "receivables", "USD")
+
+	june1 := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	_, err := client.CreateTransfer(t.Context(), receivables.ID, bank.ID, pgledger.MustParseAmount("7"),
+		pgledger.WithEventAt(june1), pgledger.WithMetadata(`{"payment_id": "p_1"}`))
+	assert.NoError(t, err)
+
+	_, err = client.ImportReconciliationLines(t.Context(), bank.ID, []pgledger.ReconciliationLineRequest{
+		{ExternalID: "l1", Amount: pgledger.MustParseAmount("7"), OccurredAt: june1.AddDate(0, 0, 2), Reference: "p_1"},
+	})
+	assert.NoError(t, err)
+
+	reconciled, err := client.Reconcile(t.Context(), bank.ID, pgledger.WithDateTolerance(time.Hour))
+	assert.NoError(t, err)
+	assert.Equal(t, pgledger.ReconciliationUnmatched, reconciled[0].Status)
+
+	// The default key is "reference", so this matches by amount and date
+	reconciled, err = client.Reconcile(t.Context(), bank.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, pgledger.ReconciliationMatched, reconciled[0].Status)
+}
+
+func TestReconciliationWithReferenceKey(t *testing.T) {
+	conn := setupTest(t)
+	client := pgledger.NewClient(conn)
+
+	bank := createAccount(t, conn, "bank", "USD")
+	receivables := createAccount(t, conn, "receivables", "USD")
+
+	june1 := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	_, err := client.CreateTransfer(t.Context(), receivables.ID, bank.ID, pgledger.MustParseAmount("7"),
+		pgledger.WithEventAt(june1), pgledger.WithMetadata(`{"payment_id": "p_1"}`))
+	assert.NoError(t, err)
+	_, err = client.CreateTransfer(t.Context(), receivables.ID, bank.ID, pgledger.MustParseAmount("3"),
+		pgledger.WithEventAt(june1), pgledger.WithMetadata(`{"payment_id": "p_1"}`))
+	assert.NoError(t, err)
+
+	_, err = client.ImportReconciliationLines(t.Context(), bank.ID, []pgledger.ReconciliationLineRequest{
+		{ExternalID: "l1", Amount: pgledger.MustParseAmount("10"), OccurredAt: june1, Reference: "p_1"},
+	})
+	assert.NoError(t, err)
+
+	reconciled, err := client.Reconcile(t.Context(), bank.ID, pgledger.WithReferenceKey("payment_id"))
+	assert.NoError(t, err)
+	assert.Equal(t, pgledger.ReconciliationMatched, reconciled[0].Status)
+	assert.Equal(t, "10", reconciled[0].MatchedAmount.String())
+}
+
+func TestImportReconciliationLinesConflict(t *testing.T) {
+	conn := setupTest(t)
+	client := pgledger.NewClient(conn)
+
+	bank := createAccount(t, conn, "bank", "USD")
+	june1 := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	line := pgledger.ReconciliationLineRequest{ExternalID: "l1", Amount: pgledger.MustParseAmount("10"), OccurredAt: june1}
+	_, err := client.ImportReconciliationLines(t.Context(), bank.ID, []pgledger.ReconciliationLineRequest{line})
+	assert.NoError(t, err)
+
+	line.Amount = pgledger.MustParseAmount("11")
+	_, err = client.ImportReconciliationLines(t.Context(), bank.ID, []pgledger.ReconciliationLineRequest{line})
+	assert.ErrorIs(t, err, pgledger.ErrReconciliationConflict)
+	assert.ErrorContains(t, err, "Reconciliation line (external_id=l1) was already imported with different values")
+
+	var ledgerErr *pgledger.LedgerError
+	if assert.ErrorAs(t, err, &ledgerErr) {
+		assert.Equal(t, "PGL23", ledgerErr.Code)
+		assert.Equal(t, bank.ID, ledgerErr.AccountID)
+		assert.Equal(t, "l1", ledgerErr.ExternalID)
+	}
+
+	_, err = client.ImportReconciliationLines(t.Context(), "pgla_missing", []pgledger.ReconciliationLineRequest{line})
+	assert.ErrorIs(t, err, pgledger.ErrAccountNotFound)
+}
@@ -0,0 +1,138 @@
+package test
+
+import (
+	"testing"
+
+	"github.com/pgr0ss/pgledger"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReverseTransfer(t *testing.T) {
+	conn := setupTest(t)
+	client := pgledger.NewClient(conn)
+
+	account1 := createAccount(t, conn, "account 1", "USD")
+	account2 := createAccount(t, conn, "account 2", "USD")
+
+	transfer := createTransfer(t, conn, account1.ID, account2.ID, "12.34")
+
+	reversal, err := client.ReverseTransfer(t.Context(), transfer.ID, pgledger.WithMetadata(`{"reason": "mistake"}`))
+	assert.NoError(t, err)
+
+	assert.NotEqual(t, transfer.ID, reversal.ID)
+	assert.Equal(t, account2.ID, reversal.FromAccountID)
+	assert.Equal(t, account1.ID, reversal.ToAccountID)
+	assert.Equal(t, "12.34", reversal.Amount.String())
+	assert.Equal(t, transfer.ID, *reversal.ReversesTransferID)
+	assert.Equal(t, `{"reason": "mistake"}`, *reversal.Metadata)
+	assert.Equal(t, reversal, getTransfer(t, conn, reversal.ID))
+
+	// The original transfer is unchanged
+	assert.Equal(t, transfer, getTransfer(t, conn, transfer.ID))
+	assert.Nil(t, transfer.ReversesTransferID)
+
+	assert.Equal(t, "0.00", getAccount(t, conn, account1.ID).Balance.String())
+	assert.Equal(t, "0.00", getAccount(t, conn, account2.ID).Balance.String())
+
+	entries := getEntries(t, conn, account2.ID)
+	assert.Len(t, entries, 2)
+	assert.Equal(t, reversal.ID, entries[1].TransferID)
+	assert.Equal(t, "-12.34", entries[1].Amount.String())
+}
+
+func TestReverseTransferTwice(t *testing.T) {
+	conn := setupTest(t)
+	client := pgledger.NewClient(conn)
+
+	account1 := createAccount(t, conn, "account 1", "USD")
+	account2 := createAccount(t, conn, "account 2", "USD")
+
+	transfer := createTransfer(t, conn, account1.ID, account2.ID, "12.34")
+
+	_, err := client.ReverseTransfer(t.Context(), transfer.ID)
+	assert.NoError(t, err)
+
+	_, err = client.ReverseTransfer(t.Context(), transfer.ID)
+	assert.ErrorIs(t, err, pgledger.ErrTransferAlreadyReversed)
+
+	var ledgerErr *pgledger.LedgerError
+	if assert.ErrorAs(t, err, &ledgerErr) {
+		assert.Equal(t, "PGL09", ledgerErr.Code)
+		assert.Equal(t, transfer.ID, ledgerErr.TransferID)
+	}
+
+	assert.Equal(t, "0.00", getAccount(t, conn, account2.ID).Balance.String())
+}
+
+func TestReverseTransferPartially(t *testing.T) {
+	conn := setupTest(t)
+	client := pgledger.NewClient(conn)
+
+	account1 := createAccount(t, conn, "account 1", "USD")
+	account2 := createAccount(t, conn, "account 2", "USD")
+
+	transfer := createTransfer(t, conn, account1.ID, account2.ID, "10.00")
+
+	reversal1, err := client.ReverseTransfer(t.Context(), transfer.ID, pgledger.WithReversalAmount(pgledger.MustParseAmount("3.00")))
+	assert.NoError(t, err)
+	assert.Equal(t, "3.00", reversal1.Amount.String())
+	assert.Equal(t, transfer.ID, *reversal1.ReversesTransferID)
+	assert.Equal(t, "7.00", getAccount(t, conn, account2.ID).Balance.String())
+
+	// More than what's left of the transfer
+	_, err = client.ReverseTransfer(t.Context(), transfer.ID, pgledger.WithReversalAmount(pgledger.MustParseAmount("7.01")))
+	assert.ErrorIs(t, err, pgledger.ErrReversalExceedsTransfer)
+
+	var ledgerErr *pgledger.LedgerError
+	if assert.ErrorAs(t, err, &ledgerErr) {
+		assert.Equal(t, "PGL10", ledgerErr.Code)
+		assert.Equal(t, transfer.ID, ledgerErr.TransferID)
+		assert.Equal(t, "7.01", ledgerErr.Amount.String())
+		assert.Equal(t, "7.00", ledgerErr.RemainingAmount.String())
+	}
+
+	_, err = client.ReverseTransfer(t.Context(), transfer.ID, pgledger.WithReversalAmount(pgledger.MustParseAmount("0")))
+	assert.ErrorIs(t, err, pgledger.ErrNonPositiveAmount)
+
+	// Without an amount, the rest of the transfer is reversed
+	reversal2, err := client.ReverseTransfer(t.Context(), transfer.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, "7.00", reversal2.Amount.String())
+
+	assert.Equal(t, "0.00", getAccount(t, conn, account1.ID).Balance.String())
+	assert.Equal(t, "0.00", getAccount(t, conn, account2.ID).Balance.String())
+
+	_, err = client.ReverseTransfer(t.Context(), transfer.ID, pgledger.WithReversalAmount(pgledger.MustParseAmount("0.01")))
+	assert.ErrorIs(t, err, pgledger.ErrTransferAlreadyReversed)
+}
+
+func TestReverseTransferRespectsBalanceConstraints(t *testing.T) {
+	conn := setupTest(t)
+	client := pgledger.NewClient(conn)
+
+	account1 := createAccount(t, conn, "account 1", "USD")
+	account2 := createAccount(t, conn, "account 2", "USD", pgledger.WithAllowNegativeBalance(false))
+	account3 := createAccount(t, conn, "account 3", "USD")
+
+	transfer := createTransfer(t, conn, account1.ID, account2.ID, "10.00")
+
+	// Most of the money has already left account 2
+	_ = createTransfer(t, conn, account2.ID, account3.ID, "8.00")
+
+	_, err := client.ReverseTransfer(t.Context(), transfer.ID)
+	assert.ErrorIs(t, err, pgledger.ErrInsufficientBalance)
+
+	// The failed reversal doesn't count towards the reversed amount
+	reversal, err := client.ReverseTransfer(t.Context(), transfer.ID, pgledger.WithReversalAmount(pgledger.MustParseAmount("2.00")))
+	assert.NoError(t, err)
+	assert.Equal(t, "2.00", reversal.Amount.String())
+	assert.Equal(t, "0.00", getAccount(t, conn, account2.ID).Balance.String())
+}
+
+func TestReverseMissingTransfer(t *testing.T) {
+	conn := setupTest(t)
+	client := pgledger.NewClient(conn)
+
+	_, err := client.ReverseTransfer(t.Context(), "pglt_missing")
+	assert.ErrorIs(t, err, pgledger.ErrTransferNotFound)
+}
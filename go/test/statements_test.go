@@ -0,0 +1,89 @@
+package test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pgr0ss/pgledger"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAccountStatement(t *testing.T) {
+	conn := setupTest(t)
+	client := pgledger.NewClient(conn)
+
+	bank := createAccount(t, conn, "bank", "USD")
+	cash := createAccount(t, conn, "cash", "USD")
+	fees := createAccount(t, conn, "fees", "USD")
+
+	may31 := time.Date(2025, 5, 31, 12, 0, 0, 0, time.UTC)
+	june1 := time.Date(2025, 6, 1, 0, 0, 0, 0, time.UTC)
+	june2 := june1.AddDate(0, 0, 1)
+	july1 := time.Date(2025, 7, 1, 0, 0, 0, 0, time.UTC)
+
+	createAt := func(from, to, amount string, eventAt time.Time, opts ...pgledger.TransferOption) *pgledger.Transfer {
+		opts = append(opts, pgledger.WithEventAt(eventAt))
+		transfer, err := client.CreateTransfer(t.Context(), from, to, pgledger.MustParseAmount(amount), opts...)
+		assert.NoError(t, err)
+		return transfer
+	}
+
+	_ = createAt(bank.ID, cash.ID, "100", may31)
+	deposit := createAt(bank.ID, cash.ID, "50", june2, pgledger.WithMetadata(`{"payment_id": "p_1"}`))
+	// Recorded after the June 2nd deposit, but happened first
+	fee := createAt(cash.ID, fees.ID, "5", june1)
+	_ = createAt(bank.ID, cash.ID, "1000", july1)
+
+	// Pending transfers are left out
+	_ = createPendingTransfer(t, client, bank.ID, cash.ID, "7")
+
+	statement, err := client.AccountStatement(t.Context(), cash.ID, june1, july1)
+	assert.NoError(t, err)
+
+	assert.Equal(t, cash.ID, statement.AccountID)
+	assert.Equal(t, june1, statement.StartAt.UTC())
+	assert.Equal(t, july1, statement.EndAt.UTC())
+	assert.Equal(t, "100", statement.OpeningBalance.String())
+	assert.Equal(t, "145", statement.ClosingBalance.String())
+
+	assert.Len(t, statement.Lines, 2)
+
+	assert.Equal(t, fee.ID, statement.Lines[0].TransferID)
+	assert.Equal(t, june1, statement.Lines[0].EventAt.UTC())
+	assert.Equal(t, fees.ID, statement.Lines[0].CounterpartyAccountID)
+	assert.Equal(t, "fees", statement.Lines[0].CounterpartyAccountName)
+	assert.Equal(t, "-5", statement.Lines[0].Amount.String())
+	assert.Equal(t, "95", statement.Lines[0].Balance.String())
+	assert.Nil(t, statement.Lines[0].Metadata)
+
+	assert.Equal(t, deposit.ID, statement.Lines[1].TransferID)
+	assert.Equal(t, bank.ID, statement.Lines[1].CounterpartyAccountID)
+	assert.Equal(t, "bank", statement.Lines[1].CounterpartyAccountName)
+	assert.Equal(t, "50", statement.Lines[1].Amount.String())
+	assert.Equal(t, "145", statement.Lines[1].Balance.String())
+	assert.JSONEq(t, `{"payment_id": "p_1"}`, *statement.Lines[1].Metadata)
+
+	// Without a period, the statement covers the whole history
+	statement, err = client.AccountStatement(t.Context(), cash.ID, time.Time{}, time.Time{})
+	assert.NoError(t, err)
+	assert.Nil(t, statement.StartAt)
+	assert.Nil(t, statement.EndAt)
+	assert.Equal(t, "0", statement.OpeningBalance.String())
+	assert.Equal(t, "1145", statement.ClosingBalance.String())
+	assert.Len(t, statement.Lines, 4)
+
+	// A period without entries still has the balances
+	statement, err = client.AccountStatement(t.Context(), cash.ID, june2.AddDate(0, 0, 1), july1)
+	assert.NoError(t, err)
+	assert.Equal(t, "145", statement.OpeningBalance.String())
+	assert.Equal(t, "145", statement.ClosingBalance.String())
+	assert.Empty(t, statement.Lines)
+}
+
+func TestAccountStatementForMissingAccount(t *testing.T) {
+	conn := setupTest(t)
+	client := pgledger.NewClient(conn)
+
+	_, err := client.AccountStatement(t.Context(), "pgla_missing", time.Time{}, time.Time{})
+	assert.ErrorIs(t, err, pgledger.ErrAccountNotFound)
+}
@@ -0,0 +1,101 @@
+package test
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/pgr0ss/pgledger"
+	"github.com/stretchr/testify/assert"
+)
+
+// problemsFor returns the problems about any of the given objects, since other
+// tests share the database.
+func problemsFor(problems []pgledger.VerificationProblem, objectIDs ...string) []pgledger.VerificationProblem {
+	var matching []pgledger.VerificationProblem
+	for _, problem := range problems {
+		if slices.Contains(objectIDs, problem.ObjectID) {
+			matching = append(matching, problem)
+		}
+	}
+	return matching
+}
+
+func TestVerifyConsistentLedger(t *testing.T) {
+	conn := setupTest(t)
+	client := pgledger.NewClient(conn)
+
+	code := fmt.Sprintf("VER%d", time.Now().UnixNano())
+	_, err := client.CreateCurrency(t.Context(), code, 2, nil)
+	assert.NoError(t, err)
+
+	account1 := createAccount(t, conn, "account 1", code)
+	account2 := createAccount(t, conn, "account 2", code)
+	account3 := createAccount(t, conn, "account 3", code)
+
+	transfer := createTransfer(t, conn, account1.ID, account2.ID, "10.00")
+	_ = createTransfer(t, conn, account2.ID, account3.ID, "4.00")
+
+	_, err = client.ReverseTransfer(t.Context(), transfer.ID, pgledger.WithReversalAmount(pgledger.MustParseAmount("3.00")))
+	assert.NoError(t, err)
+
+	// A pending transfer which stays pending, and one which is posted
+	_ = createPendingTransfer(t, client, account3.ID, account1.ID, "1.00")
+	pending := createPendingTransfer(t, client, account1.ID, account2.ID, "2.00")
+	_, err = client.PostPendingTransfer(t.Context(), pending.ID)
+	assert.NoError(t, err)
+
+	problems, err := client.Verify(t.Context())
+	assert.NoError(t, err)
+	assert.Empty(t, problemsFor(problems, account1.ID, account2.ID, account3.ID, transfer.ID, pending.ID, code))
+}
+
+func TestVerifyFindsProblems(t *testing.T) {
+	conn := setupTest(t)
+	client := pgledger.NewClient(conn)
+
+	code := fmt.Sprintf("VER%d", time.Now().UnixNano())
+	_, err := client.CreateCurrency(t.Context(), code, 2, nil)
+	assert.NoError(t, err)
+
+	account1 := createAccount(t, conn, "account 1", code)
+	account2 := createAccount(t, conn, "account 2", code)
+
+	transfer := createTransfer(t, conn, account1.ID, account2.ID, "10.00")
+	entries := getEntries(t, conn, account2.ID)
+	assert.Len(t, entries, 1)
+
+	// Corrupt the ledger in a transaction which is rolled back, so that it
+	// doesn't affect other tests
+	tx, err := conn.Begin(t.Context())
+	assert.NoError(t, err)
+	defer func() { _ = tx.Rollback(t.Context()) }()
+
+	_, err = tx.Exec(t.Context(), "SELECT pgledger_allow_direct_writes('test')")
+	assert.NoError(t, err)
+
+	_, err = tx.Exec(t.Context(), "UPDATE pgledger_accounts SET balance = 12, version = 5 WHERE id = $1", account2.ID)
+	assert.NoError(t, err)
+
+	_, err = tx.Exec(t.Context(), "UPDATE pgledger_entries SET amount = 11, account_current_balance = 11 WHERE id = $1", entries[0].ID)
+	assert.NoError(t, err)
+
+	rows, err := tx.Query(t.Context(), "select * from pgledger_verify()")
+	assert.NoError(t, err)
+	problems, err := pgx.CollectRows(rows, pgx.RowToStructByName[pgledger.VerificationProblem])
+	assert.NoError(t, err)
+
+	var found []string
+	for _, problem := range problemsFor(problems, account1.ID, account2.ID, entries[0].ID, transfer.ID, code) {
+		found = append(found, problem.Problem+" "+problem.ObjectID)
+	}
+
+	assert.ElementsMatch(t, []string{
+		"balance_drift " + account2.ID,
+		"version_gap " + account2.ID,
+		"transfer_entries " + transfer.ID,
+		"currency_total " + code,
+	}, found)
+}
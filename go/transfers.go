@@ -0,0 +1,187 @@
+package pgledger
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// The statuses of a transfer. See pgledger_create_transfers and
+// pgledger_post_pending_transfer.
+const (
+	TransferStatusPosted   = "posted"
+	TransferStatusPending  = "pending"
+	TransferStatusReleased = "released"
+)
+
+// Transfer is a row from pgledger_transfers_view. The account balances and
+// versions are the ones right after the transfer.
+type Transfer struct {
+	ID                 string
+	FromAccountID      string
+	ToAccountID        string
+	Amount             Amount
+	CreatedAt          time.Time
+	EventAt            time.Time
+	Metadata           *string
+	IdempotencyKey     *string
+	ReversesTransferID *string
+	Status             string
+	PendingTransferID  *string
+	Currency           string
+	FromAccountName    string
+	ToAccountName      string
+	FromAccountBalance Amount
+	FromAccountVersion int
+	ToAccountBalance   Amount
+	ToAccountVersion   int
+	JournalID          *string
+}
+
+// TransferRequest is a single transfer passed to CreateTransfers. It mirrors
+// the TRANSFER_REQUEST_V2 SQL type. The account IDs can also be external refs.
+//
+// Metadata and EventAt are optional, and override the WithMetadata and
+// WithEventAt options for this transfer. Metadata is encoded the same way as
+// WithMetadata.
+type TransferRequest struct {
+	FromAccountID string
+	ToAccountID   string
+	Amount        Amount
+	Metadata      any
+	EventAt       *time.Time
+}
+
+// NewTransferRequest returns a TransferRequest, which can be customized with
+// WithMetadata and WithEventAt:
+//
+//	pgledger.NewTransferRequest(from, to, amount).WithMetadata(`{"leg": "usd"}`)
+func NewTransferRequest(fromAccountID, toAccountID string, amount Amount) TransferRequest {
+	return TransferRequest{FromAccountID: fromAccountID, ToAccountID: toAccountID, Amount: amount}
+}
+
+// WithMetadata returns a copy of the request with its own metadata.
+func (r TransferRequest) WithMetadata(metadata any) TransferRequest {
+	r.Metadata = metadata
+	return r
+}
+
+// WithEventAt returns a copy of the request with its own event_at.
+func (r TransferRequest) WithEventAt(eventAt time.Time) TransferRequest {
+	r.EventAt = &eventAt
+	return r
+}
+
+// CreateTransfer calls pgledger_create_transfer to move amount from one
+// account to another. Either account can be given by its ID or external ref.
+func (c *Client) CreateTransfer(ctx context.Context, fromAccountID, toAccountID string, amount Amount, opts ...TransferOption) (*Transfer, error) {
+	named, values := transferArgs(opts).sql(3)
+
+	return queryOne[Transfer](ctx, c,
+		"select * from pgledger_create_transfer($1, $2, $3"+named+")",
+		append([]any{fromAccountID, toAccountID, amount}, values...)...)
+}
+
+// CreateTransfers calls pgledger_create_transfers to create all of the
+// transfers atomically. The options apply to every transfer, unless the
+// request sets its own metadata or event_at. The transfers are returned in the
+// same order as the requests.
+func (c *Client) CreateTransfers(ctx context.Context, requests []TransferRequest, opts ...TransferOption) ([]Transfer, error) {
+	fromAccountIDs := make([]string, len(requests))
+	toAccountIDs := make([]string, len(requests))
+	amounts := make([]Amount, len(requests))
+	metadata := make([]*string, len(requests))
+	eventAts := make([]*time.Time, len(requests))
+
+	for i, request := range requests {
+		fromAccountIDs[i] = request.FromAccountID
+		toAccountIDs[i] = request.ToAccountID
+		amounts[i] = request.Amount
+		eventAts[i] = request.EventAt
+
+		var err error
+		metadata[i], err = jsonText(request.Metadata)
+		if err != nil {
+			return nil, fmt.Errorf("encoding metadata of transfer request %d: %w", i, err)
+		}
+	}
+
+	named, values := transferArgs(opts).sql(5)
+
+	// Build the TRANSFER_REQUEST_V2[] in SQL so we don't need to register the
+	// composite type with pgx
+	sql := `
+		select * from pgledger_create_transfers(
+			array(
+				select (r.from_account_id, r.to_account_id, r.amount, r.metadata::jsonb, r.event_at)::transfer_request_v2
+				from unnest($1::text[], $2::text[], $3::numeric[], $4::text[], $5::timestamptz[])
+					with ordinality as r(from_account_id, to_account_id, amount, metadata, event_at, n)
+				order by r.n
+			)` + named + `)`
+
+	return queryAll[Transfer](ctx, c, sql, append([]any{fromAccountIDs, toAccountIDs, amounts, metadata, eventAts}, values...)...)
+}
+
+// jsonText encodes metadata the same way pgx encodes a JSONB parameter, so
+// that it can be sent in a text array.
+func jsonText(metadata any) (*string, error) {
+	switch m := metadata.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return &m, nil
+	case []byte:
+		s := string(m)
+		return &s, nil
+	default:
+		b, err := json.Marshal(m)
+		if err != nil {
+			return nil, err
+		}
+		s := string(b)
+		return &s, nil
+	}
+}
+
+// GetTransfer returns the transfer with the given ID, or pgx.ErrNoRows if it
+// does not exist.
+func (c *Client) GetTransfer(ctx context.Context, id string) (*Transfer, error) {
+	return queryOne[Transfer](ctx, c, "select * from pgledger_transfers_view where id = $1", id)
+}
+
+// ReverseTransfer calls pgledger_reverse_transfer to create a transfer in the
+// opposite direction which is linked to the original by ReversesTransferID.
+func (c *Client) ReverseTransfer(ctx context.Context, transferID string, opts ...ReversalOption) (*Transfer, error) {
+	named, values := reversalArgs(opts).sql(1)
+
+	return queryOne[Transfer](ctx, c,
+		"select * from pgledger_reverse_transfer($1"+named+")",
+		append([]any{transferID}, values...)...)
+}
+
+// PostPendingTransfer calls pgledger_post_pending_transfer to settle a pending
+// transfer, and returns the posted transfer. Use WithPostAmount to post less
+// than the pending amount.
+func (c *Client) PostPendingTransfer(ctx context.Context, pendingTransferID string, opts ...PostOption) (*Transfer, error) {
+	named, values := postArgs(opts).sql(1)
+
+	return queryOne[Transfer](ctx, c,
+		"select * from pgledger_post_pending_transfer($1"+named+")",
+		append([]any{pendingTransferID}, values...)...)
+}
+
+// VoidPendingTransfer calls pgledger_void_pending_transfer to cancel a pending
+// transfer, and returns the transfer which released the pending amount.
+func (c *Client) VoidPendingTransfer(ctx context.Context, pendingTransferID string, opts ...MetadataOption) (*Transfer, error) {
+	// Metadata is the only option when voiding
+	args := make(namedArgs, 0, len(opts))
+	for _, opt := range opts {
+		args.set(opt.transferArg())
+	}
+	named, values := args.sql(1)
+
+	return queryOne[Transfer](ctx, c,
+		"select * from pgledger_void_pending_transfer($1"+named+")",
+		append([]any{pendingTransferID}, values...)...)
+}
@@ -0,0 +1,46 @@
+package pgledger
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTransferRequestBuilder(t *testing.T) {
+	eventAt := time.Date(2025, 7, 1, 12, 0, 0, 0, time.UTC)
+
+	base := NewTransferRequest("from", "to", MustParseAmount("1.23"))
+	request := base.WithMetadata(`{"a": 1}`).WithEventAt(eventAt)
+
+	assert.Equal(t, "from", request.FromAccountID)
+	assert.Equal(t, "to", request.ToAccountID)
+	assert.Equal(t, "1.23", request.Amount.String())
+	assert.Equal(t, `{"a": 1}`, request.Metadata)
+	assert.Equal(t, eventAt, *request.EventAt)
+
+	// The builder methods return copies
+	assert.Nil(t, base.Metadata)
+	assert.Nil(t, base.EventAt)
+}
+
+func TestJSONText(t *testing.T) {
+	text, err := jsonText(nil)
+	assert.NoError(t, err)
+	assert.Nil(t, text)
+
+	text, err = jsonText(`{"a": 1}`)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"a": 1}`, *text)
+
+	text, err = jsonText([]byte(`{"b": 2}`))
+	assert.NoError(t, err)
+	assert.Equal(t, `{"b": 2}`, *text)
+
+	text, err = jsonText(map[string]int{"c": 3})
+	assert.NoError(t, err)
+	assert.Equal(t, `{"c":3}`, *text)
+
+	_, err = jsonText(func() {})
+	assert.Error(t, err)
+}
@@ -0,0 +1,19 @@
+package pgledger
+
+import "context"
+
+// VerificationProblem is a row from pgledger_verify. ObjectID is the ID of the
+// account, entry or transfer with the problem (or the currency code for
+// currency_total), and Detail is a JSON object with the values which don't
+// match.
+type VerificationProblem struct {
+	Problem  string
+	ObjectID string
+	Detail   string
+}
+
+// Verify calls pgledger_verify to check the integrity of the whole ledger. It
+// returns no problems if the ledger is consistent.
+func (c *Client) Verify(ctx context.Context) ([]VerificationProblem, error) {
+	return queryAll[VerificationProblem](ctx, c, "select * from pgledger_verify()")
+}
@@ -0,0 +1,211 @@
+-- Optional idempotency keys for pgledger_create_transfer(s), so that retrying a
+-- request (e.g. from a webhook handler) doesn't create the transfers twice.
+--
+-- The first call with a key records the parameters here and tags the transfers
+-- it creates with the key. A repeated call with the same key and parameters
+-- returns the original transfers, and a repeated call with different parameters
+-- raises an error.
+CREATE TABLE pgledger_idempotency_keys (
+    idempotency_key TEXT PRIMARY KEY,
+    request JSONB NOT NULL,
+    event_at TIMESTAMPTZ,
+    created_at TIMESTAMPTZ NOT NULL
+);
+
+ALTER TABLE pgledger_transfers ADD COLUMN idempotency_key TEXT;
+
+CREATE INDEX ON pgledger_transfers (idempotency_key) WHERE idempotency_key IS NOT NULL;
+
+CREATE OR REPLACE VIEW pgledger_transfers_view AS
+SELECT
+    id,
+    from_account_id,
+    to_account_id,
+    amount,
+    created_at,
+    event_at,
+    metadata,
+    idempotency_key
+FROM pgledger_transfers;
+
+-- The functions gain a new parameter, so the old versions have to be dropped
+-- rather than replaced (otherwise calls would be ambiguous)
+DROP FUNCTION pgledger_create_transfer(TEXT, TEXT, NUMERIC, TIMESTAMPTZ, JSONB);
+DROP FUNCTION pgledger_create_transfers(TRANSFER_REQUEST [], TIMESTAMPTZ, JSONB);
+
+CREATE FUNCTION pgledger_create_transfer(
+    from_account_id TEXT,
+    to_account_id TEXT,
+    amount NUMERIC,
+    event_at TIMESTAMPTZ DEFAULT NULL,
+    metadata JSONB DEFAULT NULL,
+    idempotency_key TEXT DEFAULT NULL
+)
+RETURNS SETOF PGLEDGER_TRANSFERS_VIEW
+AS $$
+BEGIN
+    -- Simply call pgledger_create_transfers with a single transfer
+    RETURN QUERY
+    SELECT * FROM pgledger_create_transfers(
+        transfer_requests => array[(from_account_id, to_account_id, amount)::TRANSFER_REQUEST],
+        event_at => event_at,
+        metadata => metadata,
+        idempotency_key => idempotency_key
+    );
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE FUNCTION pgledger_create_transfers(
+    transfer_requests TRANSFER_REQUEST [],
+    event_at TIMESTAMPTZ DEFAULT NULL,
+    metadata JSONB DEFAULT NULL,
+    idempotency_key TEXT DEFAULT NULL
+)
+RETURNS SETOF PGLEDGER_TRANSFERS_VIEW
+AS $$
+DECLARE
+    transfer_request transfer_request;
+    transfer_ids TEXT[] := '{}';
+    transfer_id TEXT;
+    from_account pgledger_accounts;
+    to_account pgledger_accounts;
+    from_account_id TEXT;
+    to_account_id TEXT;
+    all_account_ids TEXT[] := '{}';
+    request JSONB;
+    existing_key pgledger_idempotency_keys;
+BEGIN
+    IF idempotency_key IS NOT NULL THEN
+        request := jsonb_build_object('transfer_requests', to_jsonb(transfer_requests), 'metadata', metadata);
+
+        -- If another transaction is using the same key, this waits for it to
+        -- commit or roll back
+        INSERT INTO pgledger_idempotency_keys (idempotency_key, request, event_at, created_at)
+        VALUES (idempotency_key, request, event_at, now())
+        ON CONFLICT ON CONSTRAINT pgledger_idempotency_keys_pkey DO NOTHING;
+
+        IF NOT FOUND THEN
+            SELECT * INTO existing_key
+            FROM pgledger_idempotency_keys k
+            WHERE k.idempotency_key = pgledger_create_transfers.idempotency_key;
+
+            IF existing_key.request != request OR existing_key.event_at IS DISTINCT FROM event_at THEN
+                RAISE EXCEPTION 'Idempotency key (%) was already used with different parameters', idempotency_key
+                USING
+                    ERRCODE = 'PGL07',
+                    DETAIL = json_build_object('idempotency_key', idempotency_key)::TEXT;
+            END IF;
+
+            -- Return the transfers from the original call
+            RETURN QUERY
+            SELECT *
+            FROM pgledger_transfers_view t
+            WHERE t.idempotency_key = pgledger_create_transfers.idempotency_key
+            ORDER BY t.id;
+
+            RETURN;
+        END IF;
+    END IF;
+
+    -- Collect all unique account IDs and sort them to prevent deadlocks
+    FOREACH transfer_request IN ARRAY transfer_requests LOOP
+        all_account_ids := array_append(all_account_ids, transfer_request.from_account_id);
+        all_account_ids := array_append(all_account_ids, transfer_request.to_account_id);
+    END LOOP;
+
+    -- Remove duplicates and sort
+    SELECT ARRAY(SELECT DISTINCT unnest FROM unnest(all_account_ids) ORDER BY unnest)
+    INTO all_account_ids;
+
+    -- Lock all accounts in order
+    FOREACH from_account_id IN ARRAY all_account_ids LOOP
+        PERFORM pgledger_accounts.id
+        FROM pgledger_accounts
+        WHERE pgledger_accounts.id = from_account_id
+        FOR UPDATE;
+
+        IF NOT FOUND THEN
+            RAISE EXCEPTION 'Account (id=%) does not exist', from_account_id
+            USING
+                ERRCODE = 'PGL06',
+                DETAIL = json_build_object('account_id', from_account_id)::TEXT;
+        END IF;
+    END LOOP;
+
+    -- Process each transfer
+    FOREACH transfer_request IN ARRAY transfer_requests LOOP
+        -- Preliminary checks
+        IF transfer_request.amount <= 0 THEN
+            RAISE EXCEPTION 'Amount (%) must be positive', transfer_request.amount
+            USING
+                ERRCODE = 'PGL04',
+                DETAIL = json_build_object('amount', transfer_request.amount::TEXT)::TEXT;
+        END IF;
+
+        IF transfer_request.from_account_id = transfer_request.to_account_id THEN
+            RAISE EXCEPTION 'Cannot transfer to the same account (id=%)', transfer_request.from_account_id
+            USING
+                ERRCODE = 'PGL05',
+                DETAIL = json_build_object('account_id', transfer_request.from_account_id)::TEXT;
+        END IF;
+
+        -- Update account balances
+        UPDATE pgledger_accounts
+        SET balance = balance - transfer_request.amount,
+            version = version + 1,
+            updated_at = now()
+        WHERE pgledger_accounts.id = transfer_request.from_account_id
+        RETURNING * INTO from_account;
+
+        -- Check balance constraints for the source account
+        PERFORM pgledger_check_account_balance_constraints(from_account);
+
+        UPDATE pgledger_accounts
+        SET balance = balance + transfer_request.amount,
+            version = version + 1,
+            updated_at = now()
+        WHERE pgledger_accounts.id = transfer_request.to_account_id
+        RETURNING * INTO to_account;
+
+        -- Check balance constraints for the destination account
+        PERFORM pgledger_check_account_balance_constraints(to_account);
+
+        -- Check that currencies match
+        IF from_account.currency != to_account.currency THEN
+            RAISE EXCEPTION 'Cannot transfer between different currencies (% and %)', from_account.currency, to_account.currency
+            USING
+                ERRCODE = 'PGL03',
+                DETAIL = json_build_object(
+                    'from_account_id', from_account.id,
+                    'to_account_id', to_account.id,
+                    'from_currency', from_account.currency,
+                    'to_currency', to_account.currency
+                )::TEXT;
+        END IF;
+
+        -- Create transfer record
+        INSERT INTO pgledger_transfers (from_account_id, to_account_id, amount, created_at, event_at, metadata, idempotency_key)
+        VALUES (transfer_request.from_account_id, transfer_request.to_account_id, transfer_request.amount, now(), coalesce(event_at, now()), metadata, idempotency_key)
+        RETURNING pgledger_transfers.id INTO transfer_id;
+
+        transfer_ids := array_append(transfer_ids, transfer_id);
+
+        -- Create entry for the source account (negative amount)
+        INSERT INTO pgledger_entries (account_id, transfer_id, amount, account_previous_balance, account_current_balance, account_version, created_at)
+        VALUES (transfer_request.from_account_id, transfer_id, -transfer_request.amount, from_account.balance + transfer_request.amount, from_account.balance, from_account.version, now());
+
+        -- Create entry for the destination account (positive amount)
+        INSERT INTO pgledger_entries (account_id, transfer_id, amount, account_previous_balance, account_current_balance, account_version, created_at)
+        VALUES (transfer_request.to_account_id, transfer_id, transfer_request.amount, to_account.balance - transfer_request.amount, to_account.balance, to_account.version, now());
+    END LOOP;
+
+    -- Return all created transfers
+    RETURN QUERY
+    SELECT *
+    FROM pgledger_transfers_view
+    WHERE id = ANY(transfer_ids)
+    ORDER BY id;
+END;
+$$ LANGUAGE plpgsql;
+
+INSERT INTO pgledger_schema_migrations (version) VALUES (2);
@@ -0,0 +1,288 @@
+-- Account statuses, which replace the workaround of disallowing both negative
+-- and positive balances to lock an account:
+--
+--   active: transfers in both directions are allowed
+--   frozen: no transfers are allowed until the account is made active again
+--   closed: no transfers are allowed, ever. Only accounts with a zero balance
+--     (and nothing pending) can be closed.
+--   debit_only: the account can only be the source of transfers
+--   credit_only: the account can only be the destination of transfers
+--
+-- The status is checked for every transfer in pgledger_apply_transfer. Each
+-- change is recorded in pgledger_account_status_changes, along with who made it.
+--
+-- New error codes:
+--
+--   PGL14: account status does not allow the transfer
+--   PGL15: account cannot be closed with a non-zero balance
+--   PGL16: account is closed
+ALTER TABLE pgledger_accounts
+ADD COLUMN status TEXT NOT NULL DEFAULT 'active' CHECK (
+    status IN ('active', 'frozen', 'closed', 'debit_only', 'credit_only')
+),
+ADD COLUMN status_changed_at TIMESTAMPTZ,
+ADD COLUMN status_changed_by TEXT;
+
+CREATE TABLE pgledger_account_status_changes (
+    id TEXT PRIMARY KEY DEFAULT pgledger_generate_id('pglsc'),
+    account_id TEXT NOT NULL REFERENCES pgledger_accounts (id),
+    previous_status TEXT NOT NULL,
+    status TEXT NOT NULL,
+    changed_by TEXT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX ON pgledger_account_status_changes (account_id);
+
+CREATE OR REPLACE VIEW pgledger_accounts_view AS
+SELECT
+    id,
+    name,
+    currency,
+    balance,
+    version,
+    allow_negative_balance,
+    allow_positive_balance,
+    metadata,
+    created_at,
+    updated_at,
+    pending_debits,
+    pending_credits,
+    balance - pending_debits AS available_balance,
+    status,
+    status_changed_at,
+    status_changed_by
+FROM pgledger_accounts;
+
+-- Check that the status of the account allows it to be debited (the source of
+-- a transfer) or credited (the destination of a transfer)
+CREATE FUNCTION pgledger_check_account_status(account PGLEDGER_ACCOUNTS, debit BOOLEAN) RETURNS VOID AS $$
+BEGIN
+    IF account.status = 'active'
+        OR (debit AND account.status = 'debit_only')
+        OR (NOT debit AND account.status = 'credit_only') THEN
+        RETURN;
+    END IF;
+
+    RAISE EXCEPTION 'Account (id=%, name=%) is % and cannot be %',
+    account.id, account.name, account.status, CASE WHEN debit THEN 'debited' ELSE 'credited' END
+    USING
+        ERRCODE = 'PGL14',
+        DETAIL = json_build_object(
+            'account_id', account.id,
+            'account_name', account.name,
+            'status', account.status
+        )::TEXT;
+END;
+$$ LANGUAGE plpgsql;
+
+-- Same as before, plus the status checks
+CREATE OR REPLACE FUNCTION pgledger_apply_transfer(
+    from_account_id TEXT,
+    to_account_id TEXT,
+    amount NUMERIC,
+    transfer_status TEXT,
+    pending_transfer_id TEXT,
+    event_at TIMESTAMPTZ,
+    metadata JSONB,
+    idempotency_key TEXT
+)
+RETURNS TEXT
+AS $$
+DECLARE
+    from_account pgledger_accounts;
+    to_account pgledger_accounts;
+    balance_change NUMERIC := 0;
+    pending_change NUMERIC := 0;
+    new_transfer_id TEXT;
+BEGIN
+    -- Preliminary checks
+    IF amount <= 0 THEN
+        RAISE EXCEPTION 'Amount (%) must be positive', amount
+        USING
+            ERRCODE = 'PGL04',
+            DETAIL = json_build_object('amount', amount::TEXT)::TEXT;
+    END IF;
+
+    IF from_account_id = to_account_id THEN
+        RAISE EXCEPTION 'Cannot transfer to the same account (id=%)', from_account_id
+        USING
+            ERRCODE = 'PGL05',
+            DETAIL = json_build_object('account_id', from_account_id)::TEXT;
+    END IF;
+
+    IF transfer_status = 'posted' THEN
+        balance_change := amount;
+    ELSIF transfer_status = 'pending' THEN
+        pending_change := amount;
+    ELSE
+        pending_change := -amount;
+    END IF;
+
+    -- Update account balances
+    UPDATE pgledger_accounts a
+    SET balance = a.balance - balance_change,
+        pending_debits = a.pending_debits + pending_change,
+        version = a.version + 1,
+        updated_at = now()
+    WHERE a.id = from_account_id
+    RETURNING * INTO from_account;
+
+    -- Check status and balance constraints for the source account. Releasing a
+    -- pending amount is always allowed, so that pending transfers can still be
+    -- voided after an account is frozen.
+    IF transfer_status != 'released' THEN
+        PERFORM pgledger_check_account_status(from_account, debit => TRUE);
+    END IF;
+    PERFORM pgledger_check_account_balance_constraints(from_account);
+
+    UPDATE pgledger_accounts a
+    SET balance = a.balance + balance_change,
+        pending_credits = a.pending_credits + pending_change,
+        version = a.version + 1,
+        updated_at = now()
+    WHERE a.id = to_account_id
+    RETURNING * INTO to_account;
+
+    -- Check status and balance constraints for the destination account
+    IF transfer_status != 'released' THEN
+        PERFORM pgledger_check_account_status(to_account, debit => FALSE);
+    END IF;
+    PERFORM pgledger_check_account_balance_constraints(to_account);
+
+    -- Check that currencies match
+    IF from_account.currency != to_account.currency THEN
+        RAISE EXCEPTION 'Cannot transfer between different currencies (% and %)', from_account.currency, to_account.currency
+        USING
+            ERRCODE = 'PGL03',
+            DETAIL = json_build_object(
+                'from_account_id', from_account.id,
+                'to_account_id', to_account.id,
+                'from_currency', from_account.currency,
+                'to_currency', to_account.currency
+            )::TEXT;
+    END IF;
+
+    -- Create transfer record
+    INSERT INTO pgledger_transfers (
+        from_account_id, to_account_id, amount, created_at, event_at, metadata, idempotency_key, status, pending_transfer_id
+    )
+    VALUES (
+        from_account_id, to_account_id, amount, now(), event_at, metadata, idempotency_key, transfer_status, pending_transfer_id
+    )
+    RETURNING pgledger_transfers.id INTO new_transfer_id;
+
+    -- Create entry for the source account (negative amount, or positive when
+    -- releasing a pending amount)
+    INSERT INTO pgledger_entries (
+        account_id, transfer_id, amount, account_previous_balance, account_current_balance, account_version, created_at, pending
+    )
+    VALUES (
+        from_account_id,
+        new_transfer_id,
+        -(balance_change + pending_change),
+        from_account.balance + balance_change,
+        from_account.balance,
+        from_account.version,
+        now(),
+        transfer_status != 'posted'
+    );
+
+    -- Create entry for the destination account (positive amount, or negative
+    -- when releasing a pending amount)
+    INSERT INTO pgledger_entries (
+        account_id, transfer_id, amount, account_previous_balance, account_current_balance, account_version, created_at, pending
+    )
+    VALUES (
+        to_account_id,
+        new_transfer_id,
+        balance_change + pending_change,
+        to_account.balance - balance_change,
+        to_account.balance,
+        to_account.version,
+        now(),
+        transfer_status != 'posted'
+    );
+
+    RETURN new_transfer_id;
+END;
+$$ LANGUAGE plpgsql;
+
+
+-- Change the status of an account, recording who changed it. Closing an account
+-- is permanent.
+CREATE FUNCTION pgledger_update_account_status(
+    account_id TEXT,
+    status TEXT,
+    changed_by TEXT
+)
+RETURNS SETOF PGLEDGER_ACCOUNTS_VIEW
+AS $$
+DECLARE
+    account pgledger_accounts;
+BEGIN
+    -- Lock the account so the status can't change in the middle of a transfer
+    SELECT * INTO account
+    FROM pgledger_accounts a
+    WHERE a.id = pgledger_update_account_status.account_id
+    FOR UPDATE;
+
+    IF NOT FOUND THEN
+        RAISE EXCEPTION 'Account (id=%) does not exist', account_id
+        USING
+            ERRCODE = 'PGL06',
+            DETAIL = json_build_object('account_id', account_id)::TEXT;
+    END IF;
+
+    IF account.status = 'closed' THEN
+        RAISE EXCEPTION 'Account (id=%, name=%) is closed', account.id, account.name
+        USING
+            ERRCODE = 'PGL16',
+            DETAIL = json_build_object(
+                'account_id', account.id,
+                'account_name', account.name,
+                'status', account.status
+            )::TEXT;
+    END IF;
+
+    IF status = 'closed' AND (account.balance != 0 OR account.pending_debits != 0 OR account.pending_credits != 0) THEN
+        RAISE EXCEPTION 'Account (id=%, name=%) cannot be closed with a non-zero balance', account.id, account.name
+        USING
+            ERRCODE = 'PGL15',
+            DETAIL = json_build_object(
+                'account_id', account.id,
+                'account_name', account.name,
+                'balance', account.balance::TEXT
+            )::TEXT;
+    END IF;
+
+    UPDATE pgledger_accounts a
+    SET status = pgledger_update_account_status.status,
+        status_changed_at = now(),
+        status_changed_by = changed_by,
+        updated_at = now()
+    WHERE a.id = account.id;
+
+    INSERT INTO pgledger_account_status_changes (account_id, previous_status, status, changed_by, created_at)
+    VALUES (account.id, account.status, status, changed_by, now());
+
+    RETURN QUERY
+    SELECT *
+    FROM pgledger_accounts_view v
+    WHERE v.id = account.id;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE FUNCTION pgledger_freeze_account(account_id TEXT, changed_by TEXT)
+RETURNS SETOF PGLEDGER_ACCOUNTS_VIEW
+AS $$
+    SELECT * FROM pgledger_update_account_status(account_id, 'frozen', changed_by);
+$$ LANGUAGE sql;
+
+CREATE FUNCTION pgledger_close_account(account_id TEXT, changed_by TEXT)
+RETURNS SETOF PGLEDGER_ACCOUNTS_VIEW
+AS $$
+    SELECT * FROM pgledger_update_account_status(account_id, 'closed', changed_by);
+$$ LANGUAGE sql;
+
+INSERT INTO pgledger_schema_migrations (version) VALUES (5);
@@ -0,0 +1,113 @@
+-- Optional hierarchical paths for accounts, using the ltree extension:
+-- https://www.postgresql.org/docs/current/ltree.html
+--
+-- For example, accounts with the paths user1.available, user1.pending and
+-- user1.fees can be rolled up to get the total for user1.
+CREATE EXTENSION IF NOT EXISTS ltree;
+
+ALTER TABLE pgledger_accounts ADD COLUMN path LTREE;
+
+CREATE INDEX ON pgledger_accounts USING gist (path);
+
+CREATE OR REPLACE VIEW pgledger_accounts_view AS
+SELECT
+    id,
+    name,
+    currency,
+    balance,
+    version,
+    allow_negative_balance,
+    allow_positive_balance,
+    metadata,
+    created_at,
+    updated_at,
+    pending_debits,
+    pending_credits,
+    balance - pending_debits AS available_balance,
+    status,
+    status_changed_at,
+    status_changed_by,
+    min_balance,
+    max_balance,
+    path
+FROM pgledger_accounts;
+
+-- The function gains a new parameter, so the old version has to be dropped
+-- rather than replaced
+DROP FUNCTION pgledger_create_account(TEXT, TEXT, BOOLEAN, BOOLEAN, JSONB, NUMERIC, NUMERIC);
+
+CREATE FUNCTION pgledger_create_account(
+    name TEXT,
+    currency TEXT,
+    allow_negative_balance BOOLEAN DEFAULT TRUE,
+    allow_positive_balance BOOLEAN DEFAULT TRUE,
+    metadata JSONB DEFAULT NULL,
+    min_balance NUMERIC DEFAULT NULL,
+    max_balance NUMERIC DEFAULT NULL,
+    path LTREE DEFAULT NULL
+)
+RETURNS SETOF PGLEDGER_ACCOUNTS_VIEW
+AS $$
+DECLARE
+    new_account_id TEXT;
+BEGIN
+    INSERT INTO pgledger_accounts (
+        name,
+        currency,
+        allow_negative_balance,
+        allow_positive_balance,
+        metadata,
+        min_balance,
+        max_balance,
+        path,
+        created_at,
+        updated_at
+    )
+    VALUES (
+        name,
+        currency,
+        allow_negative_balance,
+        allow_positive_balance,
+        metadata,
+        min_balance,
+        max_balance,
+        path,
+        now(),
+        now()
+    )
+    RETURNING pgledger_accounts.id INTO new_account_id;
+
+    RETURN QUERY
+    SELECT *
+    FROM pgledger_accounts_view v
+    WHERE v.id = new_account_id;
+END;
+$$ LANGUAGE plpgsql;
+
+-- Sum the balances of accounts per currency for every subtree under
+-- path_prefix (or for every subtree, if path_prefix is NULL). For example, an
+-- account with the path user1.available adds to both user1 and user1.available.
+-- Accounts without a path are skipped.
+CREATE FUNCTION pgledger_account_tree_balances(path_prefix LTREE DEFAULT NULL)
+RETURNS TABLE (
+    path LTREE,
+    currency TEXT,
+    balance NUMERIC,
+    available_balance NUMERIC,
+    account_count BIGINT
+)
+AS $$
+    SELECT
+        subpath(a.path, 0, levels.level) AS path,
+        a.currency,
+        sum(a.balance) AS balance,
+        sum(a.balance - a.pending_debits) AS available_balance,
+        count(*) AS account_count
+    FROM pgledger_accounts a
+    CROSS JOIN LATERAL generate_series(coalesce(nlevel(path_prefix), 1), nlevel(a.path)) AS levels (level)
+    WHERE a.path <@ path_prefix OR (path_prefix IS NULL AND a.path IS NOT NULL)
+    GROUP BY 1, 2
+    ORDER BY 1, 2;
+$$ LANGUAGE sql STABLE;
+
+INSERT INTO pgledger_schema_migrations (version) VALUES (7);
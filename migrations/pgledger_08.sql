@@ -0,0 +1,214 @@
+-- Optional, unique external references for accounts, such as the ID of the
+-- account in another system. pgledger_create_transfer(s) accept either account
+-- IDs or external refs, so callers don't need to look up the IDs first.
+--
+-- External refs can't start with pgla_, so they can never be confused with
+-- account IDs.
+ALTER TABLE pgledger_accounts
+ADD COLUMN external_ref TEXT UNIQUE CHECK (external_ref NOT LIKE 'pgla\_%');
+
+CREATE OR REPLACE VIEW pgledger_accounts_view AS
+SELECT
+    id,
+    name,
+    currency,
+    balance,
+    version,
+    allow_negative_balance,
+    allow_positive_balance,
+    metadata,
+    created_at,
+    updated_at,
+    pending_debits,
+    pending_credits,
+    balance - pending_debits AS available_balance,
+    status,
+    status_changed_at,
+    status_changed_by,
+    min_balance,
+    max_balance,
+    path,
+    external_ref
+FROM pgledger_accounts;
+
+-- The function gains a new parameter, so the old version has to be dropped
+-- rather than replaced
+DROP FUNCTION pgledger_create_account(TEXT, TEXT, BOOLEAN, BOOLEAN, JSONB, NUMERIC, NUMERIC, LTREE);
+
+CREATE FUNCTION pgledger_create_account(
+    name TEXT,
+    currency TEXT,
+    allow_negative_balance BOOLEAN DEFAULT TRUE,
+    allow_positive_balance BOOLEAN DEFAULT TRUE,
+    metadata JSONB DEFAULT NULL,
+    min_balance NUMERIC DEFAULT NULL,
+    max_balance NUMERIC DEFAULT NULL,
+    path LTREE DEFAULT NULL,
+    external_ref TEXT DEFAULT NULL
+)
+RETURNS SETOF PGLEDGER_ACCOUNTS_VIEW
+AS $$
+DECLARE
+    new_account_id TEXT;
+BEGIN
+    INSERT INTO pgledger_accounts (
+        name,
+        currency,
+        allow_negative_balance,
+        allow_positive_balance,
+        metadata,
+        min_balance,
+        max_balance,
+        path,
+        external_ref,
+        created_at,
+        updated_at
+    )
+    VALUES (
+        name,
+        currency,
+        allow_negative_balance,
+        allow_positive_balance,
+        metadata,
+        min_balance,
+        max_balance,
+        path,
+        external_ref,
+        now(),
+        now()
+    )
+    RETURNING pgledger_accounts.id INTO new_account_id;
+
+    RETURN QUERY
+    SELECT *
+    FROM pgledger_accounts_view v
+    WHERE v.id = new_account_id;
+END;
+$$ LANGUAGE plpgsql;
+
+-- Return the ID of the account with the given external ref. Anything else is
+-- returned as is, and treated as an account ID (which is checked when the
+-- account is locked).
+CREATE FUNCTION pgledger_resolve_account_id(account_id_or_ref TEXT)
+RETURNS TEXT
+AS $$
+    SELECT coalesce(
+        (SELECT a.id FROM pgledger_accounts a WHERE a.external_ref = account_id_or_ref),
+        account_id_or_ref
+    );
+$$ LANGUAGE sql STABLE;
+
+-- Same as before, but resolving external refs first
+CREATE OR REPLACE FUNCTION pgledger_create_transfers(
+    transfer_requests TRANSFER_REQUEST [],
+    event_at TIMESTAMPTZ DEFAULT NULL,
+    metadata JSONB DEFAULT NULL,
+    idempotency_key TEXT DEFAULT NULL,
+    pending BOOLEAN DEFAULT FALSE
+)
+RETURNS SETOF PGLEDGER_TRANSFERS_VIEW
+AS $$
+DECLARE
+    transfer_request transfer_request;
+    resolved_requests transfer_request[] := '{}';
+    transfer_ids TEXT[] := '{}';
+    account_id TEXT;
+    all_account_ids TEXT[] := '{}';
+    request JSONB;
+    existing_key pgledger_idempotency_keys;
+BEGIN
+    IF idempotency_key IS NOT NULL THEN
+        request := jsonb_build_object('transfer_requests', to_jsonb(transfer_requests), 'metadata', metadata);
+
+        -- Only include pending when it's set, so that keys stored before it
+        -- existed still match
+        IF pending THEN
+            request := request || jsonb_build_object('pending', TRUE);
+        END IF;
+
+        -- If another transaction is using the same key, this waits for it to
+        -- commit or roll back
+        INSERT INTO pgledger_idempotency_keys (idempotency_key, request, event_at, created_at)
+        VALUES (idempotency_key, request, event_at, now())
+        ON CONFLICT ON CONSTRAINT pgledger_idempotency_keys_pkey DO NOTHING;
+
+        IF NOT FOUND THEN
+            SELECT * INTO existing_key
+            FROM pgledger_idempotency_keys k
+            WHERE k.idempotency_key = pgledger_create_transfers.idempotency_key;
+
+            IF existing_key.request != request OR existing_key.event_at IS DISTINCT FROM event_at THEN
+                RAISE EXCEPTION 'Idempotency key (%) was already used with different parameters', idempotency_key
+                USING
+                    ERRCODE = 'PGL07',
+                    DETAIL = json_build_object('idempotency_key', idempotency_key)::TEXT;
+            END IF;
+
+            -- Return the transfers from the original call
+            RETURN QUERY
+            SELECT *
+            FROM pgledger_transfers_view t
+            WHERE t.idempotency_key = pgledger_create_transfers.idempotency_key
+            ORDER BY t.id;
+
+            RETURN;
+        END IF;
+    END IF;
+
+    -- Resolve external refs to account IDs, so that the accounts are locked in
+    -- the same order no matter how they are referenced
+    FOREACH transfer_request IN ARRAY transfer_requests LOOP
+        transfer_request.from_account_id := pgledger_resolve_account_id(transfer_request.from_account_id);
+        transfer_request.to_account_id := pgledger_resolve_account_id(transfer_request.to_account_id);
+        resolved_requests := array_append(resolved_requests, transfer_request);
+    END LOOP;
+
+    -- Collect all unique account IDs and sort them to prevent deadlocks
+    FOREACH transfer_request IN ARRAY resolved_requests LOOP
+        all_account_ids := array_append(all_account_ids, transfer_request.from_account_id);
+        all_account_ids := array_append(all_account_ids, transfer_request.to_account_id);
+    END LOOP;
+
+    -- Remove duplicates and sort
+    SELECT ARRAY(SELECT DISTINCT unnest FROM unnest(all_account_ids) ORDER BY unnest)
+    INTO all_account_ids;
+
+    -- Lock all accounts in order
+    FOREACH account_id IN ARRAY all_account_ids LOOP
+        PERFORM pgledger_accounts.id
+        FROM pgledger_accounts
+        WHERE pgledger_accounts.id = account_id
+        FOR UPDATE;
+
+        IF NOT FOUND THEN
+            RAISE EXCEPTION 'Account (id=%) does not exist', account_id
+            USING
+                ERRCODE = 'PGL06',
+                DETAIL = json_build_object('account_id', account_id)::TEXT;
+        END IF;
+    END LOOP;
+
+    -- Process each transfer
+    FOREACH transfer_request IN ARRAY resolved_requests LOOP
+        transfer_ids := array_append(transfer_ids, pgledger_apply_transfer(
+            from_account_id => transfer_request.from_account_id,
+            to_account_id => transfer_request.to_account_id,
+            amount => transfer_request.amount,
+            transfer_status => CASE WHEN pending THEN 'pending' ELSE 'posted' END,
+            pending_transfer_id => NULL,
+            event_at => coalesce(event_at, now()),
+            metadata => metadata,
+            idempotency_key => idempotency_key
+        ));
+    END LOOP;
+
+    -- Return all created transfers
+    RETURN QUERY
+    SELECT *
+    FROM pgledger_transfers_view
+    WHERE id = ANY(transfer_ids)
+    ORDER BY id;
+END;
+$$ LANGUAGE plpgsql;
+
+INSERT INTO pgledger_schema_migrations (version) VALUES (8);
@@ -0,0 +1,186 @@
+-- Per-transfer metadata and event_at for pgledger_create_transfers, so that
+-- each leg of a batch (such as the USD and EUR legs of a currency conversion)
+-- can be tagged differently.
+--
+-- TRANSFER_REQUEST can't gain the new fields without breaking every existing
+-- (from_account_id, to_account_id, amount)::TRANSFER_REQUEST cast, so they are
+-- in a new type instead. When they are set, they override the metadata and
+-- event_at passed to pgledger_create_transfers for that transfer.
+CREATE TYPE TRANSFER_REQUEST_V2 AS (
+    from_account_id TEXT,
+    to_account_id TEXT,
+    amount NUMERIC,
+    metadata JSONB,
+    event_at TIMESTAMPTZ
+);
+
+-- The requests as they are recorded for an idempotency key. Null metadata and
+-- event_at are left out, so that requests without them match keys stored by
+-- the TRANSFER_REQUEST version of pgledger_create_transfers. Only those fields
+-- are left out: nulls inside the metadata are part of the request.
+CREATE FUNCTION pgledger_idempotency_transfer_requests(
+    transfer_requests TRANSFER_REQUEST_V2 []
+)
+RETURNS JSONB
+AS $$
+    SELECT coalesce(
+        jsonb_agg(
+            jsonb_build_object(
+                'from_account_id', r.from_account_id,
+                'to_account_id', r.to_account_id,
+                'amount', r.amount
+            )
+            || CASE WHEN r.metadata IS NULL THEN '{}' ELSE jsonb_build_object('metadata', r.metadata) END
+            || CASE WHEN r.event_at IS NULL THEN '{}' ELSE jsonb_build_object('event_at', r.event_at) END
+            ORDER BY r.n
+        ),
+        '[]'
+    )
+    FROM unnest(pgledger_idempotency_transfer_requests.transfer_requests)
+        WITH ORDINALITY AS r (from_account_id, to_account_id, amount, metadata, event_at, n);
+$$ LANGUAGE sql STABLE;
+
+CREATE FUNCTION pgledger_create_transfers(
+    transfer_requests TRANSFER_REQUEST_V2 [],
+    event_at TIMESTAMPTZ DEFAULT NULL,
+    metadata JSONB DEFAULT NULL,
+    idempotency_key TEXT DEFAULT NULL,
+    pending BOOLEAN DEFAULT FALSE
+)
+RETURNS SETOF PGLEDGER_TRANSFERS_VIEW
+AS $$
+DECLARE
+    transfer_request transfer_request_v2;
+    resolved_requests transfer_request_v2[] := '{}';
+    transfer_ids TEXT[] := '{}';
+    account_id TEXT;
+    all_account_ids TEXT[] := '{}';
+    request JSONB;
+    existing_key pgledger_idempotency_keys;
+BEGIN
+    IF idempotency_key IS NOT NULL THEN
+        request := jsonb_build_object(
+            'transfer_requests', pgledger_idempotency_transfer_requests(transfer_requests),
+            'metadata', metadata
+        );
+
+        -- Only include pending when it's set, so that keys stored before it
+        -- existed still match
+        IF pending THEN
+            request := request || jsonb_build_object('pending', TRUE);
+        END IF;
+
+        -- If another transaction is using the same key, this waits for it to
+        -- commit or roll back
+        INSERT INTO pgledger_idempotency_keys (idempotency_key, request, event_at, created_at)
+        VALUES (idempotency_key, request, event_at, now())
+        ON CONFLICT ON CONSTRAINT pgledger_idempotency_keys_pkey DO NOTHING;
+
+        IF NOT FOUND THEN
+            SELECT * INTO existing_key
+            FROM pgledger_idempotency_keys k
+            WHERE k.idempotency_key = pgledger_create_transfers.idempotency_key;
+
+            IF existing_key.request != request OR existing_key.event_at IS DISTINCT FROM event_at THEN
+                RAISE EXCEPTION 'Idempotency key (%) was already used with different parameters', idempotency_key
+                USING
+                    ERRCODE = 'PGL07',
+                    DETAIL = json_build_object('idempotency_key', idempotency_key)::TEXT;
+            END IF;
+
+            -- Return the transfers from the original call
+            RETURN QUERY
+            SELECT *
+            FROM pgledger_transfers_view t
+            WHERE t.idempotency_key = pgledger_create_transfers.idempotency_key
+            ORDER BY t.id;
+
+            RETURN;
+        END IF;
+    END IF;
+
+    -- Resolve external refs to account IDs, so that the accounts are locked in
+    -- the same order no matter how they are referenced
+    FOREACH transfer_request IN ARRAY transfer_requests LOOP
+        transfer_request.from_account_id := pgledger_resolve_account_id(transfer_request.from_account_id);
+        transfer_request.to_account_id := pgledger_resolve_account_id(transfer_request.to_account_id);
+        resolved_requests := array_append(resolved_requests, transfer_request);
+    END LOOP;
+
+    -- Collect all unique account IDs and sort them to prevent deadlocks
+    FOREACH transfer_request IN ARRAY resolved_requests LOOP
+        all_account_ids := array_append(all_account_ids, transfer_request.from_account_id);
+        all_account_ids := array_append(all_account_ids, transfer_request.to_account_id);
+    END LOOP;
+
+    -- Remove duplicates and sort
+    SELECT ARRAY(SELECT DISTINCT unnest FROM unnest(all_account_ids) ORDER BY unnest)
+    INTO all_account_ids;
+
+    -- Lock all accounts in order
+    FOREACH account_id IN ARRAY all_account_ids LOOP
+        PERFORM pgledger_accounts.id
+        FROM pgledger_accounts
+        WHERE pgledger_accounts.id = account_id
+        FOR UPDATE;
+
+        IF NOT FOUND THEN
+            RAISE EXCEPTION 'Account (id=%) does not exist', account_id
+            USING
+                ERRCODE = 'PGL06',
+                DETAIL = json_build_object('account_id', account_id)::TEXT;
+        END IF;
+    END LOOP;
+
+    -- Process each transfer
+    FOREACH transfer_request IN ARRAY resolved_requests LOOP
+        transfer_ids := array_append(transfer_ids, pgledger_apply_transfer(
+            from_account_id => transfer_request.from_account_id,
+            to_account_id => transfer_request.to_account_id,
+            amount => transfer_request.amount,
+            transfer_status => CASE WHEN pending THEN 'pending' ELSE 'posted' END,
+            pending_transfer_id => NULL,
+            event_at => coalesce(transfer_request.event_at, event_at, now()),
+            metadata => coalesce(transfer_request.metadata, metadata),
+            idempotency_key => idempotency_key
+        ));
+    END LOOP;
+
+    -- Return all created transfers
+    RETURN QUERY
+    SELECT *
+    FROM pgledger_transfers_view
+    WHERE id = ANY(transfer_ids)
+    ORDER BY id;
+END;
+$$ LANGUAGE plpgsql;
+
+
+-- The TRANSFER_REQUEST version now converts the requests and calls the
+-- TRANSFER_REQUEST_V2 version
+CREATE OR REPLACE FUNCTION pgledger_create_transfers(
+    transfer_requests TRANSFER_REQUEST [],
+    event_at TIMESTAMPTZ DEFAULT NULL,
+    metadata JSONB DEFAULT NULL,
+    idempotency_key TEXT DEFAULT NULL,
+    pending BOOLEAN DEFAULT FALSE
+)
+RETURNS SETOF PGLEDGER_TRANSFERS_VIEW
+AS $$
+BEGIN
+    RETURN QUERY
+    SELECT * FROM pgledger_create_transfers(
+        transfer_requests => array(
+            SELECT (r.from_account_id, r.to_account_id, r.amount, NULL::JSONB, NULL::TIMESTAMPTZ)::TRANSFER_REQUEST_V2
+            FROM unnest(transfer_requests) WITH ORDINALITY AS r (from_account_id, to_account_id, amount, n)
+            ORDER BY r.n
+        ),
+        event_at => event_at,
+        metadata => metadata,
+        idempotency_key => idempotency_key,
+        pending => pending
+    );
+END;
+$$ LANGUAGE plpgsql;
+
+INSERT INTO pgledger_schema_migrations (version) VALUES (10);
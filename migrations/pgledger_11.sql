@@ -0,0 +1,435 @@
+-- Journals, which record which transfers were created together. Every call to
+-- pgledger_create_transfers (and so pgledger_create_transfer and
+-- pgledger_reverse_transfer) creates one journal, with the metadata of the
+-- call, and every transfer it creates points to it. Posting or voiding a
+-- pending transfer also creates a journal for its transfers.
+--
+-- Transfers created before this migration don't have a journal.
+CREATE TABLE pgledger_journals (
+    id TEXT PRIMARY KEY DEFAULT pgledger_generate_id('pglj'),
+    metadata JSONB,
+    created_at TIMESTAMPTZ NOT NULL
+);
+
+ALTER TABLE pgledger_transfers ADD COLUMN journal_id TEXT REFERENCES pgledger_journals (id);
+
+CREATE INDEX ON pgledger_transfers (journal_id) WHERE journal_id IS NOT NULL;
+
+CREATE VIEW pgledger_journals_view AS
+SELECT
+    id,
+    metadata,
+    created_at
+FROM pgledger_journals;
+
+CREATE OR REPLACE VIEW pgledger_transfers_view AS
+SELECT
+    t.id,
+    t.from_account_id,
+    t.to_account_id,
+    t.amount,
+    t.created_at,
+    t.event_at,
+    t.metadata,
+    t.idempotency_key,
+    t.reverses_transfer_id,
+    t.status,
+    t.pending_transfer_id,
+    fa.currency,
+    fa.name AS from_account_name,
+    ta.name AS to_account_name,
+    fe.account_current_balance AS from_account_balance,
+    fe.account_version AS from_account_version,
+    te.account_current_balance AS to_account_balance,
+    te.account_version AS to_account_version,
+    t.journal_id
+FROM pgledger_transfers t
+JOIN pgledger_accounts fa ON t.from_account_id = fa.id
+JOIN pgledger_accounts ta ON t.to_account_id = ta.id
+JOIN pgledger_entries fe ON t.id = fe.transfer_id AND t.from_account_id = fe.account_id
+JOIN pgledger_entries te ON t.id = te.transfer_id AND t.to_account_id = te.account_id;
+
+-- The function gains a new parameter, so the old version has to be dropped
+-- rather than replaced. The functions which call it are all replaced below.
+DROP FUNCTION pgledger_apply_transfer(TEXT, TEXT, NUMERIC, TEXT, TEXT, TIMESTAMPTZ, JSONB, TEXT);
+
+CREATE FUNCTION pgledger_apply_transfer(
+    from_account_id TEXT,
+    to_account_id TEXT,
+    amount NUMERIC,
+    transfer_status TEXT,
+    pending_transfer_id TEXT,
+    event_at TIMESTAMPTZ,
+    metadata JSONB,
+    idempotency_key TEXT,
+    journal_id TEXT
+)
+RETURNS TEXT
+AS $$
+DECLARE
+    from_account pgledger_accounts;
+    to_account pgledger_accounts;
+    balance_change NUMERIC := 0;
+    pending_change NUMERIC := 0;
+    new_transfer_id TEXT;
+BEGIN
+    -- Preliminary checks
+    IF amount <= 0 THEN
+        RAISE EXCEPTION 'Amount (%) must be positive', amount
+        USING
+            ERRCODE = 'PGL04',
+            DETAIL = json_build_object('amount', amount::TEXT)::TEXT;
+    END IF;
+
+    IF from_account_id = to_account_id THEN
+        RAISE EXCEPTION 'Cannot transfer to the same account (id=%)', from_account_id
+        USING
+            ERRCODE = 'PGL05',
+            DETAIL = json_build_object('account_id', from_account_id)::TEXT;
+    END IF;
+
+    IF transfer_status = 'posted' THEN
+        balance_change := amount;
+    ELSIF transfer_status = 'pending' THEN
+        pending_change := amount;
+    ELSE
+        pending_change := -amount;
+    END IF;
+
+    -- Update account balances
+    UPDATE pgledger_accounts a
+    SET balance = a.balance - balance_change,
+        pending_debits = a.pending_debits + pending_change,
+        version = a.version + 1,
+        updated_at = now()
+    WHERE a.id = from_account_id
+    RETURNING * INTO from_account;
+
+    -- Check status and balance constraints for the source account. Releasing a
+    -- pending amount is always allowed, so that pending transfers can still be
+    -- voided after an account is frozen.
+    IF transfer_status != 'released' THEN
+        PERFORM pgledger_check_account_status(from_account, debit => TRUE);
+    END IF;
+    PERFORM pgledger_check_account_balance_constraints(from_account);
+
+    UPDATE pgledger_accounts a
+    SET balance = a.balance + balance_change,
+        pending_credits = a.pending_credits + pending_change,
+        version = a.version + 1,
+        updated_at = now()
+    WHERE a.id = to_account_id
+    RETURNING * INTO to_account;
+
+    -- Check status and balance constraints for the destination account
+    IF transfer_status != 'released' THEN
+        PERFORM pgledger_check_account_status(to_account, debit => FALSE);
+    END IF;
+    PERFORM pgledger_check_account_balance_constraints(to_account);
+
+    -- Check that currencies match
+    IF from_account.currency != to_account.currency THEN
+        RAISE EXCEPTION 'Cannot transfer between different currencies (% and %)', from_account.currency, to_account.currency
+        USING
+            ERRCODE = 'PGL03',
+            DETAIL = json_build_object(
+                'from_account_id', from_account.id,
+                'to_account_id', to_account.id,
+                'from_currency', from_account.currency,
+                'to_currency', to_account.currency
+            )::TEXT;
+    END IF;
+
+    -- Create transfer record
+    INSERT INTO pgledger_transfers (
+        from_account_id,
+        to_account_id,
+        amount,
+        created_at,
+        event_at,
+        metadata,
+        idempotency_key,
+        status,
+        pending_transfer_id,
+        journal_id
+    )
+    VALUES (
+        from_account_id,
+        to_account_id,
+        amount,
+        now(),
+        event_at,
+        metadata,
+        idempotency_key,
+        transfer_status,
+        pending_transfer_id,
+        journal_id
+    )
+    RETURNING pgledger_transfers.id INTO new_transfer_id;
+
+    -- Create entry for the source account (negative amount, or positive when
+    -- releasing a pending amount)
+    INSERT INTO pgledger_entries (
+        account_id, transfer_id, amount, account_previous_balance, account_current_balance, account_version, created_at, pending
+    )
+    VALUES (
+        from_account_id,
+        new_transfer_id,
+        -(balance_change + pending_change),
+        from_account.balance + balance_change,
+        from_account.balance,
+        from_account.version,
+        now(),
+        transfer_status != 'posted'
+    );
+
+    -- Create entry for the destination account (positive amount, or negative
+    -- when releasing a pending amount)
+    INSERT INTO pgledger_entries (
+        account_id, transfer_id, amount, account_previous_balance, account_current_balance, account_version, created_at, pending
+    )
+    VALUES (
+        to_account_id,
+        new_transfer_id,
+        balance_change + pending_change,
+        to_account.balance - balance_change,
+        to_account.balance,
+        to_account.version,
+        now(),
+        transfer_status != 'posted'
+    );
+
+    RETURN new_transfer_id;
+END;
+$$ LANGUAGE plpgsql;
+
+
+-- Same as before, but creating a journal for the transfers
+CREATE OR REPLACE FUNCTION pgledger_create_transfers(
+    transfer_requests TRANSFER_REQUEST_V2 [],
+    event_at TIMESTAMPTZ DEFAULT NULL,
+    metadata JSONB DEFAULT NULL,
+    idempotency_key TEXT DEFAULT NULL,
+    pending BOOLEAN DEFAULT FALSE
+)
+RETURNS SETOF PGLEDGER_TRANSFERS_VIEW
+AS $$
+DECLARE
+    transfer_request transfer_request_v2;
+    resolved_requests transfer_request_v2[] := '{}';
+    transfer_ids TEXT[] := '{}';
+    new_journal_id TEXT;
+    account_id TEXT;
+    all_account_ids TEXT[] := '{}';
+    request JSONB;
+    existing_key pgledger_idempotency_keys;
+BEGIN
+    IF idempotency_key IS NOT NULL THEN
+        request := jsonb_build_object(
+            'transfer_requests', pgledger_idempotency_transfer_requests(transfer_requests),
+            'metadata', metadata
+        );
+
+        -- Only include pending when it's set, so that keys stored before it
+        -- existed still match
+        IF pending THEN
+            request := request || jsonb_build_object('pending', TRUE);
+        END IF;
+
+        -- If another transaction is using the same key, this waits for it to
+        -- commit or roll back
+        INSERT INTO pgledger_idempotency_keys (idempotency_key, request, event_at, created_at)
+        VALUES (idempotency_key, request, event_at, now())
+        ON CONFLICT ON CONSTRAINT pgledger_idempotency_keys_pkey DO NOTHING;
+
+        IF NOT FOUND THEN
+            SELECT * INTO existing_key
+            FROM pgledger_idempotency_keys k
+            WHERE k.idempotency_key = pgledger_create_transfers.idempotency_key;
+
+            IF existing_key.request != request OR existing_key.event_at IS DISTINCT FROM event_at THEN
+                RAISE EXCEPTION 'Idempotency key (%) was already used with different parameters', idempotency_key
+                USING
+                    ERRCODE = 'PGL07',
+                    DETAIL = json_build_object('idempotency_key', idempotency_key)::TEXT;
+            END IF;
+
+            -- Return the transfers from the original call
+            RETURN QUERY
+            SELECT *
+            FROM pgledger_transfers_view t
+            WHERE t.idempotency_key = pgledger_create_transfers.idempotency_key
+            ORDER BY t.id;
+
+            RETURN;
+        END IF;
+    END IF;
+
+    -- Resolve external refs to account IDs, so that the accounts are locked in
+    -- the same order no matter how they are referenced
+    FOREACH transfer_request IN ARRAY transfer_requests LOOP
+        transfer_request.from_account_id := pgledger_resolve_account_id(transfer_request.from_account_id);
+        transfer_request.to_account_id := pgledger_resolve_account_id(transfer_request.to_account_id);
+        resolved_requests := array_append(resolved_requests, transfer_request);
+    END LOOP;
+
+    -- Collect all unique account IDs and sort them to prevent deadlocks
+    FOREACH transfer_request IN ARRAY resolved_requests LOOP
+        all_account_ids := array_append(all_account_ids, transfer_request.from_account_id);
+        all_account_ids := array_append(all_account_ids, transfer_request.to_account_id);
+    END LOOP;
+
+    -- Remove duplicates and sort
+    SELECT ARRAY(SELECT DISTINCT unnest FROM unnest(all_account_ids) ORDER BY unnest)
+    INTO all_account_ids;
+
+    -- Lock all accounts in order
+    FOREACH account_id IN ARRAY all_account_ids LOOP
+        PERFORM pgledger_accounts.id
+        FROM pgledger_accounts
+        WHERE pgledger_accounts.id = account_id
+        FOR UPDATE;
+
+        IF NOT FOUND THEN
+            RAISE EXCEPTION 'Account (id=%) does not exist', account_id
+            USING
+                ERRCODE = 'PGL06',
+                DETAIL = json_build_object('account_id', account_id)::TEXT;
+        END IF;
+    END LOOP;
+
+    INSERT INTO pgledger_journals (metadata, created_at)
+    VALUES (metadata, now())
+    RETURNING pgledger_journals.id INTO new_journal_id;
+
+    -- Process each transfer
+    FOREACH transfer_request IN ARRAY resolved_requests LOOP
+        transfer_ids := array_append(transfer_ids, pgledger_apply_transfer(
+            from_account_id => transfer_request.from_account_id,
+            to_account_id => transfer_request.to_account_id,
+            amount => transfer_request.amount,
+            transfer_status => CASE WHEN pending THEN 'pending' ELSE 'posted' END,
+            pending_transfer_id => NULL,
+            event_at => coalesce(transfer_request.event_at, event_at, now()),
+            metadata => coalesce(transfer_request.metadata, metadata),
+            idempotency_key => idempotency_key,
+            journal_id => new_journal_id
+        ));
+    END LOOP;
+
+    -- Return all created transfers
+    RETURN QUERY
+    SELECT *
+    FROM pgledger_transfers_view
+    WHERE id = ANY(transfer_ids)
+    ORDER BY id;
+END;
+$$ LANGUAGE plpgsql;
+
+
+-- Same as before, but creating a journal for the released and posted transfers
+CREATE OR REPLACE FUNCTION pgledger_post_pending_transfer(
+    pending_transfer_id TEXT,
+    amount NUMERIC DEFAULT NULL,
+    metadata JSONB DEFAULT NULL
+)
+RETURNS SETOF PGLEDGER_TRANSFERS_VIEW
+AS $$
+DECLARE
+    pending_transfer pgledger_transfers;
+    posted_transfer_id TEXT;
+    new_journal_id TEXT;
+BEGIN
+    pending_transfer := pgledger_lock_pending_transfer(pending_transfer_id);
+
+    amount := coalesce(amount, pending_transfer.amount);
+    metadata := coalesce(metadata, pending_transfer.metadata);
+
+    IF amount > pending_transfer.amount THEN
+        RAISE EXCEPTION 'Amount (%) exceeds the pending amount (%) of transfer (id=%)',
+        amount, pending_transfer.amount, pending_transfer.id
+        USING
+            ERRCODE = 'PGL13',
+            DETAIL = json_build_object(
+                'transfer_id', pending_transfer.id,
+                'amount', amount::TEXT,
+                'pending_amount', pending_transfer.amount::TEXT
+            )::TEXT;
+    END IF;
+
+    INSERT INTO pgledger_journals (metadata, created_at)
+    VALUES (metadata, now())
+    RETURNING pgledger_journals.id INTO new_journal_id;
+
+    PERFORM pgledger_apply_transfer(
+        from_account_id => pending_transfer.from_account_id,
+        to_account_id => pending_transfer.to_account_id,
+        amount => pending_transfer.amount,
+        transfer_status => 'released',
+        pending_transfer_id => pending_transfer.id,
+        event_at => now(),
+        metadata => metadata,
+        idempotency_key => NULL,
+        journal_id => new_journal_id
+    );
+
+    posted_transfer_id := pgledger_apply_transfer(
+        from_account_id => pending_transfer.from_account_id,
+        to_account_id => pending_transfer.to_account_id,
+        amount => amount,
+        transfer_status => 'posted',
+        pending_transfer_id => pending_transfer.id,
+        event_at => now(),
+        metadata => metadata,
+        idempotency_key => NULL,
+        journal_id => new_journal_id
+    );
+
+    RETURN QUERY
+    SELECT *
+    FROM pgledger_transfers_view v
+    WHERE v.id = posted_transfer_id;
+END;
+$$ LANGUAGE plpgsql;
+
+
+-- Same as before, but creating a journal for the released transfer
+CREATE OR REPLACE FUNCTION pgledger_void_pending_transfer(
+    pending_transfer_id TEXT,
+    metadata JSONB DEFAULT NULL
+)
+RETURNS SETOF PGLEDGER_TRANSFERS_VIEW
+AS $$
+DECLARE
+    pending_transfer pgledger_transfers;
+    released_transfer_id TEXT;
+    new_journal_id TEXT;
+BEGIN
+    pending_transfer := pgledger_lock_pending_transfer(pending_transfer_id);
+    metadata := coalesce(metadata, pending_transfer.metadata);
+
+    INSERT INTO pgledger_journals (metadata, created_at)
+    VALUES (metadata, now())
+    RETURNING pgledger_journals.id INTO new_journal_id;
+
+    released_transfer_id := pgledger_apply_transfer(
+        from_account_id => pending_transfer.from_account_id,
+        to_account_id => pending_transfer.to_account_id,
+        amount => pending_transfer.amount,
+        transfer_status => 'released',
+        pending_transfer_id => pending_transfer.id,
+        event_at => now(),
+        metadata => metadata,
+        idempotency_key => NULL,
+        journal_id => new_journal_id
+    );
+
+    RETURN QUERY
+    SELECT *
+    FROM pgledger_transfers_view v
+    WHERE v.id = released_transfer_id;
+END;
+$$ LANGUAGE plpgsql;
+
+
+INSERT INTO pgledger_schema_migrations (version) VALUES (11);
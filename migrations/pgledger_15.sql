@@ -0,0 +1,49 @@
+-- Running balances in event_at order. The balances on pgledger_entries are in
+-- the order the entries were created, so a transfer with an event_at in the
+-- past (such as a late webhook) makes them differ from the real world history,
+-- like a bank statement. This view recomputes them ordered by event_at, with
+-- the entry ID as a tiebreaker.
+--
+-- The view has the same columns as pgledger_entries_view, but only posted
+-- entries, since pending and released entries don't change the balance. The
+-- account_version is still the one from when the entry was created.
+--
+-- The balances are computed from the start of each account's history, so
+-- filter the view by account_id (which is pushed down into the window) and
+-- then by event_at, or use pgledger_account_entries_by_event_at.
+CREATE VIEW pgledger_entries_by_event_at_view AS
+SELECT
+    e.id,
+    e.account_id,
+    e.transfer_id,
+    e.amount,
+    sum(e.amount) OVER w - e.amount AS account_previous_balance,
+    sum(e.amount) OVER w AS account_current_balance,
+    e.account_version,
+    e.created_at,
+    t.event_at,
+    t.metadata,
+    e.pending
+FROM pgledger_entries e
+INNER JOIN pgledger_transfers t ON e.transfer_id = t.id
+WHERE NOT e.pending
+WINDOW w AS (PARTITION BY e.account_id ORDER BY t.event_at, e.id ROWS UNBOUNDED PRECEDING);
+
+-- The entries of an account with an event_at in [start_at, end_at), with
+-- running balances in event_at order. Either end of the period can be left out.
+CREATE FUNCTION pgledger_account_entries_by_event_at(
+    account_id TEXT,
+    start_at TIMESTAMPTZ DEFAULT NULL,
+    end_at TIMESTAMPTZ DEFAULT NULL
+)
+RETURNS SETOF PGLEDGER_ENTRIES_BY_EVENT_AT_VIEW
+AS $$
+    SELECT *
+    FROM pgledger_entries_by_event_at_view v
+    WHERE v.account_id = pgledger_account_entries_by_event_at.account_id
+        AND (pgledger_account_entries_by_event_at.start_at IS NULL OR v.event_at >= pgledger_account_entries_by_event_at.start_at)
+        AND (pgledger_account_entries_by_event_at.end_at IS NULL OR v.event_at < pgledger_account_entries_by_event_at.end_at)
+    ORDER BY v.event_at, v.id;
+$$ LANGUAGE sql STABLE;
+
+INSERT INTO pgledger_schema_migrations (version) VALUES (15);
@@ -0,0 +1,163 @@
+-- Integrity checks. pgledger_verify returns a row for every discrepancy it
+-- finds, so an empty result means the ledger is consistent:
+--
+--   balance_drift: the balance (or pending_debits/pending_credits) of an
+--     account doesn't match the sum of its entries
+--   version_gap: the account_version of an account's entries doesn't count up
+--     from 1 without gaps, or the version of the account doesn't match its last
+--     entry
+--   balance_chain: the account_previous_balance of an entry doesn't match the
+--     account_current_balance of the entry before it, or the entry's amount
+--     doesn't explain the change
+--   transfer_entries: a transfer doesn't have exactly 2 entries (one for each
+--     account) which add up to 0
+--   currency_total: the balances (or the pending amounts) in a currency don't
+--     add up to 0
+--
+-- It reads the whole ledger, so it can take a while on a big one.
+CREATE FUNCTION pgledger_verify()
+RETURNS TABLE (problem TEXT, object_id TEXT, detail JSONB)
+AS $$
+    WITH entry_totals AS (
+        SELECT
+            e.account_id,
+            sum(e.amount) FILTER (WHERE NOT e.pending) AS balance,
+            -sum(e.amount) FILTER (WHERE e.pending AND e.account_id = t.from_account_id) AS pending_debits,
+            sum(e.amount) FILTER (WHERE e.pending AND e.account_id = t.to_account_id) AS pending_credits,
+            max(e.account_version) AS version
+        FROM pgledger_entries e
+        INNER JOIN pgledger_transfers t ON e.transfer_id = t.id
+        GROUP BY e.account_id
+    ),
+
+    account_totals AS (
+        SELECT
+            a.id,
+            a.balance,
+            a.pending_debits,
+            a.pending_credits,
+            a.version,
+            coalesce(et.balance, 0) AS entries_balance,
+            coalesce(et.pending_debits, 0) AS entries_pending_debits,
+            coalesce(et.pending_credits, 0) AS entries_pending_credits,
+            coalesce(et.version, 0) AS entries_version
+        FROM pgledger_accounts a
+        LEFT JOIN entry_totals et ON a.id = et.account_id
+    ),
+
+    ordered_entries AS (
+        SELECT
+            e.id,
+            e.account_id,
+            e.amount,
+            e.pending,
+            e.account_version,
+            e.account_previous_balance,
+            e.account_current_balance,
+            coalesce(lag(e.account_version) OVER w, 0) AS expected_previous_version,
+            coalesce(lag(e.account_current_balance) OVER w, 0) AS expected_previous_balance
+        FROM pgledger_entries e
+        WINDOW w AS (PARTITION BY e.account_id ORDER BY e.account_version, e.id)
+    ),
+
+    transfer_entries AS (
+        SELECT
+            t.id,
+            count(e.id) AS entry_count,
+            coalesce(sum(e.amount), 0) AS total,
+            coalesce(bool_or(e.account_id = t.from_account_id), FALSE) AS has_from_entry,
+            coalesce(bool_or(e.account_id = t.to_account_id), FALSE) AS has_to_entry
+        FROM pgledger_transfers t
+        LEFT JOIN pgledger_entries e ON t.id = e.transfer_id
+        GROUP BY t.id
+    )
+
+    SELECT
+        'balance_drift',
+        acc.id,
+        jsonb_build_object(
+            'balance', acc.balance::TEXT,
+            'entries_balance', acc.entries_balance::TEXT,
+            'pending_debits', acc.pending_debits::TEXT,
+            'entries_pending_debits', acc.entries_pending_debits::TEXT,
+            'pending_credits', acc.pending_credits::TEXT,
+            'entries_pending_credits', acc.entries_pending_credits::TEXT
+        )
+    FROM account_totals acc
+    WHERE
+        acc.balance != acc.entries_balance
+        OR acc.pending_debits != acc.entries_pending_debits
+        OR acc.pending_credits != acc.entries_pending_credits
+
+    UNION ALL
+
+    SELECT
+        'version_gap',
+        acc.id,
+        jsonb_build_object('version', acc.version, 'entries_version', acc.entries_version)
+    FROM account_totals acc
+    WHERE acc.version != acc.entries_version
+
+    UNION ALL
+
+    SELECT
+        'version_gap',
+        oe.id,
+        jsonb_build_object(
+            'account_id', oe.account_id,
+            'account_version', oe.account_version,
+            'previous_version', oe.expected_previous_version
+        )
+    FROM ordered_entries oe
+    WHERE oe.account_version != oe.expected_previous_version + 1
+
+    UNION ALL
+
+    SELECT
+        'balance_chain',
+        oe.id,
+        jsonb_build_object(
+            'account_id', oe.account_id,
+            'account_version', oe.account_version,
+            'amount', oe.amount::TEXT,
+            'account_previous_balance', oe.account_previous_balance::TEXT,
+            'account_current_balance', oe.account_current_balance::TEXT,
+            'expected_previous_balance', oe.expected_previous_balance::TEXT
+        )
+    FROM ordered_entries oe
+    WHERE
+        oe.account_previous_balance != oe.expected_previous_balance
+        -- Pending entries change the pending amounts instead of the balance
+        OR oe.account_current_balance
+        != oe.account_previous_balance + CASE WHEN oe.pending THEN 0 ELSE oe.amount END
+
+    UNION ALL
+
+    SELECT
+        'transfer_entries',
+        te.id,
+        jsonb_build_object(
+            'entry_count', te.entry_count,
+            'total', te.total::TEXT,
+            'has_from_entry', te.has_from_entry,
+            'has_to_entry', te.has_to_entry
+        )
+    FROM transfer_entries te
+    WHERE te.entry_count != 2 OR te.total != 0 OR NOT te.has_from_entry OR NOT te.has_to_entry
+
+    UNION ALL
+
+    SELECT
+        'currency_total',
+        a.currency,
+        jsonb_build_object(
+            'balance', sum(a.balance)::TEXT,
+            'pending_debits', sum(a.pending_debits)::TEXT,
+            'pending_credits', sum(a.pending_credits)::TEXT
+        )
+    FROM pgledger_accounts a
+    GROUP BY a.currency
+    HAVING sum(a.balance) != 0 OR sum(a.pending_debits) != sum(a.pending_credits);
+$$ LANGUAGE sql STABLE;
+
+INSERT INTO pgledger_schema_migrations (version) VALUES (16);
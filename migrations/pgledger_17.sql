@@ -0,0 +1,165 @@
+-- A tamper-evident hash chain over the entries of each account. Every entry
+-- stores a SHA-256 hash of its own columns and the hash of the account's entry
+-- before it (by account_version), so editing or deleting an entry changes the
+-- hash that every later entry of the account was computed from.
+--
+-- The hash is computed over these values, joined with |, and prefixed with the
+-- bytes of the previous hash (nothing for an account's first entry):
+--
+--   id|account_id|transfer_id|amount|account_previous_balance|account_current_balance|account_version|created_at|pending
+--
+-- The amounts are formatted as NUMERIC text (keeping their scale), created_at
+-- as UTC with microseconds (2025-06-01T12:00:00.000000Z), and pending as true
+-- or false. This is enough to recompute the chain from an export of the
+-- entries, without access to the database.
+--
+-- To show that the history wasn't rewritten after the fact, record the latest
+-- hash of an account somewhere outside the ledger, such as in an audit report.
+
+-- The chain is keyed by account_version, so make sure it's unique
+CREATE UNIQUE INDEX ON pgledger_entries (account_id, account_version);
+
+ALTER TABLE pgledger_entries
+ADD COLUMN hash BYTEA;
+
+CREATE FUNCTION pgledger_entry_hash(entry PGLEDGER_ENTRIES, previous_hash BYTEA)
+RETURNS BYTEA
+AS $$
+    SELECT sha256(
+        coalesce(previous_hash, ''::BYTEA)
+        || convert_to(
+            concat_ws(
+                '|',
+                entry.id,
+                entry.account_id,
+                entry.transfer_id,
+                entry.amount::TEXT,
+                entry.account_previous_balance::TEXT,
+                entry.account_current_balance::TEXT,
+                entry.account_version::TEXT,
+                to_char(entry.created_at AT TIME ZONE 'UTC', 'YYYY-MM-DD"T"HH24:MI:SS.US"Z"'),
+                entry.pending::TEXT
+            ),
+            'UTF8'
+        )
+    );
+$$ LANGUAGE sql STABLE;
+
+-- Hash the existing entries, in order for each account
+DO $$
+DECLARE
+    entry pgledger_entries;
+    previous_account_id TEXT;
+    previous_hash BYTEA;
+BEGIN
+    FOR entry IN
+        SELECT *
+        FROM pgledger_entries e
+        ORDER BY e.account_id, e.account_version
+    LOOP
+        IF previous_account_id IS DISTINCT FROM entry.account_id THEN
+            previous_hash := NULL;
+        END IF;
+
+        previous_hash := pgledger_entry_hash(entry, previous_hash);
+        previous_account_id := entry.account_id;
+
+        UPDATE pgledger_entries e
+        SET hash = previous_hash
+        WHERE e.id = entry.id;
+    END LOOP;
+END;
+$$;
+
+ALTER TABLE pgledger_entries
+ALTER COLUMN hash SET NOT NULL;
+
+-- Set the hash of new entries. The ledger functions lock the account before
+-- adding entries to it, so the previous entry can't change underneath this.
+CREATE FUNCTION pgledger_set_entry_hash()
+RETURNS TRIGGER
+AS $$
+DECLARE
+    previous_hash BYTEA;
+BEGIN
+    SELECT e.hash INTO previous_hash
+    FROM pgledger_entries e
+    WHERE e.account_id = NEW.account_id
+        AND e.account_version < NEW.account_version
+    ORDER BY e.account_version DESC
+    LIMIT 1;
+
+    NEW.hash := pgledger_entry_hash(NEW, previous_hash);
+
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER pgledger_set_entry_hash
+BEFORE INSERT ON pgledger_entries
+FOR EACH ROW
+EXECUTE FUNCTION pgledger_set_entry_hash();
+
+CREATE OR REPLACE VIEW pgledger_entries_view AS
+SELECT
+    e.id,
+    e.account_id,
+    e.transfer_id,
+    e.amount,
+    e.account_previous_balance,
+    e.account_current_balance,
+    e.account_version,
+    e.created_at,
+    t.event_at,
+    t.metadata,
+    e.pending,
+    encode(e.hash, 'hex') AS hash
+FROM pgledger_entries e
+INNER JOIN pgledger_transfers t ON e.transfer_id = t.id;
+
+CREATE OR REPLACE VIEW pgledger_entries_by_event_at_view AS
+SELECT
+    e.id,
+    e.account_id,
+    e.transfer_id,
+    e.amount,
+    sum(e.amount) OVER w - e.amount AS account_previous_balance,
+    sum(e.amount) OVER w AS account_current_balance,
+    e.account_version,
+    e.created_at,
+    t.event_at,
+    t.metadata,
+    e.pending,
+    encode(e.hash, 'hex') AS hash
+FROM pgledger_entries e
+INNER JOIN pgledger_transfers t ON e.transfer_id = t.id
+WHERE NOT e.pending
+WINDOW w AS (PARTITION BY e.account_id ORDER BY t.event_at, e.id ROWS UNBOUNDED PRECEDING);
+
+-- Recompute the hash chain of an account and return the entries whose stored
+-- hash doesn't match. Each entry is checked against the stored hash of the
+-- entry before it, so an edited entry shows up itself, and a deleted entry (or
+-- an entry whose hash was overwritten) shows up as the entry after it. An
+-- empty result means the chain is intact.
+CREATE FUNCTION pgledger_verify_hash_chain(account_id TEXT)
+RETURNS TABLE (entry_id TEXT, account_version BIGINT, hash TEXT, expected_hash TEXT)
+AS $$
+    SELECT
+        chain.id,
+        chain.account_version,
+        encode(chain.hash, 'hex'),
+        encode(chain.expected_hash, 'hex')
+    FROM (
+        SELECT
+            e.id,
+            e.account_version,
+            e.hash,
+            pgledger_entry_hash(e, lag(e.hash) OVER (ORDER BY e.account_version)) AS expected_hash
+        FROM pgledger_entries e
+        WHERE e.account_id = pgledger_verify_hash_chain.account_id
+    ) chain
+    WHERE chain.hash IS DISTINCT FROM chain.expected_hash
+    ORDER BY chain.account_version;
+$$ LANGUAGE sql STABLE;
+
+INSERT INTO pgledger_schema_migrations (version) VALUES (17);
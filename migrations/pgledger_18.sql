@@ -0,0 +1,482 @@
+-- Ledger history is append-only. Triggers reject any UPDATE, DELETE or
+-- TRUNCATE of transfers, entries, journals and exchanges, and any UPDATE of the
+-- balance, pending amounts, version or currency of an account, unless it comes
+-- with the entry that explains it. Other account columns, such as the name and
+-- metadata, can still be updated directly.
+--
+-- When history really has to be changed, such as to repair data after an
+-- incident, call pgledger_allow_direct_writes with a reason in the same
+-- transaction:
+--
+--   BEGIN;
+--   SELECT pgledger_allow_direct_writes('Fix created_at of imported entries, see INC-123');
+--   UPDATE pgledger_entries SET created_at = ... WHERE id = ...;
+--   COMMIT;
+--
+-- Every direct write is then recorded in pgledger_direct_writes, with the row
+-- before and after, the reason and the database user. The log is protected the
+-- same way.
+--
+-- New error code:
+--   PGL22: Ledger history can't be modified outside the pgledger functions
+CREATE TABLE pgledger_direct_writes (
+    id TEXT PRIMARY KEY DEFAULT pgledger_generate_id('pglw'),
+    table_name TEXT NOT NULL,
+    operation TEXT NOT NULL,
+    row_id TEXT,
+    old_row JSONB,
+    new_row JSONB,
+    reason TEXT NOT NULL,
+    username TEXT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL
+);
+
+-- Allow direct writes to ledger history until the end of the current
+-- transaction
+CREATE FUNCTION pgledger_allow_direct_writes(reason TEXT)
+RETURNS VOID
+AS $$
+BEGIN
+    IF coalesce(trim(reason), '') = '' THEN
+        RAISE EXCEPTION 'A reason is required to allow direct writes'
+        USING ERRCODE = 'invalid_parameter_value';
+    END IF;
+
+    PERFORM set_config('pgledger.direct_write_reason', reason, TRUE);
+END;
+$$ LANGUAGE plpgsql;
+
+-- Check that an account update is explained by an entry: the version goes up
+-- by one, and the entry for the new version moves the balance or pending
+-- amounts from the old values to the new ones. pgledger_apply_transfer inserts
+-- the entries before it updates the accounts.
+CREATE FUNCTION pgledger_account_update_has_entry(old_account PGLEDGER_ACCOUNTS, new_account PGLEDGER_ACCOUNTS)
+RETURNS BOOLEAN
+AS $$
+    SELECT new_account.currency = old_account.currency
+        AND new_account.version = old_account.version + 1
+        AND EXISTS (
+            SELECT 1
+            FROM pgledger_entries e
+            JOIN pgledger_transfers t ON e.transfer_id = t.id
+            WHERE e.account_id = new_account.id
+                AND e.account_version = new_account.version
+                AND e.account_current_balance = new_account.balance
+                AND new_account.balance = old_account.balance + CASE WHEN e.pending THEN 0 ELSE e.amount END
+                AND new_account.pending_debits = old_account.pending_debits
+                - CASE WHEN e.pending AND t.from_account_id = e.account_id THEN e.amount ELSE 0 END
+                AND new_account.pending_credits = old_account.pending_credits
+                + CASE WHEN e.pending AND t.to_account_id = e.account_id THEN e.amount ELSE 0 END
+        );
+$$ LANGUAGE sql STABLE;
+
+-- Anything which reaches this trigger needs pgledger_allow_direct_writes, and
+-- is logged. The only exception is an account update which is explained by an
+-- entry.
+CREATE FUNCTION pgledger_check_ledger_write()
+RETURNS TRIGGER
+AS $$
+DECLARE
+    reason TEXT := nullif(current_setting('pgledger.direct_write_reason', TRUE), '');
+    target TEXT := TG_TABLE_NAME;
+    changed_row_id TEXT;
+    old_values JSONB;
+    new_values JSONB;
+BEGIN
+    -- Balances are checked against the entries rather than against who is
+    -- making the change, since any session can change a setting or create a
+    -- function with the same name as a pgledger function
+    IF TG_TABLE_NAME = 'pgledger_accounts' AND pgledger_account_update_has_entry(OLD, NEW) THEN
+        RETURN NEW;
+    END IF;
+
+    -- OLD and NEW are null for TRUNCATE, which applies to the whole table
+    IF TG_OP = 'UPDATE' THEN
+        changed_row_id := OLD.id;
+        old_values := to_jsonb(OLD);
+        new_values := to_jsonb(NEW);
+    ELSIF TG_OP = 'DELETE' THEN
+        changed_row_id := OLD.id;
+        old_values := to_jsonb(OLD);
+    END IF;
+
+    IF changed_row_id IS NOT NULL THEN
+        target := format('%s (id=%s)', TG_TABLE_NAME, changed_row_id);
+    END IF;
+
+    IF reason IS NULL THEN
+        RAISE EXCEPTION 'Cannot % % outside the pgledger functions', TG_OP, target
+        USING
+            ERRCODE = 'PGL22',
+            HINT = 'Use pgledger_allow_direct_writes to make an exception',
+            DETAIL = json_build_object('table', TG_TABLE_NAME, 'operation', TG_OP)::TEXT;
+    END IF;
+
+    INSERT INTO pgledger_direct_writes (table_name, operation, row_id, old_row, new_row, reason, username, created_at)
+    VALUES (TG_TABLE_NAME, TG_OP, changed_row_id, old_values, new_values, reason, session_user, now());
+
+    IF TG_OP = 'DELETE' THEN
+        RETURN OLD;
+    END IF;
+
+    -- The return value is ignored for TRUNCATE, which has no rows
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER pgledger_check_ledger_write
+BEFORE UPDATE OR DELETE ON pgledger_entries
+FOR EACH ROW
+EXECUTE FUNCTION pgledger_check_ledger_write();
+
+CREATE TRIGGER pgledger_check_ledger_truncate
+BEFORE TRUNCATE ON pgledger_entries
+FOR EACH STATEMENT
+EXECUTE FUNCTION pgledger_check_ledger_write();
+
+CREATE TRIGGER pgledger_check_ledger_write
+BEFORE UPDATE OR DELETE ON pgledger_transfers
+FOR EACH ROW
+EXECUTE FUNCTION pgledger_check_ledger_write();
+
+CREATE TRIGGER pgledger_check_ledger_truncate
+BEFORE TRUNCATE ON pgledger_transfers
+FOR EACH STATEMENT
+EXECUTE FUNCTION pgledger_check_ledger_write();
+
+CREATE TRIGGER pgledger_check_ledger_write
+BEFORE UPDATE OR DELETE ON pgledger_journals
+FOR EACH ROW
+EXECUTE FUNCTION pgledger_check_ledger_write();
+
+CREATE TRIGGER pgledger_check_ledger_truncate
+BEFORE TRUNCATE ON pgledger_journals
+FOR EACH STATEMENT
+EXECUTE FUNCTION pgledger_check_ledger_write();
+
+CREATE TRIGGER pgledger_check_ledger_write
+BEFORE UPDATE OR DELETE ON pgledger_exchanges
+FOR EACH ROW
+EXECUTE FUNCTION pgledger_check_ledger_write();
+
+CREATE TRIGGER pgledger_check_ledger_truncate
+BEFORE TRUNCATE ON pgledger_exchanges
+FOR EACH STATEMENT
+EXECUTE FUNCTION pgledger_check_ledger_write();
+
+CREATE TRIGGER pgledger_check_ledger_write
+BEFORE UPDATE OR DELETE ON pgledger_direct_writes
+FOR EACH ROW
+EXECUTE FUNCTION pgledger_check_ledger_write();
+
+CREATE TRIGGER pgledger_check_ledger_truncate
+BEFORE TRUNCATE ON pgledger_direct_writes
+FOR EACH STATEMENT
+EXECUTE FUNCTION pgledger_check_ledger_write();
+
+-- Accounts can be updated directly, except for the columns which have to match
+-- the entries. These only change together with a new entry.
+CREATE TRIGGER pgledger_check_ledger_write
+BEFORE UPDATE ON pgledger_accounts
+FOR EACH ROW
+WHEN (
+    OLD.balance IS DISTINCT FROM NEW.balance
+    OR OLD.pending_debits IS DISTINCT FROM NEW.pending_debits
+    OR OLD.pending_credits IS DISTINCT FROM NEW.pending_credits
+    OR OLD.version IS DISTINCT FROM NEW.version
+    OR OLD.currency IS DISTINCT FROM NEW.currency
+)
+EXECUTE FUNCTION pgledger_check_ledger_write();
+
+-- Same as before, but setting reverses_transfer_id when the transfer is
+-- created, since transfers can't be updated afterwards, and inserting the
+-- entries before updating the accounts, so that pgledger_check_ledger_write can
+-- find them
+DROP FUNCTION pgledger_apply_transfer(TEXT, TEXT, NUMERIC, TEXT, TEXT, TIMESTAMPTZ, JSONB, TEXT, TEXT);
+
+CREATE FUNCTION pgledger_apply_transfer(
+    from_account_id TEXT,
+    to_account_id TEXT,
+    amount NUMERIC,
+    transfer_status TEXT,
+    pending_transfer_id TEXT,
+    event_at TIMESTAMPTZ,
+    metadata JSONB,
+    idempotency_key TEXT,
+    journal_id TEXT,
+    reverses_transfer_id TEXT DEFAULT NULL
+)
+RETURNS TEXT
+AS $$
+DECLARE
+    from_account pgledger_accounts;
+    to_account pgledger_accounts;
+    balance_change NUMERIC := 0;
+    pending_change NUMERIC := 0;
+    new_transfer_id TEXT;
+    currency_scale INTEGER;
+BEGIN
+    -- Preliminary checks
+    IF amount <= 0 THEN
+        RAISE EXCEPTION 'Amount (%) must be positive', amount
+        USING
+            ERRCODE = 'PGL04',
+            DETAIL = json_build_object('amount', amount::TEXT)::TEXT;
+    END IF;
+
+    IF from_account_id = to_account_id THEN
+        RAISE EXCEPTION 'Cannot transfer to the same account (id=%)', from_account_id
+        USING
+            ERRCODE = 'PGL05',
+            DETAIL = json_build_object('account_id', from_account_id)::TEXT;
+    END IF;
+
+    IF transfer_status = 'posted' THEN
+        balance_change := amount;
+    ELSIF transfer_status = 'pending' THEN
+        pending_change := amount;
+    ELSE
+        pending_change := -amount;
+    END IF;
+
+    -- Work out the new account balances. The accounts are updated at the end,
+    -- once the entries have been inserted.
+    SELECT * INTO from_account
+    FROM pgledger_accounts a
+    WHERE a.id = from_account_id
+    FOR UPDATE;
+
+    from_account.balance := from_account.balance - balance_change;
+    from_account.pending_debits := from_account.pending_debits + pending_change;
+    from_account.version := from_account.version + 1;
+    from_account.updated_at := now();
+
+    -- Check status and balance constraints for the source account. Releasing a
+    -- pending amount is always allowed, so that pending transfers can still be
+    -- voided after an account is frozen.
+    IF transfer_status != 'released' THEN
+        PERFORM pgledger_check_account_status(from_account, debit => TRUE);
+    END IF;
+    PERFORM pgledger_check_account_balance_constraints(from_account);
+
+    SELECT * INTO to_account
+    FROM pgledger_accounts a
+    WHERE a.id = to_account_id
+    FOR UPDATE;
+
+    to_account.balance := to_account.balance + balance_change;
+    to_account.pending_credits := to_account.pending_credits + pending_change;
+    to_account.version := to_account.version + 1;
+    to_account.updated_at := now();
+
+    -- Check status and balance constraints for the destination account
+    IF transfer_status != 'released' THEN
+        PERFORM pgledger_check_account_status(to_account, debit => FALSE);
+    END IF;
+    PERFORM pgledger_check_account_balance_constraints(to_account);
+
+    -- Check that currencies match
+    IF from_account.currency != to_account.currency THEN
+        RAISE EXCEPTION 'Cannot transfer between different currencies (% and %)', from_account.currency, to_account.currency
+        USING
+            ERRCODE = 'PGL03',
+            DETAIL = json_build_object(
+                'from_account_id', from_account.id,
+                'to_account_id', to_account.id,
+                'from_currency', from_account.currency,
+                'to_currency', to_account.currency
+            )::TEXT;
+    END IF;
+
+    -- Check that the amount fits in the minor units of the currency
+    SELECT c.scale INTO currency_scale
+    FROM pgledger_currencies c
+    WHERE c.code = from_account.currency;
+
+    IF min_scale(amount) > currency_scale THEN
+        RAISE EXCEPTION 'Amount (%) has more decimal places than currency % allows (%)',
+        amount, from_account.currency, currency_scale
+        USING
+            ERRCODE = 'PGL20',
+            DETAIL = json_build_object(
+                'amount', amount::TEXT,
+                'currency', from_account.currency,
+                'scale', currency_scale
+            )::TEXT;
+    END IF;
+
+    -- Create transfer record
+    INSERT INTO pgledger_transfers (
+        from_account_id,
+        to_account_id,
+        amount,
+        created_at,
+        event_at,
+        metadata,
+        idempotency_key,
+        status,
+        pending_transfer_id,
+        journal_id,
+        reverses_transfer_id
+    )
+    VALUES (
+        from_account_id,
+        to_account_id,
+        amount,
+        now(),
+        event_at,
+        metadata,
+        idempotency_key,
+        transfer_status,
+        pending_transfer_id,
+        journal_id,
+        reverses_transfer_id
+    )
+    RETURNING pgledger_transfers.id INTO new_transfer_id;
+
+    -- Create entry for the source account (negative amount, or positive when
+    -- releasing a pending amount)
+    INSERT INTO pgledger_entries (
+        account_id, transfer_id, amount, account_previous_balance, account_current_balance, account_version, created_at, pending
+    )
+    VALUES (
+        from_account_id,
+        new_transfer_id,
+        -(balance_change + pending_change),
+        from_account.balance + balance_change,
+        from_account.balance,
+        from_account.version,
+        now(),
+        transfer_status != 'posted'
+    );
+
+    -- Create entry for the destination account (positive amount, or negative
+    -- when releasing a pending amount)
+    INSERT INTO pgledger_entries (
+        account_id, transfer_id, amount, account_previous_balance, account_current_balance, account_version, created_at, pending
+    )
+    VALUES (
+        to_account_id,
+        new_transfer_id,
+        balance_change + pending_change,
+        to_account.balance - balance_change,
+        to_account.balance,
+        to_account.version,
+        now(),
+        transfer_status != 'posted'
+    );
+
+    -- Update account balances (see pgledger_check_ledger_write)
+    UPDATE pgledger_accounts a
+    SET balance = from_account.balance,
+        pending_debits = from_account.pending_debits,
+        version = from_account.version,
+        updated_at = from_account.updated_at
+    WHERE a.id = from_account_id;
+
+    UPDATE pgledger_accounts a
+    SET balance = to_account.balance,
+        pending_credits = to_account.pending_credits,
+        version = to_account.version,
+        updated_at = to_account.updated_at
+    WHERE a.id = to_account_id;
+
+    RETURN new_transfer_id;
+END;
+$$ LANGUAGE plpgsql;
+
+-- Same as before, but creating the reversal with pgledger_apply_transfer, so
+-- that it is linked to the original transfer when it is inserted
+CREATE OR REPLACE FUNCTION pgledger_reverse_transfer(
+    transfer_id TEXT,
+    metadata JSONB DEFAULT NULL,
+    amount NUMERIC DEFAULT NULL
+)
+RETURNS SETOF PGLEDGER_TRANSFERS_VIEW
+AS $$
+DECLARE
+    original_transfer pgledger_transfers;
+    reversal_id TEXT;
+    new_journal_id TEXT;
+    remaining_amount NUMERIC;
+BEGIN
+    -- Lock the original transfer so that concurrent reversals of it can't add
+    -- up to more than the original amount
+    SELECT * INTO original_transfer
+    FROM pgledger_transfers t
+    WHERE t.id = pgledger_reverse_transfer.transfer_id
+    FOR UPDATE;
+
+    IF NOT FOUND THEN
+        RAISE EXCEPTION 'Transfer (id=%) does not exist', transfer_id
+        USING
+            ERRCODE = 'PGL08',
+            DETAIL = json_build_object('transfer_id', transfer_id)::TEXT;
+    END IF;
+
+    IF original_transfer.status != 'posted' THEN
+        RAISE EXCEPTION 'Transfer (id=%) is not posted', transfer_id
+        USING
+            ERRCODE = 'PGL12',
+            DETAIL = json_build_object('transfer_id', transfer_id)::TEXT;
+    END IF;
+
+    SELECT original_transfer.amount - coalesce(sum(t.amount), 0) INTO remaining_amount
+    FROM pgledger_transfers t
+    WHERE t.reverses_transfer_id = original_transfer.id;
+
+    IF remaining_amount <= 0 THEN
+        RAISE EXCEPTION 'Transfer (id=%) has already been reversed', transfer_id
+        USING
+            ERRCODE = 'PGL09',
+            DETAIL = json_build_object('transfer_id', transfer_id)::TEXT;
+    END IF;
+
+    -- Default to reversing whatever is left of the transfer
+    amount := coalesce(amount, remaining_amount);
+
+    IF amount > remaining_amount THEN
+        RAISE EXCEPTION 'Reversal amount (%) exceeds the remaining amount (%) of transfer (id=%)',
+        amount, remaining_amount, transfer_id
+        USING
+            ERRCODE = 'PGL10',
+            DETAIL = json_build_object(
+                'transfer_id', transfer_id,
+                'amount', amount::TEXT,
+                'remaining_amount', remaining_amount::TEXT
+            )::TEXT;
+    END IF;
+
+    -- Lock the accounts in ID order, like pgledger_create_transfers, to prevent
+    -- deadlocks with transfers between the same accounts
+    PERFORM a.id
+    FROM pgledger_accounts a
+    WHERE a.id IN (original_transfer.from_account_id, original_transfer.to_account_id)
+    ORDER BY a.id
+    FOR UPDATE;
+
+    INSERT INTO pgledger_journals (metadata, created_at)
+    VALUES (metadata, now())
+    RETURNING pgledger_journals.id INTO new_journal_id;
+
+    reversal_id := pgledger_apply_transfer(
+        from_account_id => original_transfer.to_account_id,
+        to_account_id => original_transfer.from_account_id,
+        amount => amount,
+        transfer_status => 'posted',
+        pending_transfer_id => NULL,
+        event_at => now(),
+        metadata => metadata,
+        idempotency_key => NULL,
+        journal_id => new_journal_id,
+        reverses_transfer_id => original_transfer.id
+    );
+
+    RETURN QUERY
+    SELECT *
+    FROM pgledger_transfers_view v
+    WHERE v.id = reversal_id;
+END;
+$$ LANGUAGE plpgsql;
+
+INSERT INTO pgledger_schema_migrations (version) VALUES (18);
@@ -0,0 +1,67 @@
+-- A trial balance: the totals of the account balances in each currency at a
+-- point in time. Transfers take the amount out of one account and put it into
+-- another, so the balances in each currency always add up to 0, and a non-zero
+-- net means something is wrong.
+--
+-- Negative balances are counted as debits, and positive balances as credits,
+-- matching the signs of the entries. Like pgledger_account_balance_at, the
+-- balances are as of when the entries were created (created_at, the default)
+-- or when the transfers happened in the real world (event_at), and pending
+-- transfers are ignored.
+CREATE FUNCTION pgledger_trial_balance(
+    as_of TIMESTAMPTZ DEFAULT now(),
+    by TEXT DEFAULT 'created_at'
+)
+RETURNS TABLE (currency TEXT, debits NUMERIC, credits NUMERIC, net NUMERIC)
+AS $$
+BEGIN
+    IF pgledger_trial_balance.by NOT IN ('created_at', 'event_at') THEN
+        RAISE EXCEPTION 'Invalid by (%), must be created_at or event_at', pgledger_trial_balance.by
+        USING ERRCODE = 'invalid_parameter_value';
+    END IF;
+
+    RETURN QUERY
+    WITH created_at_balances AS (
+        -- The most recent entry of each account at or before the time
+        SELECT DISTINCT ON (e.account_id)
+            e.account_id,
+            e.account_current_balance AS balance
+        FROM pgledger_entries e
+        WHERE pgledger_trial_balance.by = 'created_at'
+            AND e.created_at <= pgledger_trial_balance.as_of
+        ORDER BY e.account_id, e.created_at DESC, e.account_version DESC
+    ),
+
+    event_at_balances AS (
+        -- The posted entries of each account with an event_at at or before the
+        -- time
+        SELECT
+            e.account_id,
+            sum(e.amount) AS balance
+        FROM pgledger_entries e
+        INNER JOIN pgledger_transfers t ON e.transfer_id = t.id
+        WHERE pgledger_trial_balance.by = 'event_at'
+            AND NOT e.pending
+            AND t.event_at <= pgledger_trial_balance.as_of
+        GROUP BY e.account_id
+    ),
+
+    balances AS (
+        SELECT * FROM created_at_balances
+        UNION ALL
+        SELECT * FROM event_at_balances
+    )
+
+    SELECT
+        a.currency,
+        coalesce(-sum(b.balance) FILTER (WHERE b.balance < 0), 0),
+        coalesce(sum(b.balance) FILTER (WHERE b.balance > 0), 0),
+        sum(b.balance)
+    FROM balances b
+    INNER JOIN pgledger_accounts a ON b.account_id = a.id
+    GROUP BY a.currency
+    ORDER BY a.currency;
+END;
+$$ LANGUAGE plpgsql STABLE;
+
+INSERT INTO pgledger_schema_migrations (version) VALUES (19);
@@ -1,3 +1,18 @@
+-- This file is generated from the files in the migrations directory by
+-- `just generate`. Don't edit it directly.
+
+-- migrations/pgledger_01.sql
+
+-- The initial pgledger schema.
+--
+-- Each migration records itself in pgledger_schema_migrations, so the
+-- migrations can be applied by any tool (or by hand with psql) and still be
+-- tracked.
+CREATE TABLE IF NOT EXISTS pgledger_schema_migrations (
+    version INTEGER PRIMARY KEY,
+    applied_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
 -- uuidv7 is a new function in PostgreSQL 18:
 -- https://www.postgresql.org/docs/release/18.0/
 CREATE FUNCTION pgledger_uuidv7_exists() RETURNS BOOL
@@ -138,17 +153,42 @@ BEGIN
 END;
 $$ LANGUAGE plpgsql;
 
+-- Ledger rule violations are raised with these custom SQLSTATE codes so that
+-- callers can match on them instead of the message text. The DETAIL of each
+-- error is a JSON object with the relevant fields (account_id, amount, etc).
+--
+--   PGL01: account does not allow negative balance
+--   PGL02: account does not allow positive balance
+--   PGL03: cannot transfer between different currencies
+--   PGL04: amount must be positive
+--   PGL05: cannot transfer to the same account
+--   PGL06: account does not exist
+
 -- Helper function to check account balance constraints
 CREATE OR REPLACE FUNCTION pgledger_check_account_balance_constraints(account PGLEDGER_ACCOUNTS) RETURNS VOID AS $$
 BEGIN
     -- If account doesn't allow negative balance and balance is negative, raise an error
     IF NOT account.allow_negative_balance AND (account.balance < 0) THEN
-        RAISE EXCEPTION 'Account (id=%, name=%) does not allow negative balance', account.id, account.name;
+        RAISE EXCEPTION 'Account (id=%, name=%) does not allow negative balance', account.id, account.name
+        USING
+            ERRCODE = 'PGL01',
+            DETAIL = json_build_object(
+                'account_id', account.id,
+                'account_name', account.name,
+                'balance', account.balance::TEXT
+            )::TEXT;
     END IF;
 
     -- If account doesn't allow positive balance and balance is positive, raise an error
     IF NOT account.allow_positive_balance AND (account.balance > 0) THEN
-        RAISE EXCEPTION 'Account (id=%, name=%) does not allow positive balance', account.id, account.name;
+        RAISE EXCEPTION 'Account (id=%, name=%) does not allow positive balance', account.id, account.name
+        USING
+            ERRCODE = 'PGL02',
+            DETAIL = json_build_object(
+                'account_id', account.id,
+                'account_name', account.name,
+                'balance', account.balance::TEXT
+            )::TEXT;
     END IF;
 END;
 $$ LANGUAGE plpgsql;
@@ -223,17 +263,30 @@ BEGIN
         FROM pgledger_accounts
         WHERE pgledger_accounts.id = from_account_id
         FOR UPDATE;
+
+        IF NOT FOUND THEN
+            RAISE EXCEPTION 'Account (id=%) does not exist', from_account_id
+            USING
+                ERRCODE = 'PGL06',
+                DETAIL = json_build_object('account_id', from_account_id)::TEXT;
+        END IF;
     END LOOP;
 
     -- Process each transfer
     FOREACH transfer_request IN ARRAY transfer_requests LOOP
         -- Preliminary checks
         IF transfer_request.amount <= 0 THEN
-            RAISE EXCEPTION 'Amount (%) must be positive', transfer_request.amount;
+            RAISE EXCEPTION 'Amount (%) must be positive', transfer_request.amount
+            USING
+                ERRCODE = 'PGL04',
+                DETAIL = json_build_object('amount', transfer_request.amount::TEXT)::TEXT;
         END IF;
 
         IF transfer_request.from_account_id = transfer_request.to_account_id THEN
-            RAISE EXCEPTION 'Cannot transfer to the same account (id=%)', transfer_request.from_account_id;
+            RAISE EXCEPTION 'Cannot transfer to the same account (id=%)', transfer_request.from_account_id
+            USING
+                ERRCODE = 'PGL05',
+                DETAIL = json_build_object('account_id', transfer_request.from_account_id)::TEXT;
         END IF;
 
         -- Update account balances
@@ -259,7 +312,15 @@ BEGIN
 
         -- Check that currencies match
         IF from_account.currency != to_account.currency THEN
-            RAISE EXCEPTION 'Cannot transfer between different currencies (% and %)', from_account.currency, to_account.currency;
+            RAISE EXCEPTION 'Cannot transfer between different currencies (% and %)', from_account.currency, to_account.currency
+            USING
+                ERRCODE = 'PGL03',
+                DETAIL = json_build_object(
+                    'from_account_id', from_account.id,
+                    'to_account_id', to_account.id,
+                    'from_currency', from_account.currency,
+                    'to_currency', to_account.currency
+                )::TEXT;
         END IF;
 
         -- Create transfer record
@@ -286,3 +347,4428 @@ BEGIN
     ORDER BY id;
 END;
 $$ LANGUAGE plpgsql;
+
+INSERT INTO pgledger_schema_migrations (version) VALUES (1);
+
+-- migrations/pgledger_02.sql
+
+-- Optional idempotency keys for pgledger_create_transfer(s), so that retrying a
+-- request (e.g. from a webhook handler) doesn't create the transfers twice.
+--
+-- The first call with a key records the parameters here and tags the transfers
+-- it creates with the key. A repeated call with the same key and parameters
+-- returns the original transfers, and a repeated call with different parameters
+-- raises an error.
+CREATE TABLE pgledger_idempotency_keys (
+    idempotency_key TEXT PRIMARY KEY,
+    request JSONB NOT NULL,
+    event_at TIMESTAMPTZ,
+    created_at TIMESTAMPTZ NOT NULL
+);
+
+ALTER TABLE pgledger_transfers ADD COLUMN idempotency_key TEXT;
+
+CREATE INDEX ON pgledger_transfers (idempotency_key) WHERE idempotency_key IS NOT NULL;
+
+CREATE OR REPLACE VIEW pgledger_transfers_view AS
+SELECT
+    id,
+    from_account_id,
+    to_account_id,
+    amount,
+    created_at,
+    event_at,
+    metadata,
+    idempotency_key
+FROM pgledger_transfers;
+
+-- The functions gain a new parameter, so the old versions have to be dropped
+-- rather than replaced (otherwise calls would be ambiguous)
+DROP FUNCTION pgledger_create_transfer(TEXT, TEXT, NUMERIC, TIMESTAMPTZ, JSONB);
+DROP FUNCTION pgledger_create_transfers(TRANSFER_REQUEST [], TIMESTAMPTZ, JSONB);
+
+CREATE FUNCTION pgledger_create_transfer(
+    from_account_id TEXT,
+    to_account_id TEXT,
+    amount NUMERIC,
+    event_at TIMESTAMPTZ DEFAULT NULL,
+    metadata JSONB DEFAULT NULL,
+    idempotency_key TEXT DEFAULT NULL
+)
+RETURNS SETOF PGLEDGER_TRANSFERS_VIEW
+AS $$
+BEGIN
+    -- Simply call pgledger_create_transfers with a single transfer
+    RETURN QUERY
+    SELECT * FROM pgledger_create_transfers(
+        transfer_requests => array[(from_account_id, to_account_id, amount)::TRANSFER_REQUEST],
+        event_at => event_at,
+        metadata => metadata,
+        idempotency_key => idempotency_key
+    );
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE FUNCTION pgledger_create_transfers(
+    transfer_requests TRANSFER_REQUEST [],
+    event_at TIMESTAMPTZ DEFAULT NULL,
+    metadata JSONB DEFAULT NULL,
+    idempotency_key TEXT DEFAULT NULL
+)
+RETURNS SETOF PGLEDGER_TRANSFERS_VIEW
+AS $$
+DECLARE
+    transfer_request transfer_request;
+    transfer_ids TEXT[] := '{}';
+    transfer_id TEXT;
+    from_account pgledger_accounts;
+    to_account pgledger_accounts;
+    from_account_id TEXT;
+    to_account_id TEXT;
+    all_account_ids TEXT[] := '{}';
+    request JSONB;
+    existing_key pgledger_idempotency_keys;
+BEGIN
+    IF idempotency_key IS NOT NULL THEN
+        request := jsonb_build_object('transfer_requests', to_jsonb(transfer_requests), 'metadata', metadata);
+
+        -- If another transaction is using the same key, this waits for it to
+        -- commit or roll back
+        INSERT INTO pgledger_idempotency_keys (idempotency_key, request, event_at, created_at)
+        VALUES (idempotency_key, request, event_at, now())
+        ON CONFLICT ON CONSTRAINT pgledger_idempotency_keys_pkey DO NOTHING;
+
+        IF NOT FOUND THEN
+            SELECT * INTO existing_key
+            FROM pgledger_idempotency_keys k
+            WHERE k.idempotency_key = pgledger_create_transfers.idempotency_key;
+
+            IF existing_key.request != request OR existing_key.event_at IS DISTINCT FROM event_at THEN
+                RAISE EXCEPTION 'Idempotency key (%) was already used with different parameters', idempotency_key
+                USING
+                    ERRCODE = 'PGL07',
+                    DETAIL = json_build_object('idempotency_key', idempotency_key)::TEXT;
+            END IF;
+
+            -- Return the transfers from the original call
+            RETURN QUERY
+            SELECT *
+            FROM pgledger_transfers_view t
+            WHERE t.idempotency_key = pgledger_create_transfers.idempotency_key
+            ORDER BY t.id;
+
+            RETURN;
+        END IF;
+    END IF;
+
+    -- Collect all unique account IDs and sort them to prevent deadlocks
+    FOREACH transfer_request IN ARRAY transfer_requests LOOP
+        all_account_ids := array_append(all_account_ids, transfer_request.from_account_id);
+        all_account_ids := array_append(all_account_ids, transfer_request.to_account_id);
+    END LOOP;
+
+    -- Remove duplicates and sort
+    SELECT ARRAY(SELECT DISTINCT unnest FROM unnest(all_account_ids) ORDER BY unnest)
+    INTO all_account_ids;
+
+    -- Lock all accounts in order
+    FOREACH from_account_id IN ARRAY all_account_ids LOOP
+        PERFORM pgledger_accounts.id
+        FROM pgledger_accounts
+        WHERE pgledger_accounts.id = from_account_id
+        FOR UPDATE;
+
+        IF NOT FOUND THEN
+            RAISE EXCEPTION 'Account (id=%) does not exist', from_account_id
+            USING
+                ERRCODE = 'PGL06',
+                DETAIL = json_build_object('account_id', from_account_id)::TEXT;
+        END IF;
+    END LOOP;
+
+    -- Process each transfer
+    FOREACH transfer_request IN ARRAY transfer_requests LOOP
+        -- Preliminary checks
+        IF transfer_request.amount <= 0 THEN
+            RAISE EXCEPTION 'Amount (%) must be positive', transfer_request.amount
+            USING
+                ERRCODE = 'PGL04',
+                DETAIL = json_build_object('amount', transfer_request.amount::TEXT)::TEXT;
+        END IF;
+
+        IF transfer_request.from_account_id = transfer_request.to_account_id THEN
+            RAISE EXCEPTION 'Cannot transfer to the same account (id=%)', transfer_request.from_account_id
+            USING
+                ERRCODE = 'PGL05',
+                DETAIL = json_build_object('account_id', transfer_request.from_account_id)::TEXT;
+        END IF;
+
+        -- Update account balances
+        UPDATE pgledger_accounts
+        SET balance = balance - transfer_request.amount,
+            version = version + 1,
+            updated_at = now()
+        WHERE pgledger_accounts.id = transfer_request.from_account_id
+        RETURNING * INTO from_account;
+
+        -- Check balance constraints for the source account
+        PERFORM pgledger_check_account_balance_constraints(from_account);
+
+        UPDATE pgledger_accounts
+        SET balance = balance + transfer_request.amount,
+            version = version + 1,
+            updated_at = now()
+        WHERE pgledger_accounts.id = transfer_request.to_account_id
+        RETURNING * INTO to_account;
+
+        -- Check balance constraints for the destination account
+        PERFORM pgledger_check_account_balance_constraints(to_account);
+
+        -- Check that currencies match
+        IF from_account.currency != to_account.currency THEN
+            RAISE EXCEPTION 'Cannot transfer between different currencies (% and %)', from_account.currency, to_account.currency
+            USING
+                ERRCODE = 'PGL03',
+                DETAIL = json_build_object(
+                    'from_account_id', from_account.id,
+                    'to_account_id', to_account.id,
+                    'from_currency', from_account.currency,
+                    'to_currency', to_account.currency
+                )::TEXT;
+        END IF;
+
+        -- Create transfer record
+        INSERT INTO pgledger_transfers (from_account_id, to_account_id, amount, created_at, event_at, metadata, idempotency_key)
+        VALUES (transfer_request.from_account_id, transfer_request.to_account_id, transfer_request.amount, now(), coalesce(event_at, now()), metadata, idempotency_key)
+        RETURNING pgledger_transfers.id INTO transfer_id;
+
+        transfer_ids := array_append(transfer_ids, transfer_id);
+
+        -- Create entry for the source account (negative amount)
+        INSERT INTO pgledger_entries (account_id, transfer_id, amount, account_previous_balance, account_current_balance, account_version, created_at)
+        VALUES (transfer_request.from_account_id, transfer_id, -transfer_request.amount, from_account.balance + transfer_request.amount, from_account.balance, from_account.version, now());
+
+        -- Create entry for the destination account (positive amount)
+        INSERT INTO pgledger_entries (account_id, transfer_id, amount, account_previous_balance, account_current_balance, account_version, created_at)
+        VALUES (transfer_request.to_account_id, transfer_id, transfer_request.amount, to_account.balance - transfer_request.amount, to_account.balance, to_account.version, now());
+    END LOOP;
+
+    -- Return all created transfers
+    RETURN QUERY
+    SELECT *
+    FROM pgledger_transfers_view
+    WHERE id = ANY(transfer_ids)
+    ORDER BY id;
+END;
+$$ LANGUAGE plpgsql;
+
+INSERT INTO pgledger_schema_migrations (version) VALUES (2);
+
+-- migrations/pgledger_03.sql
+
+-- Transfer reversals. A reversal is a new transfer in the opposite direction
+-- which points back to the transfer it reverses, so the original transfer and
+-- its entries are never modified.
+ALTER TABLE pgledger_transfers ADD COLUMN reverses_transfer_id TEXT REFERENCES pgledger_transfers (id);
+
+CREATE INDEX ON pgledger_transfers (reverses_transfer_id) WHERE reverses_transfer_id IS NOT NULL;
+
+CREATE OR REPLACE VIEW pgledger_transfers_view AS
+SELECT
+    id,
+    from_account_id,
+    to_account_id,
+    amount,
+    created_at,
+    event_at,
+    metadata,
+    idempotency_key,
+    reverses_transfer_id
+FROM pgledger_transfers;
+
+-- Reverse all (or, if amount is given, part) of a transfer. A transfer can be
+-- reversed several times, as long as the reversals don't add up to more than
+-- the original amount. The reversal goes through pgledger_create_transfer, so
+-- it respects the balance constraints of both accounts.
+CREATE FUNCTION pgledger_reverse_transfer(
+    transfer_id TEXT,
+    metadata JSONB DEFAULT NULL,
+    amount NUMERIC DEFAULT NULL
+)
+RETURNS SETOF PGLEDGER_TRANSFERS_VIEW
+AS $$
+DECLARE
+    original_transfer pgledger_transfers;
+    reversal pgledger_transfers_view;
+    remaining_amount NUMERIC;
+BEGIN
+    -- Lock the original transfer so that concurrent reversals of it can't add
+    -- up to more than the original amount
+    SELECT * INTO original_transfer
+    FROM pgledger_transfers t
+    WHERE t.id = pgledger_reverse_transfer.transfer_id
+    FOR UPDATE;
+
+    IF NOT FOUND THEN
+        RAISE EXCEPTION 'Transfer (id=%) does not exist', transfer_id
+        USING
+            ERRCODE = 'PGL08',
+            DETAIL = json_build_object('transfer_id', transfer_id)::TEXT;
+    END IF;
+
+    SELECT original_transfer.amount - coalesce(sum(t.amount), 0) INTO remaining_amount
+    FROM pgledger_transfers t
+    WHERE t.reverses_transfer_id = original_transfer.id;
+
+    IF remaining_amount <= 0 THEN
+        RAISE EXCEPTION 'Transfer (id=%) has already been reversed', transfer_id
+        USING
+            ERRCODE = 'PGL09',
+            DETAIL = json_build_object('transfer_id', transfer_id)::TEXT;
+    END IF;
+
+    -- Default to reversing whatever is left of the transfer
+    amount := coalesce(amount, remaining_amount);
+
+    IF amount > remaining_amount THEN
+        RAISE EXCEPTION 'Reversal amount (%) exceeds the remaining amount (%) of transfer (id=%)',
+        amount, remaining_amount, transfer_id
+        USING
+            ERRCODE = 'PGL10',
+            DETAIL = json_build_object(
+                'transfer_id', transfer_id,
+                'amount', amount::TEXT,
+                'remaining_amount', remaining_amount::TEXT
+            )::TEXT;
+    END IF;
+
+    SELECT * INTO reversal
+    FROM pgledger_create_transfer(
+        from_account_id => original_transfer.to_account_id,
+        to_account_id => original_transfer.from_account_id,
+        amount => amount,
+        metadata => metadata
+    );
+
+    UPDATE pgledger_transfers
+    SET reverses_transfer_id = original_transfer.id
+    WHERE pgledger_transfers.id = reversal.id;
+
+    RETURN QUERY
+    SELECT *
+    FROM pgledger_transfers_view v
+    WHERE v.id = reversal.id;
+END;
+$$ LANGUAGE plpgsql;
+
+INSERT INTO pgledger_schema_migrations (version) VALUES (3);
+
+-- migrations/pgledger_04.sql
+
+-- Two-phase (pending) transfers, for flows like card payments where funds are
+-- reserved first and settled later.
+--
+-- A pending transfer doesn't change the balance of either account. Instead,
+-- it adds to the pending_debits of the source account and the pending_credits
+-- of the destination account. Pending debits reduce the available balance
+-- (balance - pending_debits), which is what the negative balance check uses,
+-- so reserved funds can't be spent twice.
+--
+-- A pending transfer is finished by posting or voiding it. Both release the
+-- reserved amount with a 'released' transfer, and posting also creates a
+-- regular 'posted' transfer for the settled amount (which can be less than the
+-- pending amount). Both point back to the pending transfer with
+-- pending_transfer_id. This way, transfers and entries are only ever inserted,
+-- every transfer has exactly two entries, and the pending entries of an
+-- account add up to its outstanding pending amounts.
+--
+-- New error codes:
+--
+--   PGL11: transfer is not pending (or was already posted or voided)
+--   PGL12: transfer is not posted
+--   PGL13: amount exceeds the pending amount of the transfer
+ALTER TABLE pgledger_accounts
+ADD COLUMN pending_debits NUMERIC NOT NULL DEFAULT 0,
+ADD COLUMN pending_credits NUMERIC NOT NULL DEFAULT 0;
+
+ALTER TABLE pgledger_transfers
+ADD COLUMN status TEXT NOT NULL DEFAULT 'posted' CHECK (status IN ('posted', 'pending', 'released')),
+ADD COLUMN pending_transfer_id TEXT REFERENCES pgledger_transfers (id);
+
+CREATE INDEX ON pgledger_transfers (pending_transfer_id) WHERE pending_transfer_id IS NOT NULL;
+
+ALTER TABLE pgledger_entries ADD COLUMN pending BOOLEAN NOT NULL DEFAULT FALSE;
+
+CREATE OR REPLACE VIEW pgledger_accounts_view AS
+SELECT
+    id,
+    name,
+    currency,
+    balance,
+    version,
+    allow_negative_balance,
+    allow_positive_balance,
+    metadata,
+    created_at,
+    updated_at,
+    pending_debits,
+    pending_credits,
+    balance - pending_debits AS available_balance
+FROM pgledger_accounts;
+
+CREATE OR REPLACE VIEW pgledger_transfers_view AS
+SELECT
+    id,
+    from_account_id,
+    to_account_id,
+    amount,
+    created_at,
+    event_at,
+    metadata,
+    idempotency_key,
+    reverses_transfer_id,
+    status,
+    pending_transfer_id
+FROM pgledger_transfers;
+
+CREATE OR REPLACE VIEW pgledger_entries_view AS
+SELECT
+    e.id,
+    e.account_id,
+    e.transfer_id,
+    e.amount,
+    e.account_previous_balance,
+    e.account_current_balance,
+    e.account_version,
+    e.created_at,
+    t.event_at,
+    t.metadata,
+    e.pending
+FROM pgledger_entries e
+INNER JOIN pgledger_transfers t ON e.transfer_id = t.id;
+
+-- The view no longer has the same columns as the table, so return the row from
+-- the view instead of using RETURNING *
+CREATE OR REPLACE FUNCTION pgledger_create_account(
+    name TEXT,
+    currency TEXT,
+    allow_negative_balance BOOLEAN DEFAULT TRUE,
+    allow_positive_balance BOOLEAN DEFAULT TRUE,
+    metadata JSONB DEFAULT NULL
+)
+RETURNS SETOF PGLEDGER_ACCOUNTS_VIEW
+AS $$
+DECLARE
+    new_account_id TEXT;
+BEGIN
+    INSERT INTO pgledger_accounts (name, currency, allow_negative_balance, allow_positive_balance, metadata, created_at, updated_at)
+    VALUES (name, currency, allow_negative_balance, allow_positive_balance, metadata, now(), now())
+    RETURNING pgledger_accounts.id INTO new_account_id;
+
+    RETURN QUERY
+    SELECT *
+    FROM pgledger_accounts_view v
+    WHERE v.id = new_account_id;
+END;
+$$ LANGUAGE plpgsql;
+
+-- Pending debits count against the negative balance check and pending credits
+-- count against the positive balance check, so that posting a pending transfer
+-- can never break them.
+CREATE OR REPLACE FUNCTION pgledger_check_account_balance_constraints(account PGLEDGER_ACCOUNTS) RETURNS VOID AS $$
+BEGIN
+    -- If account doesn't allow negative balance and available balance is negative, raise an error
+    IF NOT account.allow_negative_balance AND (account.balance - account.pending_debits < 0) THEN
+        RAISE EXCEPTION 'Account (id=%, name=%) does not allow negative balance', account.id, account.name
+        USING
+            ERRCODE = 'PGL01',
+            DETAIL = json_build_object(
+                'account_id', account.id,
+                'account_name', account.name,
+                'balance', account.balance::TEXT,
+                'available_balance', (account.balance - account.pending_debits)::TEXT
+            )::TEXT;
+    END IF;
+
+    -- If account doesn't allow positive balance and balance (including pending credits) is positive, raise an error
+    IF NOT account.allow_positive_balance AND (account.balance + account.pending_credits > 0) THEN
+        RAISE EXCEPTION 'Account (id=%, name=%) does not allow positive balance', account.id, account.name
+        USING
+            ERRCODE = 'PGL02',
+            DETAIL = json_build_object(
+                'account_id', account.id,
+                'account_name', account.name,
+                'balance', account.balance::TEXT
+            )::TEXT;
+    END IF;
+END;
+$$ LANGUAGE plpgsql;
+
+-- Apply a single transfer to accounts which the caller has already locked, and
+-- record the transfer and its two entries. Returns the ID of the new transfer.
+-- The transfer_status decides what is changed:
+--
+--   posted: amount moves from the balance of one account to the other
+--   pending: amount is added to pending_debits/pending_credits
+--   released: amount is removed from pending_debits/pending_credits
+CREATE FUNCTION pgledger_apply_transfer(
+    from_account_id TEXT,
+    to_account_id TEXT,
+    amount NUMERIC,
+    transfer_status TEXT,
+    pending_transfer_id TEXT,
+    event_at TIMESTAMPTZ,
+    metadata JSONB,
+    idempotency_key TEXT
+)
+RETURNS TEXT
+AS $$
+DECLARE
+    from_account pgledger_accounts;
+    to_account pgledger_accounts;
+    balance_change NUMERIC := 0;
+    pending_change NUMERIC := 0;
+    new_transfer_id TEXT;
+BEGIN
+    -- Preliminary checks
+    IF amount <= 0 THEN
+        RAISE EXCEPTION 'Amount (%) must be positive', amount
+        USING
+            ERRCODE = 'PGL04',
+            DETAIL = json_build_object('amount', amount::TEXT)::TEXT;
+    END IF;
+
+    IF from_account_id = to_account_id THEN
+        RAISE EXCEPTION 'Cannot transfer to the same account (id=%)', from_account_id
+        USING
+            ERRCODE = 'PGL05',
+            DETAIL = json_build_object('account_id', from_account_id)::TEXT;
+    END IF;
+
+    IF transfer_status = 'posted' THEN
+        balance_change := amount;
+    ELSIF transfer_status = 'pending' THEN
+        pending_change := amount;
+    ELSE
+        pending_change := -amount;
+    END IF;
+
+    -- Update account balances
+    UPDATE pgledger_accounts a
+    SET balance = a.balance - balance_change,
+        pending_debits = a.pending_debits + pending_change,
+        version = a.version + 1,
+        updated_at = now()
+    WHERE a.id = from_account_id
+    RETURNING * INTO from_account;
+
+    -- Check balance constraints for the source account
+    PERFORM pgledger_check_account_balance_constraints(from_account);
+
+    UPDATE pgledger_accounts a
+    SET balance = a.balance + balance_change,
+        pending_credits = a.pending_credits + pending_change,
+        version = a.version + 1,
+        updated_at = now()
+    WHERE a.id = to_account_id
+    RETURNING * INTO to_account;
+
+    -- Check balance constraints for the destination account
+    PERFORM pgledger_check_account_balance_constraints(to_account);
+
+    -- Check that currencies match
+    IF from_account.currency != to_account.currency THEN
+        RAISE EXCEPTION 'Cannot transfer between different currencies (% and %)', from_account.currency, to_account.currency
+        USING
+            ERRCODE = 'PGL03',
+            DETAIL = json_build_object(
+                'from_account_id', from_account.id,
+                'to_account_id', to_account.id,
+                'from_currency', from_account.currency,
+                'to_currency', to_account.currency
+            )::TEXT;
+    END IF;
+
+    -- Create transfer record
+    INSERT INTO pgledger_transfers (
+        from_account_id, to_account_id, amount, created_at, event_at, metadata, idempotency_key, status, pending_transfer_id
+    )
+    VALUES (
+        from_account_id, to_account_id, amount, now(), event_at, metadata, idempotency_key, transfer_status, pending_transfer_id
+    )
+    RETURNING pgledger_transfers.id INTO new_transfer_id;
+
+    -- Create entry for the source account (negative amount, or positive when
+    -- releasing a pending amount)
+    INSERT INTO pgledger_entries (
+        account_id, transfer_id, amount, account_previous_balance, account_current_balance, account_version, created_at, pending
+    )
+    VALUES (
+        from_account_id,
+        new_transfer_id,
+        -(balance_change + pending_change),
+        from_account.balance + balance_change,
+        from_account.balance,
+        from_account.version,
+        now(),
+        transfer_status != 'posted'
+    );
+
+    -- Create entry for the destination account (positive amount, or negative
+    -- when releasing a pending amount)
+    INSERT INTO pgledger_entries (
+        account_id, transfer_id, amount, account_previous_balance, account_current_balance, account_version, created_at, pending
+    )
+    VALUES (
+        to_account_id,
+        new_transfer_id,
+        balance_change + pending_change,
+        to_account.balance - balance_change,
+        to_account.balance,
+        to_account.version,
+        now(),
+        transfer_status != 'posted'
+    );
+
+    RETURN new_transfer_id;
+END;
+$$ LANGUAGE plpgsql;
+
+-- The functions gain a pending parameter, so the old versions have to be
+-- dropped rather than replaced
+DROP FUNCTION pgledger_create_transfer(TEXT, TEXT, NUMERIC, TIMESTAMPTZ, JSONB, TEXT);
+DROP FUNCTION pgledger_create_transfers(TRANSFER_REQUEST [], TIMESTAMPTZ, JSONB, TEXT);
+
+CREATE FUNCTION pgledger_create_transfer(
+    from_account_id TEXT,
+    to_account_id TEXT,
+    amount NUMERIC,
+    event_at TIMESTAMPTZ DEFAULT NULL,
+    metadata JSONB DEFAULT NULL,
+    idempotency_key TEXT DEFAULT NULL,
+    pending BOOLEAN DEFAULT FALSE
+)
+RETURNS SETOF PGLEDGER_TRANSFERS_VIEW
+AS $$
+BEGIN
+    -- Simply call pgledger_create_transfers with a single transfer
+    RETURN QUERY
+    SELECT * FROM pgledger_create_transfers(
+        transfer_requests => array[(from_account_id, to_account_id, amount)::TRANSFER_REQUEST],
+        event_at => event_at,
+        metadata => metadata,
+        idempotency_key => idempotency_key,
+        pending => pending
+    );
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE FUNCTION pgledger_create_transfers(
+    transfer_requests TRANSFER_REQUEST [],
+    event_at TIMESTAMPTZ DEFAULT NULL,
+    metadata JSONB DEFAULT NULL,
+    idempotency_key TEXT DEFAULT NULL,
+    pending BOOLEAN DEFAULT FALSE
+)
+RETURNS SETOF PGLEDGER_TRANSFERS_VIEW
+AS $$
+DECLARE
+    transfer_request transfer_request;
+    transfer_ids TEXT[] := '{}';
+    account_id TEXT;
+    all_account_ids TEXT[] := '{}';
+    request JSONB;
+    existing_key pgledger_idempotency_keys;
+BEGIN
+    IF idempotency_key IS NOT NULL THEN
+        request := jsonb_build_object('transfer_requests', to_jsonb(transfer_requests), 'metadata', metadata);
+
+        -- Only include pending when it's set, so that keys stored before it
+        -- existed still match
+        IF pending THEN
+            request := request || jsonb_build_object('pending', TRUE);
+        END IF;
+
+        -- If another transaction is using the same key, this waits for it to
+        -- commit or roll back
+        INSERT INTO pgledger_idempotency_keys (idempotency_key, request, event_at, created_at)
+        VALUES (idempotency_key, request, event_at, now())
+        ON CONFLICT ON CONSTRAINT pgledger_idempotency_keys_pkey DO NOTHING;
+
+        IF NOT FOUND THEN
+            SELECT * INTO existing_key
+            FROM pgledger_idempotency_keys k
+            WHERE k.idempotency_key = pgledger_create_transfers.idempotency_key;
+
+            IF existing_key.request != request OR existing_key.event_at IS DISTINCT FROM event_at THEN
+                RAISE EXCEPTION 'Idempotency key (%) was already used with different parameters', idempotency_key
+                USING
+                    ERRCODE = 'PGL07',
+                    DETAIL = json_build_object('idempotency_key', idempotency_key)::TEXT;
+            END IF;
+
+            -- Return the transfers from the original call
+            RETURN QUERY
+            SELECT *
+            FROM pgledger_transfers_view t
+            WHERE t.idempotency_key = pgledger_create_transfers.idempotency_key
+            ORDER BY t.id;
+
+            RETURN;
+        END IF;
+    END IF;
+
+    -- Collect all unique account IDs and sort them to prevent deadlocks
+    FOREACH transfer_request IN ARRAY transfer_requests LOOP
+        all_account_ids := array_append(all_account_ids, transfer_request.from_account_id);
+        all_account_ids := array_append(all_account_ids, transfer_request.to_account_id);
+    END LOOP;
+
+    -- Remove duplicates and sort
+    SELECT ARRAY(SELECT DISTINCT unnest FROM unnest(all_account_ids) ORDER BY unnest)
+    INTO all_account_ids;
+
+    -- Lock all accounts in order
+    FOREACH account_id IN ARRAY all_account_ids LOOP
+        PERFORM pgledger_accounts.id
+        FROM pgledger_accounts
+        WHERE pgledger_accounts.id = account_id
+        FOR UPDATE;
+
+        IF NOT FOUND THEN
+            RAISE EXCEPTION 'Account (id=%) does not exist', account_id
+            USING
+                ERRCODE = 'PGL06',
+                DETAIL = json_build_object('account_id', account_id)::TEXT;
+        END IF;
+    END LOOP;
+
+    -- Process each transfer
+    FOREACH transfer_request IN ARRAY transfer_requests LOOP
+        transfer_ids := array_append(transfer_ids, pgledger_apply_transfer(
+            from_account_id => transfer_request.from_account_id,
+            to_account_id => transfer_request.to_account_id,
+            amount => transfer_request.amount,
+            transfer_status => CASE WHEN pending THEN 'pending' ELSE 'posted' END,
+            pending_transfer_id => NULL,
+            event_at => coalesce(event_at, now()),
+            metadata => metadata,
+            idempotency_key => idempotency_key
+        ));
+    END LOOP;
+
+    -- Return all created transfers
+    RETURN QUERY
+    SELECT *
+    FROM pgledger_transfers_view
+    WHERE id = ANY(transfer_ids)
+    ORDER BY id;
+END;
+$$ LANGUAGE plpgsql;
+
+-- Lock a pending transfer which hasn't been posted or voided yet, and then its
+-- accounts. The transfer is always locked first (like in
+-- pgledger_reverse_transfer), and the accounts are locked in ID order (like in
+-- pgledger_create_transfers), to prevent deadlocks.
+CREATE FUNCTION pgledger_lock_pending_transfer(transfer_id TEXT)
+RETURNS PGLEDGER_TRANSFERS
+AS $$
+DECLARE
+    pending_transfer pgledger_transfers;
+BEGIN
+    SELECT * INTO pending_transfer
+    FROM pgledger_transfers t
+    WHERE t.id = pgledger_lock_pending_transfer.transfer_id
+    FOR UPDATE;
+
+    IF NOT FOUND THEN
+        RAISE EXCEPTION 'Transfer (id=%) does not exist', transfer_id
+        USING
+            ERRCODE = 'PGL08',
+            DETAIL = json_build_object('transfer_id', transfer_id)::TEXT;
+    END IF;
+
+    IF pending_transfer.status != 'pending' OR EXISTS (
+        SELECT 1
+        FROM pgledger_transfers t
+        WHERE t.pending_transfer_id = pending_transfer.id
+    ) THEN
+        RAISE EXCEPTION 'Transfer (id=%) is not pending', transfer_id
+        USING
+            ERRCODE = 'PGL11',
+            DETAIL = json_build_object('transfer_id', transfer_id)::TEXT;
+    END IF;
+
+    PERFORM a.id
+    FROM pgledger_accounts a
+    WHERE a.id IN (pending_transfer.from_account_id, pending_transfer.to_account_id)
+    ORDER BY a.id
+    FOR UPDATE;
+
+    RETURN pending_transfer;
+END;
+$$ LANGUAGE plpgsql;
+
+-- Settle a pending transfer for all (or, if amount is given, part) of the
+-- pending amount. Anything that isn't posted is released, so a pending transfer
+-- can only be posted once. The metadata defaults to the pending transfer's.
+CREATE FUNCTION pgledger_post_pending_transfer(
+    pending_transfer_id TEXT,
+    amount NUMERIC DEFAULT NULL,
+    metadata JSONB DEFAULT NULL
+)
+RETURNS SETOF PGLEDGER_TRANSFERS_VIEW
+AS $$
+DECLARE
+    pending_transfer pgledger_transfers;
+    posted_transfer_id TEXT;
+BEGIN
+    pending_transfer := pgledger_lock_pending_transfer(pending_transfer_id);
+
+    amount := coalesce(amount, pending_transfer.amount);
+    metadata := coalesce(metadata, pending_transfer.metadata);
+
+    IF amount > pending_transfer.amount THEN
+        RAISE EXCEPTION 'Amount (%) exceeds the pending amount (%) of transfer (id=%)',
+        amount, pending_transfer.amount, pending_transfer.id
+        USING
+            ERRCODE = 'PGL13',
+            DETAIL = json_build_object(
+                'transfer_id', pending_transfer.id,
+                'amount', amount::TEXT,
+                'pending_amount', pending_transfer.amount::TEXT
+            )::TEXT;
+    END IF;
+
+    PERFORM pgledger_apply_transfer(
+        from_account_id => pending_transfer.from_account_id,
+        to_account_id => pending_transfer.to_account_id,
+        amount => pending_transfer.amount,
+        transfer_status => 'released',
+        pending_transfer_id => pending_transfer.id,
+        event_at => now(),
+        metadata => metadata,
+        idempotency_key => NULL
+    );
+
+    posted_transfer_id := pgledger_apply_transfer(
+        from_account_id => pending_transfer.from_account_id,
+        to_account_id => pending_transfer.to_account_id,
+        amount => amount,
+        transfer_status => 'posted',
+        pending_transfer_id => pending_transfer.id,
+        event_at => now(),
+        metadata => metadata,
+        idempotency_key => NULL
+    );
+
+    RETURN QUERY
+    SELECT *
+    FROM pgledger_transfers_view v
+    WHERE v.id = posted_transfer_id;
+END;
+$$ LANGUAGE plpgsql;
+
+-- Cancel a pending transfer, releasing the whole pending amount. Returns the
+-- 'released' transfer. The metadata defaults to the pending transfer's.
+CREATE FUNCTION pgledger_void_pending_transfer(
+    pending_transfer_id TEXT,
+    metadata JSONB DEFAULT NULL
+)
+RETURNS SETOF PGLEDGER_TRANSFERS_VIEW
+AS $$
+DECLARE
+    pending_transfer pgledger_transfers;
+    released_transfer_id TEXT;
+BEGIN
+    pending_transfer := pgledger_lock_pending_transfer(pending_transfer_id);
+
+    released_transfer_id := pgledger_apply_transfer(
+        from_account_id => pending_transfer.from_account_id,
+        to_account_id => pending_transfer.to_account_id,
+        amount => pending_transfer.amount,
+        transfer_status => 'released',
+        pending_transfer_id => pending_transfer.id,
+        event_at => now(),
+        metadata => coalesce(metadata, pending_transfer.metadata),
+        idempotency_key => NULL
+    );
+
+    RETURN QUERY
+    SELECT *
+    FROM pgledger_transfers_view v
+    WHERE v.id = released_transfer_id;
+END;
+$$ LANGUAGE plpgsql;
+
+-- Only posted transfers can be reversed. Pending transfers should be voided
+-- instead, and released transfers don't move any money.
+CREATE OR REPLACE FUNCTION pgledger_reverse_transfer(
+    transfer_id TEXT,
+    metadata JSONB DEFAULT NULL,
+    amount NUMERIC DEFAULT NULL
+)
+RETURNS SETOF PGLEDGER_TRANSFERS_VIEW
+AS $$
+DECLARE
+    original_transfer pgledger_transfers;
+    reversal pgledger_transfers_view;
+    remaining_amount NUMERIC;
+BEGIN
+    -- Lock the original transfer so that concurrent reversals of it can't add
+    -- up to more than the original amount
+    SELECT * INTO original_transfer
+    FROM pgledger_transfers t
+    WHERE t.id = pgledger_reverse_transfer.transfer_id
+    FOR UPDATE;
+
+    IF NOT FOUND THEN
+        RAISE EXCEPTION 'Transfer (id=%) does not exist', transfer_id
+        USING
+            ERRCODE = 'PGL08',
+            DETAIL = json_build_object('transfer_id', transfer_id)::TEXT;
+    END IF;
+
+    IF original_transfer.status != 'posted' THEN
+        RAISE EXCEPTION 'Transfer (id=%) is not posted', transfer_id
+        USING
+            ERRCODE = 'PGL12',
+            DETAIL = json_build_object('transfer_id', transfer_id)::TEXT;
+    END IF;
+
+    SELECT original_transfer.amount - coalesce(sum(t.amount), 0) INTO remaining_amount
+    FROM pgledger_transfers t
+    WHERE t.reverses_transfer_id = original_transfer.id;
+
+    IF remaining_amount <= 0 THEN
+        RAISE EXCEPTION 'Transfer (id=%) has already been reversed', transfer_id
+        USING
+            ERRCODE = 'PGL09',
+            DETAIL = json_build_object('transfer_id', transfer_id)::TEXT;
+    END IF;
+
+    -- Default to reversing whatever is left of the transfer
+    amount := coalesce(amount, remaining_amount);
+
+    IF amount > remaining_amount THEN
+        RAISE EXCEPTION 'Reversal amount (%) exceeds the remaining amount (%) of transfer (id=%)',
+        amount, remaining_amount, transfer_id
+        USING
+            ERRCODE = 'PGL10',
+            DETAIL = json_build_object(
+                'transfer_id', transfer_id,
+                'amount', amount::TEXT,
+                'remaining_amount', remaining_amount::TEXT
+            )::TEXT;
+    END IF;
+
+    SELECT * INTO reversal
+    FROM pgledger_create_transfer(
+        from_account_id => original_transfer.to_account_id,
+        to_account_id => original_transfer.from_account_id,
+        amount => amount,
+        metadata => metadata
+    );
+
+    UPDATE pgledger_transfers
+    SET reverses_transfer_id = original_transfer.id
+    WHERE pgledger_transfers.id = reversal.id;
+
+    RETURN QUERY
+    SELECT *
+    FROM pgledger_transfers_view v
+    WHERE v.id = reversal.id;
+END;
+$$ LANGUAGE plpgsql;
+
+INSERT INTO pgledger_schema_migrations (version) VALUES (4);
+
+-- migrations/pgledger_05.sql
+
+-- Account statuses, which replace the workaround of disallowing both negative
+-- and positive balances to lock an account:
+--
+--   active: transfers in both directions are allowed
+--   frozen: no transfers are allowed until the account is made active again
+--   closed: no transfers are allowed, ever. Only accounts with a zero balance
+--     (and nothing pending) can be closed.
+--   debit_only: the account can only be the source of transfers
+--   credit_only: the account can only be the destination of transfers
+--
+-- The status is checked for every transfer in pgledger_apply_transfer. Each
+-- change is recorded in pgledger_account_status_changes, along with who made it.
+--
+-- New error codes:
+--
+--   PGL14: account status does not allow the transfer
+--   PGL15: account cannot be closed with a non-zero balance
+--   PGL16: account is closed
+ALTER TABLE pgledger_accounts
+ADD COLUMN status TEXT NOT NULL DEFAULT 'active' CHECK (
+    status IN ('active', 'frozen', 'closed', 'debit_only', 'credit_only')
+),
+ADD COLUMN status_changed_at TIMESTAMPTZ,
+ADD COLUMN status_changed_by TEXT;
+
+CREATE TABLE pgledger_account_status_changes (
+    id TEXT PRIMARY KEY DEFAULT pgledger_generate_id('pglsc'),
+    account_id TEXT NOT NULL REFERENCES pgledger_accounts (id),
+    previous_status TEXT NOT NULL,
+    status TEXT NOT NULL,
+    changed_by TEXT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX ON pgledger_account_status_changes (account_id);
+
+CREATE OR REPLACE VIEW pgledger_accounts_view AS
+SELECT
+    id,
+    name,
+    currency,
+    balance,
+    version,
+    allow_negative_balance,
+    allow_positive_balance,
+    metadata,
+    created_at,
+    updated_at,
+    pending_debits,
+    pending_credits,
+    balance - pending_debits AS available_balance,
+    status,
+    status_changed_at,
+    status_changed_by
+FROM pgledger_accounts;
+
+-- Check that the status of the account allows it to be debited (the source of
+-- a transfer) or credited (the destination of a transfer)
+CREATE FUNCTION pgledger_check_account_status(account PGLEDGER_ACCOUNTS, debit BOOLEAN) RETURNS VOID AS $$
+BEGIN
+    IF account.status = 'active'
+        OR (debit AND account.status = 'debit_only')
+        OR (NOT debit AND account.status = 'credit_only') THEN
+        RETURN;
+    END IF;
+
+    RAISE EXCEPTION 'Account (id=%, name=%) is % and cannot be %',
+    account.id, account.name, account.status, CASE WHEN debit THEN 'debited' ELSE 'credited' END
+    USING
+        ERRCODE = 'PGL14',
+        DETAIL = json_build_object(
+            'account_id', account.id,
+            'account_name', account.name,
+            'status', account.status
+        )::TEXT;
+END;
+$$ LANGUAGE plpgsql;
+
+-- Same as before, plus the status checks
+CREATE OR REPLACE FUNCTION pgledger_apply_transfer(
+    from_account_id TEXT,
+    to_account_id TEXT,
+    amount NUMERIC,
+    transfer_status TEXT,
+    pending_transfer_id TEXT,
+    event_at TIMESTAMPTZ,
+    metadata JSONB,
+    idempotency_key TEXT
+)
+RETURNS TEXT
+AS $$
+DECLARE
+    from_account pgledger_accounts;
+    to_account pgledger_accounts;
+    balance_change NUMERIC := 0;
+    pending_change NUMERIC := 0;
+    new_transfer_id TEXT;
+BEGIN
+    -- Preliminary checks
+    IF amount <= 0 THEN
+        RAISE EXCEPTION 'Amount (%) must be positive', amount
+        USING
+            ERRCODE = 'PGL04',
+            DETAIL = json_build_object('amount', amount::TEXT)::TEXT;
+    END IF;
+
+    IF from_account_id = to_account_id THEN
+        RAISE EXCEPTION 'Cannot transfer to the same account (id=%)', from_account_id
+        USING
+            ERRCODE = 'PGL05',
+            DETAIL = json_build_object('account_id', from_account_id)::TEXT;
+    END IF;
+
+    IF transfer_status = 'posted' THEN
+        balance_change := amount;
+    ELSIF transfer_status = 'pending' THEN
+        pending_change := amount;
+    ELSE
+        pending_change := -amount;
+    END IF;
+
+    -- Update account balances
+    UPDATE pgledger_accounts a
+    SET balance = a.balance - balance_change,
+        pending_debits = a.pending_debits + pending_change,
+        version = a.version + 1,
+        updated_at = now()
+    WHERE a.id = from_account_id
+    RETURNING * INTO from_account;
+
+    -- Check status and balance constraints for the source account. Releasing a
+    -- pending amount is always allowed, so that pending transfers can still be
+    -- voided after an account is frozen.
+    IF transfer_status != 'released' THEN
+        PERFORM pgledger_check_account_status(from_account, debit => TRUE);
+    END IF;
+    PERFORM pgledger_check_account_balance_constraints(from_account);
+
+    UPDATE pgledger_accounts a
+    SET balance = a.balance + balance_change,
+        pending_credits = a.pending_credits + pending_change,
+        version = a.version + 1,
+        updated_at = now()
+    WHERE a.id = to_account_id
+    RETURNING * INTO to_account;
+
+    -- Check status and balance constraints for the destination account
+    IF transfer_status != 'released' THEN
+        PERFORM pgledger_check_account_status(to_account, debit => FALSE);
+    END IF;
+    PERFORM pgledger_check_account_balance_constraints(to_account);
+
+    -- Check that currencies match
+    IF from_account.currency != to_account.currency THEN
+        RAISE EXCEPTION 'Cannot transfer between different currencies (% and %)', from_account.currency, to_account.currency
+        USING
+            ERRCODE = 'PGL03',
+            DETAIL = json_build_object(
+                'from_account_id', from_account.id,
+                'to_account_id', to_account.id,
+                'from_currency', from_account.currency,
+                'to_currency', to_account.currency
+            )::TEXT;
+    END IF;
+
+    -- Create transfer record
+    INSERT INTO pgledger_transfers (
+        from_account_id, to_account_id, amount, created_at, event_at, metadata, idempotency_key, status, pending_transfer_id
+    )
+    VALUES (
+        from_account_id, to_account_id, amount, now(), event_at, metadata, idempotency_key, transfer_status, pending_transfer_id
+    )
+    RETURNING pgledger_transfers.id INTO new_transfer_id;
+
+    -- Create entry for the source account (negative amount, or positive when
+    -- releasing a pending amount)
+    INSERT INTO pgledger_entries (
+        account_id, transfer_id, amount, account_previous_balance, account_current_balance, account_version, created_at, pending
+    )
+    VALUES (
+        from_account_id,
+        new_transfer_id,
+        -(balance_change + pending_change),
+        from_account.balance + balance_change,
+        from_account.balance,
+        from_account.version,
+        now(),
+        transfer_status != 'posted'
+    );
+
+    -- Create entry for the destination account (positive amount, or negative
+    -- when releasing a pending amount)
+    INSERT INTO pgledger_entries (
+        account_id, transfer_id, amount, account_previous_balance, account_current_balance, account_version, created_at, pending
+    )
+    VALUES (
+        to_account_id,
+        new_transfer_id,
+        balance_change + pending_change,
+        to_account.balance - balance_change,
+        to_account.balance,
+        to_account.version,
+        now(),
+        transfer_status != 'posted'
+    );
+
+    RETURN new_transfer_id;
+END;
+$$ LANGUAGE plpgsql;
+
+
+-- Change the status of an account, recording who changed it. Closing an account
+-- is permanent.
+CREATE FUNCTION pgledger_update_account_status(
+    account_id TEXT,
+    status TEXT,
+    changed_by TEXT
+)
+RETURNS SETOF PGLEDGER_ACCOUNTS_VIEW
+AS $$
+DECLARE
+    account pgledger_accounts;
+BEGIN
+    -- Lock the account so the status can't change in the middle of a transfer
+    SELECT * INTO account
+    FROM pgledger_accounts a
+    WHERE a.id = pgledger_update_account_status.account_id
+    FOR UPDATE;
+
+    IF NOT FOUND THEN
+        RAISE EXCEPTION 'Account (id=%) does not exist', account_id
+        USING
+            ERRCODE = 'PGL06',
+            DETAIL = json_build_object('account_id', account_id)::TEXT;
+    END IF;
+
+    IF account.status = 'closed' THEN
+        RAISE EXCEPTION 'Account (id=%, name=%) is closed', account.id, account.name
+        USING
+            ERRCODE = 'PGL16',
+            DETAIL = json_build_object(
+                'account_id', account.id,
+                'account_name', account.name,
+                'status', account.status
+            )::TEXT;
+    END IF;
+
+    IF status = 'closed' AND (account.balance != 0 OR account.pending_debits != 0 OR account.pending_credits != 0) THEN
+        RAISE EXCEPTION 'Account (id=%, name=%) cannot be closed with a non-zero balance', account.id, account.name
+        USING
+            ERRCODE = 'PGL15',
+            DETAIL = json_build_object(
+                'account_id', account.id,
+                'account_name', account.name,
+                'balance', account.balance::TEXT
+            )::TEXT;
+    END IF;
+
+    UPDATE pgledger_accounts a
+    SET status = pgledger_update_account_status.status,
+        status_changed_at = now(),
+        status_changed_by = changed_by,
+        updated_at = now()
+    WHERE a.id = account.id;
+
+    INSERT INTO pgledger_account_status_changes (account_id, previous_status, status, changed_by, created_at)
+    VALUES (account.id, account.status, status, changed_by, now());
+
+    RETURN QUERY
+    SELECT *
+    FROM pgledger_accounts_view v
+    WHERE v.id = account.id;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE FUNCTION pgledger_freeze_account(account_id TEXT, changed_by TEXT)
+RETURNS SETOF PGLEDGER_ACCOUNTS_VIEW
+AS $$
+    SELECT * FROM pgledger_update_account_status(account_id, 'frozen', changed_by);
+$$ LANGUAGE sql;
+
+CREATE FUNCTION pgledger_close_account(account_id TEXT, changed_by TEXT)
+RETURNS SETOF PGLEDGER_ACCOUNTS_VIEW
+AS $$
+    SELECT * FROM pgledger_update_account_status(account_id, 'closed', changed_by);
+$$ LANGUAGE sql;
+
+INSERT INTO pgledger_schema_migrations (version) VALUES (5);
+
+-- migrations/pgledger_06.sql
+
+-- Optional balance limits for accounts, such as an overdraft limit of -500
+-- (min_balance) or a wallet cap of 10000 (max_balance). NULL means no limit.
+--
+-- Like allow_negative_balance and allow_positive_balance, the limits are
+-- checked against the balance including pending amounts: the available balance
+-- (balance - pending_debits) must be at least min_balance, and balance +
+-- pending_credits must be at most max_balance.
+--
+-- New error codes:
+--
+--   PGL17: account balance would be below its minimum balance
+--   PGL18: account balance would be above its maximum balance
+ALTER TABLE pgledger_accounts
+ADD COLUMN min_balance NUMERIC,
+ADD COLUMN max_balance NUMERIC,
+ADD CHECK (min_balance <= max_balance);
+
+CREATE OR REPLACE VIEW pgledger_accounts_view AS
+SELECT
+    id,
+    name,
+    currency,
+    balance,
+    version,
+    allow_negative_balance,
+    allow_positive_balance,
+    metadata,
+    created_at,
+    updated_at,
+    pending_debits,
+    pending_credits,
+    balance - pending_debits AS available_balance,
+    status,
+    status_changed_at,
+    status_changed_by,
+    min_balance,
+    max_balance
+FROM pgledger_accounts;
+
+CREATE OR REPLACE FUNCTION pgledger_check_account_balance_constraints(account PGLEDGER_ACCOUNTS) RETURNS VOID AS $$
+BEGIN
+    -- If account doesn't allow negative balance and available balance is negative, raise an error
+    IF NOT account.allow_negative_balance AND (account.balance - account.pending_debits < 0) THEN
+        RAISE EXCEPTION 'Account (id=%, name=%) does not allow negative balance', account.id, account.name
+        USING
+            ERRCODE = 'PGL01',
+            DETAIL = json_build_object(
+                'account_id', account.id,
+                'account_name', account.name,
+                'balance', account.balance::TEXT,
+                'available_balance', (account.balance - account.pending_debits)::TEXT
+            )::TEXT;
+    END IF;
+
+    -- If account doesn't allow positive balance and balance (including pending credits) is positive, raise an error
+    IF NOT account.allow_positive_balance AND (account.balance + account.pending_credits > 0) THEN
+        RAISE EXCEPTION 'Account (id=%, name=%) does not allow positive balance', account.id, account.name
+        USING
+            ERRCODE = 'PGL02',
+            DETAIL = json_build_object(
+                'account_id', account.id,
+                'account_name', account.name,
+                'balance', account.balance::TEXT
+            )::TEXT;
+    END IF;
+
+    -- If the available balance is below the minimum balance, raise an error
+    IF account.balance - account.pending_debits < account.min_balance THEN
+        RAISE EXCEPTION 'Account (id=%, name=%) balance would be below its minimum balance (%)',
+        account.id, account.name, account.min_balance
+        USING
+            ERRCODE = 'PGL17',
+            DETAIL = json_build_object(
+                'account_id', account.id,
+                'account_name', account.name,
+                'balance', account.balance::TEXT,
+                'available_balance', (account.balance - account.pending_debits)::TEXT,
+                'min_balance', account.min_balance::TEXT
+            )::TEXT;
+    END IF;
+
+    -- If the balance (including pending credits) is above the maximum balance, raise an error
+    IF account.balance + account.pending_credits > account.max_balance THEN
+        RAISE EXCEPTION 'Account (id=%, name=%) balance would be above its maximum balance (%)',
+        account.id, account.name, account.max_balance
+        USING
+            ERRCODE = 'PGL18',
+            DETAIL = json_build_object(
+                'account_id', account.id,
+                'account_name', account.name,
+                'balance', account.balance::TEXT,
+                'max_balance', account.max_balance::TEXT
+            )::TEXT;
+    END IF;
+END;
+$$ LANGUAGE plpgsql;
+
+-- The function gains new parameters, so the old version has to be dropped
+-- rather than replaced
+DROP FUNCTION pgledger_create_account(TEXT, TEXT, BOOLEAN, BOOLEAN, JSONB);
+
+CREATE FUNCTION pgledger_create_account(
+    name TEXT,
+    currency TEXT,
+    allow_negative_balance BOOLEAN DEFAULT TRUE,
+    allow_positive_balance BOOLEAN DEFAULT TRUE,
+    metadata JSONB DEFAULT NULL,
+    min_balance NUMERIC DEFAULT NULL,
+    max_balance NUMERIC DEFAULT NULL
+)
+RETURNS SETOF PGLEDGER_ACCOUNTS_VIEW
+AS $$
+DECLARE
+    new_account_id TEXT;
+BEGIN
+    INSERT INTO pgledger_accounts (
+        name, currency, allow_negative_balance, allow_positive_balance, metadata, min_balance, max_balance, created_at, updated_at
+    )
+    VALUES (
+        name, currency, allow_negative_balance, allow_positive_balance, metadata, min_balance, max_balance, now(), now()
+    )
+    RETURNING pgledger_accounts.id INTO new_account_id;
+
+    RETURN QUERY
+    SELECT *
+    FROM pgledger_accounts_view v
+    WHERE v.id = new_account_id;
+END;
+$$ LANGUAGE plpgsql;
+
+-- Change the balance limits of an account. NULL removes a limit. The new limits
+-- are checked against the current balance, so they can't be set to something
+-- the account already breaks.
+CREATE FUNCTION pgledger_update_account_balance_limits(
+    account_id TEXT,
+    min_balance NUMERIC,
+    max_balance NUMERIC
+)
+RETURNS SETOF PGLEDGER_ACCOUNTS_VIEW
+AS $$
+DECLARE
+    account pgledger_accounts;
+BEGIN
+    UPDATE pgledger_accounts a
+    SET min_balance = pgledger_update_account_balance_limits.min_balance,
+        max_balance = pgledger_update_account_balance_limits.max_balance,
+        updated_at = now()
+    WHERE a.id = pgledger_update_account_balance_limits.account_id
+    RETURNING * INTO account;
+
+    IF NOT FOUND THEN
+        RAISE EXCEPTION 'Account (id=%) does not exist', account_id
+        USING
+            ERRCODE = 'PGL06',
+            DETAIL = json_build_object('account_id', account_id)::TEXT;
+    END IF;
+
+    PERFORM pgledger_check_account_balance_constraints(account);
+
+    RETURN QUERY
+    SELECT *
+    FROM pgledger_accounts_view v
+    WHERE v.id = account.id;
+END;
+$$ LANGUAGE plpgsql;
+
+INSERT INTO pgledger_schema_migrations (version) VALUES (6);
+
+-- migrations/pgledger_07.sql
+
+-- Optional hierarchical paths for accounts, using the ltree extension:
+-- https://www.postgresql.org/docs/current/ltree.html
+--
+-- For example, accounts with the paths user1.available, user1.pending and
+-- user1.fees can be rolled up to get the total for user1.
+CREATE EXTENSION IF NOT EXISTS ltree;
+
+ALTER TABLE pgledger_accounts ADD COLUMN path LTREE;
+
+CREATE INDEX ON pgledger_accounts USING gist (path);
+
+CREATE OR REPLACE VIEW pgledger_accounts_view AS
+SELECT
+    id,
+    name,
+    currency,
+    balance,
+    version,
+    allow_negative_balance,
+    allow_positive_balance,
+    metadata,
+    created_at,
+    updated_at,
+    pending_debits,
+    pending_credits,
+    balance - pending_debits AS available_balance,
+    status,
+    status_changed_at,
+    status_changed_by,
+    min_balance,
+    max_balance,
+    path
+FROM pgledger_accounts;
+
+-- The function gains a new parameter, so the old version has to be dropped
+-- rather than replaced
+DROP FUNCTION pgledger_create_account(TEXT, TEXT, BOOLEAN, BOOLEAN, JSONB, NUMERIC, NUMERIC);
+
+CREATE FUNCTION pgledger_create_account(
+    name TEXT,
+    currency TEXT,
+    allow_negative_balance BOOLEAN DEFAULT TRUE,
+    allow_positive_balance BOOLEAN DEFAULT TRUE,
+    metadata JSONB DEFAULT NULL,
+    min_balance NUMERIC DEFAULT NULL,
+    max_balance NUMERIC DEFAULT NULL,
+    path LTREE DEFAULT NULL
+)
+RETURNS SETOF PGLEDGER_ACCOUNTS_VIEW
+AS $$
+DECLARE
+    new_account_id TEXT;
+BEGIN
+    INSERT INTO pgledger_accounts (
+        name,
+        currency,
+        allow_negative_balance,
+        allow_positive_balance,
+        metadata,
+        min_balance,
+        max_balance,
+        path,
+        created_at,
+        updated_at
+    )
+    VALUES (
+        name,
+        currency,
+        allow_negative_balance,
+        allow_positive_balance,
+        metadata,
+        min_balance,
+        max_balance,
+        path,
+        now(),
+        now()
+    )
+    RETURNING pgledger_accounts.id INTO new_account_id;
+
+    RETURN QUERY
+    SELECT *
+    FROM pgledger_accounts_view v
+    WHERE v.id = new_account_id;
+END;
+$$ LANGUAGE plpgsql;
+
+-- Sum the balances of accounts per currency for every subtree under
+-- path_prefix (or for every subtree, if path_prefix is NULL). For example, an
+-- account with the path user1.available adds to both user1 and user1.available.
+-- Accounts without a path are skipped.
+CREATE FUNCTION pgledger_account_tree_balances(path_prefix LTREE DEFAULT NULL)
+RETURNS TABLE (
+    path LTREE,
+    currency TEXT,
+    balance NUMERIC,
+    available_balance NUMERIC,
+    account_count BIGINT
+)
+AS $$
+    SELECT
+        subpath(a.path, 0, levels.level) AS path,
+        a.currency,
+        sum(a.balance) AS balance,
+        sum(a.balance - a.pending_debits) AS available_balance,
+        count(*) AS account_count
+    FROM pgledger_accounts a
+    CROSS JOIN LATERAL generate_series(coalesce(nlevel(path_prefix), 1), nlevel(a.path)) AS levels (level)
+    WHERE a.path <@ path_prefix OR (path_prefix IS NULL AND a.path IS NOT NULL)
+    GROUP BY 1, 2
+    ORDER BY 1, 2;
+$$ LANGUAGE sql STABLE;
+
+INSERT INTO pgledger_schema_migrations (version) VALUES (7);
+
+-- migrations/pgledger_08.sql
+
+-- Optional, unique external references for accounts, such as the ID of the
+-- account in another system. pgledger_create_transfer(s) accept either account
+-- IDs or external refs, so callers don't need to look up the IDs first.
+--
+-- External refs can't start with pgla_, so they can never be confused with
+-- account IDs.
+ALTER TABLE pgledger_accounts
+ADD COLUMN external_ref TEXT UNIQUE CHECK (external_ref NOT LIKE 'pgla\_%');
+
+CREATE OR REPLACE VIEW pgledger_accounts_view AS
+SELECT
+    id,
+    name,
+    currency,
+    balance,
+    version,
+    allow_negative_balance,
+    allow_positive_balance,
+    metadata,
+    created_at,
+    updated_at,
+    pending_debits,
+    pending_credits,
+    balance - pending_debits AS available_balance,
+    status,
+    status_changed_at,
+    status_changed_by,
+    min_balance,
+    max_balance,
+    path,
+    external_ref
+FROM pgledger_accounts;
+
+-- The function gains a new parameter, so the old version has to be dropped
+-- rather than replaced
+DROP FUNCTION pgledger_create_account(TEXT, TEXT, BOOLEAN, BOOLEAN, JSONB, NUMERIC, NUMERIC, LTREE);
+
+CREATE FUNCTION pgledger_create_account(
+    name TEXT,
+    currency TEXT,
+    allow_negative_balance BOOLEAN DEFAULT TRUE,
+    allow_positive_balance BOOLEAN DEFAULT TRUE,
+    metadata JSONB DEFAULT NULL,
+    min_balance NUMERIC DEFAULT NULL,
+    max_balance NUMERIC DEFAULT NULL,
+    path LTREE DEFAULT NULL,
+    external_ref TEXT DEFAULT NULL
+)
+RETURNS SETOF PGLEDGER_ACCOUNTS_VIEW
+AS $$
+DECLARE
+    new_account_id TEXT;
+BEGIN
+    INSERT INTO pgledger_accounts (
+        name,
+        currency,
+        allow_negative_balance,
+        allow_positive_balance,
+        metadata,
+        min_balance,
+        max_balance,
+        path,
+        external_ref,
+        created_at,
+        updated_at
+    )
+    VALUES (
+        name,
+        currency,
+        allow_negative_balance,
+        allow_positive_balance,
+        metadata,
+        min_balance,
+        max_balance,
+        path,
+        external_ref,
+        now(),
+        now()
+    )
+    RETURNING pgledger_accounts.id INTO new_account_id;
+
+    RETURN QUERY
+    SELECT *
+    FROM pgledger_accounts_view v
+    WHERE v.id = new_account_id;
+END;
+$$ LANGUAGE plpgsql;
+
+-- Return the ID of the account with the given external ref. Anything else is
+-- returned as is, and treated as an account ID (which is checked when the
+-- account is locked).
+CREATE FUNCTION pgledger_resolve_account_id(account_id_or_ref TEXT)
+RETURNS TEXT
+AS $$
+    SELECT coalesce(
+        (SELECT a.id FROM pgledger_accounts a WHERE a.external_ref = account_id_or_ref),
+        account_id_or_ref
+    );
+$$ LANGUAGE sql STABLE;
+
+-- Same as before, but resolving external refs first
+CREATE OR REPLACE FUNCTION pgledger_create_transfers(
+    transfer_requests TRANSFER_REQUEST [],
+    event_at TIMESTAMPTZ DEFAULT NULL,
+    metadata JSONB DEFAULT NULL,
+    idempotency_key TEXT DEFAULT NULL,
+    pending BOOLEAN DEFAULT FALSE
+)
+RETURNS SETOF PGLEDGER_TRANSFERS_VIEW
+AS $$
+DECLARE
+    transfer_request transfer_request;
+    resolved_requests transfer_request[] := '{}';
+    transfer_ids TEXT[] := '{}';
+    account_id TEXT;
+    all_account_ids TEXT[] := '{}';
+    request JSONB;
+    existing_key pgledger_idempotency_keys;
+BEGIN
+    IF idempotency_key IS NOT NULL THEN
+        request := jsonb_build_object('transfer_requests', to_jsonb(transfer_requests), 'metadata', metadata);
+
+        -- Only include pending when it's set, so that keys stored before it
+        -- existed still match
+        IF pending THEN
+            request := request || jsonb_build_object('pending', TRUE);
+        END IF;
+
+        -- If another transaction is using the same key, this waits for it to
+        -- commit or roll back
+        INSERT INTO pgledger_idempotency_keys (idempotency_key, request, event_at, created_at)
+        VALUES (idempotency_key, request, event_at, now())
+        ON CONFLICT ON CONSTRAINT pgledger_idempotency_keys_pkey DO NOTHING;
+
+        IF NOT FOUND THEN
+            SELECT * INTO existing_key
+            FROM pgledger_idempotency_keys k
+            WHERE k.idempotency_key = pgledger_create_transfers.idempotency_key;
+
+            IF existing_key.request != request OR existing_key.event_at IS DISTINCT FROM event_at THEN
+                RAISE EXCEPTION 'Idempotency key (%) was already used with different parameters', idempotency_key
+                USING
+                    ERRCODE = 'PGL07',
+                    DETAIL = json_build_object('idempotency_key', idempotency_key)::TEXT;
+            END IF;
+
+            -- Return the transfers from the original call
+            RETURN QUERY
+            SELECT *
+            FROM pgledger_transfers_view t
+            WHERE t.idempotency_key = pgledger_create_transfers.idempotency_key
+            ORDER BY t.id;
+
+            RETURN;
+        END IF;
+    END IF;
+
+    -- Resolve external refs to account IDs, so that the accounts are locked in
+    -- the same order no matter how they are referenced
+    FOREACH transfer_request IN ARRAY transfer_requests LOOP
+        transfer_request.from_account_id := pgledger_resolve_account_id(transfer_request.from_account_id);
+        transfer_request.to_account_id := pgledger_resolve_account_id(transfer_request.to_account_id);
+        resolved_requests := array_append(resolved_requests, transfer_request);
+    END LOOP;
+
+    -- Collect all unique account IDs and sort them to prevent deadlocks
+    FOREACH transfer_request IN ARRAY resolved_requests LOOP
+        all_account_ids := array_append(all_account_ids, transfer_request.from_account_id);
+        all_account_ids := array_append(all_account_ids, transfer_request.to_account_id);
+    END LOOP;
+
+    -- Remove duplicates and sort
+    SELECT ARRAY(SELECT DISTINCT unnest FROM unnest(all_account_ids) ORDER BY unnest)
+    INTO all_account_ids;
+
+    -- Lock all accounts in order
+    FOREACH account_id IN ARRAY all_account_ids LOOP
+        PERFORM pgledger_accounts.id
+        FROM pgledger_accounts
+        WHERE pgledger_accounts.id = account_id
+        FOR UPDATE;
+
+        IF NOT FOUND THEN
+            RAISE EXCEPTION 'Account (id=%) does not exist', account_id
+            USING
+                ERRCODE = 'PGL06',
+                DETAIL = json_build_object('account_id', account_id)::TEXT;
+        END IF;
+    END LOOP;
+
+    -- Process each transfer
+    FOREACH transfer_request IN ARRAY resolved_requests LOOP
+        transfer_ids := array_append(transfer_ids, pgledger_apply_transfer(
+            from_account_id => transfer_request.from_account_id,
+            to_account_id => transfer_request.to_account_id,
+            amount => transfer_request.amount,
+            transfer_status => CASE WHEN pending THEN 'pending' ELSE 'posted' END,
+            pending_transfer_id => NULL,
+            event_at => coalesce(event_at, now()),
+            metadata => metadata,
+            idempotency_key => idempotency_key
+        ));
+    END LOOP;
+
+    -- Return all created transfers
+    RETURN QUERY
+    SELECT *
+    FROM pgledger_transfers_view
+    WHERE id = ANY(transfer_ids)
+    ORDER BY id;
+END;
+$$ LANGUAGE plpgsql;
+
+INSERT INTO pgledger_schema_migrations (version) VALUES (8);
+
+-- migrations/pgledger_09.sql
+
+-- Add the currency, the account names, and the resulting balances and versions
+-- of both accounts to pgledger_transfers_view, so that callers don't need to
+-- join to the accounts and entries themselves. Since pgledger_create_transfer(s)
+-- return the view, they return these columns too.
+--
+-- The balances and versions come from the entries of the transfer, so they are
+-- the balances of the accounts right after the transfer. Pending transfers and
+-- releases don't change the balances (only pending_debits and pending_credits),
+-- so their balances are the same as the previous transfer's.
+CREATE OR REPLACE VIEW pgledger_transfers_view AS
+SELECT
+    t.id,
+    t.from_account_id,
+    t.to_account_id,
+    t.amount,
+    t.created_at,
+    t.event_at,
+    t.metadata,
+    t.idempotency_key,
+    t.reverses_transfer_id,
+    t.status,
+    t.pending_transfer_id,
+    fa.currency,
+    fa.name AS from_account_name,
+    ta.name AS to_account_name,
+    fe.account_current_balance AS from_account_balance,
+    fe.account_version AS from_account_version,
+    te.account_current_balance AS to_account_balance,
+    te.account_version AS to_account_version
+FROM pgledger_transfers t
+JOIN pgledger_accounts fa ON t.from_account_id = fa.id
+JOIN pgledger_accounts ta ON t.to_account_id = ta.id
+JOIN pgledger_entries fe ON t.id = fe.transfer_id AND t.from_account_id = fe.account_id
+JOIN pgledger_entries te ON t.id = te.transfer_id AND t.to_account_id = te.account_id;
+
+INSERT INTO pgledger_schema_migrations (version) VALUES (9);
+
+-- migrations/pgledger_10.sql
+
+-- Per-transfer metadata and event_at for pgledger_create_transfers, so that
+-- each leg of a batch (such as the USD and EUR legs of a currency conversion)
+-- can be tagged differently.
+--
+-- TRANSFER_REQUEST can't gain the new fields without breaking every existing
+-- (from_account_id, to_account_id, amount)::TRANSFER_REQUEST cast, so they are
+-- in a new type instead. When they are set, they override the metadata and
+-- event_at passed to pgledger_create_transfers for that transfer.
+CREATE TYPE TRANSFER_REQUEST_V2 AS (
+    from_account_id TEXT,
+    to_account_id TEXT,
+    amount NUMERIC,
+    metadata JSONB,
+    event_at TIMESTAMPTZ
+);
+
+-- The requests as they are recorded for an idempotency key. Null metadata and
+-- event_at are left out, so that requests without them match keys stored by
+-- the TRANSFER_REQUEST version of pgledger_create_transfers. Only those fields
+-- are left out: nulls inside the metadata are part of the request.
+CREATE FUNCTION pgledger_idempotency_transfer_requests(
+    transfer_requests TRANSFER_REQUEST_V2 []
+)
+RETURNS JSONB
+AS $$
+    SELECT coalesce(
+        jsonb_agg(
+            jsonb_build_object(
+                'from_account_id', r.from_account_id,
+                'to_account_id', r.to_account_id,
+                'amount', r.amount
+            )
+            || CASE WHEN r.metadata IS NULL THEN '{}' ELSE jsonb_build_object('metadata', r.metadata) END
+            || CASE WHEN r.event_at IS NULL THEN '{}' ELSE jsonb_build_object('event_at', r.event_at) END
+            ORDER BY r.n
+        ),
+        '[]'
+    )
+    FROM unnest(pgledger_idempotency_transfer_requests.transfer_requests)
+        WITH ORDINALITY AS r (from_account_id, to_account_id, amount, metadata, event_at, n);
+$$ LANGUAGE sql STABLE;
+
+CREATE FUNCTION pgledger_create_transfers(
+    transfer_requests TRANSFER_REQUEST_V2 [],
+    event_at TIMESTAMPTZ DEFAULT NULL,
+    metadata JSONB DEFAULT NULL,
+    idempotency_key TEXT DEFAULT NULL,
+    pending BOOLEAN DEFAULT FALSE
+)
+RETURNS SETOF PGLEDGER_TRANSFERS_VIEW
+AS $$
+DECLARE
+    transfer_request transfer_request_v2;
+    resolved_requests transfer_request_v2[] := '{}';
+    transfer_ids TEXT[] := '{}';
+    account_id TEXT;
+    all_account_ids TEXT[] := '{}';
+    request JSONB;
+    existing_key pgledger_idempotency_keys;
+BEGIN
+    IF idempotency_key IS NOT NULL THEN
+        request := jsonb_build_object(
+            'transfer_requests', pgledger_idempotency_transfer_requests(transfer_requests),
+            'metadata', metadata
+        );
+
+        -- Only include pending when it's set, so that keys stored before it
+        -- existed still match
+        IF pending THEN
+            request := request || jsonb_build_object('pending', TRUE);
+        END IF;
+
+        -- If another transaction is using the same key, this waits for it to
+        -- commit or roll back
+        INSERT INTO pgledger_idempotency_keys (idempotency_key, request, event_at, created_at)
+        VALUES (idempotency_key, request, event_at, now())
+        ON CONFLICT ON CONSTRAINT pgledger_idempotency_keys_pkey DO NOTHING;
+
+        IF NOT FOUND THEN
+            SELECT * INTO existing_key
+            FROM pgledger_idempotency_keys k
+            WHERE k.idempotency_key = pgledger_create_transfers.idempotency_key;
+
+            IF existing_key.request != request OR existing_key.event_at IS DISTINCT FROM event_at THEN
+                RAISE EXCEPTION 'Idempotency key (%) was already used with different parameters', idempotency_key
+                USING
+                    ERRCODE = 'PGL07',
+                    DETAIL = json_build_object('idempotency_key', idempotency_key)::TEXT;
+            END IF;
+
+            -- Return the transfers from the original call
+            RETURN QUERY
+            SELECT *
+            FROM pgledger_transfers_view t
+            WHERE t.idempotency_key = pgledger_create_transfers.idempotency_key
+            ORDER BY t.id;
+
+            RETURN;
+        END IF;
+    END IF;
+
+    -- Resolve external refs to account IDs, so that the accounts are locked in
+    -- the same order no matter how they are referenced
+    FOREACH transfer_request IN ARRAY transfer_requests LOOP
+        transfer_request.from_account_id := pgledger_resolve_account_id(transfer_request.from_account_id);
+        transfer_request.to_account_id := pgledger_resolve_account_id(transfer_request.to_account_id);
+        resolved_requests := array_append(resolved_requests, transfer_request);
+    END LOOP;
+
+    -- Collect all unique account IDs and sort them to prevent deadlocks
+    FOREACH transfer_request IN ARRAY resolved_requests LOOP
+        all_account_ids := array_append(all_account_ids, transfer_request.from_account_id);
+        all_account_ids := array_append(all_account_ids, transfer_request.to_account_id);
+    END LOOP;
+
+    -- Remove duplicates and sort
+    SELECT ARRAY(SELECT DISTINCT unnest FROM unnest(all_account_ids) ORDER BY unnest)
+    INTO all_account_ids;
+
+    -- Lock all accounts in order
+    FOREACH account_id IN ARRAY all_account_ids LOOP
+        PERFORM pgledger_accounts.id
+        FROM pgledger_accounts
+        WHERE pgledger_accounts.id = account_id
+        FOR UPDATE;
+
+        IF NOT FOUND THEN
+            RAISE EXCEPTION 'Account (id=%) does not exist', account_id
+            USING
+                ERRCODE = 'PGL06',
+                DETAIL = json_build_object('account_id', account_id)::TEXT;
+        END IF;
+    END LOOP;
+
+    -- Process each transfer
+    FOREACH transfer_request IN ARRAY resolved_requests LOOP
+        transfer_ids := array_append(transfer_ids, pgledger_apply_transfer(
+            from_account_id => transfer_request.from_account_id,
+            to_account_id => transfer_request.to_account_id,
+            amount => transfer_request.amount,
+            transfer_status => CASE WHEN pending THEN 'pending' ELSE 'posted' END,
+            pending_transfer_id => NULL,
+            event_at => coalesce(transfer_request.event_at, event_at, now()),
+            metadata => coalesce(transfer_request.metadata, metadata),
+            idempotency_key => idempotency_key
+        ));
+    END LOOP;
+
+    -- Return all created transfers
+    RETURN QUERY
+    SELECT *
+    FROM pgledger_transfers_view
+    WHERE id = ANY(transfer_ids)
+    ORDER BY id;
+END;
+$$ LANGUAGE plpgsql;
+
+
+-- The TRANSFER_REQUEST version now converts the requests and calls the
+-- TRANSFER_REQUEST_V2 version
+CREATE OR REPLACE FUNCTION pgledger_create_transfers(
+    transfer_requests TRANSFER_REQUEST [],
+    event_at TIMESTAMPTZ DEFAULT NULL,
+    metadata JSONB DEFAULT NULL,
+    idempotency_key TEXT DEFAULT NULL,
+    pending BOOLEAN DEFAULT FALSE
+)
+RETURNS SETOF PGLEDGER_TRANSFERS_VIEW
+AS $$
+BEGIN
+    RETURN QUERY
+    SELECT * FROM pgledger_create_transfers(
+        transfer_requests => array(
+            SELECT (r.from_account_id, r.to_account_id, r.amount, NULL::JSONB, NULL::TIMESTAMPTZ)::TRANSFER_REQUEST_V2
+            FROM unnest(transfer_requests) WITH ORDINALITY AS r (from_account_id, to_account_id, amount, n)
+            ORDER BY r.n
+        ),
+        event_at => event_at,
+        metadata => metadata,
+        idempotency_key => idempotency_key,
+        pending => pending
+    );
+END;
+$$ LANGUAGE plpgsql;
+
+INSERT INTO pgledger_schema_migrations (version) VALUES (10);
+
+-- migrations/pgledger_11.sql
+
+-- Journals, which record which transfers were created together. Every call to
+-- pgledger_create_transfers (and so pgledger_create_transfer and
+-- pgledger_reverse_transfer) creates one journal, with the metadata of the
+-- call, and every transfer it creates points to it. Posting or voiding a
+-- pending transfer also creates a journal for its transfers.
+--
+-- Transfers created before this migration don't have a journal.
+CREATE TABLE pgledger_journals (
+    id TEXT PRIMARY KEY DEFAULT pgledger_generate_id('pglj'),
+    metadata JSONB,
+    created_at TIMESTAMPTZ NOT NULL
+);
+
+ALTER TABLE pgledger_transfers ADD COLUMN journal_id TEXT REFERENCES pgledger_journals (id);
+
+CREATE INDEX ON pgledger_transfers (journal_id) WHERE journal_id IS NOT NULL;
+
+CREATE VIEW pgledger_journals_view AS
+SELECT
+    id,
+    metadata,
+    created_at
+FROM pgledger_journals;
+
+CREATE OR REPLACE VIEW pgledger_transfers_view AS
+SELECT
+    t.id,
+    t.from_account_id,
+    t.to_account_id,
+    t.amount,
+    t.created_at,
+    t.event_at,
+    t.metadata,
+    t.idempotency_key,
+    t.reverses_transfer_id,
+    t.status,
+    t.pending_transfer_id,
+    fa.currency,
+    fa.name AS from_account_name,
+    ta.name AS to_account_name,
+    fe.account_current_balance AS from_account_balance,
+    fe.account_version AS from_account_version,
+    te.account_current_balance AS to_account_balance,
+    te.account_version AS to_account_version,
+    t.journal_id
+FROM pgledger_transfers t
+JOIN pgledger_accounts fa ON t.from_account_id = fa.id
+JOIN pgledger_accounts ta ON t.to_account_id = ta.id
+JOIN pgledger_entries fe ON t.id = fe.transfer_id AND t.from_account_id = fe.account_id
+JOIN pgledger_entries te ON t.id = te.transfer_id AND t.to_account_id = te.account_id;
+
+-- The function gains a new parameter, so the old version has to be dropped
+-- rather than replaced. The functions which call it are all replaced below.
+DROP FUNCTION pgledger_apply_transfer(TEXT, TEXT, NUMERIC, TEXT, TEXT, TIMESTAMPTZ, JSONB, TEXT);
+
+CREATE FUNCTION pgledger_apply_transfer(
+    from_account_id TEXT,
+    to_account_id TEXT,
+    amount NUMERIC,
+    transfer_status TEXT,
+    pending_transfer_id TEXT,
+    event_at TIMESTAMPTZ,
+    metadata JSONB,
+    idempotency_key TEXT,
+    journal_id TEXT
+)
+RETURNS TEXT
+AS $$
+DECLARE
+    from_account pgledger_accounts;
+    to_account pgledger_accounts;
+    balance_change NUMERIC := 0;
+    pending_change NUMERIC := 0;
+    new_transfer_id TEXT;
+BEGIN
+    -- Preliminary checks
+    IF amount <= 0 THEN
+        RAISE EXCEPTION 'Amount (%) must be positive', amount
+        USING
+            ERRCODE = 'PGL04',
+            DETAIL = json_build_object('amount', amount::TEXT)::TEXT;
+    END IF;
+
+    IF from_account_id = to_account_id THEN
+        RAISE EXCEPTION 'Cannot transfer to the same account (id=%)', from_account_id
+        USING
+            ERRCODE = 'PGL05',
+            DETAIL = json_build_object('account_id', from_account_id)::TEXT;
+    END IF;
+
+    IF transfer_status = 'posted' THEN
+        balance_change := amount;
+    ELSIF transfer_status = 'pending' THEN
+        pending_change := amount;
+    ELSE
+        pending_change := -amount;
+    END IF;
+
+    -- Update account balances
+    UPDATE pgledger_accounts a
+    SET balance = a.balance - balance_change,
+        pending_debits = a.pending_debits + pending_change,
+        version = a.version + 1,
+        updated_at = now()
+    WHERE a.id = from_account_id
+    RETURNING * INTO from_account;
+
+    -- Check status and balance constraints for the source account. Releasing a
+    -- pending amount is always allowed, so that pending transfers can still be
+    -- voided after an account is frozen.
+    IF transfer_status != 'released' THEN
+        PERFORM pgledger_check_account_status(from_account, debit => TRUE);
+    END IF;
+    PERFORM pgledger_check_account_balance_constraints(from_account);
+
+    UPDATE pgledger_accounts a
+    SET balance = a.balance + balance_change,
+        pending_credits = a.pending_credits + pending_change,
+        version = a.version + 1,
+        updated_at = now()
+    WHERE a.id = to_account_id
+    RETURNING * INTO to_account;
+
+    -- Check status and balance constraints for the destination account
+    IF transfer_status != 'released' THEN
+        PERFORM pgledger_check_account_status(to_account, debit => FALSE);
+    END IF;
+    PERFORM pgledger_check_account_balance_constraints(to_account);
+
+    -- Check that currencies match
+    IF from_account.currency != to_account.currency THEN
+        RAISE EXCEPTION 'Cannot transfer between different currencies (% and %)', from_account.currency, to_account.currency
+        USING
+            ERRCODE = 'PGL03',
+            DETAIL = json_build_object(
+                'from_account_id', from_account.id,
+                'to_account_id', to_account.id,
+                'from_currency', from_account.currency,
+                'to_currency', to_account.currency
+            )::TEXT;
+    END IF;
+
+    -- Create transfer record
+    INSERT INTO pgledger_transfers (
+        from_account_id,
+        to_account_id,
+        amount,
+        created_at,
+        event_at,
+        metadata,
+        idempotency_key,
+        status,
+        pending_transfer_id,
+        journal_id
+    )
+    VALUES (
+        from_account_id,
+        to_account_id,
+        amount,
+        now(),
+        event_at,
+        metadata,
+        idempotency_key,
+        transfer_status,
+        pending_transfer_id,
+        journal_id
+    )
+    RETURNING pgledger_transfers.id INTO new_transfer_id;
+
+    -- Create entry for the source account (negative amount, or positive when
+    -- releasing a pending amount)
+    INSERT INTO pgledger_entries (
+        account_id, transfer_id, amount, account_previous_balance, account_current_balance, account_version, created_at, pending
+    )
+    VALUES (
+        from_account_id,
+        new_transfer_id,
+        -(balance_change + pending_change),
+        from_account.balance + balance_change,
+        from_account.balance,
+        from_account.version,
+        now(),
+        transfer_status != 'posted'
+    );
+
+    -- Create entry for the destination account (positive amount, or negative
+    -- when releasing a pending amount)
+    INSERT INTO pgledger_entries (
+        account_id, transfer_id, amount, account_previous_balance, account_current_balance, account_version, created_at, pending
+    )
+    VALUES (
+        to_account_id,
+        new_transfer_id,
+        balance_change + pending_change,
+        to_account.balance - balance_change,
+        to_account.balance,
+        to_account.version,
+        now(),
+        transfer_status != 'posted'
+    );
+
+    RETURN new_transfer_id;
+END;
+$$ LANGUAGE plpgsql;
+
+
+-- Same as before, but creating a journal for the transfers
+CREATE OR REPLACE FUNCTION pgledger_create_transfers(
+    transfer_requests TRANSFER_REQUEST_V2 [],
+    event_at TIMESTAMPTZ DEFAULT NULL,
+    metadata JSONB DEFAULT NULL,
+    idempotency_key TEXT DEFAULT NULL,
+    pending BOOLEAN DEFAULT FALSE
+)
+RETURNS SETOF PGLEDGER_TRANSFERS_VIEW
+AS $$
+DECLARE
+    transfer_request transfer_request_v2;
+    resolved_requests transfer_request_v2[] := '{}';
+    transfer_ids TEXT[] := '{}';
+    new_journal_id TEXT;
+    account_id TEXT;
+    all_account_ids TEXT[] := '{}';
+    request JSONB;
+    existing_key pgledger_idempotency_keys;
+BEGIN
+    IF idempotency_key IS NOT NULL THEN
+        request := jsonb_build_object(
+            'transfer_requests', pgledger_idempotency_transfer_requests(transfer_requests),
+            'metadata', metadata
+        );
+
+        -- Only include pending when it's set, so that keys stored before it
+        -- existed still match
+        IF pending THEN
+            request := request || jsonb_build_object('pending', TRUE);
+        END IF;
+
+        -- If another transaction is using the same key, this waits for it to
+        -- commit or roll back
+        INSERT INTO pgledger_idempotency_keys (idempotency_key, request, event_at, created_at)
+        VALUES (idempotency_key, request, event_at, now())
+        ON CONFLICT ON CONSTRAINT pgledger_idempotency_keys_pkey DO NOTHING;
+
+        IF NOT FOUND THEN
+            SELECT * INTO existing_key
+            FROM pgledger_idempotency_keys k
+            WHERE k.idempotency_key = pgledger_create_transfers.idempotency_key;
+
+            IF existing_key.request != request OR existing_key.event_at IS DISTINCT FROM event_at THEN
+                RAISE EXCEPTION 'Idempotency key (%) was already used with different parameters', idempotency_key
+                USING
+                    ERRCODE = 'PGL07',
+                    DETAIL = json_build_object('idempotency_key', idempotency_key)::TEXT;
+            END IF;
+
+            -- Return the transfers from the original call
+            RETURN QUERY
+            SELECT *
+            FROM pgledger_transfers_view t
+            WHERE t.idempotency_key = pgledger_create_transfers.idempotency_key
+            ORDER BY t.id;
+
+            RETURN;
+        END IF;
+    END IF;
+
+    -- Resolve external refs to account IDs, so that the accounts are locked in
+    -- the same order no matter how they are referenced
+    FOREACH transfer_request IN ARRAY transfer_requests LOOP
+        transfer_request.from_account_id := pgledger_resolve_account_id(transfer_request.from_account_id);
+        transfer_request.to_account_id := pgledger_resolve_account_id(transfer_request.to_account_id);
+        resolved_requests := array_append(resolved_requests, transfer_request);
+    END LOOP;
+
+    -- Collect all unique account IDs and sort them to prevent deadlocks
+    FOREACH transfer_request IN ARRAY resolved_requests LOOP
+        all_account_ids := array_append(all_account_ids, transfer_request.from_account_id);
+        all_account_ids := array_append(all_account_ids, transfer_request.to_account_id);
+    END LOOP;
+
+    -- Remove duplicates and sort
+    SELECT ARRAY(SELECT DISTINCT unnest FROM unnest(all_account_ids) ORDER BY unnest)
+    INTO all_account_ids;
+
+    -- Lock all accounts in order
+    FOREACH account_id IN ARRAY all_account_ids LOOP
+        PERFORM pgledger_accounts.id
+        FROM pgledger_accounts
+        WHERE pgledger_accounts.id = account_id
+        FOR UPDATE;
+
+        IF NOT FOUND THEN
+            RAISE EXCEPTION 'Account (id=%) does not exist', account_id
+            USING
+                ERRCODE = 'PGL06',
+                DETAIL = json_build_object('account_id', account_id)::TEXT;
+        END IF;
+    END LOOP;
+
+    INSERT INTO pgledger_journals (metadata, created_at)
+    VALUES (metadata, now())
+    RETURNING pgledger_journals.id INTO new_journal_id;
+
+    -- Process each transfer
+    FOREACH transfer_request IN ARRAY resolved_requests LOOP
+        transfer_ids := array_append(transfer_ids, pgledger_apply_transfer(
+            from_account_id => transfer_request.from_account_id,
+            to_account_id => transfer_request.to_account_id,
+            amount => transfer_request.amount,
+            transfer_status => CASE WHEN pending THEN 'pending' ELSE 'posted' END,
+            pending_transfer_id => NULL,
+            event_at => coalesce(transfer_request.event_at, event_at, now()),
+            metadata => coalesce(transfer_request.metadata, metadata),
+            idempotency_key => idempotency_key,
+            journal_id => new_journal_id
+        ));
+    END LOOP;
+
+    -- Return all created transfers
+    RETURN QUERY
+    SELECT *
+    FROM pgledger_transfers_view
+    WHERE id = ANY(transfer_ids)
+    ORDER BY id;
+END;
+$$ LANGUAGE plpgsql;
+
+
+-- Same as before, but creating a journal for the released and posted transfers
+CREATE OR REPLACE FUNCTION pgledger_post_pending_transfer(
+    pending_transfer_id TEXT,
+    amount NUMERIC DEFAULT NULL,
+    metadata JSONB DEFAULT NULL
+)
+RETURNS SETOF PGLEDGER_TRANSFERS_VIEW
+AS $$
+DECLARE
+    pending_transfer pgledger_transfers;
+    posted_transfer_id TEXT;
+    new_journal_id TEXT;
+BEGIN
+    pending_transfer := pgledger_lock_pending_transfer(pending_transfer_id);
+
+    amount := coalesce(amount, pending_transfer.amount);
+    metadata := coalesce(metadata, pending_transfer.metadata);
+
+    IF amount > pending_transfer.amount THEN
+        RAISE EXCEPTION 'Amount (%) exceeds the pending amount (%) of transfer (id=%)',
+        amount, pending_transfer.amount, pending_transfer.id
+        USING
+            ERRCODE = 'PGL13',
+            DETAIL = json_build_object(
+                'transfer_id', pending_transfer.id,
+                'amount', amount::TEXT,
+                'pending_amount', pending_transfer.amount::TEXT
+            )::TEXT;
+    END IF;
+
+    INSERT INTO pgledger_journals (metadata, created_at)
+    VALUES (metadata, now())
+    RETURNING pgledger_journals.id INTO new_journal_id;
+
+    PERFORM pgledger_apply_transfer(
+        from_account_id => pending_transfer.from_account_id,
+        to_account_id => pending_transfer.to_account_id,
+        amount => pending_transfer.amount,
+        transfer_status => 'released',
+        pending_transfer_id => pending_transfer.id,
+        event_at => now(),
+        metadata => metadata,
+        idempotency_key => NULL,
+        journal_id => new_journal_id
+    );
+
+    posted_transfer_id := pgledger_apply_transfer(
+        from_account_id => pending_transfer.from_account_id,
+        to_account_id => pending_transfer.to_account_id,
+        amount => amount,
+        transfer_status => 'posted',
+        pending_transfer_id => pending_transfer.id,
+        event_at => now(),
+        metadata => metadata,
+        idempotency_key => NULL,
+        journal_id => new_journal_id
+    );
+
+    RETURN QUERY
+    SELECT *
+    FROM pgledger_transfers_view v
+    WHERE v.id = posted_transfer_id;
+END;
+$$ LANGUAGE plpgsql;
+
+
+-- Same as before, but creating a journal for the released transfer
+CREATE OR REPLACE FUNCTION pgledger_void_pending_transfer(
+    pending_transfer_id TEXT,
+    metadata JSONB DEFAULT NULL
+)
+RETURNS SETOF PGLEDGER_TRANSFERS_VIEW
+AS $$
+DECLARE
+    pending_transfer pgledger_transfers;
+    released_transfer_id TEXT;
+    new_journal_id TEXT;
+BEGIN
+    pending_transfer := pgledger_lock_pending_transfer(pending_transfer_id);
+    metadata := coalesce(metadata, pending_transfer.metadata);
+
+    INSERT INTO pgledger_journals (metadata, created_at)
+    VALUES (metadata, now())
+    RETURNING pgledger_journals.id INTO new_journal_id;
+
+    released_transfer_id := pgledger_apply_transfer(
+        from_account_id => pending_transfer.from_account_id,
+        to_account_id => pending_transfer.to_account_id,
+        amount => pending_transfer.amount,
+        transfer_status => 'released',
+        pending_transfer_id => pending_transfer.id,
+        event_at => now(),
+        metadata => metadata,
+        idempotency_key => NULL,
+        journal_id => new_journal_id
+    );
+
+    RETURN QUERY
+    SELECT *
+    FROM pgledger_transfers_view v
+    WHERE v.id = released_transfer_id;
+END;
+$$ LANGUAGE plpgsql;
+
+
+INSERT INTO pgledger_schema_migrations (version) VALUES (11);
+
+-- migrations/pgledger_12.sql
+
+-- A registry of currencies, seeded with the ISO 4217 currencies, so that typos
+-- (such as 'usd' instead of 'USD') are rejected when accounts are created, and
+-- transfer amounts can't have more decimal places than the currency's minor
+-- unit (such as 0.001 USD). Other currencies (such as BTC, or loyalty points)
+-- can be added with pgledger_create_currency.
+--
+-- Trailing zeros don't count towards the scale of an amount, so 10.000 USD is
+-- still allowed. The scale isn't checked for transfers created before this
+-- migration.
+--
+-- Existing accounts may use currencies which aren't in ISO 4217, so those are
+-- added with the largest scale already used in their transfers (and no
+-- description).
+--
+-- New error codes:
+--
+--   PGL19: currency does not exist
+--   PGL20: amount has more decimal places than the currency allows
+CREATE TABLE pgledger_currencies (
+    code TEXT PRIMARY KEY,
+    scale INTEGER NOT NULL CHECK (scale >= 0),
+    description TEXT
+);
+
+INSERT INTO pgledger_currencies (code, scale, description) VALUES
+('AED', 2, 'UAE Dirham'),
+('AFN', 2, 'Afghani'),
+('ALL', 2, 'Lek'),
+('AMD', 2, 'Armenian Dram'),
+('ANG', 2, 'Netherlands Antillean Guilder'),
+('AOA', 2, 'Kwanza'),
+('ARS', 2, 'Argentine Peso'),
+('AUD', 2, 'Australian Dollar'),
+('AWG', 2, 'Aruban Florin'),
+('AZN', 2, 'Azerbaijan Manat'),
+('BAM', 2, 'Convertible Mark'),
+('BBD', 2, 'Barbados Dollar'),
+('BDT', 2, 'Taka'),
+('BGN', 2, 'Bulgarian Lev'),
+('BHD', 3, 'Bahraini Dinar'),
+('BIF', 0, 'Burundi Franc'),
+('BMD', 2, 'Bermudian Dollar'),
+('BND', 2, 'Brunei Dollar'),
+('BOB', 2, 'Boliviano'),
+('BOV', 2, 'Mvdol'),
+('BRL', 2, 'Brazilian Real'),
+('BSD', 2, 'Bahamian Dollar'),
+('BTN', 2, 'Ngultrum'),
+('BWP', 2, 'Pula'),
+('BYN', 2, 'Belarusian Ruble'),
+('BZD', 2, 'Belize Dollar'),
+('CAD', 2, 'Canadian Dollar'),
+('CDF', 2, 'Congolese Franc'),
+('CHE', 2, 'WIR Euro'),
+('CHF', 2, 'Swiss Franc'),
+('CHW', 2, 'WIR Franc'),
+('CLF', 4, 'Unidad de Fomento'),
+('CLP', 0, 'Chilean Peso'),
+('CNY', 2, 'Yuan Renminbi'),
+('COP', 2, 'Colombian Peso'),
+('COU', 2, 'Unidad de Valor Real'),
+('CRC', 2, 'Costa Rican Colon'),
+('CUP', 2, 'Cuban Peso'),
+('CVE', 2, 'Cabo Verde Escudo'),
+('CZK', 2, 'Czech Koruna'),
+('DJF', 0, 'Djibouti Franc'),
+('DKK', 2, 'Danish Krone'),
+('DOP', 2, 'Dominican Peso'),
+('DZD', 2, 'Algerian Dinar'),
+('EGP', 2, 'Egyptian Pound'),
+('ERN', 2, 'Nakfa'),
+('ETB', 2, 'Ethiopian Birr'),
+('EUR', 2, 'Euro'),
+('FJD', 2, 'Fiji Dollar'),
+('FKP', 2, 'Falkland Islands Pound'),
+('GBP', 2, 'Pound Sterling'),
+('GEL', 2, 'Lari'),
+('GHS', 2, 'Ghana Cedi'),
+('GIP', 2, 'Gibraltar Pound'),
+('GMD', 2, 'Dalasi'),
+('GNF', 0, 'Guinean Franc'),
+('GTQ', 2, 'Quetzal'),
+('GYD', 2, 'Guyana Dollar'),
+('HKD', 2, 'Hong Kong Dollar'),
+('HNL', 2, 'Lempira'),
+('HTG', 2, 'Gourde'),
+('HUF', 2, 'Forint'),
+('IDR', 2, 'Rupiah'),
+('ILS', 2, 'New Israeli Sheqel'),
+('INR', 2, 'Indian Rupee'),
+('IQD', 3, 'Iraqi Dinar'),
+('IRR', 2, 'Iranian Rial'),
+('ISK', 0, 'Iceland Krona'),
+('JMD', 2, 'Jamaican Dollar'),
+('JOD', 3, 'Jordanian Dinar'),
+('JPY', 0, 'Yen'),
+('KES', 2, 'Kenyan Shilling'),
+('KGS', 2, 'Som'),
+('KHR', 2, 'Riel'),
+('KMF', 0, 'Comorian Franc'),
+('KPW', 2, 'North Korean Won'),
+('KRW', 0, 'Won'),
+('KWD', 3, 'Kuwaiti Dinar'),
+('KYD', 2, 'Cayman Islands Dollar'),
+('KZT', 2, 'Tenge'),
+('LAK', 2, 'Lao Kip'),
+('LBP', 2, 'Lebanese Pound'),
+('LKR', 2, 'Sri Lanka Rupee'),
+('LRD', 2, 'Liberian Dollar'),
+('LSL', 2, 'Loti'),
+('LYD', 3, 'Libyan Dinar'),
+('MAD', 2, 'Moroccan Dirham'),
+('MDL', 2, 'Moldovan Leu'),
+('MGA', 2, 'Malagasy Ariary'),
+('MKD', 2, 'Denar'),
+('MMK', 2, 'Kyat'),
+('MNT', 2, 'Tugrik'),
+('MOP', 2, 'Pataca'),
+('MRU', 2, 'Ouguiya'),
+('MUR', 2, 'Mauritius Rupee'),
+('MVR', 2, 'Rufiyaa'),
+('MWK', 2, 'Malawi Kwacha'),
+('MXN', 2, 'Mexican Peso'),
+('MXV', 2, 'Mexican Unidad de Inversion (UDI)'),
+('MYR', 2, 'Malaysian Ringgit'),
+('MZN', 2, 'Mozambique Metical'),
+('NAD', 2, 'Namibia Dollar'),
+('NGN', 2, 'Naira'),
+('NIO', 2, 'Cordoba Oro'),
+('NOK', 2, 'Norwegian Krone'),
+('NPR', 2, 'Nepalese Rupee'),
+('NZD', 2, 'New Zealand Dollar'),
+('OMR', 3, 'Rial Omani'),
+('PAB', 2, 'Balboa'),
+('PEN', 2, 'Sol'),
+('PGK', 2, 'Kina'),
+('PHP', 2, 'Philippine Peso'),
+('PKR', 2, 'Pakistan Rupee'),
+('PLN', 2, 'Zloty'),
+('PYG', 0, 'Guarani'),
+('QAR', 2, 'Qatari Rial'),
+('RON', 2, 'Romanian Leu'),
+('RSD', 2, 'Serbian Dinar'),
+('RUB', 2, 'Russian Ruble'),
+('RWF', 0, 'Rwanda Franc'),
+('SAR', 2, 'Saudi Riyal'),
+('SBD', 2, 'Solomon Islands Dollar'),
+('SCR', 2, 'Seychelles Rupee'),
+('SDG', 2, 'Sudanese Pound'),
+('SEK', 2, 'Swedish Krona'),
+('SGD', 2, 'Singapore Dollar'),
+('SHP', 2, 'Saint Helena Pound'),
+('SLE', 2, 'Leone'),
+('SOS', 2, 'Somali Shilling'),
+('SRD', 2, 'Surinam Dollar'),
+('SSP', 2, 'South Sudanese Pound'),
+('STN', 2, 'Dobra'),
+('SVC', 2, 'El Salvador Colon'),
+('SYP', 2, 'Syrian Pound'),
+('SZL', 2, 'Lilangeni'),
+('THB', 2, 'Baht'),
+('TJS', 2, 'Somoni'),
+('TMT', 2, 'Turkmenistan New Manat'),
+('TND', 3, 'Tunisian Dinar'),
+('TOP', 2, 'Pa''anga'),
+('TRY', 2, 'Turkish Lira'),
+('TTD', 2, 'Trinidad and Tobago Dollar'),
+('TWD', 2, 'New Taiwan Dollar'),
+('TZS', 2, 'Tanzanian Shilling'),
+('UAH', 2, 'Hryvnia'),
+('UGX', 0, 'Uganda Shilling'),
+('USD', 2, 'US Dollar'),
+('USN', 2, 'US Dollar (Next day)'),
+('UYI', 0, 'Uruguay Peso en Unidades Indexadas (UI)'),
+('UYU', 2, 'Peso Uruguayo'),
+('UYW', 4, 'Unidad Previsional'),
+('UZS', 2, 'Uzbekistan Sum'),
+('VED', 2, 'Bolivar Soberano'),
+('VES', 2, 'Bolivar Soberano'),
+('VND', 0, 'Dong'),
+('VUV', 0, 'Vatu'),
+('WST', 2, 'Tala'),
+('XAF', 0, 'CFA Franc BEAC'),
+('XCD', 2, 'East Caribbean Dollar'),
+('XCG', 2, 'Caribbean Guilder'),
+('XOF', 0, 'CFA Franc BCEAO'),
+('XPF', 0, 'CFP Franc'),
+('YER', 2, 'Yemeni Rial'),
+('ZAR', 2, 'Rand'),
+('ZMW', 2, 'Zambian Kwacha'),
+('ZWG', 2, 'Zimbabwe Gold');
+
+INSERT INTO pgledger_currencies (code, scale)
+SELECT
+    a.currency,
+    coalesce(max(min_scale(t.amount)), 0)
+FROM pgledger_accounts a
+LEFT JOIN pgledger_transfers t ON a.id = t.from_account_id
+WHERE a.currency NOT IN (SELECT c.code FROM pgledger_currencies c)
+GROUP BY a.currency;
+
+ALTER TABLE pgledger_accounts ADD FOREIGN KEY (currency) REFERENCES pgledger_currencies (code);
+
+CREATE VIEW pgledger_currencies_view AS
+SELECT
+    code,
+    scale,
+    description
+FROM pgledger_currencies;
+
+CREATE FUNCTION pgledger_create_currency(
+    code TEXT,
+    scale INTEGER,
+    description TEXT DEFAULT NULL
+)
+RETURNS SETOF PGLEDGER_CURRENCIES_VIEW
+AS $$
+    INSERT INTO pgledger_currencies (code, scale, description)
+    VALUES (code, scale, description);
+
+    SELECT *
+    FROM pgledger_currencies_view v
+    WHERE v.code = pgledger_create_currency.code;
+$$ LANGUAGE sql;
+
+-- Same as before, but checking that the currency exists, so that the error is
+-- clearer than the foreign key violation
+CREATE OR REPLACE FUNCTION pgledger_create_account(
+    name TEXT,
+    currency TEXT,
+    allow_negative_balance BOOLEAN DEFAULT TRUE,
+    allow_positive_balance BOOLEAN DEFAULT TRUE,
+    metadata JSONB DEFAULT NULL,
+    min_balance NUMERIC DEFAULT NULL,
+    max_balance NUMERIC DEFAULT NULL,
+    path LTREE DEFAULT NULL,
+    external_ref TEXT DEFAULT NULL
+)
+RETURNS SETOF PGLEDGER_ACCOUNTS_VIEW
+AS $$
+DECLARE
+    new_account_id TEXT;
+BEGIN
+    IF NOT EXISTS (
+        SELECT 1
+        FROM pgledger_currencies c
+        WHERE c.code = pgledger_create_account.currency
+    ) THEN
+        RAISE EXCEPTION 'Currency (%) does not exist', currency
+        USING
+            ERRCODE = 'PGL19',
+            DETAIL = json_build_object('currency', currency)::TEXT;
+    END IF;
+
+    INSERT INTO pgledger_accounts (
+        name,
+        currency,
+        allow_negative_balance,
+        allow_positive_balance,
+        metadata,
+        min_balance,
+        max_balance,
+        path,
+        external_ref,
+        created_at,
+        updated_at
+    )
+    VALUES (
+        name,
+        currency,
+        allow_negative_balance,
+        allow_positive_balance,
+        metadata,
+        min_balance,
+        max_balance,
+        path,
+        external_ref,
+        now(),
+        now()
+    )
+    RETURNING pgledger_accounts.id INTO new_account_id;
+
+    RETURN QUERY
+    SELECT *
+    FROM pgledger_accounts_view v
+    WHERE v.id = new_account_id;
+END;
+$$ LANGUAGE plpgsql;
+
+
+-- Same as before, but checking the scale of the amount
+CREATE OR REPLACE FUNCTION pgledger_apply_transfer(
+    from_account_id TEXT,
+    to_account_id TEXT,
+    amount NUMERIC,
+    transfer_status TEXT,
+    pending_transfer_id TEXT,
+    event_at TIMESTAMPTZ,
+    metadata JSONB,
+    idempotency_key TEXT,
+    journal_id TEXT
+)
+RETURNS TEXT
+AS $$
+DECLARE
+    from_account pgledger_accounts;
+    to_account pgledger_accounts;
+    balance_change NUMERIC := 0;
+    pending_change NUMERIC := 0;
+    new_transfer_id TEXT;
+    currency_scale INTEGER;
+BEGIN
+    -- Preliminary checks
+    IF amount <= 0 THEN
+        RAISE EXCEPTION 'Amount (%) must be positive', amount
+        USING
+            ERRCODE = 'PGL04',
+            DETAIL = json_build_object('amount', amount::TEXT)::TEXT;
+    END IF;
+
+    IF from_account_id = to_account_id THEN
+        RAISE EXCEPTION 'Cannot transfer to the same account (id=%)', from_account_id
+        USING
+            ERRCODE = 'PGL05',
+            DETAIL = json_build_object('account_id', from_account_id)::TEXT;
+    END IF;
+
+    IF transfer_status = 'posted' THEN
+        balance_change := amount;
+    ELSIF transfer_status = 'pending' THEN
+        pending_change := amount;
+    ELSE
+        pending_change := -amount;
+    END IF;
+
+    -- Update account balances
+    UPDATE pgledger_accounts a
+    SET balance = a.balance - balance_change,
+        pending_debits = a.pending_debits + pending_change,
+        version = a.version + 1,
+        updated_at = now()
+    WHERE a.id = from_account_id
+    RETURNING * INTO from_account;
+
+    -- Check status and balance constraints for the source account. Releasing a
+    -- pending amount is always allowed, so that pending transfers can still be
+    -- voided after an account is frozen.
+    IF transfer_status != 'released' THEN
+        PERFORM pgledger_check_account_status(from_account, debit => TRUE);
+    END IF;
+    PERFORM pgledger_check_account_balance_constraints(from_account);
+
+    UPDATE pgledger_accounts a
+    SET balance = a.balance + balance_change,
+        pending_credits = a.pending_credits + pending_change,
+        version = a.version + 1,
+        updated_at = now()
+    WHERE a.id = to_account_id
+    RETURNING * INTO to_account;
+
+    -- Check status and balance constraints for the destination account
+    IF transfer_status != 'released' THEN
+        PERFORM pgledger_check_account_status(to_account, debit => FALSE);
+    END IF;
+    PERFORM pgledger_check_account_balance_constraints(to_account);
+
+    -- Check that currencies match
+    IF from_account.currency != to_account.currency THEN
+        RAISE EXCEPTION 'Cannot transfer between different currencies (% and %)', from_account.currency, to_account.currency
+        USING
+            ERRCODE = 'PGL03',
+            DETAIL = json_build_object(
+                'from_account_id', from_account.id,
+                'to_account_id', to_account.id,
+                'from_currency', from_account.currency,
+                'to_currency', to_account.currency
+            )::TEXT;
+    END IF;
+
+    -- Check that the amount fits in the minor units of the currency
+    SELECT c.scale INTO currency_scale
+    FROM pgledger_currencies c
+    WHERE c.code = from_account.currency;
+
+    IF min_scale(amount) > currency_scale THEN
+        RAISE EXCEPTION 'Amount (%) has more decimal places than currency % allows (%)',
+        amount, from_account.currency, currency_scale
+        USING
+            ERRCODE = 'PGL20',
+            DETAIL = json_build_object(
+                'amount', amount::TEXT,
+                'currency', from_account.currency,
+                'scale', currency_scale
+            )::TEXT;
+    END IF;
+
+    -- Create transfer record
+    INSERT INTO pgledger_transfers (
+        from_account_id,
+        to_account_id,
+        amount,
+        created_at,
+        event_at,
+        metadata,
+        idempotency_key,
+        status,
+        pending_transfer_id,
+        journal_id
+    )
+    VALUES (
+        from_account_id,
+        to_account_id,
+        amount,
+        now(),
+        event_at,
+        metadata,
+        idempotency_key,
+        transfer_status,
+        pending_transfer_id,
+        journal_id
+    )
+    RETURNING pgledger_transfers.id INTO new_transfer_id;
+
+    -- Create entry for the source account (negative amount, or positive when
+    -- releasing a pending amount)
+    INSERT INTO pgledger_entries (
+        account_id, transfer_id, amount, account_previous_balance, account_current_balance, account_version, created_at, pending
+    )
+    VALUES (
+        from_account_id,
+        new_transfer_id,
+        -(balance_change + pending_change),
+        from_account.balance + balance_change,
+        from_account.balance,
+        from_account.version,
+        now(),
+        transfer_status != 'posted'
+    );
+
+    -- Create entry for the destination account (positive amount, or negative
+    -- when releasing a pending amount)
+    INSERT INTO pgledger_entries (
+        account_id, transfer_id, amount, account_previous_balance, account_current_balance, account_version, created_at, pending
+    )
+    VALUES (
+        to_account_id,
+        new_transfer_id,
+        balance_change + pending_change,
+        to_account.balance - balance_change,
+        to_account.balance,
+        to_account.version,
+        now(),
+        transfer_status != 'posted'
+    );
+
+    RETURN new_transfer_id;
+END;
+$$ LANGUAGE plpgsql;
+
+
+INSERT INTO pgledger_schema_migrations (version) VALUES (12);
+
+-- migrations/pgledger_13.sql
+
+-- Currency exchanges. pgledger_exchange creates the 2 transfers (4 entries) of
+-- an exchange in one call:
+--
+--   from_account -> from_liquidity_account: from_amount in the from currency
+--   to_liquidity_account -> to_account: to_amount in the to currency
+--
+-- Both transfers go through pgledger_create_transfers, so they share a journal,
+-- and the exchange records both amounts and the effective rate
+-- (to_amount / from_amount), which would otherwise be lost.
+--
+-- New error codes:
+--
+--   PGL21: cannot exchange between the same currency
+CREATE TABLE pgledger_exchanges (
+    id TEXT PRIMARY KEY DEFAULT pgledger_generate_id('pglx'),
+    journal_id TEXT NOT NULL UNIQUE REFERENCES pgledger_journals (id),
+    from_transfer_id TEXT NOT NULL REFERENCES pgledger_transfers (id),
+    to_transfer_id TEXT NOT NULL REFERENCES pgledger_transfers (id),
+    from_currency TEXT NOT NULL REFERENCES pgledger_currencies (code),
+    to_currency TEXT NOT NULL REFERENCES pgledger_currencies (code),
+    from_amount NUMERIC NOT NULL,
+    to_amount NUMERIC NOT NULL,
+    rate NUMERIC NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE VIEW pgledger_exchanges_view AS
+SELECT
+    id,
+    journal_id,
+    from_transfer_id,
+    to_transfer_id,
+    from_currency,
+    to_currency,
+    from_amount,
+    to_amount,
+    rate,
+    created_at
+FROM pgledger_exchanges;
+
+-- The accounts can be given by ID or external ref, and the optional parameters
+-- are passed through to pgledger_create_transfers. Retrying with the same
+-- idempotency key returns the original exchange.
+CREATE FUNCTION pgledger_exchange(
+    from_account_id TEXT,
+    to_account_id TEXT,
+    from_amount NUMERIC,
+    to_amount NUMERIC,
+    from_liquidity_account_id TEXT,
+    to_liquidity_account_id TEXT,
+    event_at TIMESTAMPTZ DEFAULT NULL,
+    metadata JSONB DEFAULT NULL,
+    idempotency_key TEXT DEFAULT NULL,
+    pending BOOLEAN DEFAULT FALSE
+)
+RETURNS SETOF PGLEDGER_EXCHANGES_VIEW
+AS $$
+DECLARE
+    leg pgledger_transfers_view;
+    from_transfer pgledger_transfers_view;
+    to_transfer pgledger_transfers_view;
+    resolved_from_account_id TEXT := pgledger_resolve_account_id(from_account_id);
+    resolved_from_liquidity_account_id TEXT := pgledger_resolve_account_id(from_liquidity_account_id);
+BEGIN
+    -- The transfers are returned in ID order, which isn't always the order of
+    -- the requests (IDs are not monotonic before PostgreSQL 18), so the legs
+    -- are told apart by their accounts
+    FOR leg IN
+        SELECT *
+        FROM pgledger_create_transfers(
+            transfer_requests => array[
+                (from_account_id, from_liquidity_account_id, from_amount, NULL, NULL)::TRANSFER_REQUEST_V2,
+                (to_liquidity_account_id, to_account_id, to_amount, NULL, NULL)::TRANSFER_REQUEST_V2
+            ],
+            event_at => event_at,
+            metadata => metadata,
+            idempotency_key => idempotency_key,
+            pending => pending
+        )
+    LOOP
+        IF from_transfer.id IS NULL
+            AND leg.from_account_id = resolved_from_account_id
+            AND leg.to_account_id = resolved_from_liquidity_account_id THEN
+            from_transfer := leg;
+        ELSE
+            to_transfer := leg;
+        END IF;
+    END LOOP;
+
+    IF from_transfer.currency = to_transfer.currency THEN
+        RAISE EXCEPTION 'Cannot exchange between the same currency (%)', from_transfer.currency
+        USING
+            ERRCODE = 'PGL21',
+            DETAIL = json_build_object(
+                'from_account_id', from_transfer.from_account_id,
+                'to_account_id', to_transfer.to_account_id,
+                'currency', from_transfer.currency
+            )::TEXT;
+    END IF;
+
+    INSERT INTO pgledger_exchanges (
+        journal_id,
+        from_transfer_id,
+        to_transfer_id,
+        from_currency,
+        to_currency,
+        from_amount,
+        to_amount,
+        rate,
+        created_at
+    )
+    VALUES (
+        from_transfer.journal_id,
+        from_transfer.id,
+        to_transfer.id,
+        from_transfer.currency,
+        to_transfer.currency,
+        from_transfer.amount,
+        to_transfer.amount,
+        to_transfer.amount / from_transfer.amount,
+        now()
+    )
+    -- A retry with the same idempotency key returns the same transfers, which
+    -- already have an exchange
+    ON CONFLICT ON CONSTRAINT pgledger_exchanges_journal_id_key DO NOTHING;
+
+    RETURN QUERY
+    SELECT *
+    FROM pgledger_exchanges_view v
+    WHERE v.journal_id = from_transfer.journal_id;
+END;
+$$ LANGUAGE plpgsql;
+
+INSERT INTO pgledger_schema_migrations (version) VALUES (13);
+
+-- migrations/pgledger_14.sql
+
+-- Historical balances. pgledger_account_balance_at returns the balance of an
+-- account at a point in time, either by when the entries were created
+-- (created_at, the default) or by when the transfers happened in the real world
+-- (event_at).
+--
+-- By created_at, the balance is the account_current_balance of the most recent
+-- entry at or before the time. Since transfers can be recorded with an event_at
+-- in the past, the entries aren't in event_at order, so by event_at the balance
+-- is the sum of the posted transfers at or before the time instead.
+--
+-- Pending transfers don't change the balance, so they are ignored either way.
+CREATE INDEX ON pgledger_entries (account_id, created_at);
+CREATE INDEX ON pgledger_transfers (from_account_id, event_at) WHERE status = 'posted';
+CREATE INDEX ON pgledger_transfers (to_account_id, event_at) WHERE status = 'posted';
+
+CREATE FUNCTION pgledger_account_balance_at(
+    account_id TEXT,
+    at TIMESTAMPTZ,
+    by TEXT DEFAULT 'created_at'
+)
+RETURNS NUMERIC
+AS $$
+DECLARE
+    balance_at NUMERIC;
+BEGIN
+    PERFORM 1
+    FROM pgledger_accounts a
+    WHERE a.id = pgledger_account_balance_at.account_id;
+
+    IF NOT FOUND THEN
+        RAISE EXCEPTION 'Account (id=%) does not exist', account_id
+        USING
+            ERRCODE = 'PGL06',
+            DETAIL = json_build_object('account_id', account_id)::TEXT;
+    END IF;
+
+    IF pgledger_account_balance_at.by = 'created_at' THEN
+        SELECT e.account_current_balance INTO balance_at
+        FROM pgledger_entries e
+        WHERE e.account_id = pgledger_account_balance_at.account_id
+            AND e.created_at <= pgledger_account_balance_at.at
+        ORDER BY e.created_at DESC, e.account_version DESC
+        LIMIT 1;
+    ELSIF pgledger_account_balance_at.by = 'event_at' THEN
+        SELECT
+            (
+                SELECT coalesce(sum(t.amount), 0)
+                FROM pgledger_transfers t
+                WHERE t.to_account_id = pgledger_account_balance_at.account_id
+                    AND t.status = 'posted'
+                    AND t.event_at <= pgledger_account_balance_at.at
+            ) - (
+                SELECT coalesce(sum(t.amount), 0)
+                FROM pgledger_transfers t
+                WHERE t.from_account_id = pgledger_account_balance_at.account_id
+                    AND t.status = 'posted'
+                    AND t.event_at <= pgledger_account_balance_at.at
+            )
+        INTO balance_at;
+    ELSE
+        RAISE EXCEPTION 'Invalid by (%), must be created_at or event_at', pgledger_account_balance_at.by
+        USING ERRCODE = 'invalid_parameter_value';
+    END IF;
+
+    RETURN coalesce(balance_at, 0);
+END;
+$$ LANGUAGE plpgsql STABLE;
+
+-- The balances of several accounts at the same point in time, such as for a
+-- balance sheet
+CREATE FUNCTION pgledger_account_balances_at(
+    account_ids TEXT [],
+    at TIMESTAMPTZ,
+    by TEXT DEFAULT 'created_at'
+)
+RETURNS TABLE (account_id TEXT, balance NUMERIC)
+AS $$
+    SELECT
+        ids.account_id,
+        pgledger_account_balance_at(ids.account_id, pgledger_account_balances_at.at, pgledger_account_balances_at.by)
+    FROM unnest(pgledger_account_balances_at.account_ids) WITH ORDINALITY AS ids (account_id, n)
+    ORDER BY ids.n;
+$$ LANGUAGE sql STABLE;
+
+INSERT INTO pgledger_schema_migrations (version) VALUES (14);
+
+-- migrations/pgledger_15.sql
+
+-- Running balances in event_at order. The balances on pgledger_entries are in
+-- the order the entries were created, so a transfer with an event_at in the
+-- past (such as a late webhook) makes them differ from the real world history,
+-- like a bank statement. This view recomputes them ordered by event_at, with
+-- the entry ID as a tiebreaker.
+--
+-- The view has the same columns as pgledger_entries_view, but only posted
+-- entries, since pending and released entries don't change the balance. The
+-- account_version is still the one from when the entry was created.
+--
+-- The balances are computed from the start of each account's history, so
+-- filter the view by account_id (which is pushed down into the window) and
+-- then by event_at, or use pgledger_account_entries_by_event_at.
+CREATE VIEW pgledger_entries_by_event_at_view AS
+SELECT
+    e.id,
+    e.account_id,
+    e.transfer_id,
+    e.amount,
+    sum(e.amount) OVER w - e.amount AS account_previous_balance,
+    sum(e.amount) OVER w AS account_current_balance,
+    e.account_version,
+    e.created_at,
+    t.event_at,
+    t.metadata,
+    e.pending
+FROM pgledger_entries e
+INNER JOIN pgledger_transfers t ON e.transfer_id = t.id
+WHERE NOT e.pending
+WINDOW w AS (PARTITION BY e.account_id ORDER BY t.event_at, e.id ROWS UNBOUNDED PRECEDING);
+
+-- The entries of an account with an event_at in [start_at, end_at), with
+-- running balances in event_at order. Either end of the period can be left out.
+CREATE FUNCTION pgledger_account_entries_by_event_at(
+    account_id TEXT,
+    start_at TIMESTAMPTZ DEFAULT NULL,
+    end_at TIMESTAMPTZ DEFAULT NULL
+)
+RETURNS SETOF PGLEDGER_ENTRIES_BY_EVENT_AT_VIEW
+AS $$
+    SELECT *
+    FROM pgledger_entries_by_event_at_view v
+    WHERE v.account_id = pgledger_account_entries_by_event_at.account_id
+        AND (pgledger_account_entries_by_event_at.start_at IS NULL OR v.event_at >= pgledger_account_entries_by_event_at.start_at)
+        AND (pgledger_account_entries_by_event_at.end_at IS NULL OR v.event_at < pgledger_account_entries_by_event_at.end_at)
+    ORDER BY v.event_at, v.id;
+$$ LANGUAGE sql STABLE;
+
+INSERT INTO pgledger_schema_migrations (version) VALUES (15);
+
+-- migrations/pgledger_16.sql
+
+-- Integrity checks. pgledger_verify returns a row for every discrepancy it
+-- finds, so an empty result means the ledger is consistent:
+--
+--   balance_drift: the balance (or pending_debits/pending_credits) of an
+--     account doesn't match the sum of its entries
+--   version_gap: the account_version of an account's entries doesn't count up
+--     from 1 without gaps, or the version of the account doesn't match its last
+--     entry
+--   balance_chain: the account_previous_balance of an entry doesn't match the
+--     account_current_balance of the entry before it, or the entry's amount
+--     doesn't explain the change
+--   transfer_entries: a transfer doesn't have exactly 2 entries (one for each
+--     account) which add up to 0
+--   currency_total: the balances (or the pending amounts) in a currency don't
+--     add up to 0
+--
+-- It reads the whole ledger, so it can take a while on a big one.
+CREATE FUNCTION pgledger_verify()
+RETURNS TABLE (problem TEXT, object_id TEXT, detail JSONB)
+AS $$
+    WITH entry_totals AS (
+        SELECT
+            e.account_id,
+            sum(e.amount) FILTER (WHERE NOT e.pending) AS balance,
+            -sum(e.amount) FILTER (WHERE e.pending AND e.account_id = t.from_account_id) AS pending_debits,
+            sum(e.amount) FILTER (WHERE e.pending AND e.account_id = t.to_account_id) AS pending_credits,
+            max(e.account_version) AS version
+        FROM pgledger_entries e
+        INNER JOIN pgledger_transfers t ON e.transfer_id = t.id
+        GROUP BY e.account_id
+    ),
+
+    account_totals AS (
+        SELECT
+            a.id,
+            a.balance,
+            a.pending_debits,
+            a.pending_credits,
+            a.version,
+            coalesce(et.balance, 0) AS entries_balance,
+            coalesce(et.pending_debits, 0) AS entries_pending_debits,
+            coalesce(et.pending_credits, 0) AS entries_pending_credits,
+            coalesce(et.version, 0) AS entries_version
+        FROM pgledger_accounts a
+        LEFT JOIN entry_totals et ON a.id = et.account_id
+    ),
+
+    ordered_entries AS (
+        SELECT
+            e.id,
+            e.account_id,
+            e.amount,
+            e.pending,
+            e.account_version,
+            e.account_previous_balance,
+            e.account_current_balance,
+            coalesce(lag(e.account_version) OVER w, 0) AS expected_previous_version,
+            coalesce(lag(e.account_current_balance) OVER w, 0) AS expected_previous_balance
+        FROM pgledger_entries e
+        WINDOW w AS (PARTITION BY e.account_id ORDER BY e.account_version, e.id)
+    ),
+
+    transfer_entries AS (
+        SELECT
+            t.id,
+            count(e.id) AS entry_count,
+            coalesce(sum(e.amount), 0) AS total,
+            coalesce(bool_or(e.account_id = t.from_account_id), FALSE) AS has_from_entry,
+            coalesce(bool_or(e.account_id = t.to_account_id), FALSE) AS has_to_entry
+        FROM pgledger_transfers t
+        LEFT JOIN pgledger_entries e ON t.id = e.transfer_id
+        GROUP BY t.id
+    )
+
+    SELECT
+        'balance_drift',
+        acc.id,
+        jsonb_build_object(
+            'balance', acc.balance::TEXT,
+            'entries_balance', acc.entries_balance::TEXT,
+            'pending_debits', acc.pending_debits::TEXT,
+            'entries_pending_debits', acc.entries_pending_debits::TEXT,
+            'pending_credits', acc.pending_credits::TEXT,
+            'entries_pending_credits', acc.entries_pending_credits::TEXT
+        )
+    FROM account_totals acc
+    WHERE
+        acc.balance != acc.entries_balance
+        OR acc.pending_debits != acc.entries_pending_debits
+        OR acc.pending_credits != acc.entries_pending_credits
+
+    UNION ALL
+
+    SELECT
+        'version_gap',
+        acc.id,
+        jsonb_build_object('version', acc.version, 'entries_version', acc.entries_version)
+    FROM account_totals acc
+    WHERE acc.version != acc.entries_version
+
+    UNION ALL
+
+    SELECT
+        'version_gap',
+        oe.id,
+        jsonb_build_object(
+            'account_id', oe.account_id,
+            'account_version', oe.account_version,
+            'previous_version', oe.expected_previous_version
+        )
+    FROM ordered_entries oe
+    WHERE oe.account_version != oe.expected_previous_version + 1
+
+    UNION ALL
+
+    SELECT
+        'balance_chain',
+        oe.id,
+        jsonb_build_object(
+            'account_id', oe.account_id,
+            'account_version', oe.account_version,
+            'amount', oe.amount::TEXT,
+            'account_previous_balance', oe.account_previous_balance::TEXT,
+            'account_current_balance', oe.account_current_balance::TEXT,
+            'expected_previous_balance', oe.expected_previous_balance::TEXT
+        )
+    FROM ordered_entries oe
+    WHERE
+        oe.account_previous_balance != oe.expected_previous_balance
+        -- Pending entries change the pending amounts instead of the balance
+        OR oe.account_current_balance
+        != oe.account_previous_balance + CASE WHEN oe.pending THEN 0 ELSE oe.amount END
+
+    UNION ALL
+
+    SELECT
+        'transfer_entries',
+        te.id,
+        jsonb_build_object(
+            'entry_count', te.entry_count,
+            'total', te.total::TEXT,
+            'has_from_entry', te.has_from_entry,
+            'has_to_entry', te.has_to_entry
+        )
+    FROM transfer_entries te
+    WHERE te.entry_count != 2 OR te.total != 0 OR NOT te.has_from_entry OR NOT te.has_to_entry
+
+    UNION ALL
+
+    SELECT
+        'currency_total',
+        a.currency,
+        jsonb_build_object(
+            'balance', sum(a.balance)::TEXT,
+            'pending_debits', sum(a.pending_debits)::TEXT,
+            'pending_credits', sum(a.pending_credits)::TEXT
+        )
+    FROM pgledger_accounts a
+    GROUP BY a.currency
+    HAVING sum(a.balance) != 0 OR sum(a.pending_debits) != sum(a.pending_credits);
+$$ LANGUAGE sql STABLE;
+
+INSERT INTO pgledger_schema_migrations (version) VALUES (16);
+
+-- migrations/pgledger_17.sql
+
+-- A tamper-evident hash chain over the entries of each account. Every entry
+-- stores a SHA-256 hash of its own columns and the hash of the account's entry
+-- before it (by account_version), so editing or deleting an entry changes the
+-- hash that every later entry of the account was computed from.
+--
+-- The hash is computed over these values, joined with |, and prefixed with the
+-- bytes of the previous hash (nothing for an account's first entry):
+--
+--   id|account_id|transfer_id|amount|account_previous_balance|account_current_balance|account_version|created_at|pending
+--
+-- The amounts are formatted as NUMERIC text (keeping their scale), created_at
+-- as UTC with microseconds (2025-06-01T12:00:00.000000Z), and pending as true
+-- or false. This is enough to recompute the chain from an export of the
+-- entries, without access to the database.
+--
+-- To show that the history wasn't rewritten after the fact, record the latest
+-- hash of an account somewhere outside the ledger, such as in an audit report.
+
+-- The chain is keyed by account_version, so make sure it's unique
+CREATE UNIQUE INDEX ON pgledger_entries (account_id, account_version);
+
+ALTER TABLE pgledger_entries
+ADD COLUMN hash BYTEA;
+
+CREATE FUNCTION pgledger_entry_hash(entry PGLEDGER_ENTRIES, previous_hash BYTEA)
+RETURNS BYTEA
+AS $$
+    SELECT sha256(
+        coalesce(previous_hash, ''::BYTEA)
+        || convert_to(
+            concat_ws(
+                '|',
+                entry.id,
+                entry.account_id,
+                entry.transfer_id,
+                entry.amount::TEXT,
+                entry.account_previous_balance::TEXT,
+                entry.account_current_balance::TEXT,
+                entry.account_version::TEXT,
+                to_char(entry.created_at AT TIME ZONE 'UTC', 'YYYY-MM-DD"T"HH24:MI:SS.US"Z"'),
+                entry.pending::TEXT
+            ),
+            'UTF8'
+        )
+    );
+$$ LANGUAGE sql STABLE;
+
+-- Hash the existing entries, in order for each account
+DO $$
+DECLARE
+    entry pgledger_entries;
+    previous_account_id TEXT;
+    previous_hash BYTEA;
+BEGIN
+    FOR entry IN
+        SELECT *
+        FROM pgledger_entries e
+        ORDER BY e.account_id, e.account_version
+    LOOP
+        IF previous_account_id IS DISTINCT FROM entry.account_id THEN
+            previous_hash := NULL;
+        END IF;
+
+        previous_hash := pgledger_entry_hash(entry, previous_hash);
+        previous_account_id := entry.account_id;
+
+        UPDATE pgledger_entries e
+        SET hash = previous_hash
+        WHERE e.id = entry.id;
+    END LOOP;
+END;
+$$;
+
+ALTER TABLE pgledger_entries
+ALTER COLUMN hash SET NOT NULL;
+
+-- Set the hash of new entries. The ledger functions lock the account before
+-- adding entries to it, so the previous entry can't change underneath this.
+CREATE FUNCTION pgledger_set_entry_hash()
+RETURNS TRIGGER
+AS $$
+DECLARE
+    previous_hash BYTEA;
+BEGIN
+    SELECT e.hash INTO previous_hash
+    FROM pgledger_entries e
+    WHERE e.account_id = NEW.account_id
+        AND e.account_version < NEW.account_version
+    ORDER BY e.account_version DESC
+    LIMIT 1;
+
+    NEW.hash := pgledger_entry_hash(NEW, previous_hash);
+
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER pgledger_set_entry_hash
+BEFORE INSERT ON pgledger_entries
+FOR EACH ROW
+EXECUTE FUNCTION pgledger_set_entry_hash();
+
+CREATE OR REPLACE VIEW pgledger_entries_view AS
+SELECT
+    e.id,
+    e.account_id,
+    e.transfer_id,
+    e.amount,
+    e.account_previous_balance,
+    e.account_current_balance,
+    e.account_version,
+    e.created_at,
+    t.event_at,
+    t.metadata,
+    e.pending,
+    encode(e.hash, 'hex') AS hash
+FROM pgledger_entries e
+INNER JOIN pgledger_transfers t ON e.transfer_id = t.id;
+
+CREATE OR REPLACE VIEW pgledger_entries_by_event_at_view AS
+SELECT
+    e.id,
+    e.account_id,
+    e.transfer_id,
+    e.amount,
+    sum(e.amount) OVER w - e.amount AS account_previous_balance,
+    sum(e.amount) OVER w AS account_current_balance,
+    e.account_version,
+    e.created_at,
+    t.event_at,
+    t.metadata,
+    e.pending,
+    encode(e.hash, 'hex') AS hash
+FROM pgledger_entries e
+INNER JOIN pgledger_transfers t ON e.transfer_id = t.id
+WHERE NOT e.pending
+WINDOW w AS (PARTITION BY e.account_id ORDER BY t.event_at, e.id ROWS UNBOUNDED PRECEDING);
+
+-- Recompute the hash chain of an account and return the entries whose stored
+-- hash doesn't match. Each entry is checked against the stored hash of the
+-- entry before it, so an edited entry shows up itself, and a deleted entry (or
+-- an entry whose hash was overwritten) shows up as the entry after it. An
+-- empty result means the chain is intact.
+CREATE FUNCTION pgledger_verify_hash_chain(account_id TEXT)
+RETURNS TABLE (entry_id TEXT, account_version BIGINT, hash TEXT, expected_hash TEXT)
+AS $$
+    SELECT
+        chain.id,
+        chain.account_version,
+        encode(chain.hash, 'hex'),
+        encode(chain.expected_hash, 'hex')
+    FROM (
+        SELECT
+            e.id,
+            e.account_version,
+            e.hash,
+            pgledger_entry_hash(e, lag(e.hash) OVER (ORDER BY e.account_version)) AS expected_hash
+        FROM pgledger_entries e
+        WHERE e.account_id = pgledger_verify_hash_chain.account_id
+    ) chain
+    WHERE chain.hash IS DISTINCT FROM chain.expected_hash
+    ORDER BY chain.account_version;
+$$ LANGUAGE sql STABLE;
+
+INSERT INTO pgledger_schema_migrations (version) VALUES (17);
+
+-- migrations/pgledger_18.sql
+
+-- Ledger history is append-only. Triggers reject any UPDATE, DELETE or
+-- TRUNCATE of transfers, entries, journals and exchanges, and any UPDATE of the
+-- balance, pending amounts, version or currency of an account, unless it comes
+-- with the entry that explains it. Other account columns, such as the name and
+-- metadata, can still be updated directly.
+--
+-- When history really has to be changed, such as to repair data after an
+-- incident, call pgledger_allow_direct_writes with a reason in the same
+-- transaction:
+--
+--   BEGIN;
+--   SELECT pgledger_allow_direct_writes('Fix created_at of imported entries, see INC-123');
+--   UPDATE pgledger_entries SET created_at = ... WHERE id = ...;
+--   COMMIT;
+--
+-- Every direct write is then recorded in pgledger_direct_writes, with the row
+-- before and after, the reason and the database user. The log is protected the
+-- same way.
+--
+-- New error code:
+--   PGL22: Ledger history can't be modified outside the pgledger functions
+CREATE TABLE pgledger_direct_writes (
+    id TEXT PRIMARY KEY DEFAULT pgledger_generate_id('pglw'),
+    table_name TEXT NOT NULL,
+    operation TEXT NOT NULL,
+    row_id TEXT,
+    old_row JSONB,
+    new_row JSONB,
+    reason TEXT NOT NULL,
+    username TEXT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL
+);
+
+-- Allow direct writes to ledger history until the end of the current
+-- transaction
+CREATE FUNCTION pgledger_allow_direct_writes(reason TEXT)
+RETURNS VOID
+AS $$
+BEGIN
+    IF coalesce(trim(reason), '') = '' THEN
+        RAISE EXCEPTION 'A reason is required to allow direct writes'
+        USING ERRCODE = 'invalid_parameter_value';
+    END IF;
+
+    PERFORM set_config('pgledger.direct_write_reason', reason, TRUE);
+END;
+$$ LANGUAGE plpgsql;
+
+-- Check that an account update is explained by an entry: the version goes up
+-- by one, and the entry for the new version moves the balance or pending
+-- amounts from the old values to the new ones. pgledger_apply_transfer inserts
+-- the entries before it updates the accounts.
+CREATE FUNCTION pgledger_account_update_has_entry(old_account PGLEDGER_ACCOUNTS, new_account PGLEDGER_ACCOUNTS)
+RETURNS BOOLEAN
+AS $$
+    SELECT new_account.currency = old_account.currency
+        AND new_account.version = old_account.version + 1
+        AND EXISTS (
+            SELECT 1
+            FROM pgledger_entries e
+            JOIN pgledger_transfers t ON e.transfer_id = t.id
+            WHERE e.account_id = new_account.id
+                AND e.account_version = new_account.version
+                AND e.account_current_balance = new_account.balance
+                AND new_account.balance = old_account.balance + CASE WHEN e.pending THEN 0 ELSE e.amount END
+                AND new_account.pending_debits = old_account.pending_debits
+                - CASE WHEN e.pending AND t.from_account_id = e.account_id THEN e.amount ELSE 0 END
+                AND new_account.pending_credits = old_account.pending_credits
+                + CASE WHEN e.pending AND t.to_account_id = e.account_id THEN e.amount ELSE 0 END
+        );
+$$ LANGUAGE sql STABLE;
+
+-- Anything which reaches this trigger needs pgledger_allow_direct_writes, and
+-- is logged. The only exception is an account update which is explained by an
+-- entry.
+CREATE FUNCTION pgledger_check_ledger_write()
+RETURNS TRIGGER
+AS $$
+DECLARE
+    reason TEXT := nullif(current_setting('pgledger.direct_write_reason', TRUE), '');
+    target TEXT := TG_TABLE_NAME;
+    changed_row_id TEXT;
+    old_values JSONB;
+    new_values JSONB;
+BEGIN
+    -- Balances are checked against the entries rather than against who is
+    -- making the change, since any session can change a setting or create a
+    -- function with the same name as a pgledger function
+    IF TG_TABLE_NAME = 'pgledger_accounts' AND pgledger_account_update_has_entry(OLD, NEW) THEN
+        RETURN NEW;
+    END IF;
+
+    -- OLD and NEW are null for TRUNCATE, which applies to the whole table
+    IF TG_OP = 'UPDATE' THEN
+        changed_row_id := OLD.id;
+        old_values := to_jsonb(OLD);
+        new_values := to_jsonb(NEW);
+    ELSIF TG_OP = 'DELETE' THEN
+        changed_row_id := OLD.id;
+        old_values := to_jsonb(OLD);
+    END IF;
+
+    IF changed_row_id IS NOT NULL THEN
+        target := format('%s (id=%s)', TG_TABLE_NAME, changed_row_id);
+    END IF;
+
+    IF reason IS NULL THEN
+        RAISE EXCEPTION 'Cannot % % outside the pgledger functions', TG_OP, target
+        USING
+            ERRCODE = 'PGL22',
+            HINT = 'Use pgledger_allow_direct_writes to make an exception',
+            DETAIL = json_build_object('table', TG_TABLE_NAME, 'operation', TG_OP)::TEXT;
+    END IF;
+
+    INSERT INTO pgledger_direct_writes (table_name, operation, row_id, old_row, new_row, reason, username, created_at)
+    VALUES (TG_TABLE_NAME, TG_OP, changed_row_id, old_values, new_values, reason, session_user, now());
+
+    IF TG_OP = 'DELETE' THEN
+        RETURN OLD;
+    END IF;
+
+    -- The return value is ignored for TRUNCATE, which has no rows
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER pgledger_check_ledger_write
+BEFORE UPDATE OR DELETE ON pgledger_entries
+FOR EACH ROW
+EXECUTE FUNCTION pgledger_check_ledger_write();
+
+CREATE TRIGGER pgledger_check_ledger_truncate
+BEFORE TRUNCATE ON pgledger_entries
+FOR EACH STATEMENT
+EXECUTE FUNCTION pgledger_check_ledger_write();
+
+CREATE TRIGGER pgledger_check_ledger_write
+BEFORE UPDATE OR DELETE ON pgledger_transfers
+FOR EACH ROW
+EXECUTE FUNCTION pgledger_check_ledger_write();
+
+CREATE TRIGGER pgledger_check_ledger_truncate
+BEFORE TRUNCATE ON pgledger_transfers
+FOR EACH STATEMENT
+EXECUTE FUNCTION pgledger_check_ledger_write();
+
+CREATE TRIGGER pgledger_check_ledger_write
+BEFORE UPDATE OR DELETE ON pgledger_journals
+FOR EACH ROW
+EXECUTE FUNCTION pgledger_check_ledger_write();
+
+CREATE TRIGGER pgledger_check_ledger_truncate
+BEFORE TRUNCATE ON pgledger_journals
+FOR EACH STATEMENT
+EXECUTE FUNCTION pgledger_check_ledger_write();
+
+CREATE TRIGGER pgledger_check_ledger_write
+BEFORE UPDATE OR DELETE ON pgledger_exchanges
+FOR EACH ROW
+EXECUTE FUNCTION pgledger_check_ledger_write();
+
+CREATE TRIGGER pgledger_check_ledger_truncate
+BEFORE TRUNCATE ON pgledger_exchanges
+FOR EACH STATEMENT
+EXECUTE FUNCTION pgledger_check_ledger_write();
+
+CREATE TRIGGER pgledger_check_ledger_write
+BEFORE UPDATE OR DELETE ON pgledger_direct_writes
+FOR EACH ROW
+EXECUTE FUNCTION pgledger_check_ledger_write();
+
+CREATE TRIGGER pgledger_check_ledger_truncate
+BEFORE TRUNCATE ON pgledger_direct_writes
+FOR EACH STATEMENT
+EXECUTE FUNCTION pgledger_check_ledger_write();
+
+-- Accounts can be updated directly, except for the columns which have to match
+-- the entries. These only change together with a new entry.
+CREATE TRIGGER pgledger_check_ledger_write
+BEFORE UPDATE ON pgledger_accounts
+FOR EACH ROW
+WHEN (
+    OLD.balance IS DISTINCT FROM NEW.balance
+    OR OLD.pending_debits IS DISTINCT FROM NEW.pending_debits
+    OR OLD.pending_credits IS DISTINCT FROM NEW.pending_credits
+    OR OLD.version IS DISTINCT FROM NEW.version
+    OR OLD.currency IS DISTINCT FROM NEW.currency
+)
+EXECUTE FUNCTION pgledger_check_ledger_write();
+
+-- Same as before, but setting reverses_transfer_id when the transfer is
+-- created, since transfers can't be updated afterwards, and inserting the
+-- entries before updating the accounts, so that pgledger_check_ledger_write can
+-- find them
+DROP FUNCTION pgledger_apply_transfer(TEXT, TEXT, NUMERIC, TEXT, TEXT, TIMESTAMPTZ, JSONB, TEXT, TEXT);
+
+CREATE FUNCTION pgledger_apply_transfer(
+    from_account_id TEXT,
+    to_account_id TEXT,
+    amount NUMERIC,
+    transfer_status TEXT,
+    pending_transfer_id TEXT,
+    event_at TIMESTAMPTZ,
+    metadata JSONB,
+    idempotency_key TEXT,
+    journal_id TEXT,
+    reverses_transfer_id TEXT DEFAULT NULL
+)
+RETURNS TEXT
+AS $$
+DECLARE
+    from_account pgledger_accounts;
+    to_account pgledger_accounts;
+    balance_change NUMERIC := 0;
+    pending_change NUMERIC := 0;
+    new_transfer_id TEXT;
+    currency_scale INTEGER;
+BEGIN
+    -- Preliminary checks
+    IF amount <= 0 THEN
+        RAISE EXCEPTION 'Amount (%) must be positive', amount
+        USING
+            ERRCODE = 'PGL04',
+            DETAIL = json_build_object('amount', amount::TEXT)::TEXT;
+    END IF;
+
+    IF from_account_id = to_account_id THEN
+        RAISE EXCEPTION 'Cannot transfer to the same account (id=%)', from_account_id
+        USING
+            ERRCODE = 'PGL05',
+            DETAIL = json_build_object('account_id', from_account_id)::TEXT;
+    END IF;
+
+    IF transfer_status = 'posted' THEN
+        balance_change := amount;
+    ELSIF transfer_status = 'pending' THEN
+        pending_change := amount;
+    ELSE
+        pending_change := -amount;
+    END IF;
+
+    -- Work out the new account balances. The accounts are updated at the end,
+    -- once the entries have been inserted.
+    SELECT * INTO from_account
+    FROM pgledger_accounts a
+    WHERE a.id = from_account_id
+    FOR UPDATE;
+
+    from_account.balance := from_account.balance - balance_change;
+    from_account.pending_debits := from_account.pending_debits + pending_change;
+    from_account.version := from_account.version + 1;
+    from_account.updated_at := now();
+
+    -- Check status and balance constraints for the source account. Releasing a
+    -- pending amount is always allowed, so that pending transfers can still be
+    -- voided after an account is frozen.
+    IF transfer_status != 'released' THEN
+        PERFORM pgledger_check_account_status(from_account, debit => TRUE);
+    END IF;
+    PERFORM pgledger_check_account_balance_constraints(from_account);
+
+    SELECT * INTO to_account
+    FROM pgledger_accounts a
+    WHERE a.id = to_account_id
+    FOR UPDATE;
+
+    to_account.balance := to_account.balance + balance_change;
+    to_account.pending_credits := to_account.pending_credits + pending_change;
+    to_account.version := to_account.version + 1;
+    to_account.updated_at := now();
+
+    -- Check status and balance constraints for the destination account
+    IF transfer_status != 'released' THEN
+        PERFORM pgledger_check_account_status(to_account, debit => FALSE);
+    END IF;
+    PERFORM pgledger_check_account_balance_constraints(to_account);
+
+    -- Check that currencies match
+    IF from_account.currency != to_account.currency THEN
+        RAISE EXCEPTION 'Cannot transfer between different currencies (% and %)', from_account.currency, to_account.currency
+        USING
+            ERRCODE = 'PGL03',
+            DETAIL = json_build_object(
+                'from_account_id', from_account.id,
+                'to_account_id', to_account.id,
+                'from_currency', from_account.currency,
+                'to_currency', to_account.currency
+            )::TEXT;
+    END IF;
+
+    -- Check that the amount fits in the minor units of the currency
+    SELECT c.scale INTO currency_scale
+    FROM pgledger_currencies c
+    WHERE c.code = from_account.currency;
+
+    IF min_scale(amount) > currency_scale THEN
+        RAISE EXCEPTION 'Amount (%) has more decimal places than currency % allows (%)',
+        amount, from_account.currency, currency_scale
+        USING
+            ERRCODE = 'PGL20',
+            DETAIL = json_build_object(
+                'amount', amount::TEXT,
+                'currency', from_account.currency,
+                'scale', currency_scale
+            )::TEXT;
+    END IF;
+
+    -- Create transfer record
+    INSERT INTO pgledger_transfers (
+        from_account_id,
+        to_account_id,
+        amount,
+        created_at,
+        event_at,
+        metadata,
+        idempotency_key,
+        status,
+        pending_transfer_id,
+        journal_id,
+        reverses_transfer_id
+    )
+    VALUES (
+        from_account_id,
+        to_account_id,
+        amount,
+        now(),
+        event_at,
+        metadata,
+        idempotency_key,
+        transfer_status,
+        pending_transfer_id,
+        journal_id,
+        reverses_transfer_id
+    )
+    RETURNING pgledger_transfers.id INTO new_transfer_id;
+
+    -- Create entry for the source account (negative amount, or positive when
+    -- releasing a pending amount)
+    INSERT INTO pgledger_entries (
+        account_id, transfer_id, amount, account_previous_balance, account_current_balance, account_version, created_at, pending
+    )
+    VALUES (
+        from_account_id,
+        new_transfer_id,
+        -(balance_change + pending_change),
+        from_account.balance + balance_change,
+        from_account.balance,
+        from_account.version,
+        now(),
+        transfer_status != 'posted'
+    );
+
+    -- Create entry for the destination account (positive amount, or negative
+    -- when releasing a pending amount)
+    INSERT INTO pgledger_entries (
+        account_id, transfer_id, amount, account_previous_balance, account_current_balance, account_version, created_at, pending
+    )
+    VALUES (
+        to_account_id,
+        new_transfer_id,
+        balance_change + pending_change,
+        to_account.balance - balance_change,
+        to_account.balance,
+        to_account.version,
+        now(),
+        transfer_status != 'posted'
+    );
+
+    -- Update account balances (see pgledger_check_ledger_write)
+    UPDATE pgledger_accounts a
+    SET balance = from_account.balance,
+        pending_debits = from_account.pending_debits,
+        version = from_account.version,
+        updated_at = from_account.updated_at
+    WHERE a.id = from_account_id;
+
+    UPDATE pgledger_accounts a
+    SET balance = to_account.balance,
+        pending_credits = to_account.pending_credits,
+        version = to_account.version,
+        updated_at = to_account.updated_at
+    WHERE a.id = to_account_id;
+
+    RETURN new_transfer_id;
+END;
+$$ LANGUAGE plpgsql;
+
+-- Same as before, but creating the reversal with pgledger_apply_transfer, so
+-- that it is linked to the original transfer when it is inserted
+CREATE OR REPLACE FUNCTION pgledger_reverse_transfer(
+    transfer_id TEXT,
+    metadata JSONB DEFAULT NULL,
+    amount NUMERIC DEFAULT NULL
+)
+RETURNS SETOF PGLEDGER_TRANSFERS_VIEW
+AS $$
+DECLARE
+    original_transfer pgledger_transfers;
+    reversal_id TEXT;
+    new_journal_id TEXT;
+    remaining_amount NUMERIC;
+BEGIN
+    -- Lock the original transfer so that concurrent reversals of it can't add
+    -- up to more than the original amount
+    SELECT * INTO original_transfer
+    FROM pgledger_transfers t
+    WHERE t.id = pgledger_reverse_transfer.transfer_id
+    FOR UPDATE;
+
+    IF NOT FOUND THEN
+        RAISE EXCEPTION 'Transfer (id=%) does not exist', transfer_id
+        USING
+            ERRCODE = 'PGL08',
+            DETAIL = json_build_object('transfer_id', transfer_id)::TEXT;
+    END IF;
+
+    IF original_transfer.status != 'posted' THEN
+        RAISE EXCEPTION 'Transfer (id=%) is not posted', transfer_id
+        USING
+            ERRCODE = 'PGL12',
+            DETAIL = json_build_object('transfer_id', transfer_id)::TEXT;
+    END IF;
+
+    SELECT original_transfer.amount - coalesce(sum(t.amount), 0) INTO remaining_amount
+    FROM pgledger_transfers t
+    WHERE t.reverses_transfer_id = original_transfer.id;
+
+    IF remaining_amount <= 0 THEN
+        RAISE EXCEPTION 'Transfer (id=%) has already been reversed', transfer_id
+        USING
+            ERRCODE = 'PGL09',
+            DETAIL = json_build_object('transfer_id', transfer_id)::TEXT;
+    END IF;
+
+    -- Default to reversing whatever is left of the transfer
+    amount := coalesce(amount, remaining_amount);
+
+    IF amount > remaining_amount THEN
+        RAISE EXCEPTION 'Reversal amount (%) exceeds the remaining amount (%) of transfer (id=%)',
+        amount, remaining_amount, transfer_id
+        USING
+            ERRCODE = 'PGL10',
+            DETAIL = json_build_object(
+                'transfer_id', transfer_id,
+                'amount', amount::TEXT,
+                'remaining_amount', remaining_amount::TEXT
+            )::TEXT;
+    END IF;
+
+    -- Lock the accounts in ID order, like pgledger_create_transfers, to prevent
+    -- deadlocks with transfers between the same accounts
+    PERFORM a.id
+    FROM pgledger_accounts a
+    WHERE a.id IN (original_transfer.from_account_id, original_transfer.to_account_id)
+    ORDER BY a.id
+    FOR UPDATE;
+
+    INSERT INTO pgledger_journals (metadata, created_at)
+    VALUES (metadata, now())
+    RETURNING pgledger_journals.id INTO new_journal_id;
+
+    reversal_id := pgledger_apply_transfer(
+        from_account_id => original_transfer.to_account_id,
+        to_account_id => original_transfer.from_account_id,
+        amount => amount,
+        transfer_status => 'posted',
+        pending_transfer_id => NULL,
+        event_at => now(),
+        metadata => metadata,
+        idempotency_key => NULL,
+        journal_id => new_journal_id,
+        reverses_transfer_id => original_transfer.id
+    );
+
+    RETURN QUERY
+    SELECT *
+    FROM pgledger_transfers_view v
+    WHERE v.id = reversal_id;
+END;
+$$ LANGUAGE plpgsql;
+
+INSERT INTO pgledger_schema_migrations (version) VALUES (18);
+
+-- migrations/pgledger_19.sql
+
+-- A trial balance: the totals of the account balances in each currency at a
+-- point in time. Transfers take the amount out of one account and put it into
+-- another, so the balances in each currency always add up to 0, and a non-zero
+-- net means something is wrong.
+--
+-- Negative balances are counted as debits, and positive balances as credits,
+-- matching the signs of the entries. Like pgledger_account_balance_at, the
+-- balances are as of when the entries were created (created_at, the default)
+-- or when the transfers happened in the real world (event_at), and pending
+-- transfers are ignored.
+CREATE FUNCTION pgledger_trial_balance(
+    as_of TIMESTAMPTZ DEFAULT now(),
+    by TEXT DEFAULT 'created_at'
+)
+RETURNS TABLE (currency TEXT, debits NUMERIC, credits NUMERIC, net NUMERIC)
+AS $$
+BEGIN
+    IF pgledger_trial_balance.by NOT IN ('created_at', 'event_at') THEN
+        RAISE EXCEPTION 'Invalid by (%), must be created_at or event_at', pgledger_trial_balance.by
+        USING ERRCODE = 'invalid_parameter_value';
+    END IF;
+
+    RETURN QUERY
+    WITH created_at_balances AS (
+        -- The most recent entry of each account at or before the time
+        SELECT DISTINCT ON (e.account_id)
+            e.account_id,
+            e.account_current_balance AS balance
+        FROM pgledger_entries e
+        WHERE pgledger_trial_balance.by = 'created_at'
+            AND e.created_at <= pgledger_trial_balance.as_of
+        ORDER BY e.account_id, e.created_at DESC, e.account_version DESC
+    ),
+
+    event_at_balances AS (
+        -- The posted entries of each account with an event_at at or before the
+        -- time
+        SELECT
+            e.account_id,
+            sum(e.amount) AS balance
+        FROM pgledger_entries e
+        INNER JOIN pgledger_transfers t ON e.transfer_id = t.id
+        WHERE pgledger_trial_balance.by = 'event_at'
+            AND NOT e.pending
+            AND t.event_at <= pgledger_trial_balance.as_of
+        GROUP BY e.account_id
+    ),
+
+    balances AS (
+        SELECT * FROM created_at_balances
+        UNION ALL
+        SELECT * FROM event_at_balances
+    )
+
+    SELECT
+        a.currency,
+        coalesce(-sum(b.balance) FILTER (WHERE b.balance < 0), 0),
+        coalesce(sum(b.balance) FILTER (WHERE b.balance > 0), 0),
+        sum(b.balance)
+    FROM balances b
+    INNER JOIN pgledger_accounts a ON b.account_id = a.id
+    GROUP BY a.currency
+    ORDER BY a.currency;
+END;
+$$ LANGUAGE plpgsql STABLE;
+
+INSERT INTO pgledger_schema_migrations (version) VALUES (19);
+
+-- migrations/pgledger_20.sql
+
+-- Account statements, such as for reconciling an account against a bank
+-- statement. pgledger_account_statement returns the opening balance of the
+-- account at start_at, its posted entries with an event_at in [start_at,
+-- end_at), and the closing balance at end_at, as rows with a line_type of
+-- opening_balance, entry and closing_balance. Either end of the period can be
+-- left out.
+--
+-- Like pgledger_account_entries_by_event_at, the statement is in event_at
+-- order, so it matches the real world history even when transfers were
+-- recorded late, and pending transfers are left out. Each entry includes the
+-- other account of the transfer (the counterparty), the running balance after
+-- the entry, and the metadata of the transfer.
+CREATE FUNCTION pgledger_account_statement(
+    account_id TEXT,
+    start_at TIMESTAMPTZ DEFAULT NULL,
+    end_at TIMESTAMPTZ DEFAULT NULL
+)
+RETURNS TABLE (
+    line_type TEXT,
+    event_at TIMESTAMPTZ,
+    entry_id TEXT,
+    transfer_id TEXT,
+    counterparty_account_id TEXT,
+    counterparty_account_name TEXT,
+    amount NUMERIC,
+    balance NUMERIC,
+    metadata JSONB
+)
+AS $$
+DECLARE
+    opening_balance NUMERIC;
+    closing_balance NUMERIC;
+BEGIN
+    PERFORM 1
+    FROM pgledger_accounts a
+    WHERE a.id = pgledger_account_statement.account_id;
+
+    IF NOT FOUND THEN
+        RAISE EXCEPTION 'Account (id=%) does not exist', account_id
+        USING
+            ERRCODE = 'PGL06',
+            DETAIL = json_build_object('account_id', account_id)::TEXT;
+    END IF;
+
+    SELECT
+        coalesce(sum(e.amount) FILTER (WHERE t.event_at < pgledger_account_statement.start_at), 0),
+        coalesce(sum(e.amount) FILTER (
+            WHERE pgledger_account_statement.end_at IS NULL OR t.event_at < pgledger_account_statement.end_at
+        ), 0)
+    INTO opening_balance, closing_balance
+    FROM pgledger_entries e
+    INNER JOIN pgledger_transfers t ON e.transfer_id = t.id
+    WHERE e.account_id = pgledger_account_statement.account_id
+        AND NOT e.pending;
+
+    RETURN QUERY
+    SELECT
+        'opening_balance'::TEXT,
+        pgledger_account_statement.start_at,
+        NULL::TEXT,
+        NULL::TEXT,
+        NULL::TEXT,
+        NULL::TEXT,
+        NULL::NUMERIC,
+        opening_balance,
+        NULL::JSONB;
+
+    RETURN QUERY
+    SELECT
+        'entry'::TEXT,
+        v.event_at,
+        v.id,
+        v.transfer_id,
+        counterparty.id,
+        counterparty.name,
+        v.amount,
+        v.account_current_balance,
+        v.metadata
+    FROM pgledger_account_entries_by_event_at(
+        pgledger_account_statement.account_id,
+        pgledger_account_statement.start_at,
+        pgledger_account_statement.end_at
+    ) v
+    INNER JOIN pgledger_transfers t ON v.transfer_id = t.id
+    INNER JOIN pgledger_accounts counterparty
+        ON counterparty.id = CASE WHEN t.from_account_id = v.account_id THEN t.to_account_id ELSE t.from_account_id END
+    ORDER BY v.event_at, v.id;
+
+    RETURN QUERY
+    SELECT
+        'closing_balance'::TEXT,
+        pgledger_account_statement.end_at,
+        NULL::TEXT,
+        NULL::TEXT,
+        NULL::TEXT,
+        NULL::TEXT,
+        NULL::NUMERIC,
+        closing_balance,
+        NULL::JSONB;
+END;
+$$ LANGUAGE plpgsql STABLE;
+
+INSERT INTO pgledger_schema_migrations (version) VALUES (20);
+
+-- migrations/pgledger_21.sql
+
+-- Reconciliation against external statements, such as the statement of a bank
+-- account. Lines from the statement are imported for the ledger account which
+-- represents the external account, and pgledger_reconcile matches them with the
+-- posted entries of that account:
+--
+--   1. By reference: entries whose transfer metadata has the line's reference
+--      (under the key "reference" by default), with an event_at within the
+--      date tolerance of the line. All such entries are matched to the line,
+--      so several transfers can make up one line, such as a payout of several
+--      payments.
+--   2. By amount and date: for lines which didn't match anything by reference,
+--      the unmatched entry with the same amount and the closest event_at
+--      within the date tolerance.
+--
+-- A line is matched when the amounts of its entries add up to the amount of
+-- the line, partially_matched when they don't (such as a short payment), and
+-- unmatched when no entry was found. Lines which aren't matched are retried the
+-- next time pgledger_reconcile runs, so entries which show up later are picked
+-- up then. An entry can only be matched to one line.
+--
+-- The amounts of the lines have the same sign as the entries of the account, so
+-- money coming into the account is positive.
+--
+-- New error code:
+--   PGL23: Reconciliation line was already imported with different values
+CREATE TABLE pgledger_reconciliation_lines (
+    id TEXT PRIMARY KEY DEFAULT pgledger_generate_id('pglr'),
+    account_id TEXT NOT NULL REFERENCES pgledger_accounts (id),
+    external_id TEXT NOT NULL,
+    amount NUMERIC NOT NULL,
+    occurred_at TIMESTAMPTZ NOT NULL,
+    reference TEXT,
+    metadata JSONB,
+    status TEXT NOT NULL DEFAULT 'unmatched' CHECK (status IN ('unmatched', 'partially_matched', 'matched')),
+    matched_amount NUMERIC NOT NULL DEFAULT 0,
+    created_at TIMESTAMPTZ NOT NULL,
+    updated_at TIMESTAMPTZ NOT NULL,
+    -- The ID of the line in the external system, so that importing the same
+    -- statement twice doesn't create duplicate lines
+    CONSTRAINT pgledger_reconciliation_lines_external_id_key UNIQUE (account_id, external_id)
+);
+
+CREATE INDEX ON pgledger_reconciliation_lines (account_id, occurred_at) WHERE status != 'matched';
+
+CREATE TABLE pgledger_reconciliation_matches (
+    line_id TEXT NOT NULL REFERENCES pgledger_reconciliation_lines (id),
+    entry_id TEXT NOT NULL UNIQUE REFERENCES pgledger_entries (id),
+    created_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX ON pgledger_reconciliation_matches (line_id);
+
+CREATE VIEW pgledger_reconciliation_lines_view AS
+SELECT
+    id,
+    account_id,
+    external_id,
+    amount,
+    occurred_at,
+    reference,
+    metadata,
+    status,
+    matched_amount,
+    created_at,
+    updated_at
+FROM pgledger_reconciliation_lines;
+
+CREATE VIEW pgledger_reconciliation_matches_view AS
+SELECT
+    line_id,
+    entry_id,
+    created_at
+FROM pgledger_reconciliation_matches;
+
+CREATE TYPE RECONCILIATION_LINE_REQUEST AS (
+    external_id TEXT,
+    amount NUMERIC,
+    occurred_at TIMESTAMPTZ,
+    reference TEXT,
+    metadata JSONB
+);
+
+-- Import lines from an external statement for the account. Lines which were
+-- already imported (by external_id) are returned as they are, so the same
+-- statement can be imported again safely, but fail with PGL23 if the amount,
+-- date or reference changed.
+CREATE FUNCTION pgledger_import_reconciliation_lines(
+    account_id TEXT,
+    lines RECONCILIATION_LINE_REQUEST []
+)
+RETURNS SETOF PGLEDGER_RECONCILIATION_LINES_VIEW
+AS $$
+DECLARE
+    line reconciliation_line_request;
+    existing_line pgledger_reconciliation_lines;
+    line_ids TEXT[] := '{}';
+BEGIN
+    PERFORM 1
+    FROM pgledger_accounts a
+    WHERE a.id = pgledger_import_reconciliation_lines.account_id;
+
+    IF NOT FOUND THEN
+        RAISE EXCEPTION 'Account (id=%) does not exist', account_id
+        USING
+            ERRCODE = 'PGL06',
+            DETAIL = json_build_object('account_id', account_id)::TEXT;
+    END IF;
+
+    FOREACH line IN ARRAY lines LOOP
+        INSERT INTO pgledger_reconciliation_lines (
+            account_id, external_id, amount, occurred_at, reference, metadata, created_at, updated_at
+        )
+        VALUES (
+            pgledger_import_reconciliation_lines.account_id,
+            line.external_id,
+            line.amount,
+            line.occurred_at,
+            line.reference,
+            line.metadata,
+            now(),
+            now()
+        )
+        ON CONFLICT ON CONSTRAINT pgledger_reconciliation_lines_external_id_key DO NOTHING;
+
+        SELECT * INTO existing_line
+        FROM pgledger_reconciliation_lines l
+        WHERE l.account_id = pgledger_import_reconciliation_lines.account_id
+            AND l.external_id = line.external_id;
+
+        IF existing_line.amount != line.amount
+            OR existing_line.occurred_at != line.occurred_at
+            OR existing_line.reference IS DISTINCT FROM line.reference THEN
+            RAISE EXCEPTION 'Reconciliation line (external_id=%) was already imported with different values', line.external_id
+            USING
+                ERRCODE = 'PGL23',
+                DETAIL = json_build_object(
+                    'account_id', account_id,
+                    'external_id', line.external_id
+                )::TEXT;
+        END IF;
+
+        line_ids := array_append(line_ids, existing_line.id);
+    END LOOP;
+
+    RETURN QUERY
+    SELECT v.*
+    FROM unnest(line_ids) WITH ORDINALITY AS ids (id, n)
+    INNER JOIN pgledger_reconciliation_lines_view v ON ids.id = v.id
+    ORDER BY ids.n;
+END;
+$$ LANGUAGE plpgsql;
+
+-- Match the lines of the account which aren't matched yet with its entries,
+-- and return those lines with their new status
+CREATE FUNCTION pgledger_reconcile(
+    account_id TEXT,
+    reference_key TEXT DEFAULT 'reference',
+    date_tolerance INTERVAL DEFAULT '3 days'
+)
+RETURNS SETOF PGLEDGER_RECONCILIATION_LINES_VIEW
+AS $$
+DECLARE
+    line pgledger_reconciliation_lines;
+    line_ids TEXT[] := '{}';
+    match_count BIGINT;
+    total_matched NUMERIC;
+BEGIN
+    -- Lock the lines, so that concurrent runs don't match the same line twice
+    FOR line IN
+        SELECT *
+        FROM pgledger_reconciliation_lines l
+        WHERE l.account_id = pgledger_reconcile.account_id
+            AND l.status != 'matched'
+        ORDER BY l.occurred_at, l.id
+        FOR UPDATE
+    LOOP
+        IF line.reference IS NOT NULL THEN
+            INSERT INTO pgledger_reconciliation_matches (line_id, entry_id, created_at)
+            SELECT line.id, e.id, now()
+            FROM pgledger_entries e
+            INNER JOIN pgledger_transfers t ON e.transfer_id = t.id
+            WHERE e.account_id = line.account_id
+                AND NOT e.pending
+                AND t.metadata ->> pgledger_reconcile.reference_key = line.reference
+                AND t.event_at BETWEEN line.occurred_at - pgledger_reconcile.date_tolerance
+                AND line.occurred_at + pgledger_reconcile.date_tolerance
+                AND NOT EXISTS (SELECT 1 FROM pgledger_reconciliation_matches m WHERE m.entry_id = e.id);
+        END IF;
+
+        -- Fall back to the amount and date if the reference didn't match
+        -- anything (or the line doesn't have one)
+        IF NOT EXISTS (SELECT 1 FROM pgledger_reconciliation_matches m WHERE m.line_id = line.id) THEN
+            INSERT INTO pgledger_reconciliation_matches (line_id, entry_id, created_at)
+            SELECT line.id, e.id, now()
+            FROM pgledger_entries e
+            INNER JOIN pgledger_transfers t ON e.transfer_id = t.id
+            WHERE e.account_id = line.account_id
+                AND NOT e.pending
+                AND e.amount = line.amount
+                AND t.event_at BETWEEN line.occurred_at - pgledger_reconcile.date_tolerance
+                AND line.occurred_at + pgledger_reconcile.date_tolerance
+                AND NOT EXISTS (SELECT 1 FROM pgledger_reconciliation_matches m WHERE m.entry_id = e.id)
+            ORDER BY abs(extract(EPOCH FROM t.event_at - line.occurred_at)), e.id
+            LIMIT 1;
+        END IF;
+
+        SELECT count(*), coalesce(sum(e.amount), 0) INTO match_count, total_matched
+        FROM pgledger_reconciliation_matches m
+        INNER JOIN pgledger_entries e ON m.entry_id = e.id
+        WHERE m.line_id = line.id;
+
+        UPDATE pgledger_reconciliation_lines l
+        SET status = CASE
+                WHEN match_count = 0 THEN 'unmatched'
+                WHEN total_matched = line.amount THEN 'matched'
+                ELSE 'partially_matched'
+            END,
+            matched_amount = total_matched,
+            updated_at = now()
+        WHERE l.id = line.id;
+
+        line_ids := array_append(line_ids, line.id);
+    END LOOP;
+
+    RETURN QUERY
+    SELECT *
+    FROM pgledger_reconciliation_lines_view v
+    WHERE v.id = ANY(line_ids)
+    ORDER BY v.occurred_at, v.id;
+END;
+$$ LANGUAGE plpgsql;
+
+-- Everything which still needs attention for the account: lines which aren't
+-- fully matched, and posted entries which aren't matched to any line (such as
+-- a transfer which never showed up on the statement). Only lines and entries
+-- in [start_at, end_at) are included, by occurred_at and event_at. Either end
+-- of the period can be left out.
+CREATE FUNCTION pgledger_reconciliation_exceptions(
+    account_id TEXT,
+    start_at TIMESTAMPTZ DEFAULT NULL,
+    end_at TIMESTAMPTZ DEFAULT NULL
+)
+RETURNS TABLE (
+    kind TEXT,
+    id TEXT,
+    status TEXT,
+    reference TEXT,
+    amount NUMERIC,
+    matched_amount NUMERIC,
+    occurred_at TIMESTAMPTZ,
+    metadata JSONB
+)
+AS $$
+    SELECT *
+    FROM (
+        SELECT
+            'line' AS kind,
+            l.id,
+            l.status,
+            l.reference,
+            l.amount,
+            l.matched_amount,
+            l.occurred_at,
+            l.metadata
+        FROM pgledger_reconciliation_lines l
+        WHERE l.account_id = pgledger_reconciliation_exceptions.account_id
+            AND l.status != 'matched'
+
+        UNION ALL
+
+        SELECT
+            'entry',
+            e.id,
+            'unmatched',
+            NULL,
+            e.amount,
+            0,
+            t.event_at,
+            t.metadata
+        FROM pgledger_entries e
+        INNER JOIN pgledger_transfers t ON e.transfer_id = t.id
+        WHERE e.account_id = pgledger_reconciliation_exceptions.account_id
+            AND NOT e.pending
+            AND NOT EXISTS (SELECT 1 FROM pgledger_reconciliation_matches m WHERE m.entry_id = e.id)
+    ) exceptions
+    WHERE (pgledger_reconciliation_exceptions.start_at IS NULL OR exceptions.occurred_at >= pgledger_reconciliation_exceptions.start_at)
+        AND (pgledger_reconciliation_exceptions.end_at IS NULL OR exceptions.occurred_at < pgledger_reconciliation_exceptions.end_at)
+    ORDER BY exceptions.occurred_at, exceptions.id;
+$$ LANGUAGE sql STABLE;
+
+INSERT INTO pgledger_schema_migrations (version) VALUES (21);